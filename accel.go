@@ -0,0 +1,283 @@
+// This file provides accelerated splitting and merging for the color spaces
+// whose channels are an affine function of the (possibly linearized) sRGB
+// components: linrgb, xyz, and ycbcr.  Rather than converting one pixel at a
+// time through a closure, each row of pixels is gathered into planar buffers
+// and transformed by an acceleration backend in a single call.  (YCoCg is
+// also an affine function of sRGB, but color-channels does not support it as
+// a color space, so there is no YCoCg path to accelerate.)
+
+package main
+
+import (
+	"context"
+	"image"
+	"sort"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/spakin/color-channels/channels"
+)
+
+// An affine3 is a 3x3 matrix followed by an offset.
+type affine3 struct {
+	M   [3][3]float64 // Matrix, indexed by output then input component
+	Off [3]float64    // Offset added to each output component
+}
+
+// An accelBackend transforms whole rows of pixels for the matrix-based color
+// spaces.
+type accelBackend interface {
+	// Affine3 sets each dst[k][i] to the sum, evaluated from left to
+	// right without fused multiply-adds, of a.M[k][0]*src[0][i],
+	// a.M[k][1]*src[1][i], a.M[k][2]*src[2][i], and a.Off[k].  Every
+	// backend therefore produces identical results.  All six slices must
+	// have the same length.
+	Affine3(dst, src [3][]float64, a *affine3)
+}
+
+// accelBackends maps the name of each available acceleration backend to the
+// backend itself.  Architecture-specific files add to the map.
+var accelBackends = map[string]accelBackend{
+	"go": goBackend{},
+}
+
+// accelPreference lists the acceleration backends from most to least
+// preferred.  --accel=auto selects the first one available.
+var accelPreference = []string{"sse2", "go"}
+
+// accelNames returns a sorted list of the names of all available
+// acceleration backends.
+func accelNames() []string {
+	names := make([]string, 0, len(accelBackends))
+	for nm := range accelBackends {
+		names = append(names, nm)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// paramsBackend returns the acceleration backend selected by p.Accel or nil
+// if acceleration is disabled.
+func paramsBackend(p *Parameters) accelBackend {
+	switch p.Accel {
+	case "none":
+		return nil
+	case "", "auto":
+		for _, nm := range accelPreference {
+			if be, ok := accelBackends[nm]; ok {
+				return be
+			}
+		}
+		return nil
+	default:
+		return accelBackends[p.Accel]
+	}
+}
+
+// goBackend is a portable acceleration backend written in Go.  It serves as
+// the reference implementation for the others.
+type goBackend struct{}
+
+// Affine3 applies an affine transformation to rows of pixels.
+func (goBackend) Affine3(dst, src [3][]float64, a *affine3) {
+	s0, s1, s2 := src[0], src[1], src[2]
+	for k, d := range dst {
+		m, off := a.M[k], a.Off[k]
+		for i := range d {
+			// The explicit conversions prevent the compiler from
+			// fusing multiplies and adds.
+			d[i] = float64(m[0]*s0[i]) + float64(m[1]*s1[i]) + float64(m[2]*s2[i]) + off
+		}
+	}
+}
+
+// A matrixSpace describes how to convert between sRGB and a color space whose
+// channels are an affine function of the sRGB components after each is
+// passed through a transfer function.
+type matrixSpace struct {
+	ToLinear   func(float64) float64 // Function to apply to each sRGB component before ToSpace
+	ToSpace    *affine3              // Transformation from sRGB to channel values (nil for identity)
+	FromSpace  *affine3              // Transformation from channel values to sRGB (nil for identity)
+	FromLinear func(float64) float64 // Function to apply to each component after FromSpace
+}
+
+// identityTransfer returns its argument.
+func identityTransfer(v float64) float64 { return v }
+
+// xyzFromLinear and linearFromXyz are go-colorful's matrices between linear
+// RGB and CIE XYZ.
+var (
+	xyzFromLinear = &affine3{M: [3][3]float64{
+		{0.41239079926595948, 0.35758433938387796, 0.18048078840183429},
+		{0.21263900587151036, 0.71516867876775593, 0.072192315360733715},
+		{0.019330818715591851, 0.11919477979462599, 0.95053215224966058},
+	}}
+	linearFromXyz = &affine3{M: [3][3]float64{
+		{3.2409699419045214, -1.5373831775700935, -0.49861076029300328},
+		{-0.96924363628087983, 1.8759675015077207, 0.041555057407175613},
+		{0.055630079696993609, -0.20397695888897657, 1.0569715142428786},
+	}}
+)
+
+// ycbcrAffines returns the transformations to and from full-range Y'CbCr that
+// correspond to toYCbCrMatrix and fromYCbCrMatrix.  The latter computes G
+// from the already computed R and B, so the inverse matrix can round
+// differently in the last place.
+func ycbcrAffines(m ycbcrMatrix) (to, from *affine3) {
+	kg := 1.0 - m.Kr - m.Kb
+	sb := 0.5 / (1.0 - m.Kb)
+	sr := 0.5 / (1.0 - m.Kr)
+	to = &affine3{
+		M: [3][3]float64{
+			{m.Kr, kg, m.Kb},
+			{-m.Kr * sb, -kg * sb, (1.0 - m.Kb) * sb},
+			{(1.0 - m.Kr) * sr, -kg * sr, -m.Kb * sr},
+		},
+		Off: [3]float64{0.0, 0.5, 0.5},
+	}
+	from = &affine3{
+		M: [3][3]float64{
+			{1.0, 0.0, 2.0 * (1.0 - m.Kr)},
+			{1.0, -2.0 * m.Kb * (1.0 - m.Kb) / kg, -2.0 * m.Kr * (1.0 - m.Kr) / kg},
+			{1.0, 2.0 * (1.0 - m.Kb), 0.0},
+		},
+		Off: [3]float64{
+			-(1.0 - m.Kr),
+			(m.Kb*(1.0-m.Kb) + m.Kr*(1.0-m.Kr)) / kg,
+			-(1.0 - m.Kb),
+		},
+	}
+	return to, from
+}
+
+// matrixSpaceFor returns a description of the color space specified by a set
+// of parameters or nil if the color space is not matrix-based.
+func matrixSpaceFor(p *Parameters) *matrixSpace {
+	switch p.ColorSpace {
+	case "linrgb":
+		return &matrixSpace{
+			ToLinear:   channels.Linearize,
+			FromLinear: channels.Delinearize,
+		}
+	case "xyz":
+		return &matrixSpace{
+			ToLinear:   channels.Linearize,
+			ToSpace:    xyzFromLinear,
+			FromSpace:  linearFromXyz,
+			FromLinear: channels.Delinearize,
+		}
+	case "ycbcr":
+		name := p.YCbCrMatrix
+		if name == "" {
+			name = "bt601"
+		}
+		to, from := ycbcrAffines(ycbcrMatrices[name])
+		return &matrixSpace{
+			ToLinear:   clamp01,
+			ToSpace:    to,
+			FromSpace:  from,
+			FromLinear: identityTransfer,
+		}
+	default:
+		return nil
+	}
+}
+
+// rowBuffers allocates the planar source and destination buffers for a row of
+// a given width.
+func rowBuffers(wd int) (src, dst [3][]float64) {
+	buf := make([]float64, 6*wd)
+	for k := 0; k < 3; k++ {
+		src[k] = buf[k*wd : (k+1)*wd]
+		dst[k] = buf[(k+3)*wd : (k+4)*wd]
+	}
+	return src, dst
+}
+
+// splitMatrix is the accelerated counterpart of splitAny for a matrix-based
+// color space.  It stops early and returns the context's error if ctx is
+// canceled.
+func splitMatrix(ctx context.Context, img image.Image, names []string, ms *matrixSpace, be accelBackend) ([]ImageInfo, error) {
+	bnds := img.Bounds()
+	wd := bnds.Dx()
+	grays := allocGrays(bnds, len(names))
+	colorAt := colorAtFunc(img)
+	meter := progressFrom(ctx)
+	meter.Expect(bnds.Dy())
+	err := forEachRow(ctx, bnds, func(y int) {
+		src, dst := rowBuffers(wd)
+		for i := 0; i < wd; i++ {
+			c := colorAt(bnds.Min.X+i, y)
+			src[0][i] = ms.ToLinear(c.R)
+			src[1][i] = ms.ToLinear(c.G)
+			src[2][i] = ms.ToLinear(c.B)
+		}
+		if ms.ToSpace != nil {
+			be.Affine3(dst, src, ms.ToSpace)
+		} else {
+			dst = src
+		}
+		for k, g := range grays {
+			row := g.Pix[g.PixOffset(bnds.Min.X, y):]
+			for i, v := range dst[k] {
+				row[i] = float32(v)
+			}
+		}
+		meter.Step()
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ImageInfo, len(names))
+	for i, nm := range names {
+		result[i].Name = nm
+		result[i].Image = grays[i]
+	}
+	return result, nil
+}
+
+// mergeMatrix is the accelerated counterpart of mergeAny for a matrix-based
+// color space.  It stops early and returns the context's error if ctx is
+// canceled.
+func mergeMatrix(ctx context.Context, imgs []*Gray32f, ms *matrixSpace, be accelBackend, gm gamutMapper, clip *clipStats) (image.Image, error) {
+	bnds := imgs[0].Bounds()
+	wd := bnds.Dx()
+	merged := NewNRGBA32f(bnds)
+	if clip != nil {
+		clip.Begin(bnds)
+	}
+	meter := progressFrom(ctx)
+	meter.Expect(bnds.Dy())
+	src, dst := rowBuffers(wd)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for k := range src {
+			row := imgs[k].Pix[imgs[k].PixOffset(bnds.Min.X, y):]
+			for i := range src[k] {
+				src[k][i] = float64(row[i])
+			}
+		}
+		out := dst
+		if ms.FromSpace != nil {
+			be.Affine3(dst, src, ms.FromSpace)
+		} else {
+			out = src
+		}
+		for i := 0; i < wd; i++ {
+			clr := colorful.Color{
+				R: ms.FromLinear(out[0][i]),
+				G: ms.FromLinear(out[1][i]),
+				B: ms.FromLinear(out[2][i]),
+			}
+			mapped := gm(clr)
+			x := bnds.Min.X + i
+			if clip != nil {
+				clip.Count(x, y, colorChanged(clr, mapped))
+			}
+			setColorful(merged, x, y, mapped)
+		}
+		meter.Step()
+	}
+	return merged, nil
+}
@@ -0,0 +1,45 @@
+//go:build amd64 && !purego
+// +build amd64,!purego
+
+// This file provides an acceleration backend that uses SSE2 instructions,
+// which every amd64 processor supports, to transform two pixels at a time.
+// The final pixel of an odd-length row is transformed by goBackend.
+
+package main
+
+func init() {
+	accelBackends["sse2"] = sse2Backend{}
+}
+
+// affine3SSE2 applies a 3x3 matrix, given in row-major order, and an offset,
+// given with each component duplicated, to n pixels, where n is even.  It is
+// implemented in accel_amd64.s.
+//
+//go:noescape
+func affine3SSE2(d0, d1, d2, s0, s1, s2 *float64, n int, coef *[9]float64, off *[6]float64)
+
+// sse2Backend is an acceleration backend written in amd64 assembly language.
+type sse2Backend struct{}
+
+// Affine3 applies an affine transformation to rows of pixels.
+func (sse2Backend) Affine3(dst, src [3][]float64, a *affine3) {
+	n := len(dst[0]) &^ 1
+	if n > 0 {
+		var coef [9]float64
+		var off [6]float64
+		for k := 0; k < 3; k++ {
+			copy(coef[3*k:3*k+3], a.M[k][:])
+			off[2*k] = a.Off[k]
+			off[2*k+1] = a.Off[k]
+		}
+		affine3SSE2(&dst[0][0], &dst[1][0], &dst[2][0],
+			&src[0][0], &src[1][0], &src[2][0], n, &coef, &off)
+	}
+	if n < len(dst[0]) {
+		// Transform the final, odd pixel.
+		goBackend{}.Affine3(
+			[3][]float64{dst[0][n:], dst[1][n:], dst[2][n:]},
+			[3][]float64{src[0][n:], src[1][n:], src[2][n:]},
+			a)
+	}
+}
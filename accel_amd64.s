@@ -0,0 +1,77 @@
+//go:build amd64 && !purego
+// +build amd64,!purego
+
+#include "textflag.h"
+
+// ROW computes one output component for two pixels held in X0 (first input
+// component), X1 (second), and X2 (third), using the broadcast matrix
+// coefficients in registers c0, c1, and c2 and the offset pair at memory
+// location off.  The result is stored at dst.  Products are summed from left
+// to right, as in goBackend.
+#define ROW(c0, c1, c2, off, dst) \
+	MOVAPD X0, X3   \
+	MULPD  c0, X3   \
+	MOVAPD X1, X13  \
+	MULPD  c1, X13  \
+	ADDPD  X13, X3  \
+	MOVAPD X2, X13  \
+	MULPD  c2, X13  \
+	ADDPD  X13, X3  \
+	MOVUPD off, X13 \
+	ADDPD  X13, X3  \
+	MOVUPD X3, dst
+
+// func affine3SSE2(d0, d1, d2, s0, s1, s2 *float64, n int, coef *[9]float64, off *[6]float64)
+TEXT ·affine3SSE2(SB), NOSPLIT, $0-72
+	MOVQ d0+0(FP), DI
+	MOVQ d1+8(FP), R8
+	MOVQ d2+16(FP), R9
+	MOVQ s0+24(FP), SI
+	MOVQ s1+32(FP), R10
+	MOVQ s2+40(FP), R11
+	MOVQ n+48(FP), CX
+	MOVQ coef+56(FP), AX
+	MOVQ off+64(FP), BX
+
+	// Broadcast each matrix coefficient to both lanes of X4-X12.
+	MOVSD    0(AX), X4
+	UNPCKLPD X4, X4
+	MOVSD    8(AX), X5
+	UNPCKLPD X5, X5
+	MOVSD    16(AX), X6
+	UNPCKLPD X6, X6
+	MOVSD    24(AX), X7
+	UNPCKLPD X7, X7
+	MOVSD    32(AX), X8
+	UNPCKLPD X8, X8
+	MOVSD    40(AX), X9
+	UNPCKLPD X9, X9
+	MOVSD    48(AX), X10
+	UNPCKLPD X10, X10
+	MOVSD    56(AX), X11
+	UNPCKLPD X11, X11
+	MOVSD    64(AX), X12
+	UNPCKLPD X12, X12
+
+loop:
+	CMPQ CX, $0
+	JLE  done
+
+	MOVUPD (SI), X0
+	MOVUPD (R10), X1
+	MOVUPD (R11), X2
+	ROW(X4, X5, X6, 0(BX), (DI))
+	ROW(X7, X8, X9, 16(BX), (R8))
+	ROW(X10, X11, X12, 32(BX), (R9))
+
+	ADDQ $16, SI
+	ADDQ $16, R10
+	ADDQ $16, R11
+	ADDQ $16, DI
+	ADDQ $16, R8
+	ADDQ $16, R9
+	SUBQ $2, CX
+	JMP  loop
+
+done:
+	RET
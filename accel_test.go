@@ -0,0 +1,183 @@
+// This file tests the acceleration backends against the portable one.
+
+package main
+
+import (
+	"context"
+	"image"
+	"math"
+	"testing"
+)
+
+// accelTestAffines returns the transformations that the accelerated color
+// spaces use, keyed by a descriptive name.
+func accelTestAffines() map[string]*affine3 {
+	to601, from601 := ycbcrAffines(ycbcrMatrices["bt601"])
+	to709, from709 := ycbcrAffines(ycbcrMatrices["bt709"])
+	return map[string]*affine3{
+		"xyz from linear": xyzFromLinear,
+		"linear from xyz": linearFromXyz,
+		"to bt601":        to601,
+		"from bt601":      from601,
+		"to bt709":        to709,
+		"from bt709":      from709,
+	}
+}
+
+// accelTestRow returns three planar rows of n samples each.  Most samples lie
+// in [0.0, 1.0], but the rows also include out-of-range, infinite, NaN, and
+// subnormal values.
+func accelTestRow(n int) [3][]float64 {
+	special := []float64{
+		-2.0, 3.5, math.Inf(1), math.Inf(-1), math.NaN(),
+		math.SmallestNonzeroFloat64, -0.0, 1e300,
+	}
+	var src [3][]float64
+	for k := range src {
+		src[k] = make([]float64, n)
+		for i := range src[k] {
+			if (i+k)%5 == 4 {
+				src[k][i] = special[(i+3*k)%len(special)]
+			} else {
+				src[k][i] = float64((i*7+k*3)%11) / 10.0
+			}
+		}
+	}
+	return src
+}
+
+// sameFloat reports whether two float64s are identical or are both NaN.
+func sameFloat(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Float64bits(a) == math.Float64bits(b)
+}
+
+// TestAccelBackends verifies that every acceleration backend produces
+// bit-for-bit the same output as goBackend, which the accelBackend interface
+// requires, for rows of every length from 0 to 19.
+func TestAccelBackends(t *testing.T) {
+	for name, be := range accelBackends {
+		for aName, a := range accelTestAffines() {
+			for n := 0; n < 20; n++ {
+				src := accelTestRow(n)
+				want, got := rowBuffersFor(n), rowBuffersFor(n)
+				goBackend{}.Affine3(want, src, a)
+				be.Affine3(got, src, a)
+				for k := range want {
+					for i := range want[k] {
+						if !sameFloat(got[k][i], want[k][i]) {
+							t.Fatalf("%s, %s, length %d: component %d of pixel %d (input %v, %v, %v): expected %v but saw %v",
+								name, aName, n, k, i, src[0][i], src[1][i], src[2][i], want[k][i], got[k][i])
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestAccelBackendsInPlace verifies that every acceleration backend leaves
+// its source rows unmodified and writes nothing beyond its destination rows.
+func TestAccelBackendsInPlace(t *testing.T) {
+	const n, pad = 9, 3
+	for name, be := range accelBackends {
+		src := accelTestRow(n)
+		orig := accelTestRow(n)
+		var dst [3][]float64
+		for k := range dst {
+			buf := make([]float64, n+pad)
+			for i := range buf {
+				buf[i] = -1.0
+			}
+			dst[k] = buf[:n]
+		}
+		be.Affine3(dst, src, xyzFromLinear)
+		for k := range src {
+			for i := range src[k] {
+				if !sameFloat(src[k][i], orig[k][i]) {
+					t.Fatalf("%s: source component %d of pixel %d changed", name, k, i)
+				}
+			}
+			for _, v := range dst[k][n : n+pad] {
+				if v != -1.0 {
+					t.Fatalf("%s: wrote beyond the end of destination row %d", name, k)
+				}
+			}
+		}
+	}
+}
+
+// rowBuffersFor returns three planar destination rows of n samples each.
+func rowBuffersFor(n int) [3][]float64 {
+	_, dst := rowBuffers(n)
+	return dst
+}
+
+// BenchmarkAffine3 measures the speed of each acceleration backend at
+// transforming a row of 4096 pixels.
+func BenchmarkAffine3(b *testing.B) {
+	const wd = 4096
+	for _, name := range accelNames() {
+		be := accelBackends[name]
+		b.Run(name, func(b *testing.B) {
+			src := accelTestRow(wd)
+			_, dst := rowBuffers(wd)
+			b.SetBytes(int64(6 * 8 * wd))
+			for i := 0; i < b.N; i++ {
+				be.Affine3(dst, src, xyzFromLinear)
+			}
+		})
+	}
+}
+
+// TestAccelSplit verifies that splitting an image into each matrix-based
+// color space produces the same channels with and without acceleration.
+func TestAccelSplit(t *testing.T) {
+	img := testColorImage(true)
+	img.SetFloats(3, 2, [4]float64{-0.5, 1.5, 0.25, 1.0})
+	for _, cs := range []string{"linrgb", "xyz", "ycbcr"} {
+		p := defaultParameters()
+		p.ColorSpace = cs
+		p.Accel = "none"
+		want, err := performImageSplit(context.Background(), &p, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, accel := range accelNames() {
+			p.Accel = accel
+			got, err := performImageSplit(context.Background(), &p, img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range want {
+				if got[i].Name != want[i].Name {
+					t.Fatalf("%s, %s: expected channel %q but saw %q", cs, accel, want[i].Name, got[i].Name)
+				}
+				checkImage(t, got[i].Image, want[i].Image, 0.0)
+			}
+		}
+	}
+}
+
+// BenchmarkSplitMatrix compares splitting an image into XYZ channels one
+// pixel at a time with splitting it using each acceleration backend.
+func BenchmarkSplitMatrix(b *testing.B) {
+	img := NewNRGBA32f(image.Rect(0, 0, 512, 512))
+	for i := range img.Pix {
+		img.Pix[i] = float32(i%1021) / 1020.0
+	}
+	for _, accel := range append([]string{"none"}, accelNames()...) {
+		p := defaultParameters()
+		p.ColorSpace = "xyz"
+		p.Accel = accel
+		b.Run(accel, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := performImageSplit(context.Background(), &p, img); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+// This file provides support for animated images (animated GIF and APNG),
+// which are split and merged one frame at a time.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// An Animation represents a sequence of fully composited frames.
+type Animation struct {
+	Frames []image.Image   // Each frame in display order
+	Delays []time.Duration // Time to display each frame
+	Plays  int             // Number of times to play the animation (0=forever)
+}
+
+// defaultFrameDelay is the delay to use for frames whose delay is unknown.
+const defaultFrameDelay = 100 * time.Millisecond
+
+// Delay returns the time to display a given frame.
+func (a *Animation) Delay(i int) time.Duration {
+	if i < len(a.Delays) {
+		return a.Delays[i]
+	}
+	return defaultFrameDelay
+}
+
+// DecodeGIFAnimation reads all frames of a GIF file.  Each frame is composited
+// onto the canvas as specified by the frame's disposal method, and the result
+// is returned as a complete image.
+func DecodeGIFAnimation(r io.Reader) (*Animation, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	canvasRect := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if canvasRect.Empty() {
+		for _, fr := range g.Image {
+			canvasRect = canvasRect.Union(fr.Bounds())
+		}
+	}
+	anim := &Animation{}
+	switch {
+	case g.LoopCount == 0:
+		anim.Plays = 0
+	case g.LoopCount < 0:
+		anim.Plays = 1
+	default:
+		anim.Plays = g.LoopCount + 1
+	}
+	canvas := image.NewNRGBA(canvasRect)
+	for i, fr := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var saved *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			saved = cloneNRGBA(canvas)
+		}
+		draw.Draw(canvas, fr.Bounds(), fr, fr.Bounds().Min, draw.Over)
+		anim.Frames = append(anim.Frames, cloneNRGBA(canvas))
+		anim.Delays = append(anim.Delays, time.Duration(g.Delay[i])*10*time.Millisecond)
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, fr.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = saved
+		}
+	}
+	return anim, nil
+}
+
+// cloneNRGBA returns a copy of an NRGBA image.
+func cloneNRGBA(img *image.NRGBA) *image.NRGBA {
+	c := *img
+	c.Pix = append([]uint8(nil), img.Pix...)
+	return &c
+}
+
+// toPaletted converts an image to a paletted image suitable for GIF output.
+// Grayscale images use a palette of 256 grays.  Color images are dithered to
+// the Plan 9 palette, with the final entry replaced by a transparent color if
+// the image is not opaque.
+func toPaletted(img image.Image) *image.Paletted {
+	bnds := img.Bounds()
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		pal := make(color.Palette, 256)
+		for i := range pal {
+			pal[i] = color.Gray{Y: uint8(i)}
+		}
+		pm := image.NewPaletted(bnds, pal)
+		for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+			for x := bnds.Min.X; x < bnds.Max.X; x++ {
+				g := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16)
+				pm.SetColorIndex(x, y, scale16To8(g.Y))
+			}
+		}
+		return pm
+	}
+	pal := append(color.Palette(nil), palette.Plan9...)
+	if o, ok := img.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+		pal[len(pal)-1] = color.Transparent
+	}
+	pm := image.NewPaletted(bnds, pal)
+	draw.FloydSteinberg.Draw(pm, bnds, img, bnds.Min)
+	return pm
+}
+
+// EncodeGIFAnimation writes an animation as an animated GIF file.  Because
+// GIF supports at most 256 colors per frame, color frames are dithered.
+func EncodeGIFAnimation(w io.Writer, anim *Animation) error {
+	g := &gif.GIF{}
+	switch {
+	case anim.Plays == 0:
+		g.LoopCount = 0
+	case anim.Plays == 1:
+		g.LoopCount = -1
+	default:
+		g.LoopCount = anim.Plays - 1
+	}
+	for i, fr := range anim.Frames {
+		g.Image = append(g.Image, toPaletted(fr))
+		g.Delay = append(g.Delay, int((anim.Delay(i)+5*time.Millisecond)/(10*time.Millisecond)))
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// encodeGIF writes an image as a single-frame GIF file.
+func encodeGIF(w io.Writer, img image.Image) error {
+	return gif.Encode(w, toPaletted(img), nil)
+}
+
+// writeGIFAnimation is the outputFormat Animate function for GIF.
+func writeGIFAnimation(w io.Writer, anim *Animation, p *Parameters) error {
+	return EncodeGIFAnimation(w, anim)
+}
+
+// writeAPNGAnimation is the outputFormat Animate function for PNG.
+func writeAPNGAnimation(w io.Writer, anim *Animation, p *Parameters) error {
+	return EncodeAPNG(w, anim, pngCompressionLevels[p.PNGCompression])
+}
+
+// ReadAnimation reads all frames of a named animated GIF, APNG, or y4m file.
+// The name "-" designates a y4m stream on the standard input device.
+// ReadAnimation returns nil if the file is not an animation or contains only
+// a single frame.  It aborts on error.
+func ReadAnimation(fn string) *Animation {
+	f := os.Stdin
+	if fn != "-" {
+		var err error
+		f, err = os.Open(fn)
+		if err != nil {
+			notify.Fatal(err)
+		}
+		defer f.Close()
+	}
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(8)
+	if fn == "-" && string(magic) != y4mMagic[:8] {
+		notify.Fatal("Only y4m streams can be read from the standard input device")
+	}
+	var anim *Animation
+	switch {
+	case string(magic) == y4mMagic[:8]:
+		anim, err = DecodeY4MAnimation(br)
+	case len(magic) >= 4 && string(magic[:4]) == "GIF8":
+		anim, err = DecodeGIFAnimation(br)
+	case string(magic) == pngSignature:
+		chunks, cerr := readPNGChunks(br)
+		if cerr != nil || !isAPNG(chunks) {
+			return nil
+		}
+		if _, err = f.Seek(0, io.SeekStart); err == nil {
+			anim, err = DecodeAPNG(f)
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		notify.Fatalf("%s: %s", fn, err)
+	}
+	if len(anim.Frames) < 2 && fn != "-" {
+		return nil
+	}
+	return anim
+}
+
+// WriteAnimation writes an animation to a named file or to the standard
+// output device if the filename is empty.
+func WriteAnimation(p *Parameters, fn string, anim *Animation) error {
+	of := outputFormats[selectOutputFormat(fn, p.Format)]
+	if of.Animate == nil {
+		return fmt.Errorf("%s does not support animation", fn)
+	}
+	q := *anim
+	q.Frames = make([]image.Image, len(anim.Frames))
+	for i, fr := range anim.Frames {
+		img, err := convertDepth(fr, p, of)
+		if err != nil {
+			return err
+		}
+		q.Frames[i] = img
+	}
+	var w io.Writer = os.Stdout
+	if fn != "" {
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return of.Animate(w, &q, p)
+}
+
+// frameVerbRE matches a frame-number verb ("%d" or, e.g., "%04d") or an
+// escaped percent sign ("%%") in a filename template.
+var frameVerbRE = regexp.MustCompile(`%%|%[0-9]*d`)
+
+// hasFrameVerb reports whether a filename template contains a frame-number
+// verb.
+func hasFrameVerb(tmpl string) bool {
+	for _, m := range frameVerbRE.FindAllString(tmpl, -1) {
+		if m != "%%" {
+			return true
+		}
+	}
+	return false
+}
+
+// baseVerbRE matches a basename verb ("%b") or an escaped percent sign ("%%")
+// in a filename template.
+var baseVerbRE = regexp.MustCompile(`%%|%b`)
+
+// hasBaseVerb reports whether a filename template contains a basename verb.
+func hasBaseVerb(tmpl string) bool {
+	for _, m := range baseVerbRE.FindAllString(tmpl, -1) {
+		if m != "%%" {
+			return true
+		}
+	}
+	return false
+}
+
+// baseName returns the base name of a file, stripped of its directory and
+// extension.
+func baseName(fn string) string {
+	base := filepath.Base(fn)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// expandBase replaces each basename verb in a filename template with a given
+// base name.  All other verbs, including "%%", are left unmodified.
+func expandBase(tmpl, base string) string {
+	return baseVerbRE.ReplaceAllStringFunc(tmpl, func(m string) string {
+		if m == "%%" {
+			return m
+		}
+		return base
+	})
+}
+
+// expandFrame replaces each frame-number verb in a filename template with a
+// given frame number.  All other verbs, including "%%", are left unmodified.
+func expandFrame(tmpl string, frame int) string {
+	return frameVerbRE.ReplaceAllStringFunc(tmpl, func(m string) string {
+		if m == "%%" {
+			return m
+		}
+		return fmt.Sprintf(m, frame)
+	})
+}
@@ -0,0 +1,306 @@
+// This file provides support for reading and writing animated PNG (APNG)
+// files.  The standard library's PNG decoder reads only an APNG file's
+// default image.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"time"
+)
+
+// A pngChunk represents a single PNG chunk.
+type pngChunk struct {
+	Name string // Chunk type
+	Data []byte // Chunk contents
+}
+
+// readPNGChunks reads all chunks from a PNG file, verifying its signature but
+// not its checksums.
+func readPNGChunks(r io.Reader) ([]pngChunk, error) {
+	br := bufio.NewReader(r)
+	var sig [8]byte
+	if _, err := io.ReadFull(br, sig[:]); err != nil || string(sig[:]) != pngSignature {
+		return nil, errors.New("png: invalid format")
+	}
+	var chunks []pngChunk
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return nil, errors.New("png: unexpected end of file")
+		}
+		n := binary.BigEndian.Uint32(hdr[:4])
+		if n > 1<<30 {
+			return nil, errors.New("png: chunk too large")
+		}
+		// Read the data incrementally so a corrupt length cannot force
+		// a large allocation before the data actually arrive.
+		data, err := readBytes(br, int64(n))
+		if err != nil {
+			return nil, errors.New("png: unexpected end of file")
+		}
+		c := pngChunk{Name: string(hdr[4:]), Data: data}
+		if _, err := br.Discard(4); err != nil { // CRC
+			return nil, errors.New("png: unexpected end of file")
+		}
+		chunks = append(chunks, c)
+		if c.Name == "IEND" {
+			return chunks, nil
+		}
+	}
+}
+
+// isAPNG reports whether a set of PNG chunks includes animation control.
+func isAPNG(chunks []pngChunk) bool {
+	for _, c := range chunks {
+		switch c.Name {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+	}
+	return false
+}
+
+// An apngFrameControl represents the contents of an APNG fcTL chunk.
+type apngFrameControl struct {
+	Rect    image.Rectangle // Region of the canvas covered by the frame
+	Delay   time.Duration   // Time to display the frame
+	Dispose byte            // 0=none, 1=background, 2=previous
+	Blend   byte            // 0=source, 1=over
+	Data    []byte          // Compressed pixel data
+}
+
+// DecodeAPNG reads all frames of an animated PNG file.  Each frame is
+// composited onto the canvas as specified by the file's frame-control
+// information, and the result is returned as a complete image.
+func DecodeAPNG(r io.Reader) (*Animation, error) {
+	chunks, err := readPNGChunks(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 || chunks[0].Name != "IHDR" || len(chunks[0].Data) != 13 {
+		return nil, errors.New("png: missing IHDR")
+	}
+	ihdr := chunks[0].Data
+	canvasRect := image.Rect(0, 0,
+		int(binary.BigEndian.Uint32(ihdr[0:])),
+		int(binary.BigEndian.Uint32(ihdr[4:])))
+
+	// Gather the frame-control information and the chunks that each
+	// frame's standalone PNG file will require.
+	anim := &Animation{}
+	var frames []*apngFrameControl
+	var shared []pngChunk
+	var cur *apngFrameControl
+	for _, c := range chunks[1:] {
+		switch c.Name {
+		case "acTL":
+			if len(c.Data) != 8 {
+				return nil, errors.New("png: invalid acTL")
+			}
+			anim.Plays = int(binary.BigEndian.Uint32(c.Data[4:]))
+		case "fcTL":
+			d := c.Data
+			if len(d) != 26 {
+				return nil, errors.New("png: invalid fcTL")
+			}
+			wd, ht := binary.BigEndian.Uint32(d[4:]), binary.BigEndian.Uint32(d[8:])
+			x0, y0 := binary.BigEndian.Uint32(d[12:]), binary.BigEndian.Uint32(d[16:])
+			num, den := binary.BigEndian.Uint16(d[20:]), binary.BigEndian.Uint16(d[22:])
+			if den == 0 {
+				den = 100
+			}
+			cur = &apngFrameControl{
+				Rect:    image.Rect(int(x0), int(y0), int(x0+wd), int(y0+ht)),
+				Delay:   time.Duration(num) * time.Second / time.Duration(den),
+				Dispose: d[24],
+				Blend:   d[25],
+			}
+			if !cur.Rect.In(canvasRect) || cur.Rect.Empty() {
+				return nil, errors.New("png: frame lies outside the canvas")
+			}
+			frames = append(frames, cur)
+		case "IDAT":
+			if cur == nil {
+				// The default image is not part of the animation.
+				cur = &apngFrameControl{Rect: canvasRect}
+			}
+			cur.Data = append(cur.Data, c.Data...)
+		case "fdAT":
+			if cur == nil || len(c.Data) < 4 {
+				return nil, errors.New("png: unexpected fdAT")
+			}
+			cur.Data = append(cur.Data, c.Data[4:]...)
+		case "PLTE", "tRNS":
+			shared = append(shared, c)
+		}
+	}
+	if len(frames) == 0 {
+		return nil, errors.New("png: no animation frames")
+	}
+
+	// Reject frames, and canvases, that are too large to be encoded by the
+	// data that are present.  Every pixel occupies at least one bit, and
+	// zlib can shrink data by at most exrMaxRatio.
+	minBytes := func(r image.Rectangle) int64 {
+		return int64(r.Dy()) * int64(r.Dx()+7) / 8
+	}
+	var total int64
+	for _, fc := range frames {
+		total += int64(len(fc.Data))
+		if minBytes(fc.Rect) > exrMaxRatio*int64(len(fc.Data)) {
+			return nil, errors.New("png: frame is too large for the file")
+		}
+	}
+	if minBytes(canvasRect) > exrMaxRatio*total {
+		return nil, errors.New("png: image is too large for the file")
+	}
+
+	// Decode each frame and composite it onto the canvas.
+	canvas := image.NewNRGBA64(canvasRect)
+	for _, fc := range frames {
+		var buf bytes.Buffer
+		buf.WriteString(pngSignature)
+		hdr := append([]byte(nil), ihdr...)
+		binary.BigEndian.PutUint32(hdr[0:], uint32(fc.Rect.Dx()))
+		binary.BigEndian.PutUint32(hdr[4:], uint32(fc.Rect.Dy()))
+		pngWriteChunk(&buf, "IHDR", hdr)
+		for _, c := range shared {
+			pngWriteChunk(&buf, c.Name, c.Data)
+		}
+		pngWriteChunk(&buf, "IDAT", fc.Data)
+		pngWriteChunk(&buf, "IEND", nil)
+		img, err := png.Decode(&buf)
+		if err != nil {
+			return nil, err
+		}
+		var saved *image.NRGBA64
+		if fc.Dispose == 2 {
+			saved = cloneNRGBA64(canvas)
+		}
+		op := draw.Src
+		if fc.Blend == 1 {
+			op = draw.Over
+		}
+		draw.Draw(canvas, fc.Rect, img, img.Bounds().Min, op)
+		anim.Frames = append(anim.Frames, cloneNRGBA64(canvas))
+		anim.Delays = append(anim.Delays, fc.Delay)
+		switch fc.Dispose {
+		case 1:
+			draw.Draw(canvas, fc.Rect, image.Transparent, image.Point{}, draw.Src)
+		case 2:
+			canvas = saved
+		}
+	}
+	return anim, nil
+}
+
+// cloneNRGBA64 returns a copy of an NRGBA64 image.
+func cloneNRGBA64(img *image.NRGBA64) *image.NRGBA64 {
+	c := *img
+	c.Pix = append([]uint8(nil), img.Pix...)
+	return &c
+}
+
+// EncodeAPNG writes an animation as an animated PNG file using the given
+// compression level.  All frames must have the same bounds.  Frames are
+// written as grayscale if all are grayscale and otherwise as RGB or, if any
+// frame is not opaque, RGBA.  Samples are written with 16 bits unless all
+// frames have 8-bit color models.
+func EncodeAPNG(w io.Writer, anim *Animation, level png.CompressionLevel) error {
+	if len(anim.Frames) == 0 {
+		return errors.New("png: no frames to encode")
+	}
+	bnds := anim.Frames[0].Bounds()
+	if bnds.Empty() {
+		return errors.New("png: cannot encode an empty image")
+	}
+
+	// Select a color type and bit depth that suits every frame.
+	var colorType, depth byte = pngGray, 8
+	for _, fr := range anim.Frames {
+		if fr.Bounds() != bnds {
+			return errors.New("png: all frames must have the same dimensions")
+		}
+		ct, d := pngColorType(fr)
+		if d > depth {
+			depth = d
+		}
+		switch {
+		case ct == pngRGBA:
+			colorType = pngRGBA
+		case ct == pngRGB && colorType == pngGray:
+			colorType = pngRGB
+		}
+	}
+
+	// Write the PNG signature, header, and animation control.
+	bw := bufio.NewWriter(w)
+	bw.WriteString(pngSignature)
+	if err := pngWriteChunk(bw, "IHDR", pngIHDR(bnds.Dx(), bnds.Dy(), colorType, depth, 0)); err != nil {
+		return err
+	}
+	var actl [8]byte
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(anim.Frames)))
+	binary.BigEndian.PutUint32(actl[4:], uint32(anim.Plays))
+	if err := pngWriteChunk(bw, "acTL", actl[:]); err != nil {
+		return err
+	}
+
+	// Write each frame as a frame-control chunk followed by the frame's
+	// pixel data.  The first frame doubles as the default image.
+	seq := uint32(0)
+	for i, fr := range anim.Frames {
+		data, err := pngCompressPixels(fr, colorType, depth, level, [][4]int{{0, 0, 1, 1}})
+		if err != nil {
+			return err
+		}
+		var fctl [26]byte
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(bnds.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(bnds.Dy()))
+		ms := anim.Delay(i).Milliseconds()
+		if ms > 65535 {
+			ms = 65535
+		}
+		binary.BigEndian.PutUint16(fctl[20:], uint16(ms))
+		binary.BigEndian.PutUint16(fctl[22:], 1000)
+		if err := pngWriteChunk(bw, "fcTL", fctl[:]); err != nil {
+			return err
+		}
+		seq++
+		if i == 0 {
+			if err := pngWriteData(bw, "IDAT", data); err != nil {
+				return err
+			}
+			continue
+		}
+		for len(data) > 0 {
+			n := len(data)
+			if n > 1<<20 {
+				n = 1 << 20
+			}
+			fdat := make([]byte, 4+n)
+			binary.BigEndian.PutUint32(fdat, seq)
+			copy(fdat[4:], data[:n])
+			if err := pngWriteChunk(bw, "fdAT", fdat); err != nil {
+				return err
+			}
+			seq++
+			data = data[n:]
+		}
+	}
+	if err := pngWriteChunk(bw, "IEND", nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
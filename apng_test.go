@@ -0,0 +1,104 @@
+// This file tests the animated PNG reader and writer.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testAnimation returns a small two-frame animation.
+func testAnimation() *Animation {
+	fr0 := testNRGBAImage(false)
+	fr1 := image.NewNRGBA(fr0.Bounds())
+	for i := range fr1.Pix {
+		fr1.Pix[i] = 255 - fr0.Pix[i]
+		if i%4 == 3 {
+			fr1.Pix[i] = 255
+		}
+	}
+	return &Animation{
+		Frames: []image.Image{fr0, fr1},
+		Delays: []time.Duration{50 * time.Millisecond, 200 * time.Millisecond},
+		Plays:  3,
+	}
+}
+
+// decodeAPNGFrame decodes an animated PNG file and returns its last frame.
+func decodeAPNGFrame(r io.Reader) (image.Image, error) {
+	anim, err := DecodeAPNG(r)
+	if err != nil {
+		return nil, err
+	}
+	return anim.Frames[len(anim.Frames)-1], nil
+}
+
+// TestAPNG verifies that an animation survives a round trip through an
+// animated PNG file.
+func TestAPNG(t *testing.T) {
+	want := testAnimation()
+	var buf bytes.Buffer
+	if err := EncodeAPNG(&buf, want, png.DefaultCompression); err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeAPNG(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Frames) != len(want.Frames) || got.Plays != want.Plays {
+		t.Fatalf("expected %d frames and %d plays but saw %d and %d",
+			len(want.Frames), want.Plays, len(got.Frames), got.Plays)
+	}
+	for i := range want.Frames {
+		checkImage(t, got.Frames[i], want.Frames[i], 0.0)
+		if got.Delays[i] != want.Delays[i] {
+			t.Errorf("frame %d: expected a delay of %v but saw %v", i, want.Delays[i], got.Delays[i])
+		}
+	}
+}
+
+// TestAPNGMalformed verifies that malformed animated PNG files are rejected
+// without panicking and that a corrupt chunk length does not cause a large
+// allocation.
+func TestAPNGMalformed(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeAPNG(&buf, testAnimation(), png.DefaultCompression); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	be32 := func(v uint32) []byte {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], v)
+		return b[:]
+	}
+	fctl := bytes.Index(data, []byte("fcTL")) + 4
+	checkPatched(t, decodeAPNGFrame, data, map[string]patch{
+		"bad signature":   {0, []byte{0}},
+		"huge chunk":      {8, be32(1 << 31)},
+		"long chunk":      {8, be32(1<<30 - 1)},
+		"missing IHDR":    {12, []byte("IHDX")},
+		"huge canvas":     {16, append(be32(1<<24), be32(1<<24)...)},
+		"frame too wide":  {fctl + 4, be32(1 << 20)},
+		"frame offscreen": {fctl + 12, be32(100)},
+	})
+	checkTruncated(t, decodeAPNGFrame, data, len(data)-12)
+	checkMutated(t, decodeAPNGFrame, data, bytes.Index(data, []byte("IDAT"))+4)
+
+	// Reading a file that claims to contain a 1 GiB chunk should allocate
+	// memory only for the data that are actually present.
+	long := append([]byte(nil), data...)
+	copy(long[8:], be32(1<<30-1))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	DecodeAPNG(bytes.NewReader(long))
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<24 {
+		t.Errorf("expected a small allocation but saw %d bytes", n)
+	}
+}
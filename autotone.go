@@ -0,0 +1,245 @@
+// This file provides support for automatic per-channel tone adjustments,
+// histogram equalization and auto-contrast, which make flat channels easier to
+// inspect when splitting or salvage flat channel scans when merging.
+
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"math"
+	"sort"
+	"strings"
+)
+
+// A toneCurve is a monotonic tone curve, represented as control points that
+// map original values to adjusted values.  Values between control points are
+// interpolated linearly.
+type toneCurve [][2]float64
+
+// curveTextKey is the keyword of the PNG tEXt chunk in which a split
+// channel's tone curve is recorded.
+const curveTextKey = "color-channels:curve"
+
+// parseAutoTone records in p.AutoTone the channels listed in the arguments to
+// --equalize and --auto-contrast, each a comma-separated list of channel
+// names.  If normalize is true, all other channels are recorded as
+// "auto-contrast".  parseAutoTone aborts on error.
+func parseAutoTone(p *Parameters, equalize, autoContrast string, normalize bool) {
+	p.AutoTone = make([]string, len(builtinChannelNames(p)))
+	for _, opt := range [...][2]string{{"equalize", equalize}, {"auto-contrast", autoContrast}} {
+		if opt[1] == "" {
+			continue
+		}
+		for _, nm := range strings.Split(opt[1], ",") {
+			ch := channelIndex(p, strings.TrimSpace(nm))
+			if p.AutoTone[ch] != "" {
+				notify.Fatalf("Channel %s was given to --%s and --%s",
+					builtinChannelNames(p)[ch], p.AutoTone[ch], opt[0])
+			}
+			p.AutoTone[ch] = opt[0]
+		}
+	}
+	if normalize {
+		for ch, mode := range p.AutoTone {
+			if mode == "" {
+				p.AutoTone[ch] = "auto-contrast"
+			}
+		}
+	}
+}
+
+// autoToneCurve returns the tone curve that equalizes (if mode is "equalize")
+// or maximizes the contrast of (if mode is "auto-contrast") a channel, as
+// control points mapping original values to adjusted values in [0.0, 1.0].
+// Pixels marked by a transparency mask, which may be nil, and NaN and
+// infinite values are ignored.  autoToneCurve returns nil if the remaining
+// pixels are constant.
+func autoToneCurve(g *Gray32f, mode string, mask *image.Gray) toneCurve {
+	bnds := g.Bounds()
+	vs := make([]float64, 0, bnds.Dx()*bnds.Dy())
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			v := g.FloatAt(x, y)
+			if !isMasked(mask, x, y) && !math.IsNaN(v) && !math.IsInf(v, 0) {
+				vs = append(vs, v)
+			}
+		}
+	}
+	if len(vs) == 0 {
+		return nil
+	}
+	sort.Float64s(vs)
+	lo, hi := vs[0], vs[len(vs)-1]
+	if lo == hi {
+		return nil
+	}
+	if mode == "auto-contrast" {
+		return toneCurve{{lo, 0.0}, {hi, 1.0}}
+	}
+
+	// Map each of a number of evenly spaced values to the fraction of
+	// pixels no brighter than it, excluding those at the minimum value.
+	const nPts = 257
+	nLo := sort.Search(len(vs), func(i int) bool { return vs[i] > lo })
+	curve := make(toneCurve, nPts)
+	for k := range curve {
+		x := lo + (hi-lo)*float64(k)/float64(nPts-1)
+		n := sort.Search(len(vs), func(i int) bool { return vs[i] > x })
+		curve[k] = [2]float64{x, float64(n-nLo) / float64(len(vs)-nLo)}
+	}
+	curve[nPts-1][1] = 1.0
+	return curve
+}
+
+// curveToLUT converts a tone curve to a 1D LUT.  If invert is true, the LUT
+// maps adjusted values back to original values.  Points that would make the
+// LUT's inputs non-increasing are discarded.
+func curveToLUT(curve toneCurve, invert bool) *lut1D {
+	in, out := 0, 1
+	if invert {
+		in, out = 1, 0
+	}
+	l := &lut1D{}
+	for _, pt := range curve {
+		if len(l.In) > 0 && pt[in] <= l.In[len(l.In)-1] {
+			continue
+		}
+		l.In = append(l.In, pt[in])
+		l.Out = append(l.Out, pt[out])
+	}
+	if len(l.In) < 2 {
+		return nil
+	}
+	return l
+}
+
+// applySplitAutoTone equalizes or maximizes the contrast of each of a set of
+// split channels as specified by p.AutoTone, recording the curve applied to
+// each channel.  Pixels marked by a transparency mask, which may be nil, do
+// not contribute to the curves.
+func applySplitAutoTone(p *Parameters, infos []ImageInfo, mask *image.Gray) {
+	if p.AutoTone == nil {
+		return
+	}
+	builtin := builtinChannelNames(p)
+	for i, info := range infos {
+		for ch, nm := range builtin {
+			if nm != info.Name || p.AutoTone[ch] == "" {
+				continue
+			}
+			curve := autoToneCurve(info.Image, p.AutoTone[ch], mask)
+			if l := curveToLUT(curve, false); l != nil {
+				infos[i].Image = mapGray(info.Image, l)
+				infos[i].Curve = curve
+			}
+		}
+	}
+}
+
+// applyMergeAutoTone prepares a set of channels to merge, given in channel
+// order.  It first undoes the tone curves recorded in a manifest, if any, and
+// then equalizes or maximizes the contrast of each channel as specified by
+// p.AutoTone.  Channels filled by --fill are left as is.  If
+// p.VisibleOnly is true, pixels that the alpha channel marks as fully
+// transparent do not contribute to the new curves.
+func applyMergeAutoTone(p *Parameters, channels []*Gray32f) []*Gray32f {
+	if p.ToneCurves == nil && p.AutoTone == nil {
+		return channels
+	}
+	var mask *image.Gray
+	if p.VisibleOnly && p.Alpha && p.AutoTone != nil && len(channels) > 0 {
+		mask = alphaTransparentMask(channels[len(channels)-1])
+	}
+	result := make([]*Gray32f, len(channels))
+	for i, g := range channels {
+		result[i] = g
+		if isFilled(p, i) {
+			continue
+		}
+		if i < len(p.ToneCurves) && p.ToneCurves[i] != nil {
+			if l := curveToLUT(p.ToneCurves[i], true); l != nil {
+				result[i] = mapGray(result[i], l)
+			}
+		}
+		if i < len(p.AutoTone) && p.AutoTone[i] != "" {
+			if l := curveToLUT(autoToneCurve(result[i], p.AutoTone[i], mask), false); l != nil {
+				result[i] = mapGray(result[i], l)
+			}
+		}
+	}
+	return result
+}
+
+// manifestToneCurves returns the tone curves recorded in a manifest, in
+// channel order, or nil if the manifest records none.
+func manifestToneCurves(man *channelManifest) []toneCurve {
+	var curves []toneCurve
+	for i, ent := range man.Channels {
+		if ent.Curve == nil {
+			continue
+		}
+		if curves == nil {
+			curves = make([]toneCurve, len(man.Channels))
+		}
+		curves[i] = ent.Curve
+	}
+	return curves
+}
+
+// curveText returns the PNG text with which to record a tone curve or nil if
+// the curve is nil.
+func curveText(curve toneCurve) map[string]string {
+	if curve == nil {
+		return nil
+	}
+	data, err := json.Marshal(curve)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	return map[string]string{curveTextKey: string(data)}
+}
+
+// readCurveText returns the tone curve recorded in a PNG channel file or nil
+// if the file is not a PNG file or records no tone curve.
+func readCurveText(fn string) toneCurve {
+	val, ok := readPNGText(fn)[curveTextKey]
+	if !ok {
+		return nil
+	}
+	var curve toneCurve
+	if json.Unmarshal([]byte(val), &curve) != nil || len(curve) < 2 {
+		notify.Fatalf("%s: Malformed %s text", fn, curveTextKey)
+	}
+	return curve
+}
+
+// readChannelCurves records in p.ToneCurves the tone curves recorded in a
+// list of channel files to merge, given in channel order but omitting
+// channels filled by --fill.  Curves recorded in the files replace those read
+// from a manifest.
+func readChannelCurves(p *Parameters, fns []string) {
+	var curves []toneCurve
+	fi := 0
+	for ch := range builtinChannelNames(p) {
+		if isFilled(p, ch) {
+			continue
+		}
+		if fi >= len(fns) {
+			break
+		}
+		curve := readCurveText(fns[fi])
+		fi++
+		if curve == nil {
+			continue
+		}
+		if curves == nil {
+			curves = make([]toneCurve, len(builtinChannelNames(p)))
+			copy(curves, p.ToneCurves)
+		}
+		curves[ch] = curve
+	}
+	if curves != nil {
+		p.ToneCurves = curves
+	}
+}
@@ -0,0 +1,34 @@
+// This file tests the automatic tone adjustments.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestAutoToneNonFinite verifies that NaN and infinite samples do not
+// contribute to a tone curve and pass through the resulting LUT safely.
+func TestAutoToneNonFinite(t *testing.T) {
+	g := testGrayImage()
+	g.SetFloat(0, 0, math.NaN())
+	g.SetFloat(1, 0, math.Inf(1))
+	g.SetFloat(2, 0, math.Inf(-1))
+	for _, mode := range []string{"equalize", "auto-contrast"} {
+		curve := autoToneCurve(g, mode, nil)
+		if len(curve) < 2 {
+			t.Fatalf("%s: expected a curve but saw %v", mode, curve)
+		}
+		if lo, hi := curve[0][0], curve[len(curve)-1][0]; lo != g.FloatAt(3, 0) || hi != 1.0 {
+			t.Fatalf("%s: expected a curve from %g to 1 but saw one from %g to %g", mode, g.FloatAt(3, 0), lo, hi)
+		}
+		l := curveToLUT(curve, false)
+		m := mapGray(g, l)
+		if v := m.FloatAt(0, 0); !math.IsNaN(v) {
+			t.Errorf("%s: expected NaN but saw %g", mode, v)
+		}
+		if v0, v1 := m.FloatAt(2, 0), m.FloatAt(1, 0); v0 != 0.0 || v1 != 1.0 {
+			t.Errorf("%s: expected infinities to map to 0 and 1 but saw %g and %g", mode, v0, v1)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// This file provides support for estimating the white point of a scene from
+// an image whose illumination is unknown.  Channels split relative to the
+// estimated white point have the scene's neutral colors at zero chroma.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"sort"
+	"strings"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// whiteEstimators maps each valid argument to --white-estimator to a
+// function that estimates an image's white point from the linear RGB values
+// of its non-transparent pixels.
+var whiteEstimators = map[string]func(pix [][3]float64) [3]float64{
+	"gray-world":  grayWorldWhite,
+	"white-patch": whitePatchWhite,
+}
+
+// whitePatchFraction is the fraction of the brightest pixels that
+// whitePatchWhite averages.  Averaging a small fraction rather than taking
+// the single brightest pixel makes the estimate robust to noise and to
+// specular highlights.
+const whitePatchFraction = 0.01
+
+// parseWhiteEstimator validates the argument to --white-estimator and returns
+// it in lowercase.  It aborts on error.
+func parseWhiteEstimator(arg string) string {
+	name := strings.ToLower(arg)
+	if _, ok := whiteEstimators[name]; !ok {
+		notify.Fatalf(`--white-estimator requires either "gray-world" or "white-patch" (not %q)`, arg)
+	}
+	return name
+}
+
+// grayWorldWhite estimates the white point as the average color, on the
+// assumption that the scene averages to gray.  For simplicity, it returns the
+// sum of the colors, which differs from the average only in luminance.
+func grayWorldWhite(pix [][3]float64) [3]float64 {
+	var sum [3]float64
+	for _, v := range pix {
+		for c := range sum {
+			sum[c] += v[c]
+		}
+	}
+	return sum
+}
+
+// whitePatchWhite estimates the white point as the average of the brightest
+// pixels, on the assumption that the brightest surfaces in the scene are
+// white.
+func whitePatchWhite(pix [][3]float64) [3]float64 {
+	lum := func(v [3]float64) float64 {
+		_, y, _ := colorful.LinearRgbToXyz(v[0], v[1], v[2])
+		return y
+	}
+	sorted := append([][3]float64(nil), pix...)
+	sort.Slice(sorted, func(i, j int) bool { return lum(sorted[i]) > lum(sorted[j]) })
+	n := int(float64(len(sorted))*whitePatchFraction + 0.5)
+	if n < 1 {
+		n = 1
+	}
+	return grayWorldWhite(sorted[:n])
+}
+
+// estimateWhitePoint estimates the white point of an image using the named
+// estimator and returns it as an XYZ color with unit luminance.  Fully
+// transparent pixels are ignored.  If the image provides no basis for an
+// estimate (e.g., it is entirely black), estimateWhitePoint returns D65.
+func estimateWhitePoint(img image.Image, method string) [3]float64 {
+	bnds := img.Bounds()
+	colorAt := colorAtFunc(img)
+	fimg, isFloat := img.(*NRGBA32f)
+	pix := make([][3]float64, 0, bnds.Dx()*bnds.Dy())
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			if isFloat {
+				if fimg.FloatsAt(x, y)[3] == 0.0 {
+					continue
+				}
+			} else if color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64).A == 0 {
+				continue
+			}
+			r, g, b := colorAt(x, y).LinearRgb()
+			pix = append(pix, [3]float64{r, g, b})
+		}
+	}
+	if len(pix) == 0 {
+		return colorful.D65
+	}
+	v := whiteEstimators[method](pix)
+	wx, wy, wz := colorful.LinearRgbToXyz(v[0], v[1], v[2])
+	if wy <= 0.0 || wx <= 0.0 || wz <= 0.0 {
+		return colorful.D65
+	}
+	return [3]float64{wx / wy, 1.0, wz / wy}
+}
+
+// applyAutoWhite replaces p.WhitePoint with an estimate of an image's white
+// point if so requested by p.AutoWhite and reports the estimate.  The
+// estimate is made only once so that all frames of an animation or image
+// sequence share the first frame's white point.
+func applyAutoWhite(p *Parameters, img image.Image) {
+	if p.AutoWhite == "" {
+		return
+	}
+	p.WhitePoint = estimateWhitePoint(img, p.AutoWhite)
+	p.AutoWhite = ""
+	wp := p.WhitePoint
+	sum := wp[0] + wp[1] + wp[2]
+	notify.Printf(`%s: Estimated white point is --white="%.5f %.5f" (merge with --cat=none)`,
+		p.InputNames[0], wp[0]/sum, wp[1]/sum)
+}
@@ -0,0 +1,270 @@
+// This file provides bounded-memory splitting and merging of PNG files.  The
+// input is read, converted, and written in bands of rows so that images far
+// larger than memory can be processed, at the cost of disallowing operations
+// that need to see the entire image at once.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"image"
+	"io"
+	"os"
+	"time"
+)
+
+// bandConflicts lists the operations that cannot be performed one band at a
+// time.  Each entry maps a description of the operation, suitable for use in
+// an error message, to a function that reports whether a set of parameters
+// requests it.
+var bandConflicts = []struct {
+	Name string
+	Used func(p *Parameters) bool
+}{
+	{"--manifest", func(p *Parameters) bool { return p.Manifest != "" }},
+	{"--montage", func(p *Parameters) bool { return p.Montage != "" }},
+	{"--visualize, --hue-wheel, or --colormap", func(p *Parameters) bool { return p.Visualize || p.HueWheel || p.Colormap != "" }},
+	{"--equalize, --auto-contrast, or --normalize", func(p *Parameters) bool { return p.AutoTone != nil }},
+	{"--white=auto", func(p *Parameters) bool { return p.AutoWhite != "" }},
+	{"--keep-alpha", func(p *Parameters) bool { return p.KeepAlpha }},
+	{"--subsample", func(p *Parameters) bool { return p.Subsample != "" && p.Subsample != "4:4:4" }},
+	{"--dither", func(p *Parameters) bool { return p.Dither != "" && p.Dither != "none" }},
+	{"--clip-mask", func(p *Parameters) bool { return p.ClipMask != "" }},
+	{"--signed", func(p *Parameters) bool { return p.Signed != "" && p.Signed != "offset" }},
+	{"--depth=32f", func(p *Parameters) bool { return p.Depth == "32f" }},
+	{"--png-interlace", func(p *Parameters) bool { return p.PNGInterlace }},
+	{"--watch", func(p *Parameters) bool { return p.Watch }},
+}
+
+// checkBandParams aborts if a set of parameters requests an operation that
+// cannot be performed one band at a time.
+func checkBandParams(p *Parameters) {
+	for _, c := range bandConflicts {
+		if c.Used(p) {
+			notify.Fatalf("--stream cannot be used with %s", c.Name)
+		}
+	}
+	if p.BandRows <= 0 {
+		notify.Fatalf("--band-rows must be positive (not %d)", p.BandRows)
+	}
+	if selectOutputFormat(p.OutputName, p.Format) != "png" {
+		notify.Fatal("--stream requires PNG output")
+	}
+	if p.Split && p.OutputName == "-" {
+		notify.Fatal("--stream cannot write split channels to the standard output device")
+	}
+	for _, fn := range p.InputNames {
+		if fn == "-" || isSequence(fn) || isZipFile(fn) || isTableFile(fn) || p.RawSize != (image.Point{}) {
+			notify.Fatal("--stream requires PNG input files")
+		}
+	}
+}
+
+// bandDepth returns the bit depth of PNG files written one band at a time.
+func bandDepth(p *Parameters) byte {
+	if p.Depth == "8" {
+		return 8
+	}
+	return 16
+}
+
+// createPNGRows creates a named PNG file, or the standard output device if the
+// name is empty, for writing one row at a time.  The file is tagged as
+// writePNGRowChunks specifies for img, which can be any band of the image.
+// createPNGRows aborts on error.
+func createPNGRows(p *Parameters, fn string, width, height int, colorType byte, img image.Image, text map[string]string) (*PNGRowWriter, io.Closer) {
+	var f *os.File = os.Stdout
+	if fn != "" {
+		var err error
+		f, err = os.Create(fn)
+		if err != nil {
+			notify.Fatal(err)
+		}
+	}
+	pw, err := NewPNGRowWriter(f, width, height, colorType, bandDepth(p), pngCompressionLevels[p.PNGCompression])
+	if err != nil {
+		notify.Fatal(err)
+	}
+	if err := writePNGRowChunks(pw, p, img, text); err != nil {
+		notify.Fatal(err)
+	}
+	return pw, f
+}
+
+// bandBounds returns the bounds of the band of rows beginning at row y0 of
+// an image of a given size.
+func bandBounds(p *Parameters, width, height, y0 int) image.Rectangle {
+	y1 := y0 + p.BandRows
+	if y1 > height {
+		y1 = height
+	}
+	return image.Rect(0, y0, width, y1)
+}
+
+// splitBands is a helper function for splitFile that splits a PNG file one
+// band of rows at a time.
+func splitBands(ctx context.Context, p *Parameters) error {
+	fn := p.InputNames[0]
+	pr, rc := OpenPNGRows(fn)
+	defer rc.Close()
+	defer pr.Close()
+	prof := inputProfile(p, fn)
+	progressFrom(ctx).SetTotal(pr.Height)
+	var pws []*PNGRowWriter
+	row := make([]float32, 4*pr.Width)
+	for y0 := 0; y0 < pr.Height; y0 += p.BandRows {
+		// Read and split a band.  Samples are stored with 16 bits of
+		// precision, which represents every PNG sample exactly, so
+		// the channels match those split from a fully decoded image.
+		start := time.Now()
+		band := image.NewNRGBA64(bandBounds(p, pr.Width, pr.Height, y0))
+		for y := band.Rect.Min.Y; y < band.Rect.Max.Y; y++ {
+			if err := pr.ReadRow(row); err != nil {
+				notify.Fatalf("%s: %s", fn, err)
+			}
+			pix := band.Pix[band.PixOffset(0, y):]
+			for i, v := range row {
+				binary.BigEndian.PutUint16(pix[2*i:], toGrayVal(float64(v)).Y)
+			}
+		}
+		p.Times.Since(stageDecode, start)
+		start = time.Now()
+		var src image.Image = band
+		if prof != nil {
+			src = prof.Convert(band)
+		}
+		outImgs, err := splitFrame(ctx, p, src)
+		if err != nil {
+			return err
+		}
+		p.Times.Since(stageConvert, start)
+
+		// Create the output files once the channels are known.
+		start = time.Now()
+		if pws == nil {
+			for i, name := range channelFileNames(p, p.OutputName, outImgs) {
+				pw, wc := createPNGRows(p, name, pr.Width, pr.Height, pngGray, outImgs[i].Image, channelText(outImgs[i]))
+				defer wc.Close()
+				pws = append(pws, pw)
+			}
+		}
+
+		// Write the band of each channel.
+		for i, info := range outImgs {
+			g := info.Image
+			for y := g.Rect.Min.Y; y < g.Rect.Max.Y; y++ {
+				off := g.PixOffset(0, y)
+				if err := pws[i].WriteRow(g.Pix[off : off+pr.Width]); err != nil {
+					notify.Fatal(err)
+				}
+			}
+		}
+		releaseChannels(outImgs)
+		p.Times.Since(stageEncode, start)
+	}
+	for _, pw := range pws {
+		if err := pw.Close(); err != nil {
+			notify.Fatal(err)
+		}
+	}
+	return nil
+}
+
+// mergeBands is a helper function for mergeInputs that merges PNG channel
+// files one band of rows at a time.
+func mergeBands(ctx context.Context, p *Parameters) error {
+	// Open all channel files, which must have the same dimensions, and
+	// read the metadata recorded in them.
+	checkChannelCount(p, len(p.InputNames))
+	prs := make([]*PNGRowReader, len(p.InputNames))
+	for i, fn := range p.InputNames {
+		var rc io.Closer
+		prs[i], rc = OpenPNGRows(fn)
+		defer rc.Close()
+		defer prs[i].Close()
+		if prs[i].Width != prs[0].Width || prs[i].Height != prs[0].Height {
+			notify.Fatal("--stream requires all input images to have the same dimensions")
+		}
+	}
+	readChannelCurves(p, p.InputNames)
+	readChannelRanges(p, p.InputNames)
+	readChannelLogScales(p, p.InputNames)
+	readChannelSubsample(p, p.InputNames)
+	if p.Subsample != "" && p.Subsample != "4:4:4" {
+		notify.Fatal("--stream cannot merge subsampled chroma channels")
+	}
+	p.GeoTags = ReadGeoTags(p.InputNames[0])
+
+	// Merge each band in turn.
+	wd, ht := prs[0].Width, prs[0].Height
+	progressFrom(ctx).SetTotal(ht)
+	row := make([]float32, 4*wd)
+	var pw *PNGRowWriter
+	for y0 := 0; y0 < ht; y0 += p.BandRows {
+		start := time.Now()
+		bnds := bandBounds(p, wd, ht, y0)
+		channels := allocGrays(bnds, len(prs))
+		for i, pr := range prs {
+			// Convert each row to grayscale, taking gray samples
+			// as is so as not to lose precision.
+			g := channels[i]
+			for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+				if err := pr.ReadRow(row); err != nil {
+					notify.Fatalf("%s: %s", p.InputNames[i], err)
+				}
+				off := g.PixOffset(0, y)
+				for x := 0; x < wd; x++ {
+					v := row[4*x : 4*x+4]
+					y := v[0]
+					if v[0] != v[1] || v[1] != v[2] {
+						y = 0.299*v[0] + 0.587*v[1] + 0.114*v[2]
+					}
+					g.Pix[off+x] = y * v[3]
+				}
+			}
+		}
+		p.Times.Since(stageDecode, start)
+		start = time.Now()
+		merged, err := mergeFrame(ctx, p, channels)
+		if err != nil {
+			return err
+		}
+		m := toDepth32f(merged).(*NRGBA32f)
+		p.Times.Since(stageConvert, start)
+
+		// Create the output file once the first band is merged.
+		start = time.Now()
+		if pw == nil {
+			colorType := byte(pngRGB)
+			if p.Alpha && !p.Opaque {
+				colorType = pngRGBA
+			}
+			var wc io.Closer
+			pw, wc = createPNGRows(p, p.OutputName, wd, ht, colorType, m, nil)
+			defer wc.Close()
+		}
+
+		// Write the band.
+		nc := 3
+		if p.Alpha && !p.Opaque {
+			nc = 4
+		}
+		out := make([]float32, nc*wd)
+		for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+			off := m.PixOffset(0, y)
+			for x := 0; x < wd; x++ {
+				copy(out[nc*x:nc*x+nc], m.Pix[off+4*x:off+4*x+nc])
+			}
+			if err := pw.WriteRow(out); err != nil {
+				notify.Fatal(err)
+			}
+		}
+		releaseGrays(channels)
+		p.Times.Since(stageEncode, start)
+	}
+	if err := pw.Close(); err != nil {
+		notify.Fatal(err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// This file provides chromatic adaptation transforms.  Colors are sRGB and
+// therefore relative to D65.  When HCL, L*a*b*, or L*u*v* channels are taken
+// relative to a different white point, each color is first adapted from D65
+// to that white point (and, when merging, back again) so that neutral colors
+// remain neutral, as they would to an observer adapted to the new
+// illumination.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// catMatrices maps each valid argument to --cat other than "none" to the
+// matrix that transforms XYZ colors to the cone-response (LMS) space in
+// which adaptation is performed.
+var catMatrices = map[string][3][3]float64{
+	"bradford": {
+		{0.8951, 0.2664, -0.1614},
+		{-0.7502, 1.7135, 0.0367},
+		{0.0389, -0.0685, 1.0296},
+	},
+	"cat02": {
+		{0.7328, 0.4296, -0.1624},
+		{-0.7036, 1.6975, 0.0061},
+		{0.0030, 0.0136, 0.9834},
+	},
+	"von-kries": {
+		{0.40024, 0.70760, -0.08081},
+		{-0.22630, 1.16532, 0.04570},
+		{0.0, 0.0, 0.91822},
+	},
+}
+
+// parseCAT validates the argument to --cat and returns it in canonical form,
+// lowercase and with words separated by hyphens (e.g., "Von Kries" becomes
+// "von-kries").  It aborts on error.
+func parseCAT(arg string) string {
+	name := strings.NewReplacer(" ", "-", "_", "-").Replace(strings.ToLower(arg))
+	if name == "vonkries" {
+		name = "von-kries"
+	}
+	if _, ok := catMatrices[name]; !ok && name != "none" {
+		notify.Fatalf(`--cat requires one of "bradford", "cat02", "von-kries", or "none" (not %q)`, arg)
+	}
+	return name
+}
+
+// whiteRelative reports whether a color space's channels are taken relative
+// to the white reference point.
+func whiteRelative(cs string) bool {
+	switch cs {
+	case "hcl", "lab", "luv":
+		return true
+	default:
+		return false
+	}
+}
+
+// mat3Mul returns the product of two 3×3 matrices.
+func mat3Mul(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+// mat3Apply returns the product of a 3×3 matrix and a vector.
+func mat3Apply(m [3][3]float64, v [3]float64) [3]float64 {
+	return [3]float64{
+		m[0][0]*v[0] + m[0][1]*v[1] + m[0][2]*v[2],
+		m[1][0]*v[0] + m[1][1]*v[1] + m[1][2]*v[2],
+		m[2][0]*v[0] + m[2][1]*v[1] + m[2][2]*v[2],
+	}
+}
+
+// mat3Inverse returns the inverse of a nonsingular 3×3 matrix.
+func mat3Inverse(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var inv [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// The inverse is the transposed matrix of cofactors
+			// divided by the determinant.
+			r0, r1 := (j+1)%3, (j+2)%3
+			c0, c1 := (i+1)%3, (i+2)%3
+			inv[i][j] = (m[r0][c0]*m[r1][c1] - m[r0][c1]*m[r1][c0]) / det
+		}
+	}
+	return inv
+}
+
+// catMatrix returns the matrix that adapts XYZ colors from one white point
+// to another using the named chromatic adaptation transform.
+func catMatrix(method string, from, to [3]float64) [3][3]float64 {
+	ma := catMatrices[method]
+	src := mat3Apply(ma, from)
+	dst := mat3Apply(ma, to)
+	var scale [3][3]float64
+	for i := range scale {
+		scale[i][i] = dst[i] / src[i]
+	}
+	return mat3Mul(mat3Inverse(ma), mat3Mul(scale, ma))
+}
+
+// adaptColor applies a chromatic adaptation matrix, as returned by
+// catMatrix, to a color.  The result is not clamped.
+func adaptColor(c colorful.Color, m [3][3]float64) colorful.Color {
+	x, y, z := fastXyz(c)
+	v := mat3Apply(m, [3]float64{x, y, z})
+	return fastFromXyz(v[0], v[1], v[2])
+}
+
+// needsAdaptation reports whether colors must be adapted from D65 to the
+// white point specified by a set of parameters before being split into (or
+// after being merged from) the channels of a given color space.
+func needsAdaptation(p *Parameters, cs string) bool {
+	return whiteRelative(cs) && p.CAT != "" && p.CAT != "none" && p.WhitePoint != colorful.D65
+}
+
+// adaptSplitKernel wraps a split kernel for a given color space so that it
+// adapts each color from D65 to p.WhitePoint using p.CAT.  The kernel is
+// returned unmodified if no adaptation is needed.
+func adaptSplitKernel(p *Parameters, cs string, fn func(colorful.Color) []float64) func(colorful.Color) []float64 {
+	if !needsAdaptation(p, cs) {
+		return fn
+	}
+	m := catMatrix(p.CAT, colorful.D65, p.WhitePoint)
+	return func(clr colorful.Color) []float64 {
+		return fn(adaptColor(clr, m))
+	}
+}
+
+// adaptMergeKernel wraps a merge kernel for a given color space so that it
+// adapts each color from p.WhitePoint back to D65 using p.CAT.  The kernel is
+// returned unmodified if no adaptation is needed.
+func adaptMergeKernel(p *Parameters, cs string, fn func(v []float64) colorful.Color) func(v []float64) colorful.Color {
+	if !needsAdaptation(p, cs) {
+		return fn
+	}
+	m := catMatrix(p.CAT, p.WhitePoint, colorful.D65)
+	return func(v []float64) colorful.Color {
+		return adaptColor(fn(v), m)
+	}
+}
@@ -0,0 +1,259 @@
+// Package channels provides the per-pixel conversions between colors and
+// channel values that color-channels uses when splitting and merging.
+//
+// Channel values use the same scaling as the channel images written by
+// color-channels --split: each is nominally in [0.0, 1.0], with hues divided
+// by 360 and signed L*a*b* and L*u*v* components mapped from [-1.0, 1.0] to
+// [0.0, 1.0].  Rescaling requested by --range or --chroma-max is not
+// applied.
+//
+// The To* functions accept any color.Color.  The From* functions return a
+// colorful.Color, which implements color.Color, without clamping it to the
+// sRGB gamut; call its Clamped method to do so.
+package channels
+
+import (
+	"image/color"
+	"math"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// toColorful converts an arbitrary color to a colorful.Color.  A
+// colorful.Color is returned as is so as not to lose precision.  Otherwise,
+// the quotients of the color components divided by alpha are rounded rather
+// than truncated, and fully transparent colors are mapped to black.
+func toColorful(c color.Color) colorful.Color {
+	if clr, ok := c.(colorful.Color); ok {
+		return clr
+	}
+	r, g, b, a := c.RGBA()
+	if a == 0 {
+		return colorful.Color{}
+	}
+	unpremult := func(v uint32) float64 {
+		return float64((v*0xffff+a/2)/a) / 65535.0
+	}
+	return colorful.Color{R: unpremult(r), G: unpremult(g), B: unpremult(b)}
+}
+
+// clamp01 clamps a value to [0.0, 1.0].
+func clamp01(v float64) float64 {
+	return math.Max(0.0, math.Min(v, 1.0))
+}
+
+// xyz converts a color to CIE XYZ using the table-driven transfer function.
+func xyz(c colorful.Color) (x, y, z float64) {
+	return colorful.LinearRgbToXyz(Linearize(c.R), Linearize(c.G), Linearize(c.B))
+}
+
+// fromXyz converts CIE XYZ to a color using the table-driven transfer
+// function.
+func fromXyz(x, y, z float64) colorful.Color {
+	r, g, b := colorful.XyzToLinearRgb(x, y, z)
+	return colorful.Color{R: Delinearize(r), G: Delinearize(g), B: Delinearize(b)}
+}
+
+// ToHCLWhiteRef converts a color to H, C, and L channel values using a given
+// white reference point.
+func ToHCLWhiteRef(c color.Color, wref [3]float64) [3]float64 {
+	x, y, z := xyz(toColorful(c))
+	h, cr, l := colorful.LabToHcl(colorful.XyzToLabWhiteRef(x, y, z, wref))
+	return [3]float64{h / 360.0, cr, l}
+}
+
+// FromHCLWhiteRef converts H, C, and L channel values to a color using a given
+// white reference point.
+func FromHCLWhiteRef(v [3]float64, wref [3]float64) colorful.Color {
+	l, a, b := colorful.HclToLab(v[0]*360.0, v[1], v[2])
+	return fromXyz(colorful.LabToXyzWhiteRef(l, a, b, wref))
+}
+
+// ToHCL converts a color to H, C, and L channel values using the D65 white
+// reference point.
+func ToHCL(c color.Color) [3]float64 { return ToHCLWhiteRef(c, colorful.D65) }
+
+// FromHCL converts H, C, and L channel values to a color using the D65 white
+// reference point.
+func FromHCL(v [3]float64) colorful.Color { return FromHCLWhiteRef(v, colorful.D65) }
+
+// ToLabWhiteRef converts a color to L*, a*, and b* channel values using a
+// given white reference point.
+func ToLabWhiteRef(c color.Color, wref [3]float64) [3]float64 {
+	x, y, z := xyz(toColorful(c))
+	l, a, b := colorful.XyzToLabWhiteRef(x, y, z, wref)
+	return [3]float64{l, (a + 1.0) / 2.0, (b + 1.0) / 2.0}
+}
+
+// FromLabWhiteRef converts L*, a*, and b* channel values to a color using a
+// given white reference point.
+func FromLabWhiteRef(v [3]float64, wref [3]float64) colorful.Color {
+	return fromXyz(colorful.LabToXyzWhiteRef(v[0], v[1]*2.0-1.0, v[2]*2.0-1.0, wref))
+}
+
+// ToLab converts a color to L*, a*, and b* channel values using the D65 white
+// reference point.
+func ToLab(c color.Color) [3]float64 { return ToLabWhiteRef(c, colorful.D65) }
+
+// FromLab converts L*, a*, and b* channel values to a color using the D65
+// white reference point.
+func FromLab(v [3]float64) colorful.Color { return FromLabWhiteRef(v, colorful.D65) }
+
+// ToLuvWhiteRef converts a color to L*, u*, and v* channel values using a
+// given white reference point.
+func ToLuvWhiteRef(c color.Color, wref [3]float64) [3]float64 {
+	x, y, z := xyz(toColorful(c))
+	l, u, v := colorful.XyzToLuvWhiteRef(x, y, z, wref)
+	return [3]float64{l, (u + 1.0) / 2.0, (v + 1.0) / 2.0}
+}
+
+// FromLuvWhiteRef converts L*, u*, and v* channel values to a color using a
+// given white reference point.
+func FromLuvWhiteRef(v [3]float64, wref [3]float64) colorful.Color {
+	return fromXyz(colorful.LuvToXyzWhiteRef(v[0], v[1]*2.0-1.0, v[2]*2.0-1.0, wref))
+}
+
+// ToLuv converts a color to L*, u*, and v* channel values using the D65 white
+// reference point.
+func ToLuv(c color.Color) [3]float64 { return ToLuvWhiteRef(c, colorful.D65) }
+
+// FromLuv converts L*, u*, and v* channel values to a color using the D65
+// white reference point.
+func FromLuv(v [3]float64) colorful.Color { return FromLuvWhiteRef(v, colorful.D65) }
+
+// ToXyy converts a color to x, y, and Y channel values.
+func ToXyy(c color.Color) [3]float64 {
+	x, y, Y := colorful.XyzToXyy(xyz(toColorful(c)))
+	return [3]float64{x, y, Y}
+}
+
+// FromXyy converts x, y, and Y channel values to a color.
+func FromXyy(v [3]float64) colorful.Color {
+	return fromXyz(colorful.XyyToXyz(v[0], v[1], v[2]))
+}
+
+// ToHSL converts a color to H, S, and L channel values.
+func ToHSL(c color.Color) [3]float64 {
+	h, s, l := toColorful(c).Hsl()
+	return [3]float64{h / 360.0, s, l}
+}
+
+// FromHSL converts H, S, and L channel values to a color.
+func FromHSL(v [3]float64) colorful.Color {
+	return colorful.Hsl(v[0]*360.0, v[1], v[2])
+}
+
+// ToHSLuv converts a color to HSLuv H, S, and L channel values.
+func ToHSLuv(c color.Color) [3]float64 {
+	h, s, l := toColorful(c).HSLuv()
+	return [3]float64{h / 360.0, s, l}
+}
+
+// FromHSLuv converts HSLuv H, S, and L channel values to a color.
+func FromHSLuv(v [3]float64) colorful.Color {
+	return colorful.HSLuv(v[0]*360.0, v[1], v[2])
+}
+
+// ToLinRGB converts a color to linear R, G, and B channel values.
+func ToLinRGB(c color.Color) [3]float64 {
+	clr := toColorful(c)
+	return [3]float64{Linearize(clr.R), Linearize(clr.G), Linearize(clr.B)}
+}
+
+// FromLinRGB converts linear R, G, and B channel values to a color.
+func FromLinRGB(v [3]float64) colorful.Color {
+	return colorful.Color{R: Delinearize(v[0]), G: Delinearize(v[1]), B: Delinearize(v[2])}
+}
+
+// ToRGB converts a color to R, G, and B channel values quantized to 8 bits.
+func ToRGB(c color.Color) [3]float64 {
+	r, g, b := toColorful(c).RGB255()
+	return [3]float64{float64(r) / 255.0, float64(g) / 255.0, float64(b) / 255.0}
+}
+
+// FromRGB converts R, G, and B channel values to a color.
+func FromRGB(v [3]float64) colorful.Color {
+	return colorful.Color{R: v[0], G: v[1], B: v[2]}
+}
+
+// ToSRGB converts a color to gamma-encoded R, G, and B channel values without
+// quantization.
+func ToSRGB(c color.Color) [3]float64 {
+	clr := toColorful(c)
+	return [3]float64{clr.R, clr.G, clr.B}
+}
+
+// FromSRGB converts gamma-encoded R, G, and B channel values to a color.
+func FromSRGB(v [3]float64) colorful.Color {
+	return colorful.Color{R: v[0], G: v[1], B: v[2]}
+}
+
+// ToCMYK converts a color to C, M, Y, and K channel values, replacing the
+// entire gray component with black, as does image/color's RGBToCMYK, but
+// without quantizing to 8 bits.
+func ToCMYK(c color.Color) [4]float64 {
+	clr := toColorful(c)
+	r, g, b := clamp01(clr.R), clamp01(clr.G), clamp01(clr.B)
+	k := 1.0 - math.Max(r, math.Max(g, b))
+	if k >= 1.0 {
+		return [4]float64{0.0, 0.0, 0.0, 1.0}
+	}
+	return [4]float64{
+		clamp01((1.0 - r - k) / (1.0 - k)),
+		clamp01((1.0 - g - k) / (1.0 - k)),
+		clamp01((1.0 - b - k) / (1.0 - k)),
+		k,
+	}
+}
+
+// FromCMYK converts C, M, Y, and K channel values to a color.  Unlike
+// image/color's CMYKToRGB, FromCMYK does not quantize to 8 bits.
+func FromCMYK(v [4]float64) colorful.Color {
+	k := 1.0 - clamp01(v[3])
+	return colorful.Color{
+		R: (1.0 - clamp01(v[0])) * k,
+		G: (1.0 - clamp01(v[1])) * k,
+		B: (1.0 - clamp01(v[2])) * k,
+	}
+}
+
+// BT.601 luma coefficients of red and blue.
+const (
+	bt601Kr = 0.299
+	bt601Kb = 0.114
+)
+
+// ToYCbCr converts a color to full-range Y', Cb, and Cr channel values using
+// the BT.601 matrix, as does image/color's RGBToYCbCr, but without quantizing
+// to 8 bits.  Cb and Cr are centered on 0.5.
+func ToYCbCr(c color.Color) [3]float64 {
+	clr := toColorful(c)
+	r, g, b := clamp01(clr.R), clamp01(clr.G), clamp01(clr.B)
+	y := bt601Kr*r + (1.0-bt601Kr-bt601Kb)*g + bt601Kb*b
+	return [3]float64{
+		y,
+		0.5 + 0.5*(b-y)/(1.0-bt601Kb),
+		0.5 + 0.5*(r-y)/(1.0-bt601Kr),
+	}
+}
+
+// FromYCbCr converts full-range Y', Cb, and Cr channel values to a color using
+// the BT.601 matrix.
+func FromYCbCr(v [3]float64) colorful.Color {
+	y := v[0]
+	r := y + 2.0*(1.0-bt601Kr)*(v[2]-0.5)
+	b := y + 2.0*(1.0-bt601Kb)*(v[1]-0.5)
+	g := (y - bt601Kr*r - bt601Kb*b) / (1.0 - bt601Kr - bt601Kb)
+	return colorful.Color{R: r, G: g, B: b}
+}
+
+// ToXYZ converts a color to X, Y, and Z channel values.
+func ToXYZ(c color.Color) [3]float64 {
+	x, y, z := xyz(toColorful(c))
+	return [3]float64{x, y, z}
+}
+
+// FromXYZ converts X, Y, and Z channel values to a color.
+func FromXYZ(v [3]float64) colorful.Color {
+	return fromXyz(v[0], v[1], v[2])
+}
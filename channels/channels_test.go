@@ -0,0 +1,141 @@
+// This file tests the per-pixel conversions.
+
+package channels
+
+import (
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// A conversion pairs a function that converts a color to channel values
+// with the function that converts them back.
+type conversion struct {
+	name string
+	to   func(color.Color) []float64
+	from func([]float64) colorful.Color
+	tol  float64 // Maximum round-trip error in any sRGB component
+}
+
+// conversions lists the conversions to test.
+var conversions = []conversion{
+	// go-colorful discards the hue of colors with a tiny chroma, so
+	// grays do not survive the round trip exactly.
+	{"hcl", func(c color.Color) []float64 { v := ToHCL(c); return v[:] },
+		func(v []float64) colorful.Color { return FromHCL([3]float64{v[0], v[1], v[2]}) }, 5e-4},
+	{"lab", func(c color.Color) []float64 { v := ToLab(c); return v[:] },
+		func(v []float64) colorful.Color { return FromLab([3]float64{v[0], v[1], v[2]}) }, 1e-6},
+	{"luv", func(c color.Color) []float64 { v := ToLuv(c); return v[:] },
+		func(v []float64) colorful.Color { return FromLuv([3]float64{v[0], v[1], v[2]}) }, 1e-6},
+	{"xyy", func(c color.Color) []float64 { v := ToXyy(c); return v[:] },
+		func(v []float64) colorful.Color { return FromXyy([3]float64{v[0], v[1], v[2]}) }, 1e-6},
+	{"hsl", func(c color.Color) []float64 { v := ToHSL(c); return v[:] },
+		func(v []float64) colorful.Color { return FromHSL([3]float64{v[0], v[1], v[2]}) }, 1e-9},
+	{"hsluv", func(c color.Color) []float64 { v := ToHSLuv(c); return v[:] },
+		func(v []float64) colorful.Color { return FromHSLuv([3]float64{v[0], v[1], v[2]}) }, 1e-6},
+	{"linrgb", func(c color.Color) []float64 { v := ToLinRGB(c); return v[:] },
+		func(v []float64) colorful.Color { return FromLinRGB([3]float64{v[0], v[1], v[2]}) }, 1e-6},
+	{"rgb", func(c color.Color) []float64 { v := ToRGB(c); return v[:] },
+		func(v []float64) colorful.Color { return FromRGB([3]float64{v[0], v[1], v[2]}) }, 0.5 / 255.0},
+	{"srgb", func(c color.Color) []float64 { v := ToSRGB(c); return v[:] },
+		func(v []float64) colorful.Color { return FromSRGB([3]float64{v[0], v[1], v[2]}) }, 0.0},
+	{"cmyk", func(c color.Color) []float64 { v := ToCMYK(c); return v[:] },
+		func(v []float64) colorful.Color { return FromCMYK([4]float64{v[0], v[1], v[2], v[3]}) }, 1e-12},
+	{"ycbcr", func(c color.Color) []float64 { v := ToYCbCr(c); return v[:] },
+		func(v []float64) colorful.Color { return FromYCbCr([3]float64{v[0], v[1], v[2]}) }, 1e-12},
+	{"xyz", func(c color.Color) []float64 { v := ToXYZ(c); return v[:] },
+		func(v []float64) colorful.Color { return FromXYZ([3]float64{v[0], v[1], v[2]}) }, 1e-6},
+}
+
+// testColors returns a set of colors spanning the sRGB gamut.
+func testColors() []colorful.Color {
+	var clrs []colorful.Color
+	for r := 0.0; r <= 1.0; r += 0.25 {
+		for g := 0.0; g <= 1.0; g += 0.25 {
+			for b := 0.0; b <= 1.0; b += 0.25 {
+				clrs = append(clrs, colorful.Color{R: r, G: g, B: b})
+			}
+		}
+	}
+	return clrs
+}
+
+// TestRoundTrip verifies that converting a color to channel values and back
+// recovers the color.
+func TestRoundTrip(t *testing.T) {
+	for _, cv := range conversions {
+		for _, clr := range testColors() {
+			v := cv.to(clr)
+			got := cv.from(v)
+			if math.Abs(got.R-clr.R) > cv.tol || math.Abs(got.G-clr.G) > cv.tol || math.Abs(got.B-clr.B) > cv.tol {
+				t.Errorf("%s: %v maps to %v, which maps back to %v", cv.name, clr, v, got)
+			}
+		}
+	}
+}
+
+// TestKnownValues verifies the channel values of a few colors against
+// independently computed values.
+func TestKnownValues(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	white := color.White
+	for _, tc := range []struct {
+		name string
+		got  []float64
+		want []float64
+		tol  float64
+	}{
+		{"Lab white", func() []float64 { v := ToLab(white); return v[:] }(), []float64{1.0, 0.5, 0.5}, 2e-4},
+		{"Luv white", func() []float64 { v := ToLuv(white); return v[:] }(), []float64{1.0, 0.5, 0.5}, 2e-4},
+		{"Lab red", func() []float64 { v := ToLab(red); return v[:] }(), []float64{0.53241, (0.80092 + 1.0) / 2.0, (0.67203 + 1.0) / 2.0}, 1e-4},
+		{"HCL red", func() []float64 { v := ToHCL(red); return v[:] }(), []float64{39.999 / 360.0, 1.04552, 0.53241}, 1e-4},
+		{"HSL red", func() []float64 { v := ToHSL(red); return v[:] }(), []float64{0.0, 1.0, 0.5}, 0.0},
+		{"XYZ white", func() []float64 { v := ToXYZ(white); return v[:] }(), []float64{0.95047, 1.0, 1.08883}, 5e-4},
+		{"xyY white", func() []float64 { v := ToXyy(white); return v[:] }(), []float64{0.31271, 0.32902, 1.0}, 1e-4},
+		{"linear gray", func() []float64 { v := ToLinRGB(color.Gray{128}); return v[:] }(), []float64{0.21586, 0.21586, 0.21586}, 1e-5},
+		{"CMYK red", func() []float64 { v := ToCMYK(red); return v[:] }(), []float64{0.0, 1.0, 1.0, 0.0}, 0.0},
+		{"CMYK gray", func() []float64 { v := ToCMYK(color.Gray16{0x8000}); return v[:] }(), []float64{0.0, 0.0, 0.0, 1.0 - 32768.0/65535.0}, 1e-12},
+		{"YCbCr red", func() []float64 { v := ToYCbCr(red); return v[:] }(), []float64{0.299, 0.5 - 0.5*0.299/0.886, 1.0}, 1e-12},
+		{"transparent", func() []float64 { v := ToSRGB(color.NRGBA{255, 255, 255, 0}); return v[:] }(), []float64{0.0, 0.0, 0.0}, 0.0},
+		{"premultiplied", func() []float64 { v := ToSRGB(color.RGBA64{0x4000, 0, 0, 0x8000}); return v[:] }(), []float64{0x8000 / 65535.0, 0.0, 0.0}, 1e-12},
+	} {
+		for i, w := range tc.want {
+			if math.Abs(tc.got[i]-w) > tc.tol {
+				t.Errorf("%s: expected %v but saw %v", tc.name, tc.want, tc.got)
+				break
+			}
+		}
+	}
+}
+
+// TestMatchesColorful verifies that the table-driven conversions agree with
+// go-colorful's exact ones.
+func TestMatchesColorful(t *testing.T) {
+	for i := 0; i <= 1000; i++ {
+		v := float64(i) / 1000.0
+		want, _, _ := colorful.Color{R: v}.LinearRgb()
+		if got := Linearize(v); math.Abs(got-want) > 1e-7 {
+			t.Fatalf("Linearize(%g): expected %g but saw %g", v, want, got)
+		}
+		if got, want := Delinearize(v), colorful.LinearRgb(v, 0, 0).R; math.Abs(got-want) > 1e-7 {
+			t.Fatalf("Delinearize(%g): expected %g but saw %g", v, want, got)
+		}
+	}
+	for _, clr := range testColors() {
+		l, a, b := clr.Lab()
+		got := ToLab(clr)
+		if math.Abs(got[0]-l) > 1e-6 || math.Abs(got[1]*2.0-1.0-a) > 1e-6 || math.Abs(got[2]*2.0-1.0-b) > 1e-6 {
+			t.Fatalf("ToLab(%v): expected (%g, %g, %g) before scaling but saw %v", clr, l, a, b, got)
+		}
+	}
+
+	// Values outside [0.0, 1.0] are converted exactly.
+	if got, want := Linearize(-0.5), -0.5/12.92; got != want {
+		t.Errorf("Linearize(-0.5): expected %g but saw %g", want, got)
+	}
+	if got, want := Delinearize(2.0), 1.055*math.Pow(2.0, 1.0/2.4)-0.055; got != want {
+		t.Errorf("Delinearize(2): expected %g but saw %g", want, got)
+	}
+}
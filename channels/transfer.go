@@ -0,0 +1,85 @@
+// This file provides table-driven versions of the sRGB transfer functions.
+// Every conversion between sRGB and a linear or CIE color space otherwise
+// calls math.Pow once per component, which dominates the cost of converting
+// large images.
+
+package channels
+
+import (
+	"math"
+	"sync"
+)
+
+// transferLUTSize is the number of entries in each transfer-function table,
+// enough for one entry per 16-bit code value.
+const transferLUTSize = 65536
+
+// linearizeLUT and delinearizeLUT tabulate the sRGB EOTF and its inverse at
+// evenly spaced points in [0.0, 1.0].  They are initialized on first use.
+var (
+	linearizeLUT   []float64
+	delinearizeLUT []float64
+	transferOnce   sync.Once
+)
+
+// linearize maps a gamma-encoded sRGB component to linear light exactly, as
+// does go-colorful.
+func linearize(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// delinearize maps a linear-light component to gamma-encoded sRGB exactly, as
+// does go-colorful.
+func delinearize(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1.0/2.4) - 0.055
+}
+
+// initTransferLUTs fills in linearizeLUT and delinearizeLUT.
+func initTransferLUTs() {
+	linearizeLUT = make([]float64, transferLUTSize)
+	delinearizeLUT = make([]float64, transferLUTSize)
+	for i := range linearizeLUT {
+		v := float64(i) / (transferLUTSize - 1)
+		linearizeLUT[i] = linearize(v)
+		delinearizeLUT[i] = delinearize(v)
+	}
+}
+
+// lookupTransfer evaluates a transfer function at v by interpolating
+// linearly between the entries of its table.  Values outside [0.0, 1.0],
+// which the table does not cover, are passed to the exact function instead.
+// At 16-bit spacing, the interpolation error is orders of magnitude below
+// the precision of a 16-bit channel.
+func lookupTransfer(lut []float64, exact func(float64) float64, v float64) float64 {
+	if !(v >= 0.0 && v <= 1.0) {
+		return exact(v)
+	}
+	pos := v * (transferLUTSize - 1)
+	i := int(pos)
+	if i >= transferLUTSize-1 {
+		return lut[transferLUTSize-1]
+	}
+	frac := pos - float64(i)
+	return lut[i] + (lut[i+1]-lut[i])*frac
+}
+
+// Linearize maps a gamma-encoded sRGB component to linear light, as does
+// go-colorful's Color.LinearRgb, but uses a lookup table rather than
+// math.Pow.
+func Linearize(v float64) float64 {
+	transferOnce.Do(initTransferLUTs)
+	return lookupTransfer(linearizeLUT, linearize, v)
+}
+
+// Delinearize maps a linear-light component to gamma-encoded sRGB, as does
+// go-colorful's LinearRgb, but uses a lookup table rather than math.Pow.
+func Delinearize(v float64) float64 {
+	transferOnce.Do(initTransferLUTs)
+	return lookupTransfer(delinearizeLUT, delinearize, v)
+}
@@ -0,0 +1,146 @@
+// This file provides support for counting and reporting the pixels whose
+// values are clamped when splitting or merging, which would otherwise lose
+// data silently.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// clipTolerance is the amount by which a value may lie outside [0.0, 1.0]
+// before it is considered clipped.  It is below the resolution of 16-bit
+// samples so that rounding errors in round trips are not reported.
+const clipTolerance = 0.5 / 255.0
+
+// isClipped reports whether clamping a value to [0.0, 1.0] would change it by
+// more than clipTolerance.
+func isClipped(v float64) bool {
+	return v < -clipTolerance || v > 1.0+clipTolerance
+}
+
+// colorChanged reports whether mapping a color into a gamut changed any of its
+// components by more than clipTolerance.
+func colorChanged(c, mapped colorful.Color) bool {
+	return math.Abs(c.R-mapped.R) > clipTolerance ||
+		math.Abs(c.G-mapped.G) > clipTolerance ||
+		math.Abs(c.B-mapped.B) > clipTolerance
+}
+
+// colorClipped reports whether clamping a color to the sRGB gamut would change
+// any of its components by more than clipTolerance.
+func colorClipped(c colorful.Color) bool {
+	return isClipped(c.R) || isClipped(c.G) || isClipped(c.B)
+}
+
+// A clipStats accumulates the number of pixels whose values were clamped and,
+// optionally, a mask of those pixels.
+type clipStats struct {
+	Pixels   int            // Number of pixels examined
+	Clipped  int            // Number of pixels with at least one clamped value
+	Channels map[string]int // Number of clamped values in each channel, when splitting
+	Order    []string       // Channel names in the order first seen
+	Mask     *image.Gray    // White where any value was clamped in any frame (nil before the first frame)
+}
+
+// Begin prepares a clipStats to count the pixels of a frame with the given
+// bounds.
+func (cs *clipStats) Begin(bnds image.Rectangle) {
+	if cs.Mask == nil {
+		cs.Mask = image.NewGray(bnds)
+	}
+}
+
+// Count records whether the pixel at (x, y) was clamped.
+func (cs *clipStats) Count(x, y int, clipped bool) {
+	cs.Pixels++
+	if clipped {
+		cs.Clipped++
+		cs.Mask.SetGray(x, y, color.Gray{Y: 255})
+	}
+}
+
+// CountChannel records that a value in the named channel was clamped.
+func (cs *clipStats) CountChannel(name string) {
+	if cs.Channels == nil {
+		cs.Channels = make(map[string]int)
+	}
+	if _, ok := cs.Channels[name]; !ok {
+		cs.Order = append(cs.Order, name)
+	}
+	cs.Channels[name]++
+}
+
+// splitClamps reports whether writing split channels as directed by a set of
+// parameters clamps values to [0.0, 1.0].  Only floating-point output
+// preserves out-of-range values.
+func splitClamps(p *Parameters) bool {
+	of := paramsOutputFormat(p)
+	return !(p.Depth == "32f" || (p.Depth == "" && of.Float))
+}
+
+// countSplitClipping records in p.Clip the pixels of a set of split channels
+// whose values lie outside [0.0, 1.0] and will therefore be clamped when
+// written.  Pixels marked by a transparency mask, which may be nil, are not
+// counted.
+func countSplitClipping(p *Parameters, infos []ImageInfo, mask *image.Gray) {
+	if p.Clip == nil || len(infos) == 0 || !splitClamps(p) {
+		return
+	}
+	bnds := infos[0].Image.Bounds()
+	p.Clip.Begin(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			if isMasked(mask, x, y) {
+				continue
+			}
+			clipped := false
+			for _, info := range infos {
+				if v := info.Image.FloatAt(x, y); isClipped(v) {
+					p.Clip.CountChannel(info.Name)
+					clipped = true
+				}
+			}
+			p.Clip.Count(x, y, clipped)
+		}
+	}
+}
+
+// reportClipping reports the number of pixels recorded in p.Clip as clamped,
+// if any, prefixing the report with a given label.  If p.ClipMask is
+// nonempty, reportClipping additionally writes a mask of the clamped pixels
+// to that file.  It aborts on error.
+func reportClipping(p *Parameters, label string) {
+	cs := p.Clip
+	if cs == nil || cs.Mask == nil {
+		return
+	}
+	if cs.Clipped > 0 {
+		verb := "were clipped"
+		if !p.Split && p.Gamut != "clamp" {
+			verb = "were mapped into the sRGB gamut"
+		}
+		msg := fmt.Sprintf("%s: %d of %d pixels (%.2f%%) %s",
+			label, cs.Clipped, cs.Pixels, 100.0*float64(cs.Clipped)/float64(cs.Pixels), verb)
+		if len(cs.Order) > 0 {
+			counts := make([]string, len(cs.Order))
+			for i, nm := range cs.Order {
+				counts[i] = fmt.Sprintf("%s: %d", nm, cs.Channels[nm])
+			}
+			msg += fmt.Sprintf(" (%s)", strings.Join(counts, ", "))
+		}
+		notify.Print(msg)
+	}
+	if p.ClipMask != "" {
+		err := WriteImage(p, p.ClipMask, cs.Mask)
+		if err != nil {
+			notify.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// This file provides support for controlling black generation, the portion
+// of each color's gray component that is printed with black ink rather than
+// with cyan, magenta, and yellow, when splitting into CMYK.
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// A blackGen describes a black-generation curve.  Once a color's gray
+// component, 1 - max(R, G, B), exceeds Start, the amount of black ink ramps
+// linearly from none at Start to Amount at a gray component of 1.0 (black).
+// The default, {1, 0}, replaces the entire gray component, as does
+// image/color's RGBToCMYK.
+type blackGen struct {
+	Amount float64 // Amount of black ink with which to print black
+	Start  float64 // Gray component below which no black ink is used
+}
+
+// parseBlackGen parses the argument to --black-generation, which has the form
+// <amount> or <amount>:<start>, each in [0.0, 1.0].  It aborts on error.
+func parseBlackGen(arg string) *blackGen {
+	amt, start := arg, "0"
+	if colon := strings.Index(arg, ":"); colon >= 0 {
+		amt, start = arg[:colon], arg[colon+1:]
+	}
+	a, err1 := strconv.ParseFloat(strings.TrimSpace(amt), 64)
+	s, err2 := strconv.ParseFloat(strings.TrimSpace(start), 64)
+	if err1 != nil || err2 != nil || a < 0.0 || a > 1.0 || s < 0.0 || s >= 1.0 {
+		notify.Fatalf("--black-generation requires <amount> or <amount>:<start>, with <amount> from 0.0 to 1.0 and <start> from 0.0 up to but not including 1.0 (not %q)", arg)
+	}
+	return &blackGen{Amount: a, Start: s}
+}
+
+// Black returns the amount of black ink with which to print a given gray
+// component.
+func (bg blackGen) Black(gray float64) float64 {
+	if gray <= bg.Start {
+		return 0.0
+	}
+	return bg.Amount * (gray - bg.Start) / (1.0 - bg.Start)
+}
+
+// toCMYKBlackGen converts a color to C, M, Y, and K channel values using a
+// given black-generation curve.  Cyan, magenta, and yellow are reduced to
+// compensate for the black ink (undercolor removal), so channels.FromCMYK
+// recovers the original color regardless of the curve.
+func toCMYKBlackGen(c colorful.Color, bg blackGen) [4]float64 {
+	r, g, b := clamp01(c.R), clamp01(c.G), clamp01(c.B)
+	k := bg.Black(1.0 - math.Max(r, math.Max(g, b)))
+	if k >= 1.0 {
+		return [4]float64{0.0, 0.0, 0.0, 1.0}
+	}
+	return [4]float64{
+		clamp01((1.0 - r - k) / (1.0 - k)),
+		clamp01((1.0 - g - k) / (1.0 - k)),
+		clamp01((1.0 - b - k) / (1.0 - k)),
+		k,
+	}
+}
@@ -0,0 +1,164 @@
+// This file provides functions for combining channels taken from different
+// source images into a single color image.
+
+package main
+
+import (
+	"context"
+	"image"
+	"strings"
+)
+
+// A combineSource describes where to find one channel of a combined image.
+type combineSource struct {
+	File    string // Name of the source image file
+	Space   string // Color space in which to split the source ("" for a grayscale source)
+	Channel string // Name of the channel within Space
+}
+
+// parseCombineSource parses a source specification of the form
+// <filename>:<space>:<channel> or, for a grayscale source, simply
+// <filename>.  The filename itself may contain colons.  It aborts on error.
+func parseCombineSource(p *Parameters, spec string) combineSource {
+	fields := strings.Split(spec, ":")
+	if len(fields) < 3 {
+		return combineSource{File: spec}
+	}
+	n := len(fields)
+	src := combineSource{
+		File:    strings.Join(fields[:n-2], ":"),
+		Channel: fields[n-1],
+	}
+	cs, _, ok := lookupColorSpace(fields[n-2])
+	if !ok {
+		notify.Fatalf("%s: color space must be one of %s (not %q)",
+			spec, colorSpaceString, fields[n-2])
+	}
+	src.Space = cs
+	names, _ := splitKernel(cs, p.WhitePoint)
+	names = append(names, "alpha")
+	for _, nm := range names {
+		if nm == src.Channel {
+			return src
+		}
+	}
+	notify.Fatalf("%s: channel must be one of %s (not %q)",
+		spec, strings.Join(names, ", "), src.Channel)
+	return src
+}
+
+// parseCombineInputs parses the input names for --combine, each of the form
+// <channel>=<source>, and returns the source of each channel of the output
+// color space, including alpha if requested.  It aborts on error.
+func parseCombineInputs(p *Parameters) []combineSource {
+	names, _ := splitKernel(p.ColorSpace, p.WhitePoint)
+	if p.Alpha {
+		names = append(names, "alpha")
+	}
+	srcs := make([]combineSource, len(names))
+	seen := make([]bool, len(names))
+	for _, arg := range p.InputNames {
+		// Split the argument into a channel name and a source.
+		eq := strings.Index(arg, "=")
+		if eq < 0 {
+			notify.Fatalf("--combine requires arguments of the form <channel>=<filename>:<space>:<channel> (not %q)", arg)
+		}
+		ch := -1
+		for i, nm := range names {
+			if nm == arg[:eq] {
+				ch = i
+				break
+			}
+		}
+		if ch < 0 {
+			notify.Fatalf("--combine requires a channel name of %s for --space=%q (not %q)",
+				strings.Join(names, ", "), p.OrigColorSpace, arg[:eq])
+		}
+		if seen[ch] {
+			notify.Fatalf("Channel %s was specified more than once", names[ch])
+		}
+		seen[ch] = true
+		srcs[ch] = parseCombineSource(p, arg[eq+1:])
+	}
+
+	// Ensure that every channel was specified.
+	for i, nm := range names {
+		if !seen[i] {
+			notify.Fatalf("No source was specified for channel %s", nm)
+		}
+	}
+	return srcs
+}
+
+// combineChannels builds a color image from channels taken from different
+// source images as directed by a set of parameters.  It returns the context's
+// error if ctx is canceled and aborts on any other error.
+func combineChannels(ctx context.Context, p *Parameters) error {
+	ctx = withWorkers(ctx, p.Workers)
+	srcs := parseCombineInputs(p)
+
+	// Extract each channel from its source, reading each file and
+	// splitting it in each color space at most once.
+	imgs := make(map[string]image.Image)
+	splits := make(map[[2]string][]ImageInfo)
+	channels := make([]*Gray32f, len(srcs))
+	for i, src := range srcs {
+		if src.Space == "" {
+			channels[i] = ReadGrayscaleImage(src.File)
+		} else {
+			img, ok := imgs[src.File]
+			if !ok {
+				img = readColorImage(p, src.File)
+				imgs[src.File] = img
+			}
+			key := [2]string{src.File, src.Space}
+			if src.Channel == "alpha" {
+				key[1] = "alpha"
+			}
+			infos, ok := splits[key]
+			if !ok {
+				var err error
+				if src.Channel == "alpha" {
+					var alpha ImageInfo
+					alpha, err = ExtractAlpha(ctx, img)
+					infos = []ImageInfo{alpha}
+				} else {
+					names, fn := splitKernel(src.Space, p.WhitePoint)
+					infos, err = splitAny(ctx, img, names, adaptSplitKernel(p, src.Space, fn))
+				}
+				if err != nil {
+					return err
+				}
+				splits[key] = infos
+			}
+			for _, info := range infos {
+				if info.Name == src.Channel {
+					channels[i] = info.Image
+					break
+				}
+			}
+		}
+		if p.GeoTags == nil {
+			p.GeoTags = ReadGeoTags(src.File)
+		}
+	}
+
+	// Ensure that all channels have the same bounds.
+	bnds := channels[0].Bounds()
+	for _, g := range channels {
+		if g.Bounds() != bnds {
+			notify.Fatal("All input images must have the same dimensions")
+		}
+	}
+
+	// Merge and write the channels.
+	merged, err := mergeFrame(ctx, p, channels)
+	if err != nil {
+		return err
+	}
+	err = WriteImage(p, p.OutputName, merged)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	return nil
+}
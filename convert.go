@@ -0,0 +1,183 @@
+// This file provides routines for re-encoding a color image through a color
+// space without writing the intermediate channels to files.
+
+package main
+
+import (
+	"context"
+	"image"
+	"math"
+	"strings"
+)
+
+// convertFrame is a helper function for convertImage that converts a single
+// image.
+func convertFrame(ctx context.Context, p *Parameters, img image.Image) (image.Image, error) {
+	return recodeFrame(ctx, p, img, -1, nil)
+}
+
+// recodeFrame splits each pixel of an image into channel values, optionally
+// replaces channel number repl (counting alpha, if any, as the final channel)
+// with the corresponding value from a grayscale image, and merges the values
+// back into a color.  A negative repl leaves all channels intact.
+func recodeFrame(ctx context.Context, p *Parameters, img image.Image, repl int, g *Gray32f) (image.Image, error) {
+	if p.Premultiplied {
+		var err error
+		img, err = Unpremultiply(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+	}
+	names, split := paramsSplitKernel(p)
+	merge := paramsMergeKernel(p)
+	colorAt := colorAtFunc(img)
+	alphaAt := alphaAtFunc(img)
+	bnds := img.Bounds()
+	conv := NewNRGBA32f(bnds)
+	err := forEachRow(ctx, bnds, func(y int) {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			vs := split(colorAt(x, y))
+			if repl >= 0 && repl < len(names) {
+				vs[repl] = g.FloatAt(x, y)
+			}
+			clr := merge(vs)
+			a := 1.0
+			if p.Alpha {
+				a = alphaAt(x, y)
+				if repl == len(names) {
+					a = g.FloatAt(x, y)
+				}
+				a = math.Max(0.0, math.Min(1.0, a))
+			}
+			conv.SetFloats(x, y, [4]float64{clr.R, clr.G, clr.B, a})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.Premultiplied {
+		return Premultiply(ctx, conv)
+	}
+	return conv, nil
+}
+
+// convertImage re-encodes an image through a color space as directed by a set
+// of parameters.  It returns the context's error if ctx is canceled and
+// aborts on any other error.
+func convertImage(ctx context.Context, p *Parameters) error {
+	ctx = withWorkers(ctx, p.Workers)
+	if len(p.InputNames) != 1 {
+		notify.Fatalf("Expected 1 input file but saw %d", len(p.InputNames))
+	}
+	in := p.InputNames[0]
+
+	// Convert each file of an image sequence in turn.
+	if isSequence(in) {
+		if !hasFrameVerb(p.OutputName) {
+			notify.Fatal(`With an image-sequence input, the output file must contain a frame number (e.g., "%05d")`)
+		}
+		for _, n := range sequenceFrames(in) {
+			fn := expandFrame(in, n)
+			p.GeoTags = ReadGeoTags(fn)
+			conv, err := convertFrame(ctx, p, readColorImage(p, fn))
+			if err != nil {
+				return err
+			}
+			err = WriteImage(p, expandFrame(p.OutputName, n), conv)
+			if err != nil {
+				notify.Fatal(err)
+			}
+		}
+		return nil
+	}
+
+	// Convert each frame of an animation in turn.
+	p.GeoTags = ReadGeoTags(in)
+	if anim := ReadAnimation(in); anim != nil {
+		conv := &Animation{Delays: anim.Delays, Plays: anim.Plays}
+		for _, fr := range anim.Frames {
+			c, err := convertFrame(ctx, p, fr)
+			if err != nil {
+				return err
+			}
+			conv.Frames = append(conv.Frames, c)
+		}
+		if hasFrameVerb(p.OutputName) {
+			for f, fr := range conv.Frames {
+				err := WriteImage(p, expandFrame(p.OutputName, f), fr)
+				if err != nil {
+					notify.Fatal(err)
+				}
+			}
+			return nil
+		}
+		err := WriteAnimation(p, p.OutputName, conv)
+		if err != nil {
+			notify.Fatal(err)
+		}
+		return nil
+	}
+
+	// Convert a single image.
+	conv, err := convertFrame(ctx, p, readColorImage(p, in))
+	if err != nil {
+		return err
+	}
+	err = WriteImage(p, p.OutputName, conv)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	return nil
+}
+
+// replaceChannel replaces one channel of a color image with a grayscale image
+// and writes the recomposed color image as directed by a set of parameters.
+// It returns the context's error if ctx is canceled and aborts on any other
+// error.
+func replaceChannel(ctx context.Context, p *Parameters) error {
+	ctx = withWorkers(ctx, p.Workers)
+	if len(p.InputNames) != 2 {
+		notify.Fatalf("Expected a color image and a channel image but saw %d input files", len(p.InputNames))
+	}
+
+	// Find the channel to replace.
+	names, _ := splitKernel(p.ColorSpace, p.WhitePoint)
+	if p.Alpha {
+		names = append(names, "alpha")
+	}
+	repl := -1
+	for i, nm := range names {
+		if nm == p.Replace {
+			repl = i
+			break
+		}
+	}
+	if repl < 0 {
+		notify.Fatalf("--replace requires one of %s for --space=%q (not %q)",
+			strings.Join(names, ", "), p.OrigColorSpace, p.Replace)
+	}
+
+	// Read the color image and the replacement channel.
+	p.GeoTags = ReadGeoTags(p.InputNames[0])
+	img := readColorImage(p, p.InputNames[0])
+	var g *Gray32f
+	if fn := p.InputNames[1]; isTableFile(fn) {
+		g = ReadTableChannel(fn)
+	} else {
+		g = ReadGrayscaleImage(fn)
+	}
+	if g.Bounds() != img.Bounds() {
+		notify.Fatal("All input images must have the same dimensions")
+	}
+
+	// Recompose and write the image.
+	conv, err := recodeFrame(ctx, p, img, repl, g)
+	if err != nil {
+		return err
+	}
+	err = WriteImage(p, p.OutputName, conv)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	return nil
+}
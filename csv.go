@@ -0,0 +1,221 @@
+// This file provides support for reading and writing channels as CSV or TSV
+// text tables, which are convenient for spreadsheet-based analysis.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tableLayouts is the set of valid --csv-layout arguments.
+var tableLayouts = map[string]bool{
+	"matrix": true,
+	"rows":   true,
+}
+
+// formatTableValue formats a sample value for output.
+func formatTableValue(v float64) string {
+	return strconv.FormatFloat(float64(float32(v)), 'g', -1, 32)
+}
+
+// encodeTable writes an image as a text table with values separated by a
+// given delimiter.  In the "matrix" layout, a grayscale image is written as
+// one line per row and one column per pixel.  In the "rows" layout, and for
+// all color images, the table contains a header line followed by one line per
+// pixel, listing the pixel's x and y coordinates and its channel values.
+func encodeTable(w io.Writer, img image.Image, p *Parameters, delim rune) error {
+	bnds := img.Bounds()
+	var names []string
+	var valuesAt func(x, y int) []float64
+	switch m := img.(type) {
+	case *Gray32f:
+		names = []string{"value"}
+		valuesAt = func(x, y int) []float64 { return []float64{m.FloatAt(x, y)} }
+	case *NRGBA32f:
+		names = []string{"R", "G", "B", "A"}
+		valuesAt = func(x, y int) []float64 {
+			v := m.FloatsAt(x, y)
+			return v[:]
+		}
+	default:
+		if img.ColorModel() == color.GrayModel || img.ColorModel() == color.Gray16Model {
+			names = []string{"value"}
+			valuesAt = func(x, y int) []float64 {
+				g := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16)
+				return []float64{float64(g.Y) / 65535.0}
+			}
+			break
+		}
+		names = []string{"R", "G", "B", "A"}
+		valuesAt = func(x, y int) []float64 {
+			c := toNRGBA64(img.At(x, y))
+			return []float64{
+				float64(c.R) / 65535.0,
+				float64(c.G) / 65535.0,
+				float64(c.B) / 65535.0,
+				float64(c.A) / 65535.0,
+			}
+		}
+	}
+
+	// Write the table.
+	cw := csv.NewWriter(w)
+	cw.Comma = delim
+	if p.CSVLayout == "matrix" && len(names) == 1 {
+		rec := make([]string, bnds.Dx())
+		for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+			for x := bnds.Min.X; x < bnds.Max.X; x++ {
+				rec[x-bnds.Min.X] = formatTableValue(valuesAt(x, y)[0])
+			}
+			cw.Write(rec)
+		}
+	} else {
+		cw.Write(append([]string{"x", "y"}, names...))
+		rec := make([]string, 2+len(names))
+		for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+			for x := bnds.Min.X; x < bnds.Max.X; x++ {
+				rec[0] = strconv.Itoa(x - bnds.Min.X)
+				rec[1] = strconv.Itoa(y - bnds.Min.Y)
+				for i, v := range valuesAt(x, y) {
+					rec[i+2] = formatTableValue(v)
+				}
+				cw.Write(rec)
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// encodeCSV writes an image as a table of comma-separated values.
+func encodeCSV(w io.Writer, img image.Image, p *Parameters) error {
+	return encodeTable(w, img, p, ',')
+}
+
+// encodeTSV writes an image as a table of tab-separated values.
+func encodeTSV(w io.Writer, img image.Image, p *Parameters) error {
+	return encodeTable(w, img, p, '\t')
+}
+
+// isTableFile reports whether a filename designates a CSV or TSV file.
+func isTableFile(fn string) bool {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".csv", ".tsv":
+		return true
+	default:
+		return false
+	}
+}
+
+// decodeTable reads a grayscale channel from a text table in either the
+// "matrix" or the "rows" layout.  The layout is inferred from the presence of
+// a header line beginning with "x" and "y".
+func decodeTable(r io.Reader, delim rune) (*Gray32f, error) {
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.Comma = delim
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	recs, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, errors.New("empty table")
+	}
+	parse := func(s string, line int) (float64, error) {
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: invalid number %q", line, s)
+		}
+		return v, nil
+	}
+
+	// Handle the "rows" layout.
+	hdr := recs[0]
+	if len(hdr) >= 3 && strings.EqualFold(hdr[0], "x") && strings.EqualFold(hdr[1], "y") {
+		if len(hdr) != 3 {
+			return nil, errors.New("expected exactly one value column")
+		}
+		type entry struct {
+			x, y int
+			v    float64
+		}
+		entries := make([]entry, 0, len(recs)-1)
+		var size image.Point
+		for i, rec := range recs[1:] {
+			if len(rec) != 3 {
+				return nil, fmt.Errorf("line %d: expected 3 fields but saw %d", i+2, len(rec))
+			}
+			var e entry
+			var err error
+			e.x, err = strconv.Atoi(strings.TrimSpace(rec[0]))
+			if err != nil || e.x < 0 {
+				return nil, fmt.Errorf("line %d: invalid x coordinate %q", i+2, rec[0])
+			}
+			e.y, err = strconv.Atoi(strings.TrimSpace(rec[1]))
+			if err != nil || e.y < 0 {
+				return nil, fmt.Errorf("line %d: invalid y coordinate %q", i+2, rec[1])
+			}
+			if e.v, err = parse(rec[2], i+2); err != nil {
+				return nil, err
+			}
+			if e.x >= size.X {
+				size.X = e.x + 1
+			}
+			if e.y >= size.Y {
+				size.Y = e.y + 1
+			}
+			entries = append(entries, e)
+		}
+		gray := NewGray32f(image.Rectangle{Max: size})
+		for _, e := range entries {
+			gray.SetFloat(e.x, e.y, e.v)
+		}
+		return gray, nil
+	}
+
+	// Handle the "matrix" layout.
+	gray := NewGray32f(image.Rect(0, 0, len(recs[0]), len(recs)))
+	for y, rec := range recs {
+		if len(rec) != len(recs[0]) {
+			return nil, fmt.Errorf("line %d: expected %d fields but saw %d", y+1, len(recs[0]), len(rec))
+		}
+		for x, s := range rec {
+			v, err := parse(s, y+1)
+			if err != nil {
+				return nil, err
+			}
+			gray.SetFloat(x, y, v)
+		}
+	}
+	return gray, nil
+}
+
+// ReadTableChannel reads a grayscale channel from a named CSV or TSV file.
+// It aborts on error.
+func ReadTableChannel(fn string) *Gray32f {
+	f, err := os.Open(fn)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	defer f.Close()
+	delim := ','
+	if strings.ToLower(filepath.Ext(fn)) == ".tsv" {
+		delim = '\t'
+	}
+	gray, err := decodeTable(f, delim)
+	if err != nil {
+		notify.Fatalf("%s: %s", fn, err)
+	}
+	return gray
+}
@@ -0,0 +1,203 @@
+// This file provides support for reading the curves presets saved by
+// Photoshop (.acv files) and GIMP so that existing tone curves can be applied
+// to channels as 1D LUTs.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// curveSamples is the number of samples with which a curve defined by control
+// points is represented as a 1D LUT.
+const curveSamples = 1024
+
+// curveLUT returns a 1D LUT that follows a smooth curve through a set of
+// control points, each an (input, output) pair in [0.0, 1.0].  Like
+// Photoshop and GIMP, curveLUT interpolates with a natural cubic spline and
+// holds the output constant beyond the first and last control points.
+func curveLUT(pts [][2]float64) (*lut1D, error) {
+	// Sort the points and discard those with duplicate inputs.
+	sort.Slice(pts, func(i, j int) bool { return pts[i][0] < pts[j][0] })
+	var xs, ys []float64
+	for _, pt := range pts {
+		if len(xs) > 0 && pt[0] == xs[len(xs)-1] {
+			continue
+		}
+		xs = append(xs, pt[0])
+		ys = append(ys, pt[1])
+	}
+	n := len(xs)
+	if n < 2 {
+		return nil, fmt.Errorf("a curve requires at least 2 control points")
+	}
+
+	// Solve for the second derivatives of a natural cubic spline.
+	d2 := make([]float64, n)
+	u := make([]float64, n)
+	for i := 1; i < n-1; i++ {
+		sig := (xs[i] - xs[i-1]) / (xs[i+1] - xs[i-1])
+		q := sig*d2[i-1] + 2.0
+		d2[i] = (sig - 1.0) / q
+		u[i] = (ys[i+1]-ys[i])/(xs[i+1]-xs[i]) - (ys[i]-ys[i-1])/(xs[i]-xs[i-1])
+		u[i] = (6.0*u[i]/(xs[i+1]-xs[i-1]) - sig*u[i-1]) / q
+	}
+	for i := n - 2; i >= 0; i-- {
+		d2[i] = d2[i]*d2[i+1] + u[i]
+	}
+
+	// Sample the spline.
+	l := &lut1D{In: make([]float64, curveSamples), Out: make([]float64, curveSamples)}
+	k := 0
+	for s := range l.In {
+		x := xs[0] + (xs[n-1]-xs[0])*float64(s)/float64(curveSamples-1)
+		for k < n-2 && x > xs[k+1] {
+			k++
+		}
+		h := xs[k+1] - xs[k]
+		a := (xs[k+1] - x) / h
+		b := (x - xs[k]) / h
+		y := a*ys[k] + b*ys[k+1] + ((a*a*a-a)*d2[k]+(b*b*b-b)*d2[k+1])*h*h/6.0
+		l.In[s] = x
+		l.Out[s] = clamp01(y)
+	}
+	return l, nil
+}
+
+// isACVFile reports whether a filename designates a Photoshop curves file.
+func isACVFile(fn string) bool {
+	return strings.ToLower(filepath.Ext(fn)) == ".acv"
+}
+
+// decodeACV reads a Photoshop curves (.acv) file and returns its first curve,
+// which applies to all color channels, as a 1D LUT.
+func decodeACV(r io.Reader) (*lut1D, error) {
+	var hdr [2]uint16 // Version and number of curves
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("malformed curves file (%s)", err)
+	}
+	if hdr[0] != 1 && hdr[0] != 4 {
+		return nil, fmt.Errorf("unsupported curves-file version %d", hdr[0])
+	}
+	if hdr[1] == 0 {
+		return nil, fmt.Errorf("curves file contains no curves")
+	}
+	var nPts uint16
+	if err := binary.Read(r, binary.BigEndian, &nPts); err != nil {
+		return nil, fmt.Errorf("malformed curves file (%s)", err)
+	}
+	raw := make([][2]uint16, nPts) // Each point is an (output, input) pair.
+	if err := binary.Read(r, binary.BigEndian, raw); err != nil {
+		return nil, fmt.Errorf("malformed curves file (%s)", err)
+	}
+	pts := make([][2]float64, nPts)
+	for i, pt := range raw {
+		pts[i] = [2]float64{float64(pt[1]) / 255.0, float64(pt[0]) / 255.0}
+	}
+	return curveLUT(pts)
+}
+
+// isGIMPCurves reports whether a buffered file is a GIMP curves file, without
+// consuming any of its contents.
+func isGIMPCurves(br *bufio.Reader) bool {
+	hdr, _ := br.Peek(32)
+	s := strings.ToLower(string(hdr))
+	return strings.HasPrefix(s, "# gimp curves") || strings.HasPrefix(s, "# gimp-curves")
+}
+
+// decodeGIMPCurves reads a GIMP curves file and returns its first curve,
+// which applies to the value (i.e., all color) channels, as a 1D LUT.  Both
+// the original format, which lists 17 control points per channel, and the
+// GimpCurvesConfig format introduced in GIMP 2.8 are supported.
+func decodeGIMPCurves(br *bufio.Reader) (*lut1D, error) {
+	text, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(text), "\n")
+	if strings.HasPrefix(strings.ToLower(lines[0]), "# gimp curves file") {
+		return decodeOldGIMPCurves(lines[1:])
+	}
+	return decodeGIMPCurvesConfig(string(text))
+}
+
+// decodeOldGIMPCurves is a helper function for decodeGIMPCurves that parses
+// the control points of the first curve in an original-format GIMP curves
+// file.  Points are given as x-y pairs in [0, 255], with -1 for unused points.
+func decodeOldGIMPCurves(lines []string) (*lut1D, error) {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("malformed curve %q", line)
+		}
+		var pts [][2]float64
+		for i := 0; i < len(fields); i += 2 {
+			x, err1 := strconv.Atoi(fields[i])
+			y, err2 := strconv.Atoi(fields[i+1])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("malformed curve %q", line)
+			}
+			if x < 0 || y < 0 {
+				continue
+			}
+			pts = append(pts, [2]float64{float64(x) / 255.0, float64(y) / 255.0})
+		}
+		return curveLUT(pts)
+	}
+	return nil, fmt.Errorf("curves file contains no curves")
+}
+
+// decodeGIMPCurvesConfig is a helper function for decodeGIMPCurves that
+// parses the first curve in a GimpCurvesConfig file.  The curve's samples are
+// used if present; otherwise, its control points are interpolated.
+func decodeGIMPCurvesConfig(text string) (*lut1D, error) {
+	// Extract the numbers following the first occurrence of a keyword.
+	numbers := func(key string) ([]float64, bool) {
+		i := strings.Index(text, "("+key+" ")
+		if i < 0 {
+			return nil, false
+		}
+		rest := text[i+len(key)+2:]
+		if j := strings.Index(rest, ")"); j >= 0 {
+			rest = rest[:j]
+		}
+		vs, err := parseLUTFloats(strings.Fields(rest))
+		if err != nil || len(vs) == 0 {
+			return nil, false
+		}
+		return vs[1:], true // The first number is a count.
+	}
+
+	// Use the curve's samples if available.
+	if samples, ok := numbers("samples"); ok && len(samples) >= 2 {
+		l := &lut1D{In: make([]float64, len(samples)), Out: samples}
+		for i := range l.In {
+			l.In[i] = float64(i) / float64(len(samples)-1)
+		}
+		return l, nil
+	}
+
+	// Otherwise, interpolate the curve's control points.
+	vs, ok := numbers("points")
+	if !ok || len(vs)%2 != 0 {
+		return nil, fmt.Errorf("curves file contains no curves")
+	}
+	var pts [][2]float64
+	for i := 0; i < len(vs); i += 2 {
+		if vs[i] >= 0.0 && vs[i+1] >= 0.0 {
+			pts = append(pts, [2]float64{vs[i], vs[i+1]})
+		}
+	}
+	return curveLUT(pts)
+}
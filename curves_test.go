@@ -0,0 +1,157 @@
+// This file tests the readers for Photoshop and GIMP curves files.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+// checkLUT fails the test if a LUT does not map each of a set of inputs to
+// the corresponding output within tol.
+func checkLUT(t *testing.T, l *lut1D, want map[float64]float64, tol float64) {
+	t.Helper()
+	for in, out := range want {
+		if got := l.Map(in); math.Abs(got-out) > tol {
+			t.Errorf("mapping %g: expected %g but saw %g", in, out, got)
+		}
+	}
+}
+
+// acvTestFile returns a Photoshop curves file with a given version whose
+// curves each pass through a given set of (input, output) points.
+func acvTestFile(version uint16, nCurves int, pts ...[2]uint16) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, [2]uint16{version, uint16(nCurves)})
+	for i := 0; i < nCurves; i++ {
+		binary.Write(&buf, binary.BigEndian, uint16(len(pts)))
+		for _, pt := range pts {
+			binary.Write(&buf, binary.BigEndian, [2]uint16{pt[1], pt[0]})
+		}
+	}
+	return buf.Bytes()
+}
+
+// TestACV verifies that decodeACV reads the first curve of a Photoshop
+// curves file and interpolates it smoothly.
+func TestACV(t *testing.T) {
+	t.Run("identity", func(t *testing.T) {
+		l, err := decodeACV(bytes.NewReader(acvTestFile(4, 5, [2]uint16{0, 0}, [2]uint16{255, 255})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLUT(t, l, map[float64]float64{0.0: 0.0, 0.25: 0.25, 0.5: 0.5, 1.0: 1.0}, 1e-9)
+	})
+	t.Run("inverted", func(t *testing.T) {
+		l, err := decodeACV(bytes.NewReader(acvTestFile(1, 1, [2]uint16{255, 0}, [2]uint16{0, 255})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLUT(t, l, map[float64]float64{0.0: 1.0, 0.5: 0.5, 1.0: 0.0}, 1e-9)
+	})
+	t.Run("S curve", func(t *testing.T) {
+		// The curve passes through its control points and is
+		// constant beyond its end points.
+		data := acvTestFile(4, 1, [2]uint16{51, 0}, [2]uint16{102, 51}, [2]uint16{153, 204}, [2]uint16{204, 255})
+		l, err := decodeACV(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLUT(t, l, map[float64]float64{0.0: 0.0, 0.2: 0.0, 0.4: 0.2, 0.6: 0.8, 0.8: 1.0, 1.0: 1.0}, 1e-3)
+		if v := l.Map(0.5); v <= 0.4 || v >= 0.6 {
+			t.Errorf("mapping 0.5: expected a value near 0.5 but saw %g", v)
+		}
+	})
+}
+
+// TestACVMalformed verifies that decodeACV rejects corrupt files.
+func TestACVMalformed(t *testing.T) {
+	data := acvTestFile(4, 1, [2]uint16{0, 0}, [2]uint16{128, 64}, [2]uint16{255, 255})
+	for n := 0; n < len(data); n++ {
+		if _, err := decodeACV(bytes.NewReader(data[:n])); err == nil {
+			t.Fatalf("decoding the first %d of %d bytes unexpectedly succeeded", n, len(data))
+		}
+	}
+	for name, data := range map[string][]byte{
+		"bad version":  acvTestFile(2, 1, [2]uint16{0, 0}, [2]uint16{255, 255}),
+		"no curves":    acvTestFile(4, 0),
+		"one point":    acvTestFile(4, 1, [2]uint16{0, 0}),
+		"same inputs":  acvTestFile(4, 1, [2]uint16{9, 0}, [2]uint16{9, 255}),
+		"many points":  {0, 4, 0, 1, 0xff, 0xff},
+		"empty file":   {},
+		"short header": {0, 4, 0},
+	} {
+		if _, err := decodeACV(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// decodeGIMPText decodes a GIMP curves file from a string.
+func decodeGIMPText(s string) (*lut1D, error) {
+	return decodeGIMPCurves(bufio.NewReader(strings.NewReader(s)))
+}
+
+// TestGIMPCurves verifies that decodeGIMPCurves reads the first curve of both
+// original-format and GimpCurvesConfig files.
+func TestGIMPCurves(t *testing.T) {
+	t.Run("original", func(t *testing.T) {
+		text := "# GIMP Curves File\n" +
+			"0 0 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 -1 255 0\n" +
+			"0 0 255 255\n"
+		if !isGIMPCurves(bufio.NewReader(strings.NewReader(text))) {
+			t.Fatal("failed to recognize a GIMP curves file")
+		}
+		l, err := decodeGIMPText(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLUT(t, l, map[float64]float64{0.0: 0.0, 1.0: 0.0}, 1e-9)
+	})
+	t.Run("points", func(t *testing.T) {
+		text := "# GIMP curves tool settings\n\n" +
+			"(time 0)\n(channel value)\n(curve\n    (curve-type smooth)\n" +
+			"    (n-points 3)\n    (points 6 0 1 0.5 0.5 1 0)\n    (point-types 3 0 0 0)\n" +
+			"    (n-samples 0)\n    (samples 0))\n(channel red)\n(curve\n    (points 4 0 0 1 1))\n"
+		l, err := decodeGIMPText(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLUT(t, l, map[float64]float64{0.0: 1.0, 0.5: 0.5, 1.0: 0.0}, 1e-9)
+	})
+	t.Run("samples", func(t *testing.T) {
+		text := "# GIMP curves tool settings\n(channel value)\n(curve\n" +
+			"    (points 4 0 0 1 1)\n    (n-samples 5)\n    (samples 5 0 0.5 0.6 0.7 1))\n"
+		l, err := decodeGIMPText(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLUT(t, l, map[float64]float64{0.0: 0.0, 0.125: 0.25, 0.25: 0.5, 0.75: 0.7, 1.0: 1.0}, 1e-9)
+	})
+}
+
+// TestGIMPCurvesMalformed verifies that decodeGIMPCurves rejects corrupt
+// files.
+func TestGIMPCurvesMalformed(t *testing.T) {
+	for name, text := range map[string]string{
+		"empty original":    "# GIMP Curves File\n",
+		"odd original":      "# GIMP Curves File\n0 0 255\n",
+		"bad number":        "# GIMP Curves File\n0 0 x 255\n",
+		"unused points":     "# GIMP Curves File\n-1 -1 -1 -1\n",
+		"no curve":          "# GIMP curves tool settings\n(channel value)\n",
+		"odd points":        "# GIMP curves tool settings\n(points 3 0 0 1)\n",
+		"bad points":        "# GIMP curves tool settings\n(points 4 0 0 one 1)\n",
+		"one point":         "# GIMP curves tool settings\n(points 2 0.5 0.5)\n",
+		"negative points":   "# GIMP curves tool settings\n(points 4 -1 0 NaN 1)\n",
+		"unterminated list": "# GIMP curves tool settings\n(points 4 0 0 1",
+		"empty points":      "# GIMP curves tool settings\n(points )\n",
+	} {
+		if _, err := decodeGIMPText(text); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
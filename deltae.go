@@ -0,0 +1,168 @@
+// This file provides functions for computing per-pixel color differences
+// (Delta E) between two images.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// deltaEMetrics maps each supported Delta E formula to a function that
+// computes it.  The functions return Delta E/100, following go-colorful's
+// convention.
+var deltaEMetrics = map[string]func(c1, c2 colorful.Color) float64{
+	"76":   func(c1, c2 colorful.Color) float64 { return c1.DistanceCIE76(c2) },
+	"94":   func(c1, c2 colorful.Color) float64 { return c1.DistanceCIE94(c2) },
+	"2000": func(c1, c2 colorful.Color) float64 { return c1.DistanceCIEDE2000(c2) },
+}
+
+// relabelWhite prepares a color for go-colorful's Delta E functions, which
+// compute Delta E from D65 L*a*b* values.  To honor a white reference point,
+// it re-expresses the color's L*a*b* values relative to wref as a color with
+// the same L*a*b* values relative to D65.
+func relabelWhite(c colorful.Color, wref [3]float64) colorful.Color {
+	l, a, b := c.LabWhiteRef(wref)
+	return colorful.Lab(l, a, b)
+}
+
+// DeltaE computes the per-pixel Delta E between two images of the same
+// bounds using the named formula ("76", "94", or "2000") and a given white
+// reference point.  The result holds unscaled Delta E values (e.g., 2.3 for a
+// just-noticeable difference), indexed by row and then column.  DeltaE
+// returns the context's error if ctx is canceled.
+func DeltaE(ctx context.Context, a, b image.Image, metric string, wref [3]float64) ([][]float64, error) {
+	dist, ok := deltaEMetrics[metric]
+	if !ok {
+		return nil, fmt.Errorf("unknown Delta E formula %q", metric)
+	}
+
+	// Compute Delta E for each pixel.
+	bnds := a.Bounds()
+	colorAtA := colorAtFunc(a)
+	colorAtB := colorAtFunc(b)
+	de := make([][]float64, bnds.Dy())
+	err := forEachRow(ctx, bnds, func(y int) {
+		row := make([]float64, bnds.Dx())
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			c1 := relabelWhite(colorAtA(x, y), wref)
+			c2 := relabelWhite(colorAtB(x, y), wref)
+			row[x-bnds.Min.X] = dist(c1, c2) * 100.0
+		}
+		de[y-bnds.Min.Y] = row
+	})
+	if err != nil {
+		return nil, err
+	}
+	return de, nil
+}
+
+// heatColor maps a value in [0.0, 1.0] to a black-red-yellow-white heat-map
+// color.
+func heatColor(v float64) [4]float64 {
+	v = math.Max(0.0, math.Min(1.0, v)) * 3.0
+	return [4]float64{
+		math.Min(v, 1.0),
+		math.Max(0.0, math.Min(v-1.0, 1.0)),
+		math.Max(0.0, math.Min(v-2.0, 1.0)),
+		1.0,
+	}
+}
+
+// deltaEImage renders per-pixel Delta E values as an image, mapping
+// p.DeltaEMax to full intensity.  The result is a grayscale image or, if
+// p.HeatMap is true, a heat map.
+func deltaEImage(p *Parameters, bnds image.Rectangle, de [][]float64) image.Image {
+	if p.HeatMap {
+		img := NewNRGBA32f(bnds)
+		for y, row := range de {
+			for x, v := range row {
+				img.SetFloats(x+bnds.Min.X, y+bnds.Min.Y, heatColor(v/p.DeltaEMax))
+			}
+		}
+		return img
+	}
+	img := NewGray32f(bnds)
+	for y, row := range de {
+		for x, v := range row {
+			img.SetFloat(x+bnds.Min.X, y+bnds.Min.Y, v/p.DeltaEMax)
+		}
+	}
+	return img
+}
+
+// reportDeltaE outputs summary statistics for a set of per-pixel Delta E
+// values.  Pixels marked by a transparency mask, which may be nil, are
+// excluded.
+func reportDeltaE(p *Parameters, bnds image.Rectangle, de [][]float64, mask *image.Gray) {
+	var vals []float64
+	for r, row := range de {
+		if mask == nil {
+			vals = append(vals, row...)
+			continue
+		}
+		for c, v := range row {
+			if !isMasked(mask, bnds.Min.X+c, bnds.Min.Y+r) {
+				vals = append(vals, v)
+			}
+		}
+	}
+	if len(vals) == 0 {
+		return
+	}
+	sort.Float64s(vals)
+	sum := 0.0
+	nVisible := 0
+	for _, v := range vals {
+		sum += v
+		if v > 2.3 {
+			nVisible++
+		}
+	}
+	pct := func(q float64) float64 { return vals[int(q*float64(len(vals)-1)+0.5)] }
+	fmt.Printf("DeltaE%s mean:   %.4f\n", p.DeltaE, sum/float64(len(vals)))
+	fmt.Printf("DeltaE%s median: %.4f\n", p.DeltaE, pct(0.5))
+	fmt.Printf("DeltaE%s 95th:   %.4f\n", p.DeltaE, pct(0.95))
+	fmt.Printf("DeltaE%s max:    %.4f\n", p.DeltaE, vals[len(vals)-1])
+	fmt.Printf("Pixels with DeltaE%s > 2.3: %d of %d (%.2f%%)\n",
+		p.DeltaE, nVisible, len(vals), 100.0*float64(nVisible)/float64(len(vals)))
+}
+
+// deltaEImages computes the per-pixel Delta E between two images as directed
+// by a set of parameters, reports summary statistics, and writes a Delta E
+// map if an output file was specified.  It returns the context's error if ctx
+// is canceled and aborts on any other error.
+func deltaEImages(ctx context.Context, p *Parameters) error {
+	ctx = withWorkers(ctx, p.Workers)
+	if len(p.InputNames) != 2 {
+		notify.Fatalf("Expected 2 input files but saw %d", len(p.InputNames))
+	}
+	imgA := readColorImage(p, p.InputNames[0])
+	imgB := readColorImage(p, p.InputNames[1])
+	if imgA.Bounds() != imgB.Bounds() {
+		notify.Fatal("All input images must have the same dimensions")
+	}
+	de, err := DeltaE(ctx, imgA, imgB, p.DeltaE, p.WhitePoint)
+	if err != nil {
+		return err
+	}
+	var mask *image.Gray
+	if p.VisibleOnly {
+		mask = bothTransparentMask(imgA, imgB)
+	}
+	reportDeltaE(p, imgA.Bounds(), de, mask)
+	if p.OutputName == "" {
+		return nil
+	}
+	p.GeoTags = ReadGeoTags(p.InputNames[0])
+	err = WriteImage(p, p.OutputName, deltaEImage(p, imgA.Bounds(), de))
+	if err != nil {
+		notify.Fatal(err)
+	}
+	return nil
+}
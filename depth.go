@@ -0,0 +1,207 @@
+// This file provides conversions that give output images a requested pixel
+// depth.
+
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+)
+
+// outputDepths lists the acceptable arguments to --depth.
+var outputDepths = map[string]bool{
+	"8":   true,
+	"16":  true,
+	"32f": true,
+}
+
+// toUint8 clamps a floating-point value to [0.0, 1.0] and scales it to
+// [0, 255].
+func toUint8(v float64) uint8 {
+	switch {
+	case v <= 0.0 || math.IsNaN(v):
+		return 0
+	case v >= 1.0:
+		return 255
+	default:
+		return uint8(v*255.0 + 0.5)
+	}
+}
+
+// scale16To8 scales a 16-bit sample to 8 bits, rounding to the nearest value.
+func scale16To8(v uint16) uint8 {
+	return uint8((uint32(v)*255 + 32767) / 65535)
+}
+
+// unpremultiply16 divides an alpha-premultiplied 16-bit color sample by a
+// nonzero 16-bit alpha value, rounding to the nearest value.
+func unpremultiply16(v, a uint32) uint16 {
+	return uint16((v*0xffff + a/2) / a)
+}
+
+// toNRGBA64 converts a color to 16-bit non-premultiplied RGBA as does
+// color.NRGBA64Model but rounds, rather than truncates, the quotients of
+// color samples divided by alpha.
+func toNRGBA64(c color.Color) color.NRGBA64 {
+	if n, ok := c.(color.NRGBA64); ok {
+		return n
+	}
+	r, g, b, a := c.RGBA()
+	switch a {
+	case 0:
+		return color.NRGBA64{}
+	case 0xffff:
+		return color.NRGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: 0xffff}
+	}
+	return color.NRGBA64{
+		R: unpremultiply16(r, a),
+		G: unpremultiply16(g, a),
+		B: unpremultiply16(b, a),
+		A: uint16(a),
+	}
+}
+
+// isGrayImage reports whether an image holds a single channel of data.
+func isGrayImage(img image.Image) bool {
+	m := img.ColorModel()
+	return m == color.GrayModel || m == color.Gray16Model
+}
+
+// toDepth8 converts an image to 8-bit grayscale or 8-bit non-premultiplied
+// RGBA.
+func toDepth8(img image.Image) image.Image {
+	bnds := img.Bounds()
+	switch m := img.(type) {
+	case *image.Gray, *image.NRGBA:
+		return img
+	case *Gray32f:
+		gray := image.NewGray(bnds)
+		for y := 0; y < bnds.Dy(); y++ {
+			src := m.Pix[y*m.Stride : y*m.Stride+bnds.Dx()]
+			dst := gray.Pix[y*gray.Stride:]
+			for x, f := range src {
+				dst[x] = toUint8(float64(f))
+			}
+		}
+		return gray
+	case *NRGBA32f:
+		nrgba := image.NewNRGBA(bnds)
+		for y := 0; y < bnds.Dy(); y++ {
+			src := m.Pix[y*m.Stride : y*m.Stride+4*bnds.Dx()]
+			dst := nrgba.Pix[y*nrgba.Stride:]
+			for i, f := range src {
+				dst[i] = toUint8(float64(f))
+			}
+		}
+		return nrgba
+	}
+	if isGrayImage(img) {
+		gray := image.NewGray(bnds)
+		for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+			for x := bnds.Min.X; x < bnds.Max.X; x++ {
+				g := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16)
+				gray.SetGray(x, y, color.Gray{Y: scale16To8(g.Y)})
+			}
+		}
+		return gray
+	}
+	nrgba := image.NewNRGBA(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			c := toNRGBA64(img.At(x, y))
+			nrgba.SetNRGBA(x, y, color.NRGBA{
+				R: scale16To8(c.R),
+				G: scale16To8(c.G),
+				B: scale16To8(c.B),
+				A: scale16To8(c.A),
+			})
+		}
+	}
+	return nrgba
+}
+
+// toDepth16 converts an image to 16-bit grayscale or 16-bit non-premultiplied
+// RGBA.
+func toDepth16(img image.Image) image.Image {
+	switch img.(type) {
+	case *image.Gray16, *image.NRGBA64:
+		return img
+	case *Gray32f, *NRGBA32f:
+		return quantizeImage(img)
+	}
+	bnds := img.Bounds()
+	if isGrayImage(img) {
+		gray := image.NewGray16(bnds)
+		for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+			for x := bnds.Min.X; x < bnds.Max.X; x++ {
+				gray.Set(x, y, img.At(x, y))
+			}
+		}
+		return gray
+	}
+	nrgba := image.NewNRGBA64(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			nrgba.SetNRGBA64(x, y, toNRGBA64(img.At(x, y)))
+		}
+	}
+	return nrgba
+}
+
+// toDepth32f converts an image to a Gray32f or an NRGBA32f.
+func toDepth32f(img image.Image) image.Image {
+	switch img.(type) {
+	case *Gray32f, *NRGBA32f:
+		return img
+	}
+	if isGrayImage(img) {
+		return toGray32f(img)
+	}
+	bnds := img.Bounds()
+	nrgba := NewNRGBA32f(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			nrgba.Set(x, y, img.At(x, y))
+		}
+	}
+	return nrgba
+}
+
+// convertDepth converts an image to the pixel depth specified by p.Depth for
+// writing in a given output format.  With no explicit depth, floating-point
+// images are quantized to 16 bits unless the output format can store
+// floating-point samples, and images are quantized to 8 bits, rounding rather
+// than leaving the encoder to truncate them, if the output format stores at
+// most 8 bits.  Images quantized to 8 bits, either explicitly or because the
+// output format stores at most 8 bits, are dithered as specified by p.Dither.
+// It returns an error if a floating-point depth is requested for a format
+// that cannot store floating-point samples.
+func convertDepth(img image.Image, p *Parameters, of outputFormat) (image.Image, error) {
+	dither := p.Dither != "" && p.Dither != "none"
+	switch p.Depth {
+	case "8":
+		if dither {
+			return ditherDepth8(img, p.Dither), nil
+		}
+		return toDepth8(img), nil
+	case "16":
+		return toDepth16(img), nil
+	case "32f":
+		if !of.Float {
+			return nil, errors.New("--depth=32f requires a format that stores floating-point samples")
+		}
+		return toDepth32f(img), nil
+	default:
+		switch {
+		case of.Float:
+			return img, nil
+		case of.Max8 && dither:
+			return ditherDepth8(img, p.Dither), nil
+		case of.Max8:
+			return toDepth8(img), nil
+		}
+		return quantizeImage(img), nil
+	}
+}
@@ -0,0 +1,115 @@
+// This file provides functions for comparing two color images channel by
+// channel.
+
+package main
+
+import (
+	"context"
+	"image"
+	"strings"
+)
+
+// DiffChannels returns one grayscale image per channel representing the
+// difference between two sets of channels with the same names and bounds.
+// Each difference is halved and offset by 0.5 so that mid-gray indicates no
+// difference, brighter values indicate that a exceeds b, and darker values
+// indicate that b exceeds a.  DiffChannels returns the context's error if ctx
+// is canceled.
+func DiffChannels(ctx context.Context, a, b []ImageInfo) ([]ImageInfo, error) {
+	if len(a) == 0 {
+		return nil, nil
+	}
+	bnds := a[0].Image.Bounds()
+	grays := allocGrays(bnds, len(a))
+	err := forEachRow(ctx, bnds, func(y int) {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			for c := range a {
+				d := a[c].Image.FloatAt(x, y) - b[c].Image.FloatAt(x, y)
+				grays[c].SetFloat(x, y, 0.5+d/2.0)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ImageInfo, len(a))
+	for i := range a {
+		result[i].Name = a[i].Name
+		result[i].Image = grays[i]
+	}
+	return result, nil
+}
+
+// diffFrame is a helper function for diffImages that splits a single image
+// into the channels to compare.
+func diffFrame(ctx context.Context, p *Parameters, img image.Image) ([]ImageInfo, error) {
+	infos, err := performImageSplit(ctx, p, img)
+	if err != nil {
+		return nil, err
+	}
+	if p.Alpha && channelWanted(p, "alpha") {
+		alpha, err := ExtractAlpha(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, alpha)
+	}
+	return infos, nil
+}
+
+// diffImages writes the per-channel difference between two color images as
+// directed by a set of parameters.  It returns the context's error if ctx is
+// canceled and aborts on any other error.
+func diffImages(ctx context.Context, p *Parameters) error {
+	ctx = withWorkers(ctx, p.Workers)
+	if len(p.InputNames) != 2 {
+		notify.Fatalf("Expected 2 input files but saw %d", len(p.InputNames))
+	}
+	if p.OutputName == "" {
+		notify.Fatal("An output-file template must be specified when --diff is used")
+	}
+	bundle := outputFormats[selectOutputFormat(p.OutputName, p.Format)].Bundle != nil
+	if !bundle && !namesChannels(p.OutputName) {
+		notify.Fatalf(`With --diff, the output file must contain "%%s" or "{{.Channel}}"`)
+	}
+
+	// Ensure that every requested channel exists.
+	names, _ := splitKernel(p.ColorSpace, p.WhitePoint)
+	if p.Alpha {
+		names = append(names, "alpha")
+	}
+	for _, nm := range p.Channels {
+		found := false
+		for _, cn := range names {
+			found = found || nm == cn
+		}
+		if !found {
+			notify.Fatalf("--channels requires channels from %s for --space=%q (not %q)",
+				strings.Join(names, ", "), p.OrigColorSpace, nm)
+		}
+	}
+
+	// Read and split both images.
+	imgA := readColorImage(p, p.InputNames[0])
+	imgB := readColorImage(p, p.InputNames[1])
+	if imgA.Bounds() != imgB.Bounds() {
+		notify.Fatal("All input images must have the same dimensions")
+	}
+	p.GeoTags = ReadGeoTags(p.InputNames[0])
+	a, err := diffFrame(ctx, p, imgA)
+	if err != nil {
+		return err
+	}
+	b, err := diffFrame(ctx, p, imgB)
+	if err != nil {
+		return err
+	}
+
+	// Compute and write the differences.
+	diffs, err := DiffChannels(ctx, a, b)
+	if err != nil {
+		return err
+	}
+	writeChannels(p, p.OutputName, diffs)
+	return nil
+}
@@ -0,0 +1,240 @@
+// This file provides support for dithering images when quantizing them to 8
+// bits, which avoids banding in smooth gradients.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// ditherModes lists the valid arguments to --dither.
+var ditherModes = map[string]bool{
+	"none":            true,
+	"floyd-steinberg": true,
+	"blue-noise":      true,
+}
+
+// parseDither validates the argument to --dither and returns it in lowercase.
+// It aborts on error.
+func parseDither(arg string) string {
+	mode := strings.ToLower(arg)
+	if !ditherModes[mode] {
+		notify.Fatalf(`--dither requires one of "none", "floyd-steinberg", or "blue-noise" (not %q)`, arg)
+	}
+	return mode
+}
+
+// A ditherPlane is a single plane of floating-point samples to be dithered.
+type ditherPlane struct {
+	Bounds image.Rectangle
+	Get    func(x, y int) float64  // Return the sample at (x, y)
+	Set    func(x, y int, v uint8) // Store the quantized sample at (x, y)
+}
+
+// ditherFloydSteinberg quantizes a plane to 8 bits, diffusing each pixel's
+// quantization error to its unprocessed neighbors.  Rows are processed in
+// alternating directions to avoid directional artifacts.
+func ditherFloydSteinberg(pl ditherPlane) {
+	bnds := pl.Bounds
+	wd := bnds.Dx()
+	cur := make([]float64, wd+2) // Error carried into the current row
+	next := make([]float64, wd+2)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		ltr := (y-bnds.Min.Y)%2 == 0
+		for i := 0; i < wd; i++ {
+			c, dir := i, 1
+			if !ltr {
+				c, dir = wd-1-i, -1
+			}
+			x := bnds.Min.X + c
+			v := clamp01(pl.Get(x, y)) + cur[c+1]
+			q := toUint8(v)
+			pl.Set(x, y, q)
+			e := v - float64(q)/255.0
+			cur[c+1+dir] += e * 7.0 / 16.0
+			next[c+1-dir] += e * 3.0 / 16.0
+			next[c+1] += e * 5.0 / 16.0
+			next[c+1+dir] += e * 1.0 / 16.0
+		}
+		cur, next = next, cur
+		for i := range next {
+			next[i] = 0.0
+		}
+	}
+}
+
+// blueNoiseSize is the width and height of the blue-noise threshold map.
+const blueNoiseSize = 64
+
+var (
+	blueNoiseOnce sync.Once
+	blueNoiseMap  []float64 // Thresholds in (0.0, 1.0), row-major
+)
+
+// blueNoiseThresholds returns a blue-noise threshold map, generating it on
+// first use with Ulichney's void-and-cluster algorithm.  The map is
+// deterministic.
+func blueNoiseThresholds() []float64 {
+	blueNoiseOnce.Do(func() {
+		const n = blueNoiseSize * blueNoiseSize
+		const sigma = 1.5
+
+		// Precompute a toroidal Gaussian kernel.
+		kernel := make([]float64, n)
+		for dy := 0; dy < blueNoiseSize; dy++ {
+			for dx := 0; dx < blueNoiseSize; dx++ {
+				wx := math.Min(float64(dx), float64(blueNoiseSize-dx))
+				wy := math.Min(float64(dy), float64(blueNoiseSize-dy))
+				kernel[dy*blueNoiseSize+dx] = math.Exp(-(wx*wx + wy*wy) / (2.0 * sigma * sigma))
+			}
+		}
+
+		// Maintain each point's "energy", the sum of the kernel
+		// centered on every set point.
+		pattern := make([]bool, n)
+		energy := make([]float64, n)
+		toggle := func(i int, on bool) {
+			pattern[i] = on
+			sign := 1.0
+			if !on {
+				sign = -1.0
+			}
+			ix, iy := i%blueNoiseSize, i/blueNoiseSize
+			for j := range energy {
+				dx := (j%blueNoiseSize - ix + blueNoiseSize) % blueNoiseSize
+				dy := (j/blueNoiseSize - iy + blueNoiseSize) % blueNoiseSize
+				energy[j] += sign * kernel[dy*blueNoiseSize+dx]
+			}
+		}
+		extreme := func(set, highest bool) int {
+			best := -1
+			for i, on := range pattern {
+				if on != set {
+					continue
+				}
+				if best < 0 || (highest && energy[i] > energy[best]) || (!highest && energy[i] < energy[best]) {
+					best = i
+				}
+			}
+			return best
+		}
+
+		// Seed a random initial pattern and relax it until moving the
+		// tightest cluster into the largest void changes nothing.
+		rng := rand.New(rand.NewSource(1))
+		nOnes := n / 10
+		for _, i := range rng.Perm(n)[:nOnes] {
+			toggle(i, true)
+		}
+		for iter := 0; iter < n; iter++ {
+			cluster := extreme(true, true)
+			toggle(cluster, false)
+			void := extreme(false, false)
+			if void == cluster {
+				toggle(cluster, true)
+				break
+			}
+			toggle(void, true)
+		}
+		proto := make([]bool, n)
+		copy(proto, pattern)
+		protoEnergy := make([]float64, n)
+		copy(protoEnergy, energy)
+
+		// Rank the initial pattern's points by removing tightest
+		// clusters, then rank the remaining points by filling largest
+		// voids.
+		rank := make([]int, n)
+		for r := nOnes - 1; r >= 0; r-- {
+			i := extreme(true, true)
+			toggle(i, false)
+			rank[i] = r
+		}
+		copy(pattern, proto)
+		copy(energy, protoEnergy)
+		for r := nOnes; r < n; r++ {
+			i := extreme(false, false)
+			toggle(i, true)
+			rank[i] = r
+		}
+		blueNoiseMap = make([]float64, n)
+		for i, r := range rank {
+			blueNoiseMap[i] = (float64(r) + 0.5) / n
+		}
+	})
+	return blueNoiseMap
+}
+
+// ditherBlueNoise quantizes a plane to 8 bits, rounding each sample up or
+// down according to a tiled blue-noise threshold map.
+func ditherBlueNoise(pl ditherPlane) {
+	thresh := blueNoiseThresholds()
+	bnds := pl.Bounds
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		ty := (y - bnds.Min.Y) % blueNoiseSize
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			tx := (x - bnds.Min.X) % blueNoiseSize
+			v := clamp01(pl.Get(x, y)) * 255.0
+			lo := math.Floor(v)
+			if v-lo > thresh[ty*blueNoiseSize+tx] {
+				lo++
+			}
+			pl.Set(x, y, uint8(math.Min(lo, 255.0)))
+		}
+	}
+}
+
+// ditherPlaneWith dithers a plane using the named dithering mode.
+func ditherPlaneWith(pl ditherPlane, mode string) {
+	switch mode {
+	case "floyd-steinberg":
+		ditherFloydSteinberg(pl)
+	case "blue-noise":
+		ditherBlueNoise(pl)
+	default:
+		panic("Internal error: unimplemented dithering mode")
+	}
+}
+
+// ditherDepth8 converts an image to 8-bit grayscale or 8-bit
+// non-premultiplied RGBA, as does toDepth8, but dithers its color samples
+// using the named dithering mode.  Alpha is rounded rather than dithered.
+func ditherDepth8(img image.Image, mode string) image.Image {
+	switch img.(type) {
+	case *image.Gray, *image.NRGBA:
+		return img
+	}
+	bnds := img.Bounds()
+	switch m := toDepth32f(img).(type) {
+	case *Gray32f:
+		gray := image.NewGray(bnds)
+		ditherPlaneWith(ditherPlane{
+			Bounds: bnds,
+			Get:    m.FloatAt,
+			Set:    func(x, y int, v uint8) { gray.SetGray(x, y, color.Gray{v}) },
+		}, mode)
+		return gray
+	case *NRGBA32f:
+		nrgba := image.NewNRGBA(bnds)
+		for c := 0; c < 3; c++ {
+			c := c
+			ditherPlaneWith(ditherPlane{
+				Bounds: bnds,
+				Get:    func(x, y int) float64 { return m.FloatsAt(x, y)[c] },
+				Set:    func(x, y int, v uint8) { nrgba.Pix[nrgba.PixOffset(x, y)+c] = v },
+			}, mode)
+		}
+		for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+			for x := bnds.Min.X; x < bnds.Max.X; x++ {
+				nrgba.Pix[nrgba.PixOffset(x, y)+3] = toUint8(m.FloatsAt(x, y)[3])
+			}
+		}
+		return nrgba
+	}
+	return toDepth8(img)
+}
@@ -0,0 +1,315 @@
+// This file provides support for reading and writing Digital Picture Exchange
+// (DPX) images, as used in film scanning and digital intermediate work.  Only
+// the first image element is used.  Input images may have 8, 10, 12, or 16
+// bits per sample; output images always have 16 bits per sample.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+)
+
+// These are the DPX image-element descriptors we support.
+const (
+	dpxLuma = 6  // Luminance only
+	dpxRGB  = 50 // R, G, B
+	dpxRGBA = 51 // R, G, B, A
+)
+
+// dpxHeaderSize is the size of the DPX header we write.
+const dpxHeaderSize = 2048
+
+// init registers the DPX format (in both byte orders) with the image package.
+func init() {
+	image.RegisterFormat("dpx", "SDPX", DecodeDPX, DecodeDPXConfig)
+	image.RegisterFormat("dpx", "XPDS", DecodeDPX, DecodeDPXConfig)
+}
+
+// A dpxHeader represents the parts of a DPX header that we use.
+type dpxHeader struct {
+	Order      binary.ByteOrder // Byte order of the file
+	Width      int              // Pixels per line
+	Height     int              // Lines per image element
+	Descriptor byte             // Image-element descriptor
+	Depth      int              // Bits per sample
+	Packing    int              // Packing method (0, 1, or 2)
+	DataOffset int              // Offset in bytes to the image data
+}
+
+// channels returns the number of samples per pixel.
+func (hdr dpxHeader) channels() int {
+	switch hdr.Descriptor {
+	case dpxRGB:
+		return 3
+	case dpxRGBA:
+		return 4
+	default:
+		return 1
+	}
+}
+
+// parseDPXHeader parses the fixed-size portion of a DPX header.
+func parseDPXHeader(data []byte) (dpxHeader, error) {
+	var hdr dpxHeader
+	if len(data) < 816 {
+		return hdr, errors.New("dpx: truncated header")
+	}
+	switch string(data[:4]) {
+	case "SDPX":
+		hdr.Order = binary.BigEndian
+	case "XPDS":
+		hdr.Order = binary.LittleEndian
+	default:
+		return hdr, errors.New("dpx: invalid format")
+	}
+	hdr.DataOffset = int(hdr.Order.Uint32(data[4:]))
+	if n := hdr.Order.Uint16(data[770:]); n < 1 {
+		return hdr, errors.New("dpx: no image elements")
+	}
+	hdr.Width = int(hdr.Order.Uint32(data[772:]))
+	hdr.Height = int(hdr.Order.Uint32(data[776:]))
+	if hdr.Width <= 0 || hdr.Height <= 0 || hdr.Width > 1<<20 || hdr.Height > 1<<20 {
+		return hdr, errors.New("dpx: invalid image dimensions")
+	}
+	hdr.Descriptor = data[800]
+	switch hdr.Descriptor {
+	case dpxLuma, dpxRGB, dpxRGBA:
+	default:
+		return hdr, fmt.Errorf("dpx: unsupported image descriptor %d", hdr.Descriptor)
+	}
+	hdr.Depth = int(data[803])
+	hdr.Packing = int(hdr.Order.Uint16(data[804:]))
+	if enc := hdr.Order.Uint16(data[806:]); enc != 0 {
+		return hdr, errors.New("dpx: run-length-encoded images are not supported")
+	}
+	switch {
+	case hdr.Depth == 8 || hdr.Depth == 16:
+	case (hdr.Depth == 10 || hdr.Depth == 12) && (hdr.Packing == 1 || hdr.Packing == 2):
+	default:
+		return hdr, fmt.Errorf("dpx: unsupported combination of bit depth (%d) and packing (%d)",
+			hdr.Depth, hdr.Packing)
+	}
+	if ofs := hdr.Order.Uint32(data[808:]); ofs != 0 && ofs != 0xffffffff {
+		hdr.DataOffset = int(ofs)
+	}
+	return hdr, nil
+}
+
+// dpxSamples unpacks all samples of a DPX image, scaling each to 16 bits.
+func dpxSamples(data []byte, hdr dpxHeader) ([]uint16, error) {
+	nc := hdr.channels()
+	perLine := hdr.Width * nc
+
+	// Reject images larger than the file before allocating memory for
+	// them.  Only the last line may omit its padding.
+	var lineSize int
+	switch hdr.Depth {
+	case 8:
+		lineSize = (perLine + 3) &^ 3
+	case 10:
+		lineSize = 4 * ((perLine + 2) / 3)
+	default:
+		lineSize = (2*perLine + 3) &^ 3
+	}
+	if hdr.DataOffset > len(data) || lineSize*(hdr.Height-1) > len(data)-hdr.DataOffset {
+		return nil, errors.New("dpx: truncated image data")
+	}
+	out := make([]uint16, 0, perLine*hdr.Height)
+	maxVal := uint32(1)<<uint(hdr.Depth) - 1
+	scale := func(v uint32) uint16 {
+		return uint16((v*65535 + maxVal/2) / maxVal)
+	}
+	pos := hdr.DataOffset
+	need := func(n int) error {
+		if pos < 0 || pos+n > len(data) {
+			return errors.New("dpx: truncated image data")
+		}
+		return nil
+	}
+	for y := 0; y < hdr.Height; y++ {
+		switch hdr.Depth {
+		case 8:
+			if err := need(perLine); err != nil {
+				return nil, err
+			}
+			for i := 0; i < perLine; i++ {
+				out = append(out, scale(uint32(data[pos+i])))
+			}
+		case 10:
+			// Three samples per 32-bit word, padded at the low end
+			// (method A) or the high end (method B).
+			if err := need(lineSize); err != nil {
+				return nil, err
+			}
+			shift := uint(2)
+			if hdr.Packing == 2 {
+				shift = 0
+			}
+			for i := 0; i < perLine; i++ {
+				word := hdr.Order.Uint32(data[pos+4*(i/3):])
+				v := (word >> (shift + 10*uint(2-i%3))) & 0x3ff
+				out = append(out, scale(v))
+			}
+		case 12, 16:
+			if err := need(2 * perLine); err != nil {
+				return nil, err
+			}
+			for i := 0; i < perLine; i++ {
+				v := uint32(hdr.Order.Uint16(data[pos+2*i:]))
+				if hdr.Depth == 12 {
+					if hdr.Packing == 1 {
+						v >>= 4
+					} else {
+						v &= 0xfff
+					}
+				}
+				out = append(out, scale(v))
+			}
+		}
+		pos += lineSize
+	}
+	return out, nil
+}
+
+// DecodeDPX decodes a DPX image.  Luminance images are returned as an
+// *image.Gray16, and RGB and RGBA images are returned as an *image.NRGBA64.
+func DecodeDPX(r io.Reader) (image.Image, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := parseDPXHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := dpxSamples(data, hdr)
+	if err != nil {
+		return nil, err
+	}
+	bnds := image.Rect(0, 0, hdr.Width, hdr.Height)
+	nc := hdr.channels()
+	if nc == 1 {
+		img := image.NewGray16(bnds)
+		for i, v := range samples {
+			img.SetGray16(i%hdr.Width, i/hdr.Width, color.Gray16{Y: v})
+		}
+		return img, nil
+	}
+	img := image.NewNRGBA64(bnds)
+	for i := 0; i < len(samples); i += nc {
+		clr := color.NRGBA64{R: samples[i], G: samples[i+1], B: samples[i+2], A: 0xffff}
+		if nc == 4 {
+			clr.A = samples[i+3]
+		}
+		px := i / nc
+		img.SetNRGBA64(px%hdr.Width, px/hdr.Width, clr)
+	}
+	return img, nil
+}
+
+// DecodeDPXConfig returns the color model and dimensions of a DPX image
+// without decoding the entire image.
+func DecodeDPXConfig(r io.Reader) (image.Config, error) {
+	var cfg image.Config
+	data := make([]byte, 816)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return cfg, errors.New("dpx: truncated header")
+	}
+	hdr, err := parseDPXHeader(data)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ColorModel = color.NRGBA64Model
+	if hdr.Descriptor == dpxLuma {
+		cfg.ColorModel = color.Gray16Model
+	}
+	cfg.Width = hdr.Width
+	cfg.Height = hdr.Height
+	return cfg, nil
+}
+
+// EncodeDPX writes an image in big-endian, 16-bit DPX format.  Grayscale
+// images are written as luminance, opaque color images as RGB, and all other
+// images as RGBA.
+func EncodeDPX(w io.Writer, img image.Image) error {
+	bnds := img.Bounds()
+	if bnds.Empty() {
+		return errors.New("dpx: cannot encode an empty image")
+	}
+
+	// Determine the image-element descriptor.
+	var desc byte = dpxRGBA
+	switch {
+	case img.ColorModel() == color.GrayModel || img.ColorModel() == color.Gray16Model:
+		desc = dpxLuma
+	default:
+		if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+			desc = dpxRGB
+		}
+	}
+	hdr := dpxHeader{Descriptor: desc}
+	nc := hdr.channels()
+	wd, ht := bnds.Dx(), bnds.Dy()
+	lineSize := (2*wd*nc + 3) &^ 3
+	dataSize := lineSize * ht
+
+	// Construct the header.
+	be := binary.BigEndian
+	h := make([]byte, dpxHeaderSize)
+	copy(h[0:], "SDPX")
+	be.PutUint32(h[4:], dpxHeaderSize)
+	copy(h[8:], "V2.0")
+	be.PutUint32(h[16:], uint32(dpxHeaderSize+dataSize))
+	be.PutUint32(h[20:], 1)            // Ditto key: new image
+	be.PutUint32(h[24:], 1664)         // Generic header size
+	be.PutUint32(h[28:], 384)          // Industry header size
+	be.PutUint32(h[32:], 0)            // User data size
+	copy(h[160:260], "color-channels") // Creator
+	be.PutUint16(h[768:], 0)           // Orientation: left to right, top to bottom
+	be.PutUint16(h[770:], 1)           // Number of image elements
+	be.PutUint32(h[772:], uint32(wd))
+	be.PutUint32(h[776:], uint32(ht))
+	be.PutUint32(h[780:], 0)      // Data sign: unsigned
+	be.PutUint32(h[784:], 0)      // Reference low data code
+	be.PutUint32(h[792:], 0xffff) // Reference high data code
+	h[800] = desc
+	h[801] = 2 // Transfer characteristic: linear
+	h[802] = 2 // Colorimetric specification: linear
+	h[803] = 16
+	be.PutUint16(h[804:], 0) // Packing
+	be.PutUint16(h[806:], 0) // Encoding: none
+	be.PutUint32(h[808:], dpxHeaderSize)
+	be.PutUint32(h[812:], 0) // End-of-line padding
+	be.PutUint32(h[816:], 0) // End-of-image padding
+
+	// Write the header followed by the image data.
+	bw := bufio.NewWriter(w)
+	bw.Write(h)
+	line := make([]byte, lineSize)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			i := 2 * nc * (x - bnds.Min.X)
+			if nc == 1 {
+				g := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16)
+				be.PutUint16(line[i:], g.Y)
+				continue
+			}
+			c := toNRGBA64(img.At(x, y))
+			be.PutUint16(line[i:], c.R)
+			be.PutUint16(line[i+2:], c.G)
+			be.PutUint16(line[i+4:], c.B)
+			if nc == 4 {
+				be.PutUint16(line[i+6:], c.A)
+			}
+		}
+		bw.Write(line)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,143 @@
+// This file tests the DPX reader and writer.
+
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// TestDPXRoundTrip verifies that 16-bit images written by EncodeDPX are read
+// back exactly by DecodeDPX.
+func TestDPXRoundTrip(t *testing.T) {
+	gray := image.NewGray16(image.Rect(0, 0, 7, 5))
+	draw.Draw(gray, gray.Bounds(), testGrayImage(), image.Point{}, draw.Src)
+	for _, tc := range []struct {
+		name  string
+		img   draw.Image
+		alpha bool
+	}{
+		{"gray", gray, false},
+		{"opaque", image.NewNRGBA64(gray.Bounds()), false},
+		{"alpha", image.NewNRGBA64(gray.Bounds()), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.img != gray {
+				draw.Draw(tc.img, tc.img.Bounds(), testColorImage(tc.alpha), image.Point{}, draw.Src)
+			}
+			data := encodeImage(t, EncodeDPX, tc.img)
+			checkImage(t, decodeImage(t, DecodeDPX, data), tc.img, 0.0)
+		})
+	}
+}
+
+// dpxTestFile returns a DPX file with a given byte order, image-element
+// descriptor, bit depth, packing, and dimensions, followed by the given image
+// data.
+func dpxTestFile(order binary.ByteOrder, desc byte, depth, packing, wd, ht int, pix []byte) []byte {
+	const dataOffset = 1024
+	h := make([]byte, dataOffset, dataOffset+len(pix))
+	if order == binary.BigEndian {
+		copy(h, "SDPX")
+	} else {
+		copy(h, "XPDS")
+	}
+	order.PutUint32(h[4:], dataOffset)
+	order.PutUint16(h[770:], 1)
+	order.PutUint32(h[772:], uint32(wd))
+	order.PutUint32(h[776:], uint32(ht))
+	h[800] = desc
+	h[803] = byte(depth)
+	order.PutUint16(h[804:], uint16(packing))
+	order.PutUint32(h[808:], dataOffset)
+	return append(h, pix...)
+}
+
+// TestDPXGolden verifies that DecodeDPX unpacks 8-, 10-, and 12-bit samples
+// in either byte order.
+func TestDPXGolden(t *testing.T) {
+	// 8-bit luminance with each line padded to a 32-bit boundary
+	t.Run("8-bit", func(t *testing.T) {
+		data := dpxTestFile(binary.BigEndian, dpxLuma, 8, 0, 3, 2,
+			[]byte{0, 128, 255, 0xee, 51, 102, 204})
+		want := image.NewGray16(image.Rect(0, 0, 3, 2))
+		for i, v := range []uint16{0, 0x8080, 0xffff, 0x3333, 0x6666, 0xcccc} {
+			want.SetGray16(i%3, i/3, color.Gray16{Y: v})
+		}
+		checkImage(t, decodeImage(t, DecodeDPX, data), want, 0.0)
+		checkTruncated(t, DecodeDPX, data, len(data))
+	})
+
+	// 10-bit RGB, three samples per word, in both packing methods
+	for _, tc := range []struct {
+		name    string
+		order   binary.ByteOrder
+		packing int
+		shift   uint
+	}{
+		{"10-bit method A", binary.BigEndian, 1, 2},
+		{"10-bit method B", binary.LittleEndian, 2, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pix := make([]byte, 8)
+			tc.order.PutUint32(pix, (1023<<20|512<<10|0)<<tc.shift)
+			tc.order.PutUint32(pix[4:], (1<<20|2<<10|3)<<tc.shift)
+			data := dpxTestFile(tc.order, dpxRGB, 10, tc.packing, 2, 1, pix)
+			want := image.NewNRGBA64(image.Rect(0, 0, 2, 1))
+			want.SetNRGBA64(0, 0, color.NRGBA64{0xffff, 32800, 0, 0xffff})
+			want.SetNRGBA64(1, 0, color.NRGBA64{64, 128, 192, 0xffff})
+			checkImage(t, decodeImage(t, DecodeDPX, data), want, 0.0)
+			checkTruncated(t, DecodeDPX, data, len(data))
+		})
+	}
+
+	// 12-bit RGBA, one sample per 16-bit word, in both packing methods
+	for _, tc := range []struct {
+		name    string
+		packing int
+		shift   uint
+	}{
+		{"12-bit method A", 1, 4},
+		{"12-bit method B", 2, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pix := make([]byte, 8)
+			for i, v := range []uint16{0xfff, 0x800, 0, 0x001} {
+				binary.BigEndian.PutUint16(pix[2*i:], v<<tc.shift)
+			}
+			data := dpxTestFile(binary.BigEndian, dpxRGBA, 12, tc.packing, 1, 1, pix)
+			want := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+			want.SetNRGBA64(0, 0, color.NRGBA64{0xffff, 32776, 0, 16})
+			checkImage(t, decodeImage(t, DecodeDPX, data), want, 0.0)
+			checkTruncated(t, DecodeDPX, data, len(data))
+		})
+	}
+}
+
+// TestDPXMalformed verifies that DecodeDPX rejects corrupt files without
+// panicking.
+func TestDPXMalformed(t *testing.T) {
+	data := encodeImage(t, EncodeDPX, testColorImage(true))
+	be32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+	checkPatched(t, DecodeDPX, data, map[string]patch{
+		"bad magic":       {0, []byte("DPX!")},
+		"no elements":     {770, []byte{0, 0}},
+		"zero width":      {772, be32(0)},
+		"huge width":      {772, be32(0xffffffff)},
+		"huge image":      {772, append(be32(1<<20), be32(1<<20)...)},
+		"bad descriptor":  {800, []byte{100}},
+		"bad depth":       {803, []byte{11}},
+		"packed 16-bit":   {803, []byte{10}},
+		"run-length":      {806, []byte{0, 1}},
+		"bad offset":      {808, be32(0x7fffffff)},
+		"offset past end": {808, be32(uint32(len(data) - 4))},
+	})
+	checkMutated(t, DecodeDPX, data, 816)
+}
@@ -0,0 +1,575 @@
+// This file provides support for reading and writing OpenEXR images.  Only
+// single-part scanline images are supported.  Input images may be
+// uncompressed or use RLE, ZIPS, or ZIP compression.  Output images are always
+// uncompressed and use 32-bit floating-point samples.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// exrMagic is the magic number that begins every OpenEXR file.
+const exrMagic = "\x76\x2f\x31\x01"
+
+// These are the OpenEXR pixel types.
+const (
+	exrUint  = 0
+	exrHalf  = 1
+	exrFloat = 2
+)
+
+// These are the OpenEXR compression methods we support.
+const (
+	exrNoCompression = 0
+	exrRLE           = 1
+	exrZIPS          = 2
+	exrZIP           = 3
+)
+
+// exrMaxRatio is the greatest factor by which a block of OpenEXR pixel data
+// can shrink when compressed, which is zlib's (about 1032:1).
+const exrMaxRatio = 1032
+
+// init registers the OpenEXR format with the image package.
+func init() {
+	image.RegisterFormat("exr", exrMagic, DecodeEXR, DecodeEXRConfig)
+}
+
+// An exrChannel describes one channel of an OpenEXR image.
+type exrChannel struct {
+	Name      string // Channel name
+	Type      int32  // Pixel type (exrUint, exrHalf, or exrFloat)
+	XSampling int32  // Horizontal subsampling factor
+	YSampling int32  // Vertical subsampling factor
+}
+
+// An exrHeader represents the parts of an OpenEXR header that we use.
+type exrHeader struct {
+	Channels    []exrChannel    // All channels in the file, sorted by name
+	Compression byte            // Compression method
+	DataWindow  image.Rectangle // Bounds of the pixel data
+}
+
+// An exrReader reads little-endian values from a byte slice.  It remembers
+// the first error encountered so that callers can check for errors once
+// after a sequence of reads.
+type exrReader struct {
+	data []byte // Entire file contents
+	pos  int    // Current offset into data
+	err  error  // First error encountered
+}
+
+// bytes returns the next n bytes.
+func (r *exrReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = errors.New("exr: unexpected end of file")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+// uint32 returns the next 32-bit unsigned integer.
+func (r *exrReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// int32 returns the next 32-bit signed integer.
+func (r *exrReader) int32() int32 {
+	return int32(r.uint32())
+}
+
+// uint64 returns the next 64-bit unsigned integer.
+func (r *exrReader) uint64() uint64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// cstring returns the next NUL-terminated string.
+func (r *exrReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	n := bytes.IndexByte(r.data[r.pos:], 0)
+	if n < 0 {
+		r.err = errors.New("exr: unterminated string")
+		return ""
+	}
+	s := string(r.data[r.pos : r.pos+n])
+	r.pos += n + 1
+	return s
+}
+
+// readHeader parses an OpenEXR header.
+func (r *exrReader) readHeader() (exrHeader, error) {
+	var hdr exrHeader
+	if string(r.bytes(4)) != exrMagic {
+		return hdr, errors.New("exr: invalid format")
+	}
+	vers := r.uint32()
+	if vers&0xff != 2 {
+		return hdr, fmt.Errorf("exr: unsupported version %d", vers&0xff)
+	}
+	if vers&0x1a00 != 0 {
+		return hdr, errors.New("exr: only single-part scanline images are supported")
+	}
+	var sawChannels, sawWindow bool
+	for {
+		name := r.cstring()
+		if name == "" {
+			break
+		}
+		r.cstring() // Attribute type
+		size := int(r.int32())
+		val := &exrReader{data: r.bytes(size)}
+		switch name {
+		case "channels":
+			for {
+				var ch exrChannel
+				ch.Name = val.cstring()
+				if ch.Name == "" {
+					break
+				}
+				ch.Type = val.int32()
+				val.bytes(4) // pLinear plus three reserved bytes
+				ch.XSampling = val.int32()
+				ch.YSampling = val.int32()
+				hdr.Channels = append(hdr.Channels, ch)
+			}
+			sawChannels = true
+		case "compression":
+			if b := val.bytes(1); b != nil {
+				hdr.Compression = b[0]
+			}
+		case "dataWindow":
+			x0, y0 := val.int32(), val.int32()
+			x1, y1 := val.int32(), val.int32()
+			hdr.DataWindow = image.Rect(int(x0), int(y0), int(x1)+1, int(y1)+1)
+			sawWindow = true
+		}
+		if val.err != nil {
+			return hdr, fmt.Errorf("exr: malformed %q attribute", name)
+		}
+	}
+	if r.err != nil {
+		return hdr, r.err
+	}
+	if !sawChannels || !sawWindow {
+		return hdr, errors.New("exr: missing required header attribute")
+	}
+	if hdr.DataWindow.Empty() {
+		return hdr, errors.New("exr: empty data window")
+	}
+	for _, ch := range hdr.Channels {
+		if ch.XSampling != 1 || ch.YSampling != 1 {
+			return hdr, fmt.Errorf("exr: subsampled channel %q is not supported", ch.Name)
+		}
+		if ch.Type < exrUint || ch.Type > exrFloat {
+			return hdr, fmt.Errorf("exr: channel %q has an invalid pixel type", ch.Name)
+		}
+	}
+	switch hdr.Compression {
+	case exrNoCompression, exrRLE, exrZIPS, exrZIP:
+	default:
+		return hdr, fmt.Errorf("exr: unsupported compression method %d", hdr.Compression)
+	}
+	return hdr, nil
+}
+
+// exrIsColor reports whether an OpenEXR image contains R, G, and B channels.
+// If not, it returns the name of the channel to treat as grayscale.
+func exrIsColor(hdr exrHeader) (bool, string, error) {
+	have := make(map[string]bool, len(hdr.Channels))
+	for _, ch := range hdr.Channels {
+		have[ch.Name] = true
+	}
+	switch {
+	case have["R"] && have["G"] && have["B"]:
+		return true, "", nil
+	case have["Y"]:
+		return false, "Y", nil
+	case len(hdr.Channels) == 1:
+		return false, hdr.Channels[0].Name, nil
+	default:
+		return false, "", errors.New("exr: image contains neither R, G, and B channels nor a single grayscale channel")
+	}
+}
+
+// halfToFloat32 converts an IEEE 754 half-precision number to a float32.
+func halfToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+	switch exp {
+	case 0:
+		// Zero or subnormal
+		f := float32(mant) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		// Infinity or NaN
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	default:
+		return math.Float32frombits(sign | (exp-15+127)<<23 | mant<<13)
+	}
+}
+
+// exrUncompress decompresses a block of OpenEXR pixel data, returning the
+// uncompressed data.
+func exrUncompress(method byte, data []byte, size int) ([]byte, error) {
+	if method == exrNoCompression || len(data) == size {
+		// Data that would not shrink when compressed is stored as is.
+		return data, nil
+	}
+
+	// Decompress the data.
+	tmp := make([]byte, 0, size)
+	switch method {
+	case exrRLE:
+		for len(data) > 0 {
+			n := int(int8(data[0]))
+			if n < 0 {
+				if 1-n > len(data) {
+					return nil, errors.New("exr: corrupt RLE data")
+				}
+				tmp = append(tmp, data[1:1-n]...)
+				data = data[1-n:]
+			} else {
+				if len(data) < 2 {
+					return nil, errors.New("exr: corrupt RLE data")
+				}
+				for i := 0; i <= n; i++ {
+					tmp = append(tmp, data[1])
+				}
+				data = data[2:]
+			}
+		}
+	case exrZIPS, exrZIP:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		tmp, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(tmp) != size {
+		return nil, errors.New("exr: decompressed data has the wrong size")
+	}
+
+	// Undo the predictor.
+	for i := 1; i < len(tmp); i++ {
+		tmp[i] = tmp[i-1] + tmp[i] - 128
+	}
+
+	// Reinterleave the two halves of the data.
+	out := make([]byte, size)
+	half := (size + 1) / 2
+	for i := range out {
+		if i%2 == 0 {
+			out[i] = tmp[i/2]
+		} else {
+			out[i] = tmp[half+i/2]
+		}
+	}
+	return out, nil
+}
+
+// DecodeEXR decodes an OpenEXR image.  Images with R, G, and B channels are
+// returned as an *NRGBA32f, with linear color values converted to
+// gamma-encoded values.  Images with a Y channel or with only a single channel
+// are returned as a *Gray32f containing that channel's values verbatim.
+func DecodeEXR(rd io.Reader) (image.Image, error) {
+	// Read the header.
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	r := &exrReader{data: data}
+	hdr, err := r.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	isColor, grayName, err := exrIsColor(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Allocate one plane per channel.  Reject data windows larger than
+	// the file could describe, even with maximal compression, before
+	// allocating memory for them.
+	bnds := hdr.DataWindow
+	wd, ht := bnds.Dx(), bnds.Dy()
+	lineSize := 0
+	for _, ch := range hdr.Channels {
+		if ch.Type == exrHalf {
+			lineSize += 2 * wd
+		} else {
+			lineSize += 4 * wd
+		}
+	}
+	linesPerBlock := 1
+	if hdr.Compression == exrZIP {
+		linesPerBlock = 16
+	}
+	nBlocks := (ht + linesPerBlock - 1) / linesPerBlock
+	if nBlocks > (len(data)-r.pos)/8 || lineSize > exrMaxRatio*len(data)/ht {
+		return nil, errors.New("exr: data window is too large for the file")
+	}
+	planes := make([][]float32, len(hdr.Channels))
+	for i := range planes {
+		planes[i] = make([]float32, wd*ht)
+	}
+
+	// Read each block of scanlines into the channel planes.
+	offsets := make([]uint64, nBlocks)
+	for i := range offsets {
+		offsets[i] = r.uint64()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	for _, ofs := range offsets {
+		if ofs > uint64(len(data)) {
+			return nil, errors.New("exr: invalid scanline offset")
+		}
+		blk := &exrReader{data: data, pos: int(ofs)}
+		y0 := int(blk.int32()) - bnds.Min.Y
+		nLines := linesPerBlock
+		if y0+nLines > ht {
+			nLines = ht - y0
+		}
+		if y0 < 0 || nLines <= 0 {
+			return nil, errors.New("exr: invalid scanline coordinate")
+		}
+		packed := blk.bytes(int(blk.int32()))
+		if blk.err != nil {
+			return nil, blk.err
+		}
+		pix, err := exrUncompress(hdr.Compression, packed, nLines*lineSize)
+		if err != nil {
+			return nil, err
+		}
+		pr := &exrReader{data: pix}
+		for y := y0; y < y0+nLines; y++ {
+			for c, ch := range hdr.Channels {
+				row := planes[c][y*wd : (y+1)*wd]
+				for x := range row {
+					switch ch.Type {
+					case exrUint:
+						row[x] = float32(pr.uint32())
+					case exrHalf:
+						b := pr.bytes(2)
+						if b != nil {
+							row[x] = halfToFloat32(binary.LittleEndian.Uint16(b))
+						}
+					case exrFloat:
+						row[x] = math.Float32frombits(pr.uint32())
+					}
+				}
+			}
+		}
+		if pr.err != nil {
+			return nil, pr.err
+		}
+	}
+
+	// Assemble the planes into an image.
+	plane := make(map[string][]float32, len(planes))
+	for i, ch := range hdr.Channels {
+		plane[ch.Name] = planes[i]
+	}
+	if !isColor {
+		img := NewGray32f(bnds)
+		copy(img.Pix, plane[grayName])
+		return img, nil
+	}
+	img := NewNRGBA32f(bnds)
+	alpha, hasAlpha := plane["A"]
+	for i := 0; i < wd*ht; i++ {
+		clr := colorful.LinearRgb(float64(plane["R"][i]), float64(plane["G"][i]), float64(plane["B"][i]))
+		img.Pix[4*i+0] = float32(clr.R)
+		img.Pix[4*i+1] = float32(clr.G)
+		img.Pix[4*i+2] = float32(clr.B)
+		img.Pix[4*i+3] = 1.0
+		if hasAlpha {
+			img.Pix[4*i+3] = alpha[i]
+		}
+	}
+	return img, nil
+}
+
+// DecodeEXRConfig returns the color model and dimensions of an OpenEXR image
+// without decoding the entire image.
+func DecodeEXRConfig(rd io.Reader) (image.Config, error) {
+	var cfg image.Config
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return cfg, err
+	}
+	r := &exrReader{data: data}
+	hdr, err := r.readHeader()
+	if err != nil {
+		return cfg, err
+	}
+	isColor, _, err := exrIsColor(hdr)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ColorModel = color.Gray16Model
+	if isColor {
+		cfg.ColorModel = color.NRGBA64Model
+	}
+	cfg.Width = hdr.DataWindow.Dx()
+	cfg.Height = hdr.DataWindow.Dy()
+	return cfg, nil
+}
+
+// exrAttribute appends an OpenEXR header attribute to a buffer.
+func exrAttribute(buf *bytes.Buffer, name, typ string, val ...interface{}) {
+	var vbuf bytes.Buffer
+	for _, v := range val {
+		if s, ok := v.(string); ok {
+			vbuf.WriteString(s)
+			vbuf.WriteByte(0)
+			continue
+		}
+		binary.Write(&vbuf, binary.LittleEndian, v)
+	}
+	buf.WriteString(name)
+	buf.WriteByte(0)
+	buf.WriteString(typ)
+	buf.WriteByte(0)
+	binary.Write(buf, binary.LittleEndian, int32(vbuf.Len()))
+	buf.Write(vbuf.Bytes())
+}
+
+// EncodeEXR writes an image in OpenEXR format.  Grayscale images are written
+// as a single Y channel containing the image's values verbatim.  Color images
+// are written as linear R, G, and B channels plus an A channel if the image
+// is not opaque.
+func EncodeEXR(w io.Writer, img image.Image) error {
+	bnds := img.Bounds()
+	if bnds.Empty() {
+		return errors.New("exr: cannot encode an empty image")
+	}
+
+	// Determine the channels to write and a function that returns the
+	// values of those channels, in alphabetical order, for a given pixel.
+	var names []string
+	var valuesAt func(x, y int) []float64
+	switch m := img.(type) {
+	case *Gray32f:
+		names = []string{"Y"}
+		valuesAt = func(x, y int) []float64 {
+			return []float64{m.FloatAt(x, y)}
+		}
+	case *image.Gray, *image.Gray16:
+		names = []string{"Y"}
+		valuesAt = func(x, y int) []float64 {
+			g := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16)
+			return []float64{float64(g.Y) / 65535.0}
+		}
+	default:
+		names = []string{"B", "G", "R"}
+		if o, ok := img.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+			names = []string{"A", "B", "G", "R"}
+		}
+		fimg, isFloat := img.(*NRGBA32f)
+		valuesAt = func(x, y int) []float64 {
+			var v [4]float64
+			if isFloat {
+				v = fimg.FloatsAt(x, y)
+			} else {
+				n := toNRGBA64(img.At(x, y))
+				v = [4]float64{
+					float64(n.R) / 65535.0,
+					float64(n.G) / 65535.0,
+					float64(n.B) / 65535.0,
+					float64(n.A) / 65535.0,
+				}
+			}
+			r, g, b := colorful.Color{R: v[0], G: v[1], B: v[2]}.LinearRgb()
+			if len(names) == 4 {
+				return []float64{v[3], b, g, r}
+			}
+			return []float64{b, g, r}
+		}
+	}
+
+	// Construct the header.
+	var hdr bytes.Buffer
+	hdr.WriteString(exrMagic)
+	binary.Write(&hdr, binary.LittleEndian, uint32(2))
+	chlist := make([]interface{}, 0, 6*len(names)+1)
+	for _, nm := range names {
+		chlist = append(chlist, nm, int32(exrFloat), uint32(0), int32(1), int32(1))
+	}
+	chlist = append(chlist, "")
+	exrAttribute(&hdr, "channels", "chlist", chlist...)
+	exrAttribute(&hdr, "compression", "compression", uint8(exrNoCompression))
+	window := []interface{}{
+		int32(bnds.Min.X), int32(bnds.Min.Y),
+		int32(bnds.Max.X - 1), int32(bnds.Max.Y - 1),
+	}
+	exrAttribute(&hdr, "dataWindow", "box2i", window...)
+	exrAttribute(&hdr, "displayWindow", "box2i", window...)
+	exrAttribute(&hdr, "lineOrder", "lineOrder", uint8(0))
+	exrAttribute(&hdr, "pixelAspectRatio", "float", float32(1.0))
+	exrAttribute(&hdr, "screenWindowCenter", "v2f", float32(0.0), float32(0.0))
+	exrAttribute(&hdr, "screenWindowWidth", "float", float32(1.0))
+	hdr.WriteByte(0)
+
+	// Write the header and the scanline offset table.
+	bw := bufio.NewWriter(w)
+	bw.Write(hdr.Bytes())
+	lineSize := 4 * bnds.Dx() * len(names)
+	ofs := uint64(hdr.Len() + 8*bnds.Dy())
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		binary.Write(bw, binary.LittleEndian, ofs)
+		ofs += uint64(8 + lineSize)
+	}
+
+	// Write each scanline.
+	line := make([]byte, lineSize)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		wd := bnds.Dx()
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			for c, v := range valuesAt(x, y) {
+				i := 4 * (c*wd + x - bnds.Min.X)
+				binary.LittleEndian.PutUint32(line[i:], math.Float32bits(float32(v)))
+			}
+		}
+		binary.Write(bw, binary.LittleEndian, int32(y))
+		binary.Write(bw, binary.LittleEndian, int32(lineSize))
+		bw.Write(line)
+	}
+	return bw.Flush()
+}
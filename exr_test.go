@@ -0,0 +1,222 @@
+// This file tests the OpenEXR reader and writer.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"math"
+	"testing"
+)
+
+// TestEXRRoundTrip verifies that images written by EncodeEXR are read back
+// by DecodeEXR with at most floating-point rounding error.
+func TestEXRRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+		tol  float64
+	}{
+		{"gray", testGrayImage(), 0.0},
+		{"opaque", testColorImage(false), 1e-6},
+		{"alpha", testColorImage(true), 1e-6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := encodeImage(t, EncodeEXR, tc.img)
+			checkImage(t, decodeImage(t, DecodeEXR, data), tc.img, tc.tol)
+		})
+	}
+}
+
+// TestEXRHalf verifies the conversion of half-precision numbers.
+func TestEXRHalf(t *testing.T) {
+	for _, tc := range []struct {
+		h    uint16
+		want float32
+	}{
+		{0x0000, 0.0},
+		{0x3c00, 1.0},
+		{0x3800, 0.5},
+		{0xc000, -2.0},
+		{0x7bff, 65504.0},
+		{0x0001, 1.0 / (1 << 24)},
+		{0x0400, 1.0 / (1 << 14)},
+		{0x7c00, float32(math.Inf(1))},
+		{0xfc00, float32(math.Inf(-1))},
+	} {
+		if got := halfToFloat32(tc.h); got != tc.want {
+			t.Errorf("halfToFloat32(%#04x): expected %g but saw %g", tc.h, tc.want, got)
+		}
+	}
+	if got := halfToFloat32(0x7e00); !math.IsNaN(float64(got)) {
+		t.Errorf("halfToFloat32(0x7e00): expected NaN but saw %g", got)
+	}
+}
+
+// exrCompressBlock compresses a block of OpenEXR pixel data as the OpenEXR
+// library does: by splitting the data into even and odd bytes, applying a
+// delta predictor, and compressing the result with RLE or zlib.
+func exrCompressBlock(method byte, data []byte) []byte {
+	tmp := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i += 2 {
+		tmp = append(tmp, data[i])
+	}
+	for i := 1; i < len(data); i += 2 {
+		tmp = append(tmp, data[i])
+	}
+	for i := len(tmp) - 1; i > 0; i-- {
+		tmp[i] = tmp[i] - tmp[i-1] + 128
+	}
+	var out bytes.Buffer
+	switch method {
+	case exrRLE:
+		for i := 0; i < len(tmp); {
+			run := 1
+			for i+run < len(tmp) && tmp[i+run] == tmp[i] && run < 128 {
+				run++
+			}
+			if run >= 3 {
+				out.WriteByte(byte(run - 1))
+				out.WriteByte(tmp[i])
+				i += run
+				continue
+			}
+			lit := 1
+			for i+lit < len(tmp) && lit < 127 && !(i+lit+2 < len(tmp) && tmp[i+lit] == tmp[i+lit+1] && tmp[i+lit] == tmp[i+lit+2]) {
+				lit++
+			}
+			out.WriteByte(byte(-int8(lit)))
+			out.Write(tmp[i : i+lit])
+			i += lit
+		}
+	default:
+		zw := zlib.NewWriter(&out)
+		zw.Write(tmp)
+		zw.Close()
+	}
+	return out.Bytes()
+}
+
+// buildEXR constructs an OpenEXR file with a single, 32-bit floating-point Y
+// channel holding a given grayscale image, compressed with a given method.
+func buildEXR(img *Gray32f, method byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(exrMagic)
+	binary.Write(&buf, binary.LittleEndian, uint32(2))
+	exrAttribute(&buf, "channels", "chlist", "Y", int32(exrFloat), uint32(0), int32(1), int32(1), "")
+	exrAttribute(&buf, "compression", "compression", method)
+	bnds := img.Bounds()
+	exrAttribute(&buf, "dataWindow", "box2i",
+		int32(bnds.Min.X), int32(bnds.Min.Y), int32(bnds.Max.X-1), int32(bnds.Max.Y-1))
+	buf.WriteByte(0)
+
+	// Compress each block of scanlines.
+	linesPerBlock := 1
+	if method == exrZIP {
+		linesPerBlock = 16
+	}
+	var blocks [][]byte
+	for y := bnds.Min.Y; y < bnds.Max.Y; y += linesPerBlock {
+		var raw bytes.Buffer
+		for yy := y; yy < y+linesPerBlock && yy < bnds.Max.Y; yy++ {
+			for x := bnds.Min.X; x < bnds.Max.X; x++ {
+				binary.Write(&raw, binary.LittleEndian, float32(img.FloatAt(x, yy)))
+			}
+		}
+		packed := raw.Bytes()
+		if method != exrNoCompression {
+			if c := exrCompressBlock(method, packed); len(c) < len(packed) {
+				packed = c
+			}
+		}
+		var blk bytes.Buffer
+		binary.Write(&blk, binary.LittleEndian, int32(y))
+		binary.Write(&blk, binary.LittleEndian, int32(len(packed)))
+		blk.Write(packed)
+		blocks = append(blocks, blk.Bytes())
+	}
+
+	// Write the offset table followed by the blocks.
+	ofs := uint64(buf.Len() + 8*len(blocks))
+	for _, blk := range blocks {
+		binary.Write(&buf, binary.LittleEndian, ofs)
+		ofs += uint64(len(blk))
+	}
+	for _, blk := range blocks {
+		buf.Write(blk)
+	}
+	return buf.Bytes()
+}
+
+// TestEXRCompression verifies that DecodeEXR reads each supported
+// compression method.
+func TestEXRCompression(t *testing.T) {
+	// Use an image that is large enough for ZIP's 16-line blocks and
+	// that has runs of identical values for RLE to compress.
+	img := NewGray32f(image.Rect(2, 3, 42, 40))
+	bnds := img.Bounds()
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			img.SetFloat(x, y, float64((x/8+y/4)%5)/4.0)
+		}
+	}
+	for _, tc := range []struct {
+		name   string
+		method byte
+	}{
+		{"none", exrNoCompression},
+		{"RLE", exrRLE},
+		{"ZIPS", exrZIPS},
+		{"ZIP", exrZIP},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := buildEXR(img, tc.method)
+			checkImage(t, decodeImage(t, DecodeEXR, data), img, 0.0)
+			checkTruncated(t, DecodeEXR, data, len(data))
+		})
+	}
+}
+
+// TestEXRTruncated verifies that DecodeEXR rejects truncated files.
+func TestEXRTruncated(t *testing.T) {
+	data := encodeImage(t, EncodeEXR, testColorImage(true))
+	checkTruncated(t, DecodeEXR, data, len(data))
+}
+
+// TestEXRMalformed verifies that DecodeEXR rejects corrupt files without
+// panicking.
+func TestEXRMalformed(t *testing.T) {
+	data := encodeImage(t, EncodeEXR, testGrayImage())
+	win := bytes.Index(data, []byte("dataWindow\x00box2i\x00")) + len("dataWindow\x00box2i\x00") + 4
+	comp := bytes.Index(data, []byte("compression\x00compression\x00")) + len("compression\x00compression\x00") + 4
+	table := bytes.Index(data, []byte("screenWindowWidth\x00float\x00")) + len("screenWindowWidth\x00float\x00") + 4 + 4 + 1
+	first := int(binary.LittleEndian.Uint64(data[table:]))
+	le32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, v)
+		return b
+	}
+	le64 := func(v uint64) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, v)
+		return b
+	}
+	checkPatched(t, DecodeEXR, data, map[string]patch{
+		"bad magic":          {0, []byte("EXR!")},
+		"bad version":        {4, le32(1)},
+		"multipart":          {4, le32(2 | 0x1000)},
+		"bad compression":    {comp, []byte{9}},
+		"huge window":        {win + 8, le32(0x7ffffffe)},
+		"wide window":        {win + 8, le32(1 << 28)},
+		"tall window":        {win + 12, le32(1 << 28)},
+		"bad offset":         {table, le64(1 << 40)},
+		"bad scanline":       {first, le32(1000)},
+		"negative scanline":  {first, le32(0xffffff00)},
+		"bad scanline size":  {first + 4, le32(0x7fffffff)},
+		"short scanline":     {first + 4, le32(4)},
+		"unterminated names": {8, bytes.Repeat([]byte{'x'}, len(data)-8)},
+	})
+	checkMutated(t, DecodeEXR, data, first+16)
+}
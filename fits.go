@@ -0,0 +1,349 @@
+// This file provides support for reading and writing Flexible Image Transport
+// System (FITS) images, as used in astronomy.  Only the primary HDU is used.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// fitsBlockSize is the size of a FITS logical record.
+const fitsBlockSize = 2880
+
+// fitsCardSize is the size of a FITS header card.
+const fitsCardSize = 80
+
+// init registers the FITS format with the image package.
+func init() {
+	image.RegisterFormat("fits", "SIMPLE  =", DecodeFITS, DecodeFITSConfig)
+}
+
+// A fitsHeader represents the parts of a FITS header that we use.
+type fitsHeader struct {
+	Bitpix    int     // Bits per sample; negative for floating point
+	Width     int     // NAXIS1
+	Height    int     // NAXIS2
+	Planes    int     // NAXIS3, or 1 if not specified
+	DataMin   float64 // Minimum data value, if HasMinMax
+	DataMax   float64 // Maximum data value, if HasMinMax
+	HasMinMax bool    // true: DATAMIN and DATAMAX were both specified
+}
+
+// readFITSHeader reads and parses a FITS primary header.
+func readFITSHeader(r io.Reader) (fitsHeader, error) {
+	hdr := fitsHeader{Planes: 1}
+	vals := make(map[string]string)
+	card := make([]byte, fitsCardSize)
+	nCards := 0
+	for {
+		if _, err := io.ReadFull(r, card); err != nil {
+			return hdr, errors.New("fits: truncated header")
+		}
+		nCards++
+		key := strings.TrimSpace(string(card[:8]))
+		if key == "END" {
+			break
+		}
+		if string(card[8:10]) != "= " {
+			continue
+		}
+		v := string(card[10:])
+		if i := strings.Index(v, "/"); i >= 0 && !strings.Contains(v[:i], "'") {
+			v = v[:i]
+		}
+		vals[key] = strings.TrimSpace(v)
+	}
+
+	// Skip the remainder of the header block.
+	if rem := (nCards * fitsCardSize) % fitsBlockSize; rem != 0 {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(fitsBlockSize-rem)); err != nil {
+			return hdr, errors.New("fits: truncated header")
+		}
+	}
+
+	// Parse the keywords we care about.
+	if vals["SIMPLE"] != "T" {
+		return hdr, errors.New("fits: not a standard FITS file")
+	}
+	intVal := func(key string) (int, error) {
+		n, err := strconv.Atoi(vals[key])
+		if err != nil {
+			return 0, fmt.Errorf("fits: missing or invalid %s", key)
+		}
+		return n, nil
+	}
+	var err error
+	if hdr.Bitpix, err = intVal("BITPIX"); err != nil {
+		return hdr, err
+	}
+	switch hdr.Bitpix {
+	case 8, 16, 32, 64, -32, -64:
+	default:
+		return hdr, fmt.Errorf("fits: invalid BITPIX %d", hdr.Bitpix)
+	}
+	naxis, err := intVal("NAXIS")
+	if err != nil {
+		return hdr, err
+	}
+	if naxis != 2 && naxis != 3 {
+		return hdr, fmt.Errorf("fits: NAXIS must be 2 or 3, not %d", naxis)
+	}
+	if hdr.Width, err = intVal("NAXIS1"); err != nil {
+		return hdr, err
+	}
+	if hdr.Height, err = intVal("NAXIS2"); err != nil {
+		return hdr, err
+	}
+	if naxis == 3 {
+		if hdr.Planes, err = intVal("NAXIS3"); err != nil {
+			return hdr, err
+		}
+		if hdr.Planes != 1 && hdr.Planes != 3 && hdr.Planes != 4 {
+			return hdr, fmt.Errorf("fits: NAXIS3 must be 1, 3, or 4, not %d", hdr.Planes)
+		}
+	}
+	if hdr.Width <= 0 || hdr.Height <= 0 || hdr.Width > 1<<20 || hdr.Height > 1<<20 {
+		return hdr, errors.New("fits: invalid image dimensions")
+	}
+	dmin, err1 := strconv.ParseFloat(vals["DATAMIN"], 64)
+	dmax, err2 := strconv.ParseFloat(vals["DATAMAX"], 64)
+	if err1 == nil && err2 == nil && dmax > dmin {
+		hdr.DataMin, hdr.DataMax, hdr.HasMinMax = dmin, dmax, true
+	}
+	return hdr, nil
+}
+
+// fitsNormalize returns a function that maps a raw FITS sample to a value in
+// [0.0, 1.0].  Integer samples are mapped from the full range of their type.
+// Floating-point samples are mapped from [DATAMIN, DATAMAX] if those are
+// specified or are returned as is if not.
+func fitsNormalize(hdr fitsHeader) func(float64) float64 {
+	if hdr.Bitpix < 0 {
+		if !hdr.HasMinMax {
+			return func(v float64) float64 { return v }
+		}
+		return func(v float64) float64 { return (v - hdr.DataMin) / (hdr.DataMax - hdr.DataMin) }
+	}
+	lo, hi := -math.Ldexp(1, hdr.Bitpix-1), math.Ldexp(1, hdr.Bitpix-1)-1
+	if hdr.Bitpix == 8 {
+		lo, hi = 0, 255 // 8-bit data are unsigned.
+	}
+	return func(v float64) float64 { return (v - lo) / (hi - lo) }
+}
+
+// DecodeFITS decodes a FITS image.  Two-dimensional images and
+// three-dimensional images with a single plane are returned as a *Gray32f.
+// Three-dimensional images with three or four planes are returned as an
+// *NRGBA32f, with the fourth plane, if any, treated as alpha.
+func DecodeFITS(rd io.Reader) (image.Image, error) {
+	r := bufio.NewReader(rd)
+	hdr, err := readFITSHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	norm := fitsNormalize(hdr)
+
+	// Read each plane.  FITS stores rows from bottom to top.
+	bnds := image.Rect(0, 0, hdr.Width, hdr.Height)
+	planes := make([]*Gray32f, hdr.Planes)
+	bps := hdr.Bitpix / 8
+	if bps < 0 {
+		bps = -bps
+	}
+	rowSize := bps * hdr.Width
+	for p := range planes {
+		// Read the plane's samples before allocating the plane so
+		// that a corrupt header cannot cause an enormous allocation.
+		data, err := readBytes(r, int64(rowSize)*int64(hdr.Height))
+		if err != nil {
+			return nil, errors.New("fits: truncated image data")
+		}
+		planes[p] = NewGray32f(bnds)
+		for y := hdr.Height - 1; y >= 0; y-- {
+			row := data[:rowSize]
+			data = data[rowSize:]
+			for x := 0; x < hdr.Width; x++ {
+				b := row[x*bps:]
+				var v float64
+				switch hdr.Bitpix {
+				case 8:
+					v = float64(b[0])
+				case 16:
+					v = float64(int16(binary.BigEndian.Uint16(b)))
+				case 32:
+					v = float64(int32(binary.BigEndian.Uint32(b)))
+				case 64:
+					v = float64(int64(binary.BigEndian.Uint64(b)))
+				case -32:
+					v = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+				case -64:
+					v = math.Float64frombits(binary.BigEndian.Uint64(b))
+				}
+				planes[p].SetFloat(x, y, norm(v))
+			}
+		}
+	}
+	if hdr.Planes == 1 {
+		return planes[0], nil
+	}
+
+	// Combine the planes into a color image.
+	img := NewNRGBA32f(bnds)
+	for y := 0; y < hdr.Height; y++ {
+		for x := 0; x < hdr.Width; x++ {
+			v := [4]float64{planes[0].FloatAt(x, y), planes[1].FloatAt(x, y), planes[2].FloatAt(x, y), 1.0}
+			if hdr.Planes == 4 {
+				v[3] = planes[3].FloatAt(x, y)
+			}
+			img.SetFloats(x, y, v)
+		}
+	}
+	return img, nil
+}
+
+// DecodeFITSConfig returns the color model and dimensions of a FITS image
+// without decoding the entire image.
+func DecodeFITSConfig(r io.Reader) (image.Config, error) {
+	var cfg image.Config
+	hdr, err := readFITSHeader(r)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ColorModel = color.Gray16Model
+	if hdr.Planes > 1 {
+		cfg.ColorModel = color.NRGBA64Model
+	}
+	cfg.Width = hdr.Width
+	cfg.Height = hdr.Height
+	return cfg, nil
+}
+
+// fitsCard formats a single FITS header card.
+func fitsCard(key string, val interface{}, comment string) string {
+	var v string
+	switch val := val.(type) {
+	case bool:
+		v = "F"
+		if val {
+			v = "T"
+		}
+	case int:
+		v = strconv.Itoa(val)
+	case string:
+		v = fmt.Sprintf("%-20s", "'"+val+"'") // Strings are left-justified.
+	}
+	c := fmt.Sprintf("%-8s= %20s / %s", key, v, comment)
+	if len(c) > fitsCardSize {
+		c = c[:fitsCardSize]
+	}
+	return fmt.Sprintf("%-80s", c)
+}
+
+// EncodeFITS writes an image in FITS format.  A *Gray32f is written with
+// 32-bit floating-point samples, and other grayscale images are written with
+// unsigned 16-bit samples.  Color images are written as a cube of three (or,
+// if not opaque, four) planes, using 32-bit floating-point samples for an
+// *NRGBA32f and unsigned 16-bit samples otherwise.
+func EncodeFITS(w io.Writer, img image.Image) error {
+	bnds := img.Bounds()
+	if bnds.Empty() {
+		return errors.New("fits: cannot encode an empty image")
+	}
+
+	// Determine the number of planes and a function that returns a
+	// sample from a given plane.
+	planes := 1
+	var sampleAt func(p, x, y int) float64
+	switch m := img.(type) {
+	case *Gray32f:
+		sampleAt = func(p, x, y int) float64 { return m.FloatAt(x, y) }
+	case *NRGBA32f:
+		sampleAt = func(p, x, y int) float64 { return m.FloatsAt(x, y)[p] }
+	default:
+		if img.ColorModel() == color.GrayModel || img.ColorModel() == color.Gray16Model {
+			sampleAt = func(p, x, y int) float64 {
+				return float64(color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y)
+			}
+			break
+		}
+		sampleAt = func(p, x, y int) float64 {
+			c := toNRGBA64(img.At(x, y))
+			return float64([4]uint16{c.R, c.G, c.B, c.A}[p])
+		}
+	}
+	if img.ColorModel() != color.GrayModel && img.ColorModel() != color.Gray16Model {
+		planes = 4
+		if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+			planes = 3
+		}
+	}
+	_, isGray32f := img.(*Gray32f)
+	_, isNRGBA32f := img.(*NRGBA32f)
+	isFloat := isGray32f || isNRGBA32f
+
+	// Write the header.
+	bw := bufio.NewWriter(w)
+	cards := []string{fitsCard("SIMPLE", true, "Conforms to the FITS standard")}
+	if isFloat {
+		cards = append(cards, fitsCard("BITPIX", -32, "32-bit floating-point samples"))
+	} else {
+		cards = append(cards, fitsCard("BITPIX", 16, "16-bit integer samples"))
+	}
+	if planes == 1 {
+		cards = append(cards, fitsCard("NAXIS", 2, "Number of axes"))
+	} else {
+		cards = append(cards, fitsCard("NAXIS", 3, "Number of axes"))
+	}
+	cards = append(cards,
+		fitsCard("NAXIS1", bnds.Dx(), "Image width"),
+		fitsCard("NAXIS2", bnds.Dy(), "Image height"))
+	if planes > 1 {
+		cards = append(cards, fitsCard("NAXIS3", planes, "Number of color planes"))
+	}
+	if !isFloat {
+		cards = append(cards,
+			fitsCard("BZERO", 32768, "Offset for unsigned 16-bit samples"),
+			fitsCard("BSCALE", 1, "Sample scale factor"))
+	}
+	cards = append(cards,
+		fitsCard("CREATOR", "color-channels", "Program that wrote this file"),
+		fmt.Sprintf("%-80s", "END"))
+	hlen := 0
+	for _, c := range cards {
+		bw.WriteString(c)
+		hlen += len(c)
+	}
+	bw.WriteString(strings.Repeat(" ", (fitsBlockSize-hlen%fitsBlockSize)%fitsBlockSize))
+
+	// Write the data, padded to a multiple of the block size.
+	dlen := 0
+	var buf [4]byte
+	for p := 0; p < planes; p++ {
+		for y := bnds.Max.Y - 1; y >= bnds.Min.Y; y-- {
+			for x := bnds.Min.X; x < bnds.Max.X; x++ {
+				v := sampleAt(p, x, y)
+				if isFloat {
+					binary.BigEndian.PutUint32(buf[:], math.Float32bits(float32(v)))
+					bw.Write(buf[:4])
+					dlen += 4
+				} else {
+					binary.BigEndian.PutUint16(buf[:], uint16(int(v)-32768))
+					bw.Write(buf[:2])
+					dlen += 2
+				}
+			}
+		}
+	}
+	bw.Write(make([]byte, (fitsBlockSize-dlen%fitsBlockSize)%fitsBlockSize))
+	return bw.Flush()
+}
@@ -0,0 +1,143 @@
+// This file tests the FITS reader and writer.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+	"testing"
+)
+
+// TestFITSRoundTrip verifies that images written by EncodeFITS are read back
+// by DecodeFITS with at most floating-point rounding error.
+func TestFITSRoundTrip(t *testing.T) {
+	gray16 := image.NewGray16(image.Rect(0, 0, 7, 5))
+	draw.Draw(gray16, gray16.Bounds(), testGrayImage(), image.Point{}, draw.Src)
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+		tol  float64
+	}{
+		{"gray", testGrayImage(), 0.0},
+		{"gray16", gray16, 1e-7},
+		{"opaque", testColorImage(false), 0.0},
+		{"alpha", testColorImage(true), 0.0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := encodeImage(t, EncodeFITS, tc.img)
+			checkImage(t, decodeImage(t, DecodeFITS, data), tc.img, tc.tol)
+		})
+	}
+}
+
+// fitsTestFile returns a FITS file with a given set of header cards followed
+// by the given image data.  The header and data are each padded to a
+// multiple of the block size.
+func fitsTestFile(cards []string, pix []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fitsCard("SIMPLE", true, "Conforms to the FITS standard"))
+	for _, c := range cards {
+		buf.WriteString(fmt.Sprintf("%-80s", c))
+	}
+	buf.WriteString(fmt.Sprintf("%-80s", "END"))
+	buf.WriteString(strings.Repeat(" ", (fitsBlockSize-buf.Len()%fitsBlockSize)%fitsBlockSize))
+	buf.Write(pix)
+	buf.Write(make([]byte, (fitsBlockSize-len(pix)%fitsBlockSize)%fitsBlockSize))
+	return buf.Bytes()
+}
+
+// TestFITSGolden verifies that DecodeFITS reads hand-constructed files with
+// 8-bit and 64-bit floating-point samples, which are stored with rows from
+// bottom to top.
+func TestFITSGolden(t *testing.T) {
+	t.Run("8-bit", func(t *testing.T) {
+		pix := []byte{0, 51, 102, 255} // Bottom row then top row
+		data := fitsTestFile([]string{
+			"BITPIX  =                    8",
+			"NAXIS   =                    2",
+			"NAXIS1  =                    2 / Width",
+			"NAXIS2  =                    2 / Height",
+		}, pix)
+		want := NewGray32f(image.Rect(0, 0, 2, 2))
+		want.SetFloat(0, 1, 0.0)
+		want.SetFloat(1, 1, 0.2)
+		want.SetFloat(0, 0, 0.4)
+		want.SetFloat(1, 0, 1.0)
+		checkImage(t, decodeImage(t, DecodeFITS, data), want, 1e-7)
+		checkTruncated(t, DecodeFITS, data, fitsBlockSize+len(pix))
+	})
+	t.Run("64-bit", func(t *testing.T) {
+		pix := []byte{
+			0x40, 0x24, 0, 0, 0, 0, 0, 0, // 10.0
+			0x40, 0x59, 0, 0, 0, 0, 0, 0, // 100.0
+		}
+		data := fitsTestFile([]string{
+			"BITPIX  =                  -64",
+			"NAXIS   =                    3",
+			"NAXIS1  =                    2",
+			"NAXIS2  =                    1",
+			"NAXIS3  =                    1",
+			"DATAMIN =                 10.0",
+			"DATAMAX =                110.0",
+		}, pix)
+		want := NewGray32f(image.Rect(0, 0, 2, 1))
+		want.SetFloat(0, 0, 0.0)
+		want.SetFloat(1, 0, 0.9)
+		checkImage(t, decodeImage(t, DecodeFITS, data), want, 1e-7)
+		checkTruncated(t, DecodeFITS, data, fitsBlockSize+len(pix))
+	})
+}
+
+// TestFITSTruncated verifies that DecodeFITS rejects truncated files.  The
+// padding that follows the data is not required.
+func TestFITSTruncated(t *testing.T) {
+	img := testColorImage(true)
+	data := encodeImage(t, EncodeFITS, img)
+	checkTruncated(t, DecodeFITS, data, fitsBlockSize+4*len(img.Pix))
+}
+
+// TestFITSMalformed verifies that DecodeFITS rejects corrupt headers without
+// panicking.
+func TestFITSMalformed(t *testing.T) {
+	valid := []string{
+		"BITPIX  =                   16",
+		"NAXIS   =                    2",
+		"NAXIS1  =                    2",
+		"NAXIS2  =                    2",
+	}
+	for name, repl := range map[string][2]string{
+		"bad BITPIX":   {valid[0], "BITPIX  =                   12"},
+		"no BITPIX":    {valid[0], "COMMENT  BITPIX = 16"},
+		"bad NAXIS":    {valid[1], "NAXIS   =                    4"},
+		"bad NAXIS1":   {valid[2], "NAXIS1  =                  two"},
+		"zero width":   {valid[2], "NAXIS1  =                    0"},
+		"huge width":   {valid[2], "NAXIS1  =          99999999999"},
+		"huge height":  {valid[3], "NAXIS2  =              1048576"},
+		"missing axis": {valid[3], "NAXIS3  =                    2"},
+	} {
+		cards := append([]string(nil), valid...)
+		for i, c := range cards {
+			if c == repl[0] {
+				cards[i] = repl[1]
+			}
+		}
+		if _, err := decodeSafely(DecodeFITS, fitsTestFile(cards, make([]byte, 8))); err == nil || isPanic(err) {
+			t.Errorf("%s: expected an error but saw %v", name, err)
+		}
+	}
+	for name, data := range map[string][]byte{
+		"not SIMPLE": bytes.Replace(fitsTestFile(valid, make([]byte, 8)), []byte("= "+strings.Repeat(" ", 19)+"T"), []byte("= "+strings.Repeat(" ", 19)+"F"), 1),
+		"bad NAXIS3": fitsTestFile(append([]string{valid[0], "NAXIS   =                    3"}, valid[2], valid[3], "NAXIS3  =                    2"), make([]byte, 16)),
+		"huge cube":  fitsTestFile([]string{valid[0], "NAXIS   =                    3", "NAXIS1  =              1048576", "NAXIS2  =              1048576", "NAXIS3  =                    4"}, make([]byte, 16)),
+		"no END":     bytes.Repeat([]byte(fitsCard("SIMPLE", true, "")), 40),
+	} {
+		if _, err := decodeSafely(DecodeFITS, data); err == nil || isPanic(err) {
+			t.Errorf("%s: expected an error but saw %v", name, err)
+		}
+	}
+	data := encodeImage(t, EncodeFITS, testGrayImage())
+	checkMutated(t, DecodeFITS, data, 8*fitsCardSize)
+}
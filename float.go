@@ -0,0 +1,217 @@
+// This file provides image types whose pixels are stored as floating-point
+// numbers.  These let channel data pass through the program without being
+// quantized.
+
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// Gray32f is an in-memory image whose At method returns color.Gray16 values
+// but whose pixels are stored as 32-bit floating-point numbers.  Pixel values
+// are nominally in [0.0, 1.0] but are not clamped to that range.
+type Gray32f struct {
+	Pix    []float32       // Pixel values
+	Stride int             // Pix stride (in elements) between vertically adjacent pixels
+	Rect   image.Rectangle // Image bounds
+}
+
+// NewGray32f returns a new Gray32f image with the given bounds.
+func NewGray32f(r image.Rectangle) *Gray32f {
+	return &Gray32f{
+		Pix:    make([]float32, r.Dx()*r.Dy()),
+		Stride: r.Dx(),
+		Rect:   r,
+	}
+}
+
+// ColorModel returns the Gray32f's color model.
+func (p *Gray32f) ColorModel() color.Model { return color.Gray16Model }
+
+// Bounds returns the Gray32f's bounds.
+func (p *Gray32f) Bounds() image.Rectangle { return p.Rect }
+
+// At returns the color of the pixel at (x, y), clamped to [0.0, 1.0] and
+// quantized to 16 bits.
+func (p *Gray32f) At(x, y int) color.Color { return p.Gray16At(x, y) }
+
+// Gray16At returns the color of the pixel at (x, y) as a color.Gray16,
+// clamped to [0.0, 1.0] and quantized to 16 bits.
+func (p *Gray32f) Gray16At(x, y int) color.Gray16 { return toGrayVal(p.FloatAt(x, y)) }
+
+// PixOffset returns the index of the element of Pix that corresponds to the
+// pixel at (x, y).
+func (p *Gray32f) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x - p.Rect.Min.X)
+}
+
+// FloatAt returns the unclamped value of the pixel at (x, y).
+func (p *Gray32f) FloatAt(x, y int) float64 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0.0
+	}
+	return float64(p.Pix[p.PixOffset(x, y)])
+}
+
+// SetFloat assigns a value to the pixel at (x, y).
+func (p *Gray32f) SetFloat(x, y int, f float64) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	p.Pix[p.PixOffset(x, y)] = float32(f)
+}
+
+// Set assigns an arbitrary color to the pixel at (x, y), converting it to
+// grayscale.
+func (p *Gray32f) Set(x, y int, c color.Color) {
+	g := color.Gray16Model.Convert(c).(color.Gray16)
+	p.SetFloat(x, y, float64(g.Y)/65535.0)
+}
+
+// Gray16 returns a copy of the image quantized to 16-bit grayscale.
+func (p *Gray32f) Gray16() *image.Gray16 {
+	w := p.Rect.Dx()
+	gray := &image.Gray16{
+		Pix:    getBytes(2 * w * p.Rect.Dy()),
+		Stride: 2 * w,
+		Rect:   p.Rect,
+	}
+	for y := 0; y < p.Rect.Dy(); y++ {
+		// Operate directly on the pixel buffers, which is much faster
+		// than converting one color.Color at a time.
+		src := p.Pix[y*p.Stride : y*p.Stride+w]
+		dst := gray.Pix[y*gray.Stride : y*gray.Stride+2*w]
+		for x, f := range src {
+			v := toGrayVal(float64(f)).Y
+			dst[2*x] = uint8(v >> 8)
+			dst[2*x+1] = uint8(v)
+		}
+	}
+	return gray
+}
+
+// NRGBA32f is an in-memory image whose At method returns color.NRGBA64
+// values but whose pixels are stored as 32-bit floating-point numbers in R,
+// G, B, A order.  Color components are gamma-encoded (i.e., they use the same
+// scale as a colorful.Color) and alpha is not premultiplied.  Component values
+// are nominally in [0.0, 1.0] but are not clamped to that range, which lets
+// NRGBA32f represent high-dynamic-range images.
+type NRGBA32f struct {
+	Pix    []float32       // Pixel values
+	Stride int             // Pix stride (in elements) between vertically adjacent pixels
+	Rect   image.Rectangle // Image bounds
+}
+
+// NewNRGBA32f returns a new NRGBA32f image with the given bounds.
+func NewNRGBA32f(r image.Rectangle) *NRGBA32f {
+	return &NRGBA32f{
+		Pix:    make([]float32, 4*r.Dx()*r.Dy()),
+		Stride: 4 * r.Dx(),
+		Rect:   r,
+	}
+}
+
+// ColorModel returns the NRGBA32f's color model.
+func (p *NRGBA32f) ColorModel() color.Model { return color.NRGBA64Model }
+
+// Bounds returns the NRGBA32f's bounds.
+func (p *NRGBA32f) Bounds() image.Rectangle { return p.Rect }
+
+// At returns the color of the pixel at (x, y), clamped to [0.0, 1.0] and
+// quantized to 16 bits per component.
+func (p *NRGBA32f) At(x, y int) color.Color {
+	v := p.FloatsAt(x, y)
+	return color.NRGBA64{
+		R: toGrayVal(v[0]).Y,
+		G: toGrayVal(v[1]).Y,
+		B: toGrayVal(v[2]).Y,
+		A: toGrayVal(v[3]).Y,
+	}
+}
+
+// PixOffset returns the index of the first element of Pix that corresponds to
+// the pixel at (x, y).
+func (p *NRGBA32f) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x-p.Rect.Min.X)*4
+}
+
+// FloatsAt returns the unclamped R, G, B, and A values of the pixel at (x, y).
+func (p *NRGBA32f) FloatsAt(x, y int) [4]float64 {
+	var v [4]float64
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return v
+	}
+	i := p.PixOffset(x, y)
+	for c := range v {
+		v[c] = float64(p.Pix[i+c])
+	}
+	return v
+}
+
+// SetFloats assigns R, G, B, and A values to the pixel at (x, y).
+func (p *NRGBA32f) SetFloats(x, y int, v [4]float64) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	i := p.PixOffset(x, y)
+	for c, f := range v {
+		p.Pix[i+c] = float32(f)
+	}
+}
+
+// Set assigns an arbitrary color to the pixel at (x, y).
+func (p *NRGBA32f) Set(x, y int, c color.Color) {
+	n := toNRGBA64(c)
+	p.SetFloats(x, y, [4]float64{
+		float64(n.R) / 65535.0,
+		float64(n.G) / 65535.0,
+		float64(n.B) / 65535.0,
+		float64(n.A) / 65535.0,
+	})
+}
+
+// Opaque scans the entire image and reports whether it is fully opaque.
+func (p *NRGBA32f) Opaque() bool {
+	for i := 3; i < len(p.Pix); i += 4 {
+		if p.Pix[i] < 1.0 {
+			return false
+		}
+	}
+	return true
+}
+
+// NRGBA64 returns a copy of the image clamped to [0.0, 1.0] and quantized to
+// 16 bits per component.
+func (p *NRGBA32f) NRGBA64() *image.NRGBA64 {
+	n := 4 * p.Rect.Dx()
+	img := &image.NRGBA64{
+		Pix:    getBytes(2 * n * p.Rect.Dy()),
+		Stride: 2 * n,
+		Rect:   p.Rect,
+	}
+	for y := 0; y < p.Rect.Dy(); y++ {
+		src := p.Pix[y*p.Stride : y*p.Stride+n]
+		dst := img.Pix[y*img.Stride : y*img.Stride+2*n]
+		for i, f := range src {
+			v := toGrayVal(float64(f)).Y
+			dst[2*i] = uint8(v >> 8)
+			dst[2*i+1] = uint8(v)
+		}
+	}
+	return img
+}
+
+// quantizeImage converts a floating-point image to the corresponding 16-bit
+// integer image type.  Other images are returned unmodified.
+func quantizeImage(img image.Image) image.Image {
+	switch img := img.(type) {
+	case *Gray32f:
+		return img.Gray16()
+	case *NRGBA32f:
+		return img.NRGBA64()
+	default:
+		return img
+	}
+}
@@ -0,0 +1,204 @@
+// This file provides helpers for testing the readers and writers of the
+// various image formats.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"testing"
+)
+
+// A decoder is a function that decodes an image, such as DecodeEXR.
+type decoder func(r io.Reader) (image.Image, error)
+
+// An encoder is a function that encodes an image, such as EncodeEXR.
+type encoder func(w io.Writer, img image.Image) error
+
+// testColorImage returns a small color image in which every pixel differs.  If
+// alpha is true, the image is partially transparent; otherwise, it is opaque.
+func testColorImage(alpha bool) *NRGBA32f {
+	img := NewNRGBA32f(image.Rect(0, 0, 7, 5))
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 7; x++ {
+			a := 1.0
+			if alpha {
+				a = float64(x+7*y+1) / 35.0
+			}
+			img.SetFloats(x, y, [4]float64{float64(x) / 6.0, float64(y) / 4.0, float64(x+y) / 10.0, a})
+		}
+	}
+	return img
+}
+
+// testGrayImage returns a small grayscale image in which every pixel differs.
+func testGrayImage() *Gray32f {
+	img := NewGray32f(image.Rect(0, 0, 7, 5))
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 7; x++ {
+			img.SetFloat(x, y, float64(x+7*y)/34.0)
+		}
+	}
+	return img
+}
+
+// pixelFloats returns the R, G, B, and A samples (or, for a grayscale image,
+// the gray value plus an alpha of 1.0) of a pixel as float64s.
+// Floating-point images are read without quantization.
+func pixelFloats(img image.Image, x, y int) [4]float64 {
+	switch m := img.(type) {
+	case *Gray32f:
+		v := m.FloatAt(x, y)
+		return [4]float64{v, v, v, 1.0}
+	case *NRGBA32f:
+		return m.FloatsAt(x, y)
+	}
+	c := img.At(x, y)
+	if n, ok := c.(color.NRGBA); ok {
+		// Avoid the loss of precision that premultiplication causes.
+		return [4]float64{
+			float64(n.R) / 255.0,
+			float64(n.G) / 255.0,
+			float64(n.B) / 255.0,
+			float64(n.A) / 255.0,
+		}
+	}
+	n := toNRGBA64(c)
+	return [4]float64{
+		float64(n.R) / 65535.0,
+		float64(n.G) / 65535.0,
+		float64(n.B) / 65535.0,
+		float64(n.A) / 65535.0,
+	}
+}
+
+// checkImage fails the test if two images differ in bounds or if any sample
+// differs by more than tol.
+func checkImage(t *testing.T, got, want image.Image, tol float64) {
+	t.Helper()
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("expected bounds %v but saw %v", want.Bounds(), got.Bounds())
+	}
+	bnds := want.Bounds()
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			g, w := pixelFloats(got, x, y), pixelFloats(want, x, y)
+			for c := range w {
+				if math.Abs(g[c]-w[c]) > tol {
+					t.Fatalf("pixel (%d, %d): expected %v but saw %v", x, y, w, g)
+				}
+			}
+		}
+	}
+}
+
+// encodeImage encodes an image, failing the test on error.
+func encodeImage(t *testing.T, enc encoder, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := enc(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decodeImage decodes an image, failing the test on error.
+func decodeImage(t *testing.T, dec decoder, data []byte) image.Image {
+	t.Helper()
+	img, err := decodeSafely(dec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// A panicError is an error that represents a recovered panic.
+type panicError struct {
+	Value interface{} // Value passed to panic
+}
+
+// Error returns the panic value as a string.
+func (e panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// decodeSafely decodes an image, converting a panic into a panicError.
+func decodeSafely(dec decoder, data []byte) (img image.Image, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			img, err = nil, panicError{r}
+		}
+	}()
+	return dec(bytes.NewReader(data))
+}
+
+// isPanic reports whether an error returned by decodeSafely represents a
+// panic.
+func isPanic(err error) bool {
+	_, ok := err.(panicError)
+	return ok
+}
+
+// checkTruncated verifies that decoding each prefix of a valid file shorter
+// than need bytes returns an error and that no prefix causes a panic.
+func checkTruncated(t *testing.T, dec decoder, data []byte, need int) {
+	t.Helper()
+	for n := 0; n < len(data); n++ {
+		_, err := decodeSafely(dec, data[:n])
+		switch {
+		case isPanic(err):
+			t.Fatalf("decoding the first %d of %d bytes: %v", n, len(data), err)
+		case err == nil && n < need:
+			t.Fatalf("decoding the first %d of %d bytes unexpectedly succeeded", n, len(data))
+		}
+	}
+}
+
+// checkMutated overwrites each of the first n bytes of a valid file in turn
+// with several different values and verifies that decoding the result never
+// panics.  The result may or may not decode successfully.
+func checkMutated(t *testing.T, dec decoder, data []byte, n int) {
+	t.Helper()
+	if n > len(data) {
+		n = len(data)
+	}
+	mut := make([]byte, len(data))
+	for i := 0; i < n; i++ {
+		for _, v := range []byte{0x00, 0x01, 0x7f, 0x80, 0xff, '9', data[i] ^ 0x55} {
+			copy(mut, data)
+			mut[i] = v
+			if _, err := decodeSafely(dec, mut); isPanic(err) {
+				t.Fatalf("setting byte %d to %#02x: %v", i, v, err)
+			}
+		}
+	}
+}
+
+// A patch describes a corruption of a valid file: the bytes at a given
+// offset are replaced.
+type patch struct {
+	Offset int    // Offset at which to overwrite bytes
+	Data   []byte // Bytes with which to overwrite the file
+}
+
+// checkPatched applies each of a set of named patches to a copy of a valid
+// file and verifies that decoding the result returns an error rather than
+// panicking.
+func checkPatched(t *testing.T, dec decoder, data []byte, patches map[string]patch) {
+	t.Helper()
+	for name, p := range patches {
+		mut := append([]byte(nil), data...)
+		copy(mut[p.Offset:], p.Data)
+		_, err := decodeSafely(dec, mut)
+		switch {
+		case isPanic(err):
+			t.Errorf("%s: %v", name, err)
+		case err == nil:
+			t.Errorf("%s: decoding unexpectedly succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// This file provides support for applying a display gamma to individual
+// channels when splitting, which makes dim channels easier to inspect, and for
+// undoing it when merging.
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseGamma parses the argument to --gamma, which is either a single
+// exponent, applied to every color channel, or a comma-separated list of
+// <channel>=<exponent> pairs.  It returns the exponent for each channel in
+// channel order, with 1.0 for channels not adjusted.  parseGamma aborts on
+// error.
+func parseGamma(p *Parameters, arg string) []float64 {
+	parseExp := func(s string) float64 {
+		g, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || g <= 0.0 || math.IsInf(g, 0) {
+			notify.Fatalf("--gamma requires positive exponents (not %q)", s)
+		}
+		return g
+	}
+	gamma := make([]float64, len(builtinChannelNames(p)))
+	for i := range gamma {
+		gamma[i] = 1.0
+	}
+
+	// Apply a single exponent to every color channel.
+	if !strings.Contains(arg, "=") {
+		g := parseExp(arg)
+		for i := 0; i < colorChannelCount(p.ColorSpace); i++ {
+			gamma[i] = g
+		}
+		return gamma
+	}
+
+	// Apply an exponent to each channel listed.
+	seen := make([]bool, len(gamma))
+	for _, pair := range strings.Split(arg, ",") {
+		eq := strings.Index(pair, "=")
+		if eq <= 0 {
+			notify.Fatalf("--gamma requires either an exponent or a list of <channel>=<exponent> pairs (not %q)", pair)
+		}
+		ch := channelIndex(p, strings.TrimSpace(pair[:eq]))
+		if seen[ch] {
+			notify.Fatalf("--gamma specifies channel %s more than once", builtinChannelNames(p)[ch])
+		}
+		seen[ch] = true
+		gamma[ch] = parseExp(pair[eq+1:])
+	}
+	return gamma
+}
+
+// channelGamma returns the gamma exponent for the channel with a given
+// built-in name.  Channels without an exponent have a gamma of 1.0.
+func channelGamma(p *Parameters, name string) float64 {
+	if p.Gamma == nil {
+		return 1.0
+	}
+	for i, nm := range builtinChannelNames(p) {
+		if nm == name {
+			return p.Gamma[i]
+		}
+	}
+	return 1.0
+}
+
+// powGray returns a copy of a Gray32f image with each pixel value raised to a
+// given power.  Negative values are mapped symmetrically to positive values.
+func powGray(g *Gray32f, exp float64) *Gray32f {
+	bnds := g.Bounds()
+	out := NewGray32f(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			v := g.FloatAt(x, y)
+			out.SetFloat(x, y, math.Copysign(math.Pow(math.Abs(v), exp), v))
+		}
+	}
+	return out
+}
+
+// encodeGamma applies the gamma exponents given by p.Gamma to a set of split
+// channels, mapping each value v to v^(1/gamma).
+func encodeGamma(p *Parameters, infos []ImageInfo) {
+	for i, info := range infos {
+		if g := channelGamma(p, info.Name); g != 1.0 {
+			infos[i].Image = powGray(info.Image, 1.0/g)
+		}
+	}
+}
+
+// decodeGamma undoes the gamma exponents given by p.Gamma for a set of
+// channels to merge, given in channel order, mapping each value v to
+// v^gamma.  Channels filled by --fill are left as is.
+func decodeGamma(p *Parameters, channels []*Gray32f) []*Gray32f {
+	if p.Gamma == nil {
+		return channels
+	}
+	result := make([]*Gray32f, len(channels))
+	for i, g := range channels {
+		result[i] = g
+		if i < len(p.Gamma) && p.Gamma[i] != 1.0 && !isFilled(p, i) {
+			result[i] = powGray(g, p.Gamma[i])
+		}
+	}
+	return result
+}
+
+// manifestGamma returns the gamma exponents recorded in a manifest, in
+// channel order, or nil if the manifest records none.
+func manifestGamma(man *channelManifest) []float64 {
+	var gamma []float64
+	for i, ent := range man.Channels {
+		if ent.Gamma == 0.0 || ent.Gamma == 1.0 {
+			continue
+		}
+		if gamma == nil {
+			gamma = make([]float64, len(man.Channels))
+			for j := range gamma {
+				gamma[j] = 1.0
+			}
+		}
+		gamma[i] = ent.Gamma
+	}
+	return gamma
+}
@@ -0,0 +1,83 @@
+// This file provides support for mapping merged colors that lie outside the
+// sRGB gamut back into the gamut.  Reducing chroma along a line of constant
+// hue distorts colors far less than clamping each RGB component separately.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// A gamutMapper maps a color that may lie outside the sRGB gamut to one that
+// lies inside.
+type gamutMapper func(c colorful.Color) colorful.Color
+
+// gamutMappers maps each valid argument to --gamut to the corresponding
+// gamutMapper.  "error" clamps as well, as merged colors are clamped only
+// after out-of-gamut pixels are counted.
+var gamutMappers = map[string]gamutMapper{
+	"clamp":        colorful.Color.Clamped,
+	"scale-chroma": scaleChroma,
+	"project":      projectToGamut,
+	"error":        colorful.Color.Clamped,
+}
+
+// gamutSteps is the number of bisection steps with which a gamutMapper
+// searches for the boundary of the sRGB gamut.
+const gamutSteps = 24
+
+// parseGamut validates the argument to --gamut and returns it in lowercase.
+// It aborts on error.
+func parseGamut(arg string) string {
+	mode := strings.ToLower(arg)
+	if _, ok := gamutMappers[mode]; !ok {
+		notify.Fatalf(`--gamut requires one of "clamp", "scale-chroma", "project", or "error" (not %q)`, arg)
+	}
+	return mode
+}
+
+// inGamut reports whether a color lies inside the sRGB gamut, ignoring
+// differences too small to be considered clipped.
+func inGamut(c colorful.Color) bool {
+	return !colorClipped(c)
+}
+
+// bisectGamut returns the in-gamut color nearest to c on the line in CIE
+// L*a*b* from an in-gamut anchor color to c.
+func bisectGamut(c colorful.Color, anchor [3]float64) colorful.Color {
+	l, a, b := c.Lab()
+	lo, hi := 0.0, 1.0
+	for i := 0; i < gamutSteps; i++ {
+		t := (lo + hi) / 2.0
+		trial := colorful.Lab(anchor[0]+(l-anchor[0])*t, anchor[1]+(a-anchor[1])*t, anchor[2]+(b-anchor[2])*t)
+		if inGamut(trial) {
+			lo = t
+		} else {
+			hi = t
+		}
+	}
+	return colorful.Lab(anchor[0]+(l-anchor[0])*lo, anchor[1]+(a-anchor[1])*lo, anchor[2]+(b-anchor[2])*lo).Clamped()
+}
+
+// scaleChroma maps an out-of-gamut color into the sRGB gamut by reducing its
+// CIE L*a*b* chroma while preserving its lightness and hue.
+func scaleChroma(c colorful.Color) colorful.Color {
+	if inGamut(c) {
+		return c.Clamped()
+	}
+	l, _, _ := c.Lab()
+	return bisectGamut(c, [3]float64{clamp01(l), 0.0, 0.0})
+}
+
+// projectToGamut maps an out-of-gamut color into the sRGB gamut by moving it
+// toward mid-gray in CIE L*a*b*, preserving its hue.  Unlike scaleChroma,
+// projectToGamut trades lightness for chroma, which better preserves the
+// saturation of very light and very dark colors.
+func projectToGamut(c colorful.Color) colorful.Color {
+	if inGamut(c) {
+		return c.Clamped()
+	}
+	return bisectGamut(c, [3]float64{0.5, 0.0, 0.0})
+}
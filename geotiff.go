@@ -0,0 +1,201 @@
+// This file provides support for carrying GeoTIFF geo-referencing tags from
+// TIFF inputs to TIFF outputs.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+// geoTagIDs is the set of TIFF tags that convey geo-referencing information.
+var geoTagIDs = map[uint16]bool{
+	33550: true, // ModelPixelScaleTag
+	33922: true, // ModelTiepointTag
+	34264: true, // ModelTransformationTag
+	34735: true, // GeoKeyDirectoryTag
+	34736: true, // GeoDoubleParamsTag
+	34737: true, // GeoAsciiParamsTag
+	42112: true, // GDAL_METADATA
+	42113: true, // GDAL_NODATA
+}
+
+// tiffTypeSizes maps a TIFF field type to the size in bytes of each
+// byte-order-sensitive unit of that type.
+var tiffTypeSizes = map[uint16]int{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	5:  4, // RATIONAL (two LONGs)
+	6:  1, // SBYTE
+	7:  1, // UNDEFINED
+	8:  2, // SSHORT
+	9:  4, // SLONG
+	10: 4, // SRATIONAL (two SLONGs)
+	11: 4, // FLOAT
+	12: 8, // DOUBLE
+}
+
+// A tiffTag represents a single TIFF tag.
+type tiffTag struct {
+	ID    uint16 // Tag number
+	Type  uint16 // Field type
+	Count uint32 // Number of values
+	Data  []byte // Value bytes, little-endian
+}
+
+// readTIFFTags reads all tags from the first IFD of a TIFF file for which a
+// given predicate returns true.
+func readTIFFTags(r io.ReaderAt, keep func(id uint16) bool) ([]tiffTag, error) {
+	// Parse the TIFF header.
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return nil, err
+	}
+	var bo binary.ByteOrder
+	switch string(hdr[:4]) {
+	case "II*\x00":
+		bo = binary.LittleEndian
+	case "MM\x00*":
+		bo = binary.BigEndian
+	default:
+		return nil, errors.New("tiff: invalid format")
+	}
+	ifd := int64(bo.Uint32(hdr[4:]))
+
+	// Read each entry in the first IFD.
+	var nbuf [2]byte
+	if _, err := r.ReadAt(nbuf[:], ifd); err != nil {
+		return nil, err
+	}
+	n := int(bo.Uint16(nbuf[:]))
+	entries := make([]byte, 12*n)
+	if _, err := r.ReadAt(entries, ifd+2); err != nil {
+		return nil, err
+	}
+	var tags []tiffTag
+	for i := 0; i < n; i++ {
+		e := entries[12*i : 12*(i+1)]
+		tag := tiffTag{
+			ID:    bo.Uint16(e[0:]),
+			Type:  bo.Uint16(e[2:]),
+			Count: bo.Uint32(e[4:]),
+		}
+		unit, ok := tiffTypeSizes[tag.Type]
+		if !keep(tag.ID) || !ok {
+			continue
+		}
+		size := int64(tag.Count) * int64(unit)
+		if tag.Type == 5 || tag.Type == 10 {
+			size *= 2
+		}
+		if size > 1<<24 {
+			return nil, errors.New("tiff: tag too large")
+		}
+		tag.Data = make([]byte, size)
+		if size <= 4 {
+			copy(tag.Data, e[8:])
+		} else if _, err := r.ReadAt(tag.Data, int64(bo.Uint32(e[8:]))); err != nil {
+			return nil, err
+		}
+
+		// Convert the value to little-endian byte order.
+		if bo == binary.BigEndian && unit > 1 {
+			for j := 0; j+unit <= len(tag.Data); j += unit {
+				u := tag.Data[j : j+unit]
+				for a, b := 0, unit-1; a < b; a, b = a+1, b-1 {
+					u[a], u[b] = u[b], u[a]
+				}
+			}
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// ReadGeoTags returns the GeoTIFF tags from a named file.  It returns nil if
+// the file is not a TIFF file or contains no GeoTIFF tags.
+func ReadGeoTags(fn string) []tiffTag {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	tags, err := readTIFFTags(f, func(id uint16) bool { return geoTagIDs[id] })
+	if err != nil {
+		return nil
+	}
+	return tags
+}
+
+// addTIFFTags adds tags to the first IFD of a little-endian TIFF file held in
+// memory.  The original IFD is left in place, and a new, augmented IFD is
+// appended to the file.  Added tags replace any existing tags with the same
+// ID.
+func addTIFFTags(data []byte, tags []tiffTag) ([]byte, error) {
+	// Parse the existing IFD.
+	le := binary.LittleEndian
+	if len(data) < 8 || string(data[:4]) != "II*\x00" {
+		return nil, errors.New("tiff: expected a little-endian TIFF file")
+	}
+	ifd := int(le.Uint32(data[4:]))
+	if ifd+2 > len(data) {
+		return nil, errors.New("tiff: invalid IFD offset")
+	}
+	n := int(le.Uint16(data[ifd:]))
+	if ifd+2+12*n > len(data) {
+		return nil, errors.New("tiff: truncated IFD")
+	}
+	replaced := make(map[uint16]bool, len(tags))
+	for _, t := range tags {
+		replaced[t.ID] = true
+	}
+	entries := make([][]byte, 0, n+len(tags))
+	for i := 0; i < n; i++ {
+		e := data[ifd+2+12*i : ifd+2+12*(i+1)]
+		if !replaced[le.Uint16(e)] {
+			entries = append(entries, append([]byte(nil), e...))
+		}
+	}
+
+	// Append the out-of-line values of the new tags and construct their
+	// IFD entries.
+	out := append([]byte(nil), data...)
+	for _, t := range tags {
+		e := make([]byte, 12)
+		le.PutUint16(e[0:], t.ID)
+		le.PutUint16(e[2:], t.Type)
+		le.PutUint32(e[4:], t.Count)
+		if len(t.Data) <= 4 {
+			copy(e[8:], t.Data)
+		} else {
+			if len(out)%2 == 1 {
+				out = append(out, 0)
+			}
+			le.PutUint32(e[8:], uint32(len(out)))
+			out = append(out, t.Data...)
+		}
+		entries = append(entries, e)
+	}
+
+	// Append the new IFD, sorted by tag, and point the header at it.
+	sort.Slice(entries, func(i, j int) bool {
+		return le.Uint16(entries[i]) < le.Uint16(entries[j])
+	})
+	if len(out)%2 == 1 {
+		out = append(out, 0)
+	}
+	le.PutUint32(out[4:], uint32(len(out)))
+	var cnt [2]byte
+	le.PutUint16(cnt[:], uint16(len(entries)))
+	out = append(out, cnt[:]...)
+	for _, e := range entries {
+		out = append(out, e...)
+	}
+	out = append(out, 0, 0, 0, 0) // No next IFD
+	return out, nil
+}
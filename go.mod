@@ -5,4 +5,5 @@ go 1.17
 require (
 	github.com/lucasb-eyer/go-colorful v1.2.0
 	github.com/spakin/netpbm v1.3.0
+	golang.org/x/image v0.0.0-20220413100746-70e8d0d3baa9
 )
@@ -0,0 +1,205 @@
+// This file provides support for reading Radiance RGBE (.hdr) images.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// init registers the Radiance format with the image package.
+func init() {
+	image.RegisterFormat("hdr", "#?RADIANCE", DecodeHDR, DecodeHDRConfig)
+	image.RegisterFormat("hdr", "#?RGBE", DecodeHDR, DecodeHDRConfig)
+}
+
+// An hdrHeader represents the parts of a Radiance header that we use.
+type hdrHeader struct {
+	XYZE   bool // true: pixels are XYZE; false: pixels are RGBE
+	Width  int  // Image width in pixels
+	Height int  // Image height in pixels
+	FlipY  bool // true: rows are stored from bottom to top
+}
+
+// readHDRHeader reads and parses a Radiance header, including the resolution
+// string.
+func readHDRHeader(r *bufio.Reader) (hdrHeader, error) {
+	var hdr hdrHeader
+
+	// Read header lines up to the first blank line.
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "#?") {
+		return hdr, errors.New("hdr: invalid format")
+	}
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return hdr, errors.New("hdr: truncated header")
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") {
+			switch strings.TrimPrefix(line, "FORMAT=") {
+			case "32-bit_rle_rgbe":
+				hdr.XYZE = false
+			case "32-bit_rle_xyze":
+				hdr.XYZE = true
+			default:
+				return hdr, fmt.Errorf("hdr: unsupported %s", line)
+			}
+		}
+	}
+
+	// Parse the resolution string.  We support only the standard,
+	// left-to-right orientations.
+	line, err = r.ReadString('\n')
+	if err != nil {
+		return hdr, errors.New("hdr: missing resolution string")
+	}
+	var ySign, xSign string
+	_, err = fmt.Sscanf(line, "%1sY %d %1sX %d", &ySign, &hdr.Height, &xSign, &hdr.Width)
+	if err != nil || xSign != "+" || (ySign != "-" && ySign != "+") {
+		return hdr, fmt.Errorf("hdr: unsupported resolution string %q", strings.TrimSpace(line))
+	}
+	if hdr.Width <= 0 || hdr.Height <= 0 || hdr.Width > 1<<24 || hdr.Height > 1<<24 {
+		return hdr, errors.New("hdr: invalid image dimensions")
+	}
+	hdr.FlipY = ySign == "+"
+	return hdr, nil
+}
+
+// readHDRScanline reads one scanline of width RGBE (or XYZE) pixels and
+// appends its 4*width bytes to buf.  It handles both run-length-encoded and
+// flat scanlines.
+func readHDRScanline(r *bufio.Reader, buf []byte, width int) ([]byte, error) {
+	hd, err := r.Peek(4)
+	if err != nil {
+		return nil, errors.New("hdr: truncated pixel data")
+	}
+	if width < 8 || width > 0x7fff || hd[0] != 2 || hd[1] != 2 || hd[2]&0x80 != 0 {
+		// Flat scanline
+		line, err := readBytes(r, 4*int64(width))
+		if err != nil {
+			return nil, errors.New("hdr: truncated pixel data")
+		}
+		return append(buf, line...), nil
+	}
+	if int(hd[2])<<8|int(hd[3]) != width {
+		return nil, errors.New("hdr: scanline width mismatch")
+	}
+	r.Discard(4)
+	start := len(buf)
+	buf = append(buf, make([]byte, 4*width)...)
+	line := buf[start:]
+
+	// Run-length-encoded scanline: each of the four components is
+	// encoded separately.
+	for c := 0; c < 4; c++ {
+		for x := 0; x < width; {
+			n, err := r.ReadByte()
+			if err != nil {
+				return nil, errors.New("hdr: truncated pixel data")
+			}
+			if n > 128 {
+				// Run of a single value
+				n -= 128
+				v, err := r.ReadByte()
+				if err != nil {
+					return nil, errors.New("hdr: truncated pixel data")
+				}
+				if n == 0 || x+int(n) > width {
+					return nil, errors.New("hdr: corrupt run-length encoding")
+				}
+				for ; n > 0; n-- {
+					line[4*x+c] = v
+					x++
+				}
+			} else {
+				// Literal values
+				if n == 0 || x+int(n) > width {
+					return nil, errors.New("hdr: corrupt run-length encoding")
+				}
+				for ; n > 0; n-- {
+					v, err := r.ReadByte()
+					if err != nil {
+						return nil, errors.New("hdr: truncated pixel data")
+					}
+					line[4*x+c] = v
+					x++
+				}
+			}
+		}
+	}
+	return buf, nil
+}
+
+// DecodeHDR decodes a Radiance RGBE or XYZE image.  The image is returned as
+// an *NRGBA32f so that values brighter than 1.0 are preserved.
+func DecodeHDR(rd io.Reader) (image.Image, error) {
+	r := bufio.NewReader(rd)
+	hdr, err := readHDRHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read all scanlines before allocating the image so that a corrupt
+	// header cannot cause an enormous allocation.
+	var pix []byte
+	for row := 0; row < hdr.Height; row++ {
+		pix, err = readHDRScanline(r, pix, hdr.Width)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Convert the pixels to floating point.
+	img := NewNRGBA32f(image.Rect(0, 0, hdr.Width, hdr.Height))
+	for row := 0; row < hdr.Height; row++ {
+		buf := pix[4*hdr.Width*row:]
+		y := row
+		if hdr.FlipY {
+			y = hdr.Height - 1 - row
+		}
+		for x := 0; x < hdr.Width; x++ {
+			var v [3]float64
+			if e := buf[4*x+3]; e != 0 {
+				f := math.Ldexp(1.0, int(e)-(128+8))
+				for c := range v {
+					v[c] = float64(buf[4*x+c]) * f
+				}
+			}
+			var clr colorful.Color
+			if hdr.XYZE {
+				clr = colorful.Xyz(v[0], v[1], v[2])
+			} else {
+				clr = colorful.LinearRgb(v[0], v[1], v[2])
+			}
+			img.SetFloats(x, y, [4]float64{clr.R, clr.G, clr.B, 1.0})
+		}
+	}
+	return img, nil
+}
+
+// DecodeHDRConfig returns the color model and dimensions of a Radiance image
+// without decoding the entire image.
+func DecodeHDRConfig(rd io.Reader) (image.Config, error) {
+	var cfg image.Config
+	hdr, err := readHDRHeader(bufio.NewReader(rd))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ColorModel = color.NRGBA64Model
+	cfg.Width = hdr.Width
+	cfg.Height = hdr.Height
+	return cfg, nil
+}
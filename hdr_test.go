@@ -0,0 +1,125 @@
+// This file tests the Radiance HDR reader.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// hdrTestPixel returns the RGBE value of a pixel of an hdrTestImage.
+func hdrTestPixel(x, y int) [4]byte {
+	return [4]byte{byte(16 * x), byte(100 + 10*y), 77, byte(128 + y)}
+}
+
+// hdrTestImage returns the image that hdrTestFile encodes.
+func hdrTestImage(wd, ht int, flip bool) *NRGBA32f {
+	img := NewNRGBA32f(image.Rect(0, 0, wd, ht))
+	for row := 0; row < ht; row++ {
+		y := row
+		if flip {
+			y = ht - 1 - row
+		}
+		for x := 0; x < wd; x++ {
+			p := hdrTestPixel(x, row)
+			f := math.Ldexp(1.0, int(p[3])-(128+8))
+			clr := colorful.LinearRgb(float64(p[0])*f, float64(p[1])*f, float64(p[2])*f)
+			img.SetFloats(x, y, [4]float64{clr.R, clr.G, clr.B, 1.0})
+		}
+	}
+	return img
+}
+
+// hdrTestFile returns a Radiance file of a given size.  If rle is true,
+// scanlines are run-length encoded, with the blue and exponent components
+// encoded as runs and the red and green components encoded as literals.  If
+// flip is true, rows are stored from bottom to top.
+func hdrTestFile(wd, ht int, rle, flip bool) []byte {
+	var buf bytes.Buffer
+	ySign := "-"
+	if flip {
+		ySign = "+"
+	}
+	fmt.Fprintf(&buf, "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\nEXPOSURE=1.0\n\n%sY %d +X %d\n", ySign, ht, wd)
+	for y := 0; y < ht; y++ {
+		if !rle {
+			for x := 0; x < wd; x++ {
+				p := hdrTestPixel(x, y)
+				buf.Write(p[:])
+			}
+			continue
+		}
+		buf.Write([]byte{2, 2, byte(wd >> 8), byte(wd)})
+		for c := 0; c < 4; c++ {
+			if c >= 2 {
+				p := hdrTestPixel(0, y)
+				buf.Write([]byte{byte(128 + wd), p[c]})
+				continue
+			}
+			buf.WriteByte(byte(wd))
+			for x := 0; x < wd; x++ {
+				buf.WriteByte(hdrTestPixel(x, y)[c])
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// TestHDRGolden verifies that DecodeHDR reads flat and run-length-encoded
+// scanlines stored in either vertical order.
+func TestHDRGolden(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		wd   int
+		rle  bool
+		flip bool
+	}{
+		{"flat", 5, false, false},
+		{"flat flipped", 5, false, true},
+		{"RLE", 9, true, false},
+		{"RLE flipped", 9, true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := hdrTestFile(tc.wd, 3, tc.rle, tc.flip)
+			checkImage(t, decodeImage(t, DecodeHDR, data), hdrTestImage(tc.wd, 3, tc.flip), 1e-6)
+			checkTruncated(t, DecodeHDR, data, len(data))
+		})
+	}
+}
+
+// TestHDRMalformed verifies that DecodeHDR rejects corrupt files without
+// panicking.
+func TestHDRMalformed(t *testing.T) {
+	data := hdrTestFile(9, 3, true, false)
+	res := bytes.Index(data, []byte("-Y 3 +X 9\n"))
+	pix := res + len("-Y 3 +X 9\n")
+	checkPatched(t, DecodeHDR, data, map[string]patch{
+		"bad magic":       {0, []byte("#!")},
+		"bad format":      {18, []byte("64")},
+		"bad orientation": {res, []byte("-Y 3 -X")},
+		"zero height":     {res + 3, []byte("0")},
+		"width mismatch":  {pix + 3, []byte{8}},
+		"zero run":        {pix + 4, []byte{0}},
+		"long literal":    {pix + 4, []byte{10}},
+		"long run":        {pix + 4 + 10 + 10, []byte{128 + 10}},
+	})
+	for name, hdr := range map[string]string{
+		"huge width":  "#?RADIANCE\n\n-Y 1 +X 99999999999\n",
+		"huge image":  "#?RADIANCE\n\n-Y 16777216 +X 16777216\n",
+		"no blank":    "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n",
+		"no size":     "#?RADIANCE\n\n",
+		"wide RLE":    "#?RADIANCE\n\n-Y 1 +X 32768\n\x02\x02\x80\x00",
+		"short flat":  "#?RADIANCE\n\n-Y 1 +X 1000\n\x01\x02\x03\x04",
+		"missing row": "#?RADIANCE\n\n-Y 2 +X 1\n\x01\x02\x03\x04",
+	} {
+		if _, err := decodeSafely(DecodeHDR, []byte(hdr)); err == nil || isPanic(err) {
+			t.Errorf("%s: expected an error but saw %v", name, err)
+		}
+	}
+	checkMutated(t, DecodeHDR, data, len(data))
+}
@@ -0,0 +1,25 @@
+// This file registers the HEIF and AVIF formats with the image package.  The
+// decoders themselves are provided by libheif when the program is built with
+// "-tags heif" and are otherwise stubs that report how to enable support.
+
+package main
+
+import "image"
+
+// heifBrands lists the ISO base-media-file-format brands that identify HEIF
+// (HEIC) images.
+var heifBrands = []string{"heic", "heix", "hevc", "heim", "heis", "hevm", "mif1", "msf1"}
+
+// avifBrands lists the ISO base-media-file-format brands that identify AVIF
+// images.
+var avifBrands = []string{"avif", "avis"}
+
+// init registers the HEIF and AVIF formats with the image package.
+func init() {
+	for _, b := range heifBrands {
+		image.RegisterFormat("heif", "????ftyp"+b, decodeHEIF, decodeHEIFConfig)
+	}
+	for _, b := range avifBrands {
+		image.RegisterFormat("avif", "????ftyp"+b, decodeHEIF, decodeHEIFConfig)
+	}
+}
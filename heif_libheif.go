@@ -0,0 +1,154 @@
+//go:build heif
+// +build heif
+
+// This file provides HEIF (HEIC) and AVIF decoding via libheif.  Build with
+// "-tags heif" to enable it.
+
+package main
+
+/*
+#cgo pkg-config: libheif
+#include <stdlib.h>
+#include <libheif/heif.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"unsafe"
+)
+
+// heifError converts a libheif error to a Go error.  It returns nil on
+// success.
+func heifError(e C.struct_heif_error) error {
+	if e.code == C.heif_error_Ok {
+		return nil
+	}
+	return errors.New("heif: " + C.GoString(e.message))
+}
+
+// heifContext reads a HEIF or AVIF file into a libheif context and returns
+// the context and the handle of its primary image.  The caller must release
+// both.
+func heifContext(r io.Reader) (*C.struct_heif_context, *C.struct_heif_image_handle, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil, errors.New("heif: empty file")
+	}
+	ctx := C.heif_context_alloc()
+	cdata := C.CBytes(data)
+	defer C.free(cdata)
+	err = heifError(C.heif_context_read_from_memory(ctx, cdata, C.size_t(len(data)), nil))
+	if err != nil {
+		C.heif_context_free(ctx)
+		return nil, nil, err
+	}
+	var handle *C.struct_heif_image_handle
+	err = heifError(C.heif_context_get_primary_image_handle(ctx, &handle))
+	if err != nil {
+		C.heif_context_free(ctx)
+		return nil, nil, err
+	}
+	return ctx, handle, nil
+}
+
+// decodeHEIF reads the primary image of a HEIF or AVIF file.  Images with
+// more than 8 bits per sample are returned with 16 bits per sample.
+func decodeHEIF(r io.Reader) (image.Image, error) {
+	ctx, handle, err := heifContext(r)
+	if err != nil {
+		return nil, err
+	}
+	defer C.heif_context_free(ctx)
+	defer C.heif_image_handle_release(handle)
+
+	// Decode the image to interleaved RGB or RGBA.
+	alpha := C.heif_image_handle_has_alpha_channel(handle) != 0
+	bits := int(C.heif_image_handle_get_luma_bits_per_pixel(handle))
+	var chroma C.enum_heif_chroma
+	switch {
+	case bits > 8 && alpha:
+		chroma = C.heif_chroma_interleaved_RRGGBBAA_BE
+	case bits > 8:
+		chroma = C.heif_chroma_interleaved_RRGGBB_BE
+	case alpha:
+		chroma = C.heif_chroma_interleaved_RGBA
+	default:
+		chroma = C.heif_chroma_interleaved_RGB
+	}
+	var img *C.struct_heif_image
+	err = heifError(C.heif_decode_image(handle, &img, C.heif_colorspace_RGB, chroma, nil))
+	if err != nil {
+		return nil, err
+	}
+	defer C.heif_image_release(img)
+	var cstride C.int
+	plane := C.heif_image_get_plane_readonly(img, C.heif_channel_interleaved, &cstride)
+	if plane == nil {
+		return nil, errors.New("heif: failed to access decoded pixels")
+	}
+	wd := int(C.heif_image_get_width(img, C.heif_channel_interleaved))
+	ht := int(C.heif_image_get_height(img, C.heif_channel_interleaved))
+	stride := int(cstride)
+	pix := C.GoBytes(unsafe.Pointer(plane), C.int(stride*ht))
+
+	// Convert the pixels to an NRGBA64 image, scaling high-bit-depth
+	// samples to 16 bits.
+	nc := 3
+	if alpha {
+		nc = 4
+	}
+	maxVal := uint32(255)
+	if bits > 8 {
+		maxVal = uint32(1)<<uint(bits) - 1
+	}
+	sample := func(row []byte, i int) uint16 {
+		var v uint32
+		if bits > 8 {
+			v = uint32(row[2*i])<<8 | uint32(row[2*i+1])
+		} else {
+			v = uint32(row[i])
+		}
+		return uint16((v*65535 + maxVal/2) / maxVal)
+	}
+	out := image.NewNRGBA64(image.Rect(0, 0, wd, ht))
+	for y := 0; y < ht; y++ {
+		row := pix[y*stride:]
+		for x := 0; x < wd; x++ {
+			c := color.NRGBA64{
+				R: sample(row, x*nc),
+				G: sample(row, x*nc+1),
+				B: sample(row, x*nc+2),
+				A: 0xffff,
+			}
+			if alpha {
+				c.A = sample(row, x*nc+3)
+			}
+			out.SetNRGBA64(x, y, c)
+		}
+	}
+	return out, nil
+}
+
+// decodeHEIFConfig returns the color model and dimensions of the primary image
+// of a HEIF or AVIF file without decoding the image.
+func decodeHEIFConfig(r io.Reader) (image.Config, error) {
+	ctx, handle, err := heifContext(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer C.heif_context_free(ctx)
+	defer C.heif_image_handle_release(handle)
+	return image.Config{
+		ColorModel: color.NRGBA64Model,
+		Width:      int(C.heif_image_handle_get_width(handle)),
+		Height:     int(C.heif_image_handle_get_height(handle)),
+	}, nil
+}
@@ -0,0 +1,26 @@
+//go:build !heif
+// +build !heif
+
+// This file provides placeholder HEIF and AVIF decoders for builds without
+// libheif.
+
+package main
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// errNoHEIF is returned when decoding HEIF or AVIF without libheif support.
+var errNoHEIF = errors.New("heif: HEIF/AVIF input requires building with \"-tags heif\" and libheif installed")
+
+// decodeHEIF reports that HEIF and AVIF decoding is unavailable.
+func decodeHEIF(r io.Reader) (image.Image, error) {
+	return nil, errNoHEIF
+}
+
+// decodeHEIFConfig reports that HEIF and AVIF decoding is unavailable.
+func decodeHEIFConfig(r io.Reader) (image.Config, error) {
+	return image.Config{}, errNoHEIF
+}
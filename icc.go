@@ -0,0 +1,629 @@
+// This file provides support for honoring the ICC profiles embedded in input
+// images and for describing the color space of output images.  Wide-gamut
+// images, such as those in Adobe RGB, Display P3, or ProPhoto RGB, are
+// converted to (unclamped) sRGB, the working space of all color-space
+// conversions, so their colors are not silently distorted.  Only matrix/TRC
+// RGB profiles, which describe nearly all RGB working spaces, are supported.
+// Color output images are correspondingly tagged as sRGB.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// iccModes lists the valid arguments to --icc.
+var iccModes = map[string]bool{
+	"convert": true,
+	"ignore":  true,
+}
+
+// parseICCMode validates the argument to --icc and returns it in lowercase.
+// It aborts on error.
+func parseICCMode(arg string) string {
+	mode := strings.ToLower(arg)
+	if !iccModes[mode] {
+		notify.Fatalf(`--icc requires either "convert" or "ignore" (not %q)`, arg)
+	}
+	return mode
+}
+
+// embedModes lists the valid arguments to --embed-profile.
+var embedModes = map[string]bool{
+	"both": true,
+	"icc":  true,
+	"cicp": true,
+	"none": true,
+}
+
+// parseEmbedMode validates the argument to --embed-profile and returns it in
+// lowercase.  It aborts on error.
+func parseEmbedMode(arg string) string {
+	mode := strings.ToLower(arg)
+	if !embedModes[mode] {
+		notify.Fatalf(`--embed-profile requires one of "both", "icc", "cicp", or "none" (not %q)`, arg)
+	}
+	return mode
+}
+
+// embedsICC reports whether an image is to be written with an embedded sRGB
+// ICC profile.  Grayscale images represent channels, not colors, so they are
+// never tagged.
+func embedsICC(p *Parameters, img image.Image) bool {
+	return (p.EmbedProfile == "both" || p.EmbedProfile == "icc") && !isGrayImage(img)
+}
+
+// embedsCICP reports whether an image is to be written, if in PNG format,
+// with a cICP chunk that identifies its colors as sRGB.
+func embedsCICP(p *Parameters, img image.Image) bool {
+	return (p.EmbedProfile == "both" || p.EmbedProfile == "cicp") && !isGrayImage(img)
+}
+
+// tiffICCTag is the ID of the TIFF tag that holds an ICC profile.
+const tiffICCTag = 34675
+
+// ReadICCProfile returns the ICC profile embedded in a named PNG, JPEG, or
+// TIFF file or nil if the file contains no profile or cannot be read.
+func ReadICCProfile(fn string) []byte {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var magic [8]byte
+	if _, err := f.ReadAt(magic[:], 0); err != nil {
+		return nil
+	}
+	switch {
+	case string(magic[:]) == pngSignature:
+		return pngReadICC(f)
+	case magic[0] == 0xFF && magic[1] == 0xD8:
+		return jpegReadICC(f)
+	case string(magic[:4]) == "II*\x00" || string(magic[:4]) == "MM\x00*":
+		tags, err := readTIFFTags(f, func(id uint16) bool { return id == tiffICCTag })
+		if err != nil || len(tags) == 0 {
+			return nil
+		}
+		return tags[0].Data
+	}
+	return nil
+}
+
+// pngReadICC returns the ICC profile stored in a PNG stream's iCCP chunk or
+// nil if there is none.
+func pngReadICC(r io.Reader) []byte {
+	if _, err := io.CopyN(ioutil.Discard, r, int64(len(pngSignature))); err != nil {
+		return nil
+	}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil
+		}
+		n := binary.BigEndian.Uint32(hdr[:4])
+		name := string(hdr[4:])
+		if name == "IDAT" || name == "IEND" || n > 1<<24 {
+			return nil
+		}
+		data := make([]byte, n+4) // Data plus CRC
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil
+		}
+		if name != "iCCP" {
+			continue
+		}
+
+		// An iCCP chunk holds a profile name, a NUL, a compression
+		// method (always 0, for zlib), and the compressed profile.
+		nul := bytes.IndexByte(data[:n], 0)
+		if nul < 0 || int(n) < nul+2 || data[nul+1] != 0 {
+			return nil
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(data[nul+2 : n]))
+		if err != nil {
+			return nil
+		}
+		prof, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return nil
+		}
+		return prof
+	}
+}
+
+// jpegReadICC returns the ICC profile stored in a JPEG stream's APP2
+// segments or nil if there is none.  A profile may be split across multiple
+// segments, each labeled with its sequence number.
+func jpegReadICC(r io.Reader) []byte {
+	const iccLabel = "ICC_PROFILE\x00"
+	if _, err := io.CopyN(ioutil.Discard, r, 2); err != nil {
+		return nil
+	}
+	chunks := make(map[int][]byte)
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil || hdr[0] != 0xFF {
+			break
+		}
+		marker := hdr[1]
+		if marker == 0xDA || marker == 0xD9 {
+			break // Start of scan or end of image
+		}
+		n := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if n < 0 {
+			break
+		}
+		seg := make([]byte, n)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			break
+		}
+		if marker == 0xE2 && len(seg) > len(iccLabel)+2 && string(seg[:len(iccLabel)]) == iccLabel {
+			chunks[int(seg[len(iccLabel)])] = seg[len(iccLabel)+2:]
+		}
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	seqs := make([]int, 0, len(chunks))
+	for s := range chunks {
+		seqs = append(seqs, s)
+	}
+	sort.Ints(seqs)
+	var prof []byte
+	for _, s := range seqs {
+		prof = append(prof, chunks[s]...)
+	}
+	return prof
+}
+
+// An iccProfile represents the parts of a matrix/TRC RGB ICC profile needed
+// to convert its colors to sRGB.
+type iccProfile struct {
+	Name   string                   // Profile description
+	Matrix [3][3]float64            // Linear RGB to D50 XYZ, with colorants as columns
+	TRCs   [3]func(float64) float64 // Tone reproduction curve of each of R, G, and B
+}
+
+// iccTagData returns the data of each tag in an ICC profile, keyed by
+// signature.
+func iccTagData(data []byte) (map[string][]byte, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("not an ICC profile")
+	}
+	be := binary.BigEndian
+	n := int(be.Uint32(data[128:]))
+	if 132+12*n > len(data) {
+		return nil, errors.New("truncated tag table")
+	}
+	tags := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		e := data[132+12*i:]
+		off, size := int(be.Uint32(e[4:])), int(be.Uint32(e[8:]))
+		if off < 0 || size < 0 || off+size > len(data) {
+			return nil, errors.New("tag lies outside the profile")
+		}
+		tags[string(e[:4])] = data[off : off+size]
+	}
+	return tags, nil
+}
+
+// iccS15 decodes an s15Fixed16Number.
+func iccS15(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536.0
+}
+
+// iccParseXYZ parses an XYZType tag.
+func iccParseXYZ(b []byte) ([3]float64, error) {
+	if len(b) < 20 || string(b[:4]) != "XYZ " {
+		return [3]float64{}, errors.New("malformed colorant tag")
+	}
+	return [3]float64{iccS15(b[8:]), iccS15(b[12:]), iccS15(b[16:])}, nil
+}
+
+// iccParseTRC parses a curveType or parametricCurveType tag and returns the
+// function it represents, which maps an encoded value in [0.0, 1.0] to a
+// linear value.
+func iccParseTRC(b []byte) (func(float64) float64, error) {
+	be := binary.BigEndian
+	if len(b) < 12 {
+		return nil, errors.New("malformed TRC tag")
+	}
+	switch string(b[:4]) {
+	case "curv":
+		n := int(be.Uint32(b[8:]))
+		if len(b) < 12+2*n {
+			return nil, errors.New("truncated curv tag")
+		}
+		switch n {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			g := float64(be.Uint16(b[12:])) / 256.0
+			return func(v float64) float64 { return math.Pow(math.Max(v, 0.0), g) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(be.Uint16(b[12+2*i:])) / 65535.0
+		}
+		return func(v float64) float64 {
+			t := clamp01(v) * float64(n-1)
+			i := int(t)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			return table[i] + (t-float64(i))*(table[i+1]-table[i])
+		}, nil
+	case "para":
+		nParams := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+		ft := be.Uint16(b[8:])
+		np, ok := nParams[ft]
+		if !ok || len(b) < 12+4*np {
+			return nil, errors.New("malformed para tag")
+		}
+		var q [7]float64
+		for i := 0; i < np; i++ {
+			q[i] = iccS15(b[12+4*i:])
+		}
+		g, a, bb, c, d, e, f := q[0], q[1], q[2], q[3], q[4], q[5], q[6]
+		pow := func(x float64) float64 { return math.Pow(math.Max(x, 0.0), g) }
+		switch ft {
+		case 0:
+			return pow, nil
+		case 1:
+			return func(x float64) float64 {
+				if x >= -bb/a {
+					return pow(a*x + bb)
+				}
+				return 0.0
+			}, nil
+		case 2:
+			return func(x float64) float64 {
+				if x >= -bb/a {
+					return pow(a*x+bb) + c
+				}
+				return c
+			}, nil
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return pow(a*x + bb)
+				}
+				return c * x
+			}, nil
+		default:
+			return func(x float64) float64 {
+				if x >= d {
+					return pow(a*x+bb) + e
+				}
+				return c*x + f
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported TRC type %q", string(b[:4]))
+}
+
+// iccParseDesc returns the text of a textDescriptionType (ICC v2) or
+// multiLocalizedUnicodeType (ICC v4) tag or "" if it cannot be parsed.
+func iccParseDesc(b []byte) string {
+	be := binary.BigEndian
+	switch {
+	case len(b) >= 12 && string(b[:4]) == "desc":
+		n := int(be.Uint32(b[8:]))
+		if len(b) < 12+n {
+			return ""
+		}
+		return strings.TrimRight(string(b[12:12+n]), "\x00")
+	case len(b) >= 28 && string(b[:4]) == "mluc":
+		n, off := int(be.Uint32(b[20:])), int(be.Uint32(b[24:]))
+		if off+n > len(b) {
+			return ""
+		}
+		u := make([]uint16, n/2)
+		for i := range u {
+			u[i] = be.Uint16(b[off+2*i:])
+		}
+		return string(utf16.Decode(u))
+	}
+	return ""
+}
+
+// parseICCProfile parses a matrix/TRC RGB ICC profile.
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	tags, err := iccTagData(data)
+	if err != nil {
+		return nil, err
+	}
+	if cs := string(data[16:20]); cs != "RGB " {
+		return nil, fmt.Errorf("unsupported color space %q", strings.TrimSpace(cs))
+	}
+	prof := &iccProfile{Name: iccParseDesc(tags["desc"])}
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		b, ok := tags[sig]
+		if !ok {
+			return nil, errors.New("not a matrix/TRC profile")
+		}
+		xyz, err := iccParseXYZ(b)
+		if err != nil {
+			return nil, err
+		}
+		for j := range xyz {
+			prof.Matrix[j][i] = xyz[j]
+		}
+	}
+	for i, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		b, ok := tags[sig]
+		if !ok {
+			return nil, errors.New("not a matrix/TRC profile")
+		}
+		if prof.TRCs[i], err = iccParseTRC(b); err != nil {
+			return nil, err
+		}
+	}
+	return prof, nil
+}
+
+// srgbMatrixD50 is the matrix from linear sRGB to D50 XYZ that sRGB ICC
+// profiles specify.
+var srgbMatrixD50 = [3][3]float64{
+	{0.436066, 0.385147, 0.143066},
+	{0.222488, 0.716873, 0.060608},
+	{0.013916, 0.097076, 0.714096},
+}
+
+// bradfordD50ToD65 adapts D50 XYZ colors to D65 using the Bradford transform.
+var bradfordD50ToD65 = [3][3]float64{
+	{0.9555766, -0.0230393, 0.0631636},
+	{-0.0282895, 1.0099416, 0.0210077},
+	{0.0122982, -0.0204830, 1.3299098},
+}
+
+// IsSRGB reports whether a profile describes sRGB, within a tolerance that
+// allows for the rounding of different vendors' sRGB profiles.
+func (prof *iccProfile) IsSRGB() bool {
+	const tol = 0.002
+	for i := range srgbMatrixD50 {
+		for j := range srgbMatrixD50[i] {
+			if math.Abs(prof.Matrix[i][j]-srgbMatrixD50[i][j]) > tol {
+				return false
+			}
+		}
+	}
+	for _, trc := range prof.TRCs {
+		for i := 0; i <= 64; i++ {
+			v := float64(i) / 64.0
+			lin, _, _ := colorful.Color{R: v}.LinearRgb()
+			if math.Abs(trc(v)-lin) > tol {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Convert returns a copy of an image, whose colors are encoded in the
+// profile's color space, with each color converted to sRGB.  Colors outside
+// the sRGB gamut are not clamped.  Alpha is left unchanged.
+func (prof *iccProfile) Convert(img image.Image) *NRGBA32f {
+	// Combine the profile's matrix, chromatic adaptation, and the
+	// conversion from D65 XYZ to linear sRGB.
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += bradfordD50ToD65[i][k] * prof.Matrix[k][j]
+			}
+		}
+	}
+
+	// Tabulate each TRC at 16-bit precision.
+	var luts [3][]float64
+	for c, trc := range prof.TRCs {
+		luts[c] = make([]float64, 65536)
+		for i := range luts[c] {
+			luts[c][i] = trc(float64(i) / 65535.0)
+		}
+	}
+
+	// Convert each pixel.
+	bnds := img.Bounds()
+	out := NewNRGBA32f(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			n := toNRGBA64(img.At(x, y))
+			r, g, b := luts[0][n.R], luts[1][n.G], luts[2][n.B]
+			clr := colorful.Xyz(
+				m[0][0]*r+m[0][1]*g+m[0][2]*b,
+				m[1][0]*r+m[1][1]*g+m[1][2]*b,
+				m[2][0]*r+m[2][1]*g+m[2][2]*b)
+			out.SetFloats(x, y, [4]float64{clr.R, clr.G, clr.B, float64(n.A) / 65535.0})
+		}
+	}
+	return out
+}
+
+// readColorImage reads a color image from a named file and, unless p.ICC is
+// "ignore", converts it from the color space described by its embedded ICC
+// profile, if any, to sRGB.  Unsupported profiles are reported and ignored.
+// readColorImage aborts on error.
+func readColorImage(p *Parameters, fn string) image.Image {
+	img := ReadImage(fn)
+	if p.ICC == "ignore" {
+		return img
+	}
+	if _, ok := img.(*NRGBA32f); ok {
+		return img // Floating-point formats carry no ICC profiles.
+	}
+	if prof := inputProfile(p, fn); prof != nil {
+		return prof.Convert(img)
+	}
+	return img
+}
+
+// inputProfile returns the ICC profile embedded in a named file if its colors
+// must be converted to sRGB as directed by p.ICC or nil if they need not be.
+func inputProfile(p *Parameters, fn string) *iccProfile {
+	if p.ICC == "ignore" {
+		return nil
+	}
+	data := ReadICCProfile(fn)
+	if data == nil {
+		return nil
+	}
+	prof, err := parseICCProfile(data)
+	if err != nil {
+		notify.Printf("%s: Ignoring embedded ICC profile (%s)", fn, err)
+		return nil
+	}
+	if prof.IsSRGB() {
+		return nil
+	}
+	return prof
+}
+
+// srgbCICP is the content of a PNG cICP chunk that identifies full-range sRGB:
+// BT.709 primaries, the sRGB transfer function, and no matrix coefficients.
+var srgbCICP = []byte{1, 13, 0, 1}
+
+// iccPutS15 encodes an s15Fixed16Number.
+func iccPutS15(b []byte, v float64) {
+	binary.BigEndian.PutUint32(b, uint32(int32(math.Round(v*65536.0))))
+}
+
+// iccXYZTag returns an XYZType tag holding a single XYZ value.
+func iccXYZTag(xyz [3]float64) []byte {
+	b := make([]byte, 20)
+	copy(b, "XYZ ")
+	for i, v := range xyz {
+		iccPutS15(b[8+4*i:], v)
+	}
+	return b
+}
+
+// iccDescTag returns a textDescriptionType tag holding a given ASCII string
+// and no Unicode or ScriptCode equivalents.
+func iccDescTag(text string) []byte {
+	b := make([]byte, 12+len(text)+1+4+4+2+1+67)
+	copy(b, "desc")
+	binary.BigEndian.PutUint32(b[8:], uint32(len(text)+1))
+	copy(b[12:], text)
+	return b
+}
+
+// srgbICCProfile returns a version 2 matrix/TRC ICC profile that describes
+// sRGB.
+func srgbICCProfile() []byte {
+	be := binary.BigEndian
+
+	// Construct each tag's data.
+	const nTRC = 1024
+	trc := make([]byte, 12+2*nTRC)
+	copy(trc, "curv")
+	be.PutUint32(trc[8:], nTRC)
+	for i := 0; i < nTRC; i++ {
+		lin, _, _ := colorful.Color{R: float64(i) / (nTRC - 1)}.LinearRgb()
+		be.PutUint16(trc[12+2*i:], uint16(math.Round(clamp01(lin)*65535.0)))
+	}
+	cprt := append([]byte("text\x00\x00\x00\x00"), "No copyright, use freely\x00"...)
+	var colorants [3][3]float64
+	for i := range colorants {
+		for j := range colorants[i] {
+			colorants[i][j] = srgbMatrixD50[j][i]
+		}
+	}
+	tags := []struct {
+		Sig  string
+		Data []byte
+	}{
+		{"desc", iccDescTag("sRGB (color-channels)")},
+		{"cprt", cprt},
+		{"wtpt", iccXYZTag([3]float64{0.9642, 1.0, 0.8249})},
+		{"rXYZ", iccXYZTag(colorants[0])},
+		{"gXYZ", iccXYZTag(colorants[1])},
+		{"bXYZ", iccXYZTag(colorants[2])},
+		{"rTRC", trc},
+		{"gTRC", trc},
+		{"bTRC", trc},
+	}
+
+	// Lay out the header, the tag table, and the tag data, padding each
+	// tag to a four-byte boundary.  The three TRC tags share their data.
+	prof := make([]byte, 132+12*len(tags))
+	offsets := make(map[string]int)
+	for i, t := range tags {
+		off, ok := offsets[string(t.Data)]
+		if !ok {
+			off = len(prof)
+			offsets[string(t.Data)] = off
+			prof = append(prof, t.Data...)
+			for len(prof)%4 != 0 {
+				prof = append(prof, 0)
+			}
+		}
+		e := prof[132+12*i:]
+		copy(e, t.Sig)
+		be.PutUint32(e[4:], uint32(off))
+		be.PutUint32(e[8:], uint32(len(t.Data)))
+	}
+	be.PutUint32(prof[0:], uint32(len(prof)))
+	be.PutUint32(prof[8:], 0x02100000) // Version 2.1
+	copy(prof[12:], "mntrRGB XYZ ")
+	copy(prof[36:], "acsp")
+	iccPutS15(prof[68:], 0.9642) // D50 illuminant
+	iccPutS15(prof[72:], 1.0)
+	iccPutS15(prof[76:], 0.8249)
+	be.PutUint32(prof[128:], uint32(len(tags)))
+	return prof
+}
+
+// srgbICCPChunk returns the content of a PNG iCCP chunk holding an sRGB ICC
+// profile.
+func srgbICCPChunk() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("sRGB\x00\x00") // Profile name and compression method
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(srgbICCProfile()); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// tagPNG returns a copy of an encoded PNG file that describes its colors as
+// sRGB, using an iCCP chunk, a cICP chunk, or both, as specified by
+// p.EmbedProfile.  It returns the data unmodified if img is not to be tagged.
+func tagPNG(data []byte, img image.Image, p *Parameters) ([]byte, error) {
+	var err error
+	if embedsCICP(p, img) {
+		data, err = pngInsertChunk(data, "cICP", srgbCICP)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if embedsICC(p, img) {
+		iccp, err := srgbICCPChunk()
+		if err != nil {
+			return nil, err
+		}
+		data, err = pngInsertChunk(data, "iCCP", iccp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,285 @@
+// This file tests the parsing of ICC profiles and their extraction from
+// image files.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+	"math"
+	"testing"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// TestICCSRGB verifies that the sRGB profile that color-channels embeds is
+// recognized as sRGB and that converting from it leaves colors nearly
+// unchanged.
+func TestICCSRGB(t *testing.T) {
+	prof, err := parseICCProfile(srgbICCProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prof.Name != "sRGB (color-channels)" {
+		t.Fatalf("expected the name %q but saw %q", "sRGB (color-channels)", prof.Name)
+	}
+	if !prof.IsSRGB() {
+		t.Fatal("failed to recognize the sRGB profile")
+	}
+	img := testColorImage(true)
+	checkImage(t, prof.Convert(img), img, 5e-3)
+
+	// Swapping the red and green colorants yields a profile that is
+	// not sRGB and that swaps red and green.
+	prof.Matrix[0][0], prof.Matrix[0][1] = prof.Matrix[0][1], prof.Matrix[0][0]
+	prof.Matrix[1][0], prof.Matrix[1][1] = prof.Matrix[1][1], prof.Matrix[1][0]
+	prof.Matrix[2][0], prof.Matrix[2][1] = prof.Matrix[2][1], prof.Matrix[2][0]
+	if prof.IsSRGB() {
+		t.Fatal("incorrectly recognized a modified profile as sRGB")
+	}
+	swapped := NewNRGBA32f(img.Bounds())
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 7; x++ {
+			v := img.FloatsAt(x, y)
+			swapped.SetFloats(x, y, [4]float64{v[1], v[0], v[2], v[3]})
+		}
+	}
+	checkImage(t, prof.Convert(img), swapped, 5e-3)
+}
+
+// TestICCTRC verifies the evaluation of each kind of tone reproduction
+// curve.
+func TestICCTRC(t *testing.T) {
+	s15 := func(vs ...float64) []byte {
+		b := make([]byte, 4*len(vs))
+		for i, v := range vs {
+			iccPutS15(b[4*i:], v)
+		}
+		return b
+	}
+	para := func(ft uint16, vs ...float64) []byte {
+		b := []byte("para\x00\x00\x00\x00\x00\x00\x00\x00")
+		binary.BigEndian.PutUint16(b[8:], ft)
+		return append(b, s15(vs...)...)
+	}
+	curv := func(vs ...uint16) []byte {
+		b := make([]byte, 12+2*len(vs))
+		copy(b, "curv")
+		binary.BigEndian.PutUint32(b[8:], uint32(len(vs)))
+		for i, v := range vs {
+			binary.BigEndian.PutUint16(b[12+2*i:], v)
+		}
+		return b
+	}
+	srgb := func(v float64) float64 {
+		lin, _, _ := colorful.Color{R: v}.LinearRgb()
+		return lin
+	}
+	for _, tc := range []struct {
+		name string
+		tag  []byte
+		want func(v float64) float64
+		tol  float64
+	}{
+		{"identity", curv(), func(v float64) float64 { return v }, 0.0},
+		{"gamma", curv(0x0200), func(v float64) float64 { return v * v }, 0.0},
+		{"table", curv(0, 0x4000, 0xffff), func(v float64) float64 {
+			if v < 0.5 {
+				return 2 * v * 0x4000 / 65535.0
+			}
+			return (0x4000 + 2*(v-0.5)*(0xffff-0x4000)) / 65535.0
+		}, 1e-12},
+		{"para 0", para(0, 2.0), func(v float64) float64 { return v * v }, 1e-12},
+		{"para 1", para(1, 1.0, 2.0, -0.5), func(v float64) float64 { return math.Max(2*v-0.5, 0.0) }, 1e-12},
+		{"para 2", para(2, 1.0, 2.0, -0.5, 0.25), func(v float64) float64 { return math.Max(2*v-0.5, 0.0) + 0.25 }, 1e-12},
+		{"para 3", para(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045), srgb, 1e-4},
+		{"para 4", para(4, 1.0, 0.5, 0.0, 0.0, 0.5, 0.125, 0.25), func(v float64) float64 {
+			if v >= 0.5 {
+				return 0.5*v + 0.125
+			}
+			return 0.25
+		}, 1e-12},
+	} {
+		trc, err := iccParseTRC(tc.tag)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		for i := 0; i <= 16; i++ {
+			v := float64(i) / 16.0
+			if got, want := trc(v), tc.want(v); math.Abs(got-want) > tc.tol {
+				t.Errorf("%s: mapping %g: expected %g but saw %g", tc.name, v, want, got)
+			}
+		}
+	}
+	for name, tag := range map[string][]byte{
+		"short":           []byte("curv\x00\x00\x00\x00"),
+		"bad type":        []byte("sf32\x00\x00\x00\x00\x00\x00\x00\x00"),
+		"truncated curv":  curv(0, 1, 2)[:15],
+		"huge curv":       append([]byte("curv\x00\x00\x00\x00\xff\xff\xff\xff"), 0, 0),
+		"bad para type":   para(5, 1, 2, 3, 4, 5, 6, 7),
+		"truncated para":  para(4, 1, 2, 3, 4, 5, 6),
+		"truncated gamma": append([]byte("para\x00\x00\x00\x00\x00\x00\x00\x00"), 0, 2),
+	} {
+		if _, err := iccParseTRC(tag); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// TestICCDesc verifies the parsing of both kinds of profile description.
+func TestICCDesc(t *testing.T) {
+	mluc := []byte("mluc\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x0cenUS\x00\x00\x00\x06\x00\x00\x00\x1c\x00A\x00b\x00c")
+	for _, tc := range []struct {
+		tag  []byte
+		want string
+	}{
+		{iccDescTag("Display P3"), "Display P3"},
+		{mluc, "Abc"},
+		{mluc[:len(mluc)-1], ""},
+		{iccDescTag("Display P3")[:15], ""},
+		{[]byte("text\x00\x00\x00\x00Abc"), ""},
+	} {
+		if got := iccParseDesc(tc.tag); got != tc.want {
+			t.Errorf("expected %q but saw %q", tc.want, got)
+		}
+	}
+}
+
+// iccParseSafely parses an ICC profile, converting a panic into a
+// panicError.
+func iccParseSafely(data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError{r}
+		}
+	}()
+	_, err = parseICCProfile(data)
+	return err
+}
+
+// TestICCMalformed verifies that parseICCProfile rejects corrupt profiles
+// without panicking.
+func TestICCMalformed(t *testing.T) {
+	data := srgbICCProfile()
+	nTags := int(binary.BigEndian.Uint32(data[128:]))
+	tagOfs := func(sig string) int {
+		for i := 0; i < nTags; i++ {
+			if e := 132 + 12*i; string(data[e:e+4]) == sig {
+				return e
+			}
+		}
+		t.Fatalf("no %s tag", sig)
+		return 0
+	}
+	be32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+	rXYZ := int(binary.BigEndian.Uint32(data[tagOfs("rXYZ")+4:]))
+	rTRC := int(binary.BigEndian.Uint32(data[tagOfs("rTRC")+4:]))
+	for name, p := range map[string]patch{
+		"not a profile":   {36, []byte("ACSP")},
+		"gray":            {16, []byte("GRAY")},
+		"huge tag count":  {128, be32(0xffffffff)},
+		"tag outside":     {tagOfs("bXYZ") + 4, be32(uint32(len(data)))},
+		"huge tag":        {tagOfs("bXYZ") + 8, be32(0xffffffff)},
+		"no rXYZ":         {tagOfs("rXYZ"), []byte("rXYY")},
+		"no gTRC":         {tagOfs("gTRC"), []byte("gTRD")},
+		"short XYZ":       {tagOfs("gXYZ") + 8, be32(19)},
+		"bad XYZ type":    {rXYZ, []byte("XYZZ")},
+		"bad TRC type":    {rTRC, []byte("mAB ")},
+		"huge TRC length": {rTRC + 8, be32(0x7fffffff)},
+	} {
+		mut := append([]byte(nil), data...)
+		copy(mut[p.Offset:], p.Data)
+		if err := iccParseSafely(mut); err == nil || isPanic(err) {
+			t.Errorf("%s: expected an error but saw %v", name, err)
+		}
+	}
+	for n := 0; n < len(data); n++ {
+		if err := iccParseSafely(data[:n]); isPanic(err) {
+			t.Fatalf("parsing the first %d of %d bytes: %v", n, len(data), err)
+		}
+	}
+	mut := make([]byte, len(data))
+	for i := 0; i < 132+12*nTags; i++ {
+		for _, v := range []byte{0x00, 0x01, 0x7f, 0x80, 0xff} {
+			copy(mut, data)
+			mut[i] = v
+			if err := iccParseSafely(mut); isPanic(err) {
+				t.Fatalf("setting byte %d to %#02x: %v", i, v, err)
+			}
+		}
+	}
+}
+
+// TestICCPNG verifies that pngReadICC extracts the profile that tagPNG
+// embeds and returns nil for files without a usable profile.
+func TestICCPNG(t *testing.T) {
+	img := testNRGBAImage(false)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+	tagged, err := tagPNG(plain, img, &Parameters{EmbedProfile: "both"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prof := pngReadICC(bytes.NewReader(tagged)); !bytes.Equal(prof, srgbICCProfile()) {
+		t.Fatal("failed to extract the embedded profile")
+	}
+	if prof := pngReadICC(bytes.NewReader(plain)); prof != nil {
+		t.Fatal("extracted a profile from a file without one")
+	}
+	for n := 0; n < len(tagged); n++ {
+		pngReadICC(bytes.NewReader(tagged[:n]))
+	}
+	iccp := bytes.Index(tagged, []byte("iCCP"))
+	for name, p := range map[string]patch{
+		"huge chunk":     {iccp - 4, []byte{0xff, 0xff, 0xff, 0xff}},
+		"no name end":    {iccp + 4, bytes.Repeat([]byte{'x'}, 200)},
+		"bad method":     {iccp + 4 + len("sRGB\x00"), []byte{1}},
+		"corrupt stream": {iccp + 4 + len("sRGB\x00\x00"), []byte("not zlib")},
+	} {
+		mut := append([]byte(nil), tagged...)
+		copy(mut[p.Offset:], p.Data)
+		if prof := pngReadICC(bytes.NewReader(mut)); prof != nil {
+			t.Errorf("%s: unexpectedly extracted a profile", name)
+		}
+	}
+}
+
+// jpegICCSegment returns a JPEG APP2 segment holding part of an ICC profile.
+func jpegICCSegment(seq, total int, data []byte) []byte {
+	seg := []byte{0xff, 0xe2, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(2+len("ICC_PROFILE\x00")+2+len(data)))
+	seg = append(seg, "ICC_PROFILE\x00"...)
+	seg = append(seg, byte(seq), byte(total))
+	return append(seg, data...)
+}
+
+// TestICCJPEG verifies that jpegReadICC reassembles a profile split across
+// several segments, regardless of their order.
+func TestICCJPEG(t *testing.T) {
+	prof := srgbICCProfile()
+	half := len(prof) / 2
+	var jpg []byte
+	jpg = append(jpg, 0xff, 0xd8)
+	jpg = append(jpg, 0xff, 0xe0, 0, 4, 'J', 'F')
+	jpg = append(jpg, jpegICCSegment(2, 2, prof[half:])...)
+	jpg = append(jpg, jpegICCSegment(1, 2, prof[:half])...)
+	jpg = append(jpg, 0xff, 0xda, 0, 2)
+	if got := jpegReadICC(bytes.NewReader(jpg)); !bytes.Equal(got, prof) {
+		t.Fatal("failed to reassemble the embedded profile")
+	}
+	for n := 0; n < len(jpg); n++ {
+		jpegReadICC(bytes.NewReader(jpg[:n]))
+	}
+	if got := jpegReadICC(bytes.NewReader([]byte{0xff, 0xd8, 0xff, 0xe2, 0, 1})); got != nil {
+		t.Fatal("extracted a profile from a malformed segment")
+	}
+}
@@ -3,17 +3,281 @@
 package main
 
 import (
+	"bytes"
 	"image"
+	"image/color"
+	"image/draw"
 	_ "image/gif"
 	_ "image/jpeg"
 	"image/png"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
-	_ "github.com/spakin/netpbm"
+	"github.com/spakin/netpbm"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
 )
 
-// ReadImage reads an arbitrary image from a named file.  It aborts on error.
+// An imageEncoder is a function that encodes an image in a particular file
+// format.
+type imageEncoder func(w io.Writer, img image.Image, p *Parameters) error
+
+// An outputFormat describes how to write an image in a particular file
+// format.
+type outputFormat struct {
+	Exts   []string     // Lowercase filename extensions, including the leading "."
+	Encode imageEncoder // Function that encodes an image in the given format
+	Float  bool         // true: format can store floating-point pixels; false: pixels must be quantized
+	Max8   bool         // true: format stores at most 8 bits per sample; false: format can store more
+
+	// Bundle, if non-nil, writes all split channels to a single file.
+	Bundle func(w io.Writer, infos []ImageInfo, p *Parameters) error
+
+	// Animate, if non-nil, writes a multi-frame animation.
+	Animate func(w io.Writer, anim *Animation, p *Parameters) error
+}
+
+// ignoreParams adapts an encoder that accepts no parameters to an
+// imageEncoder.
+func ignoreParams(enc func(w io.Writer, img image.Image) error) imageEncoder {
+	return func(w io.Writer, img image.Image, p *Parameters) error {
+		return enc(w, img)
+	}
+}
+
+// outputFormats maps a lowercase format name to a description of that format.
+var outputFormats = map[string]outputFormat{
+	"png": {
+		Exts:    []string{".png", ".apng"},
+		Encode:  encodePNG,
+		Animate: writeAPNGAnimation,
+	},
+	"gif": {
+		Exts:    []string{".gif"},
+		Encode:  ignoreParams(encodeGIF),
+		Animate: writeGIFAnimation,
+		Max8:    true,
+	},
+	"tsv": {
+		Exts:   []string{".tsv"},
+		Encode: encodeTSV,
+		Float:  true,
+	},
+	"tiff": {
+		Exts:   []string{".tif", ".tiff"},
+		Encode: encodeTIFF,
+	},
+	"bmp": {
+		Exts:   []string{".bmp"},
+		Encode: ignoreParams(encodeBMP),
+		Max8:   true,
+	},
+	"csv": {
+		Exts:   []string{".csv"},
+		Encode: encodeCSV,
+		Float:  true,
+	},
+	"dpx": {
+		Exts:   []string{".dpx"},
+		Encode: ignoreParams(EncodeDPX),
+	},
+	"exr": {
+		Exts:   []string{".exr"},
+		Encode: ignoreParams(EncodeEXR),
+		Float:  true,
+	},
+	"qoi": {
+		Exts:   []string{".qoi"},
+		Encode: ignoreParams(EncodeQOI),
+		Max8:   true,
+	},
+	"fits": {
+		Exts:   []string{".fits", ".fit", ".fts"},
+		Encode: ignoreParams(EncodeFITS),
+		Float:  true,
+	},
+	"npy": {
+		Exts:   []string{".npy"},
+		Encode: ignoreParams(EncodeNPY),
+		Float:  true,
+	},
+	"npz": {
+		Exts:   []string{".npz"},
+		Encode: encodeNPZ,
+		Float:  true,
+		Bundle: writeNPZ,
+	},
+	"raw": {
+		Exts:   []string{".raw"},
+		Encode: encodeRaw,
+		Float:  true,
+	},
+	"pgm": {
+		Exts:   []string{".pgm"},
+		Encode: netpbmEncoder(netpbm.PGM),
+	},
+	"ppm": {
+		Exts:   []string{".ppm"},
+		Encode: netpbmEncoder(netpbm.PPM),
+	},
+	"pam": {
+		Exts:   []string{".pam"},
+		Encode: netpbmEncoder(netpbm.PAM),
+	},
+	"pnm": {
+		Exts:   []string{".pnm"},
+		Encode: netpbmEncoder(netpbm.PNM),
+	},
+	"zip": {
+		Exts:   []string{".zip"},
+		Encode: encodeZip,
+		Bundle: writeZip,
+	},
+	"y4m": {
+		Exts:    []string{".y4m"},
+		Encode:  ignoreParams(encodeY4M),
+		Animate: writeY4MAnimation,
+	},
+	"pfm": {
+		Exts:   []string{".pfm"},
+		Encode: ignoreParams(EncodePFM),
+		Float:  true,
+	},
+}
+
+// defaultOutputFormat is the name of the output format to use when neither
+// --format nor the output filename's extension designates a format.
+const defaultOutputFormat = "png"
+
+// outputFormatNames returns a sorted list of all valid output-format names.
+func outputFormatNames() []string {
+	names := make([]string, 0, len(outputFormats))
+	for nm := range outputFormats {
+		names = append(names, nm)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pngCompressionLevels maps each valid --png-compression argument to a PNG
+// compression level.
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"default": png.DefaultCompression,
+	"best":    png.BestCompression,
+}
+
+// encodePNG writes an image in PNG format, honoring the PNG-specific
+// compression and interlacing parameters.  Color images are tagged as sRGB
+// as specified by p.EmbedProfile.
+func encodePNG(w io.Writer, img image.Image, p *Parameters) error {
+	level := pngCompressionLevels[p.PNGCompression]
+	if !embedsICC(p, img) && !embedsCICP(p, img) {
+		if p.PNGInterlace {
+			return EncodeInterlacedPNG(w, img, level)
+		}
+		enc := png.Encoder{CompressionLevel: level}
+		return enc.Encode(w, img)
+	}
+	var buf bytes.Buffer
+	var err error
+	if p.PNGInterlace {
+		err = EncodeInterlacedPNG(&buf, img, level)
+	} else {
+		enc := png.Encoder{CompressionLevel: level}
+		err = enc.Encode(&buf, img)
+	}
+	if err != nil {
+		return err
+	}
+	data, err := tagPNG(buf.Bytes(), img, p)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// encodeTIFF writes an image in TIFF format.  Grayscale images are written
+// as 16-bit grayscale, and color images are written as 8-bit or 16-bit RGBA,
+// as appropriate.  Any GeoTIFF tags read from the input are included in the
+// output, and color images are tagged with an sRGB ICC profile as specified
+// by p.EmbedProfile.
+func encodeTIFF(w io.Writer, img image.Image, p *Parameters) error {
+	tags := p.GeoTags
+	if embedsICC(p, img) {
+		prof := srgbICCProfile()
+		tags = append(tags[:len(tags):len(tags)],
+			tiffTag{ID: tiffICCTag, Type: 7, Count: uint32(len(prof)), Data: prof})
+	}
+	if len(tags) == 0 {
+		return tiff.Encode(w, img, nil)
+	}
+	var buf bytes.Buffer
+	err := tiff.Encode(&buf, img, nil)
+	if err != nil {
+		return err
+	}
+	data, err := addTIFFTags(buf.Bytes(), tags)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// encodeBMP writes an image in BMP format.  BMP supports only 8 bits per
+// channel so grayscale images are written as 8-bit grayscale and color images
+// are written as 8-bit RGB or, if not opaque, 8-bit RGBA.
+func encodeBMP(w io.Writer, img image.Image) error {
+	var dst draw.Image
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		dst = image.NewGray(img.Bounds())
+	default:
+		dst = image.NewNRGBA(img.Bounds())
+	}
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return bmp.Encode(w, dst)
+}
+
+// netpbmEncoder returns an imageEncoder that writes an image in a given
+// Netpbm format with 16 bits per channel.  Grayscale images are written with
+// a GRAYSCALE tuple type and color images with an RGB tuple type or, if not
+// opaque, an RGB_ALPHA tuple type.  Given netpbm.PNM, the encoder selects PGM,
+// PPM, or PAM based on the tuple type.
+func netpbmEncoder(f netpbm.Format) imageEncoder {
+	return func(w io.Writer, img image.Image, p *Parameters) error {
+		tt := "RGB_ALPHA"
+		switch img.ColorModel() {
+		case color.GrayModel, color.Gray16Model:
+			tt = "GRAYSCALE"
+		default:
+			if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+				tt = "RGB"
+			}
+		}
+		maxVal := uint16(65535)
+		switch img.ColorModel() {
+		case color.GrayModel, color.NRGBAModel, color.RGBAModel:
+			maxVal = 255
+		}
+		return netpbm.Encode(w, img, &netpbm.EncodeOptions{
+			Format:    f,
+			MaxValue:  maxVal,
+			TupleType: tt,
+		})
+	}
+}
+
+// ReadImage reads an arbitrary image from a named file.  The image can be in
+// any format registered with the image package: PNG, JPEG, GIF, TIFF, BMP,
+// QOI, DPX, FITS, OpenEXR, PFM, Radiance HDR, PSD, y4m, or any of the Netpbm
+// formats.  It aborts on error.
 func ReadImage(fn string) image.Image {
 	// Read the input image.
 	r, err := os.Open(fn)
@@ -28,15 +292,79 @@ func ReadImage(fn string) image.Image {
 	return img
 }
 
+// spoolStdin copies the standard input device to a temporary file so that
+// functions that expect a named, seekable file can read it.  It returns the
+// file's name and a function that removes the file.  spoolStdin aborts on
+// error.
+func spoolStdin() (string, func()) {
+	f, err := os.CreateTemp("", "color-channels-*")
+	if err != nil {
+		notify.Fatal(err)
+	}
+	defer f.Close()
+	remove := func() { os.Remove(f.Name()) }
+	if _, err = io.Copy(f, os.Stdin); err != nil {
+		remove()
+		notify.Fatalf("standard input: %s", err)
+	}
+	return f.Name(), remove
+}
+
+// readBytes reads exactly n bytes from r.  Unlike io.ReadFull into an n-byte
+// buffer, readBytes allocates memory only as data arrive so that a corrupt
+// header claiming an enormous image cannot exhaust memory before the file runs
+// out.  readBytes returns io.ErrUnexpectedEOF if r holds fewer than n bytes.
+func readBytes(r io.Reader, n int64) ([]byte, error) {
+	var buf bytes.Buffer
+	m, err := io.CopyN(&buf, r, n)
+	if m < n {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // ReadGrayscaleImage reads a grayscale image from a named file.  It aborts on
 // error.
-func ReadGrayscaleImage(fn string) *image.Gray16 {
-	// Read a generic image.
-	img := ReadImage(fn)
+func ReadGrayscaleImage(fn string) *Gray32f {
+	// Read a generic image.  Return floating-point grayscale images as is.
+	// 16-bit grayscale images (as produced by, e.g., ImageJ or Photoshop
+	// TIFF exports) are converted without loss of precision.
+	return toGray32f(ReadImage(fn))
+}
 
-	// Convert the image to grayscale.
+// toGray32f converts an arbitrary image to a Gray32f.  A Gray32f is returned
+// as is.
+func toGray32f(img image.Image) *Gray32f {
 	bnds := img.Bounds()
-	gray := image.NewGray16(bnds)
+	gray := NewGray32f(bnds)
+	w := bnds.Dx()
+	switch m := img.(type) {
+	case *Gray32f:
+		return m
+	case *image.Gray:
+		// Read the common 8- and 16-bit grayscale formats directly
+		// from their pixel buffers.
+		for y := 0; y < bnds.Dy(); y++ {
+			src := m.Pix[y*m.Stride : y*m.Stride+w]
+			dst := gray.Pix[y*gray.Stride : y*gray.Stride+w]
+			for x, v := range src {
+				dst[x] = float32(float64(v) / 255.0)
+			}
+		}
+		return gray
+	case *image.Gray16:
+		for y := 0; y < bnds.Dy(); y++ {
+			src := m.Pix[y*m.Stride : y*m.Stride+2*w]
+			dst := gray.Pix[y*gray.Stride : y*gray.Stride+w]
+			for x := range dst {
+				dst[x] = float32(float64(uint16(src[2*x])<<8|uint16(src[2*x+1])) / 65535.0)
+			}
+		}
+		return gray
+	}
 	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
 		for x := bnds.Min.X; x < bnds.Max.X; x++ {
 			gray.Set(x, y, img.At(x, y))
@@ -45,9 +373,79 @@ func ReadGrayscaleImage(fn string) *image.Gray16 {
 	return gray
 }
 
-// WritePNG writes an arbitrary image to a named PNG file.  If the file is "",
-// write to standard output.
-func WritePNG(fn string, img image.Image) error {
+// selectOutputFormat returns the name of the format in which to write a named
+// file.  An explicitly specified format takes precedence over the filename's
+// extension.  If neither designates a known format, the default format is
+// used.
+func selectOutputFormat(fn, format string) string {
+	if format != "" {
+		return format
+	}
+	ext := strings.ToLower(filepath.Ext(fn))
+	for nm, of := range outputFormats {
+		for _, e := range of.Exts {
+			if ext == e {
+				return nm
+			}
+		}
+	}
+	return defaultOutputFormat
+}
+
+// WriteImage writes an arbitrary image to a named file.  If the file is "",
+// write to standard output.  The file format is taken from p.Format or, if
+// that is empty, from the filename's extension.
+func WriteImage(p *Parameters, fn string, img image.Image) error {
+	return writeAnnotatedImage(p, fn, img, nil)
+}
+
+// writeAnnotatedImage writes an image to a named file, as does WriteImage.
+// If the output format is PNG, each key-value pair in text is additionally
+// stored in a tEXt chunk.  Other formats ignore text.
+func writeAnnotatedImage(p *Parameters, fn string, img image.Image, text map[string]string) error {
+	ofName := selectOutputFormat(fn, p.Format)
+	of := outputFormats[ofName]
+	m, rows := img.(*NRGBA32f)
+	rows = rows && ofName == "png" && !p.PNGInterlace && (p.Depth == "" || p.Depth == "16")
+	switch {
+	case rows:
+		// Encode floating-point color images, typically large merged
+		// images, one row at a time rather than first quantizing the
+		// entire image.
+		of.Encode = func(w io.Writer, img image.Image, p *Parameters) error {
+			return encodePNGRows(w, m, p, text)
+		}
+	case len(text) > 0 && ofName == "png":
+		of.Encode = func(w io.Writer, img image.Image, p *Parameters) error {
+			var buf bytes.Buffer
+			err := encodePNG(&buf, img, p)
+			if err != nil {
+				return err
+			}
+			data := buf.Bytes()
+			keys := make([]string, 0, len(text))
+			for k := range text {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				data, err = pngInsertText(data, k, text[k])
+				if err != nil {
+					return err
+				}
+			}
+			_, err = w.Write(data)
+			return err
+		}
+	}
+	orig := img
+	if !rows {
+		var err error
+		img, err = convertDepth(img, p, of)
+		if err != nil {
+			return err
+		}
+	}
 	var w io.Writer = os.Stdout
 	if fn != "" {
 		f, err := os.Create(fn)
@@ -57,9 +455,35 @@ func WritePNG(fn string, img image.Image) error {
 		defer f.Close()
 		w = f
 	}
-	err := png.Encode(w, img)
-	if err != nil {
-		return err
+	err := of.Encode(w, img, p)
+	releaseQuantized(orig, img)
+	return err
+}
+
+// WriteBundle writes a set of channel images to a single named file using a
+// format that supports bundling.  If the file is "", write to standard
+// output.
+func WriteBundle(p *Parameters, fn string, infos []ImageInfo) error {
+	of := outputFormats[selectOutputFormat(fn, p.Format)]
+	conv := make([]ImageInfo, len(infos))
+	for i, info := range infos {
+		// Quantize each channel to the requested depth but continue
+		// to represent it as a Gray32f.
+		img, err := convertDepth(info.Image, p, of)
+		if err != nil {
+			return err
+		}
+		conv[i] = info
+		conv[i].Image = toGray32f(img)
+	}
+	var w io.Writer = os.Stdout
+	if fn != "" {
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
 	}
-	return nil
+	return of.Bundle(w, conv, p)
 }
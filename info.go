@@ -0,0 +1,336 @@
+// This file provides a mode that describes input images without converting
+// them, which helps diagnose unexpected split or merge results.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// describePixels returns a description of an image's pixel format and bit
+// depth and reports whether the image has an alpha channel.
+func describePixels(img image.Image) (format, depth string, alpha bool) {
+	switch img := img.(type) {
+	case *PSDImage:
+		return describePixels(img.Image)
+	case *image.Gray:
+		return "grayscale", "8 bits", false
+	case *image.Gray16:
+		return "grayscale", "16 bits", false
+	case *Gray32f:
+		return "grayscale", "32-bit floating point", false
+	case *image.Alpha:
+		return "alpha only", "8 bits", true
+	case *image.Alpha16:
+		return "alpha only", "16 bits", true
+	case *image.RGBA:
+		return "premultiplied RGBA", "8 bits", true
+	case *image.RGBA64:
+		return "premultiplied RGBA", "16 bits", true
+	case *image.NRGBA:
+		return "RGBA", "8 bits", true
+	case *image.NRGBA64:
+		return "RGBA", "16 bits", true
+	case *NRGBA32f:
+		return "RGBA", "32-bit floating point", true
+	case *image.CMYK:
+		return "CMYK", "8 bits", false
+	case *image.YCbCr:
+		return "Y'CbCr " + subsampleString(img.SubsampleRatio), "8 bits", false
+	case *image.NYCbCrA:
+		return "Y'CbCr " + subsampleString(img.SubsampleRatio) + " plus alpha", "8 bits", true
+	case *image.Paletted:
+		for _, c := range img.Palette {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				alpha = true
+				break
+			}
+		}
+		return fmt.Sprintf("paletted (%d colors)", len(img.Palette)), "8 bits", alpha
+	}
+
+	// Fall back to describing the color model.
+	switch img.ColorModel() {
+	case color.GrayModel:
+		return "grayscale", "8 bits", false
+	case color.Gray16Model:
+		return "grayscale", "16 bits", false
+	case color.NRGBA64Model, color.RGBA64Model:
+		return "RGBA", "16 bits", true
+	default:
+		return fmt.Sprintf("%T", img), "unknown", true
+	}
+}
+
+// subsampleString returns a Y'CbCr subsampling ratio in J:a:b notation.
+func subsampleString(r image.YCbCrSubsampleRatio) string {
+	digits := strings.TrimPrefix(r.String(), "YCbCrSubsampleRatio")
+	if len(digits) != 3 {
+		return digits
+	}
+	return digits[:1] + ":" + digits[1:2] + ":" + digits[2:]
+}
+
+// readPNGMetadata returns the ICC profile and EXIF data, if any, stored in
+// PNG data.
+func readPNGMetadata(data []byte) (icc, exif []byte) {
+	for pos := 8; pos+12 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		if n < 0 || pos+12+n > len(data) {
+			break
+		}
+		body := data[pos+8 : pos+8+n]
+		switch typ {
+		case "iCCP":
+			// The profile follows a NUL-terminated name and a
+			// compression-method byte.
+			if nul := bytes.IndexByte(body, 0); nul >= 0 && nul+2 <= len(body) {
+				zr, err := zlib.NewReader(bytes.NewReader(body[nul+2:]))
+				if err == nil {
+					icc, _ = io.ReadAll(zr)
+				}
+			}
+		case "eXIf":
+			exif = body
+		case "IDAT", "IEND":
+			return
+		}
+		pos += 12 + n
+	}
+	return
+}
+
+// readJPEGMetadata returns the ICC profile and EXIF data, if any, stored in
+// JPEG data.
+func readJPEGMetadata(data []byte) (icc, exif []byte) {
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break // Start of scan or end of image
+		}
+		n := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if n < 2 || pos+2+n > len(data) {
+			break
+		}
+		body := data[pos+4 : pos+2+n]
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(body, []byte("Exif\x00\x00")):
+			exif = body[6:]
+		case marker == 0xE2 && bytes.HasPrefix(body, []byte("ICC_PROFILE\x00")) && len(body) >= 14:
+			// Profiles may be split across multiple APP2
+			// segments, which appear in order in practice.
+			icc = append(icc, body[14:]...)
+		}
+		pos += 2 + n
+	}
+	return
+}
+
+// readMetadata returns the ICC profile and EXIF data, if any, stored in a
+// PNG, JPEG, or TIFF file's contents.
+func readMetadata(data []byte) (icc, exif []byte) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return readPNGMetadata(data)
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return readJPEGMetadata(data)
+	case bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")):
+		tags, err := readTIFFTags(bytes.NewReader(data), func(id uint16) bool { return id == 34675 })
+		if err == nil && len(tags) > 0 {
+			icc = tags[0].Data
+		}
+		return icc, data
+	}
+	return nil, nil
+}
+
+// describeICC summarizes an ICC profile.
+func describeICC(icc []byte) string {
+	if len(icc) < 132 {
+		return fmt.Sprintf("invalid (%d bytes)", len(icc))
+	}
+	version := fmt.Sprintf("v%d.%d", icc[8], icc[9]>>4)
+	class := strings.TrimSpace(string(icc[12:16]))
+	space := strings.TrimSpace(string(icc[16:20]))
+	summary := fmt.Sprintf("%s, class %s, color space %s, %d bytes", version, class, space, len(icc))
+
+	// Look for a profile description.
+	nTags := int(binary.BigEndian.Uint32(icc[128:]))
+	for i := 0; i < nTags && 132+12*(i+1) <= len(icc); i++ {
+		e := icc[132+12*i:]
+		if string(e[:4]) != "desc" {
+			continue
+		}
+		off := int(binary.BigEndian.Uint32(e[4:]))
+		size := int(binary.BigEndian.Uint32(e[8:]))
+		if off < 0 || size < 12 || off+size > len(icc) {
+			break
+		}
+		if desc := iccText(icc[off : off+size]); desc != "" {
+			return fmt.Sprintf("%q (%s)", desc, summary)
+		}
+	}
+	return summary
+}
+
+// iccText extracts the text from an ICC textDescriptionType or
+// multiLocalizedUnicodeType tag.  It returns "" if the text cannot be
+// extracted.
+func iccText(tag []byte) string {
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n < 0 || 12+n > len(tag) {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+n]), "\x00")
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+		n := int(binary.BigEndian.Uint32(tag[20:]))
+		off := int(binary.BigEndian.Uint32(tag[24:]))
+		if n < 0 || off < 0 || off+n > len(tag) {
+			return ""
+		}
+		u := make([]uint16, n/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(tag[off+2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+	}
+	return ""
+}
+
+// exifFields lists the EXIF (TIFF) tags to summarize, in output order.
+var exifFields = []struct {
+	ID   uint16
+	Name string
+}{
+	{271, "Make"},
+	{272, "Model"},
+	{305, "Software"},
+	{306, "DateTime"},
+	{274, "Orientation"},
+}
+
+// describeEXIF summarizes EXIF data.  It returns "" if the data contain none
+// of the fields of interest.
+func describeEXIF(exif []byte) string {
+	want := make(map[uint16]bool, len(exifFields))
+	for _, f := range exifFields {
+		want[f.ID] = true
+	}
+	tags, err := readTIFFTags(bytes.NewReader(exif), func(id uint16) bool { return want[id] })
+	if err != nil {
+		return ""
+	}
+	var fields []string
+	for _, f := range exifFields {
+		for _, t := range tags {
+			if t.ID != f.ID {
+				continue
+			}
+			switch {
+			case t.Type == 2:
+				fields = append(fields, fmt.Sprintf("%s=%q", f.Name, strings.TrimRight(string(t.Data), "\x00 ")))
+			case t.Type == 3 && len(t.Data) >= 2:
+				fields = append(fields, fmt.Sprintf("%s=%d", f.Name, binary.LittleEndian.Uint16(t.Data)))
+			}
+		}
+	}
+	return strings.Join(fields, ", ")
+}
+
+// describeImage writes a description of a named image file to a given
+// writer.  It aborts on error.
+func describeImage(w io.Writer, fn string) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		notify.Fatalf("%s: %s", fn, err)
+	}
+	pixFmt, depth, alpha := describePixels(img)
+	bnds := img.Bounds()
+	fmt.Fprintf(w, "%s:\n", fn)
+	fmt.Fprintf(w, "  Format:      %s\n", format)
+	fmt.Fprintf(w, "  Dimensions:  %dx%d\n", bnds.Dx(), bnds.Dy())
+	fmt.Fprintf(w, "  Pixels:      %s\n", pixFmt)
+	fmt.Fprintf(w, "  Bit depth:   %s per channel\n", depth)
+	switch {
+	case !alpha:
+		fmt.Fprintf(w, "  Alpha:       no\n")
+	case isOpaque(img):
+		fmt.Fprintf(w, "  Alpha:       yes (all pixels opaque)\n")
+	default:
+		fmt.Fprintf(w, "  Alpha:       yes\n")
+	}
+	if ex, ok := img.(interface{ ExtraChannels() []ImageInfo }); ok {
+		var names []string
+		for _, info := range ex.ExtraChannels() {
+			names = append(names, info.Name)
+		}
+		if len(names) > 0 {
+			fmt.Fprintf(w, "  Extra:       %s\n", strings.Join(names, ", "))
+		}
+	}
+	if anim := ReadAnimation(fn); anim != nil {
+		fmt.Fprintf(w, "  Frames:      %d\n", len(anim.Frames))
+	}
+	icc, exif := readMetadata(data)
+	if icc != nil {
+		fmt.Fprintf(w, "  ICC profile: %s\n", describeICC(icc))
+	}
+	if exif != nil {
+		if desc := describeEXIF(exif); desc != "" {
+			fmt.Fprintf(w, "  EXIF:        %s\n", desc)
+		}
+	}
+	if geo := ReadGeoTags(fn); geo != nil {
+		fmt.Fprintf(w, "  GeoTIFF:     %d tags\n", len(geo))
+	}
+}
+
+// isOpaque reports whether every pixel of an image is fully opaque.
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	bnds := img.Bounds()
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// describeImages writes a description of each input file to the standard
+// output as directed by a set of parameters.  It aborts on error.
+func describeImages(p *Parameters) error {
+	if len(p.InputNames) == 0 {
+		notify.Fatal("--info requires at least one input file")
+	}
+	for i, fn := range p.InputNames {
+		if i > 0 {
+			fmt.Println()
+		}
+		describeImage(os.Stdout, fn)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// This file provides support for expanding glob patterns and directories
+// named on the command line into lists of input files.  This benefits
+// primarily users whose shells do not expand wildcards.
+
+package main
+
+import (
+	"image"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isImageFile reports whether a named file's contents are in a recognized
+// image format.
+func isImageFile(fn string) bool {
+	f, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, _, err = image.DecodeConfig(f)
+	return err == nil
+}
+
+// listFiles returns the names of all files in a directory that satisfy a
+// given predicate, in lexical order, skipping hidden files.  If recursive is
+// true, the directory's subdirectories are searched as well.
+func listFiles(dir string, recursive bool, keep func(fn string) bool) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(dir, func(fn string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if fn != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case d.IsDir() && fn != dir && !recursive:
+			return filepath.SkipDir
+		case d.Type().IsRegular() && keep(fn):
+			names = append(names, fn)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// expandDirectory returns the names of all image files in a directory, in
+// lexical order, skipping hidden files.  If recursive is true, the
+// directory's subdirectories are searched as well.  expandDirectory aborts on
+// error.
+func expandDirectory(dir string, recursive bool) []string {
+	names, err := listFiles(dir, recursive, isImageFile)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	if len(names) == 0 {
+		notify.Fatalf("%s: Directory contains no image files", dir)
+	}
+	return names
+}
+
+// expandInputs expands each glob pattern in a list of input filenames into
+// the names of the files it matches and each directory into the names of the
+// image files it contains, searching subdirectories if recursive is true.
+// Names of existing files, including those containing glob metacharacters,
+// are retained as is, as are image-sequence templates.  expandInputs aborts
+// on error.
+func expandInputs(names []string, recursive bool) []string {
+	var result []string
+	for _, fn := range names {
+		st, err := os.Stat(fn)
+		switch {
+		case err == nil && st.IsDir():
+			result = append(result, expandDirectory(fn, recursive)...)
+		case err == nil || !strings.ContainsAny(fn, "*?["):
+			result = append(result, fn)
+		default:
+			matches, err := filepath.Glob(fn)
+			if err != nil {
+				notify.Fatalf("%s: %s", fn, err)
+			}
+			if len(matches) == 0 {
+				notify.Fatalf("No files match %s", fn)
+			}
+			for _, m := range matches {
+				if st, err := os.Stat(m); err == nil && st.IsDir() {
+					result = append(result, expandDirectory(m, recursive)...)
+				} else {
+					result = append(result, m)
+				}
+			}
+		}
+	}
+	return result
+}
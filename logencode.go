@@ -0,0 +1,232 @@
+// This file provides support for encoding channels logarithmically, which
+// lets high-dynamic-range lightness or luminance channels be stored in 16-bit
+// files without crushing highlights.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// A logScale describes a logarithmic encoding, which maps a channel value v
+// to log2(1 + v/Black)/Stops.  Values near zero are thus encoded nearly
+// linearly, and values much larger than Black are encoded logarithmically,
+// with a value of Black*(2^Stops - 1) mapped to 1.0.
+type logScale struct {
+	Black float64 `json:"black"` // Value at which the encoding turns from linear to logarithmic
+	Stops float64 `json:"stops"` // Number of doublings above Black represented
+}
+
+// logTextKey is the keyword of the PNG tEXt chunk in which a split channel's
+// logarithmic encoding is recorded.
+const logTextKey = "color-channels:log"
+
+// logChannelNames maps a color space to the names of the channels that
+// --encode=log encodes: those that represent lightness or luminance or, for
+// RGB color spaces, all color channels.
+var logChannelNames = map[string][]string{
+	"hcl":    {"L"},
+	"lab":    {"L"},
+	"luv":    {"L"},
+	"hsl":    {"L"},
+	"hsluv":  {"L"},
+	"xyy":    {"YY"},
+	"xyz":    {"X", "Y", "Z"},
+	"linrgb": {"R", "G", "B"},
+	"rgb":    {"R", "G", "B"},
+	"srgb":   {"R", "G", "B"},
+	"ycbcr":  {"Y"},
+}
+
+// Encode maps a channel value to its logarithmic encoding.  Negative values
+// are encoded symmetrically.
+func (ls *logScale) Encode(v float64) float64 {
+	return math.Copysign(math.Log2(1.0+math.Abs(v)/ls.Black)/ls.Stops, v)
+}
+
+// Decode maps a logarithmically encoded value back to a channel value.
+func (ls *logScale) Decode(e float64) float64 {
+	return math.Copysign(ls.Black*(math.Exp2(math.Abs(e)*ls.Stops)-1.0), e)
+}
+
+// parseLogScales returns, for each channel in channel order, the logarithmic
+// encoding that --encode=log applies, or nil for channels left linear.
+// parseLogScales aborts on error.
+func parseLogScales(p *Parameters, encode string, black, stops float64) []*logScale {
+	switch strings.ToLower(encode) {
+	case "linear":
+		return nil
+	case "log":
+	default:
+		notify.Fatalf(`--encode requires either "linear" or "log" (not %q)`, encode)
+	}
+	if !(black > 0.0) || math.IsInf(black, 0) {
+		notify.Fatalf("--log-black must be positive (not %g)", black)
+	}
+	if !(stops > 0.0) || math.IsInf(stops, 0) {
+		notify.Fatalf("--log-stops must be positive (not %g)", stops)
+	}
+	names, ok := logChannelNames[p.ColorSpace]
+	if !ok {
+		notify.Fatalf("--encode=log is not supported for --space=%q", p.OrigColorSpace)
+	}
+	scales := make([]*logScale, len(builtinChannelNames(p)))
+	for _, nm := range names {
+		ch := channelIndex(p, nm)
+		if p.Ranges != nil && p.Ranges[ch] != defaultRanges(p)[ch] {
+			notify.Fatalf("--range and --encode=log cannot both apply to channel %s", nm)
+		}
+		scales[ch] = &logScale{Black: black, Stops: stops}
+	}
+	return scales
+}
+
+// channelLogScale returns the logarithmic encoding for the channel with a
+// given built-in name or nil if the channel is encoded linearly.
+func channelLogScale(p *Parameters, name string) *logScale {
+	for ch, nm := range builtinChannelNames(p) {
+		if nm == name && ch < len(p.LogScales) {
+			return p.LogScales[ch]
+		}
+	}
+	return nil
+}
+
+// mapGrayFunc returns a copy of a Gray32f image with each pixel value mapped
+// through a given function.
+func mapGrayFunc(g *Gray32f, fn func(float64) float64) *Gray32f {
+	bnds := g.Bounds()
+	out := NewGray32f(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			out.SetFloat(x, y, fn(g.FloatAt(x, y)))
+		}
+	}
+	return out
+}
+
+// applySplitLog encodes logarithmically each of a set of split channels for
+// which p.LogScales specifies an encoding, recording the encoding in the
+// channel's ImageInfo.
+func applySplitLog(p *Parameters, infos []ImageInfo) {
+	if p.LogScales == nil {
+		return
+	}
+	for i, info := range infos {
+		if ls := channelLogScale(p, info.Name); ls != nil {
+			infos[i].Image = mapGrayFunc(info.Image, ls.Encode)
+			infos[i].Log = ls
+		}
+	}
+}
+
+// applyMergeLog undoes the logarithmic encoding that p.LogScales specifies
+// for each of a set of channels to merge, given in channel order.
+func applyMergeLog(p *Parameters, channels []*Gray32f) []*Gray32f {
+	if p.LogScales == nil {
+		return channels
+	}
+	result := make([]*Gray32f, len(channels))
+	for i, g := range channels {
+		result[i] = g
+		if i < len(p.LogScales) && p.LogScales[i] != nil {
+			result[i] = mapGrayFunc(g, p.LogScales[i].Decode)
+		}
+	}
+	return result
+}
+
+// preservesHDR reports whether merging as directed by a set of parameters
+// should preserve values above 1.0, which represent high-dynamic-range
+// highlights: whether any channel is encoded logarithmically and the merged
+// image will be written with floating-point samples.
+func preservesHDR(p *Parameters) bool {
+	if p.LogScales == nil || (p.Depth != "" && p.Depth != "32f") {
+		return false
+	}
+	for _, ls := range p.LogScales {
+		if ls != nil {
+			return paramsOutputFormat(p).Float
+		}
+	}
+	return false
+}
+
+// clampNonNegative clamps each component of a color below at 0.0 but, unlike
+// colorful.Color.Clamped, leaves components above 1.0 unchanged.
+func clampNonNegative(c colorful.Color) colorful.Color {
+	return colorful.Color{R: math.Max(c.R, 0.0), G: math.Max(c.G, 0.0), B: math.Max(c.B, 0.0)}
+}
+
+// manifestLogScales returns the logarithmic encodings recorded in a manifest,
+// in channel order, or nil if the manifest records none.
+func manifestLogScales(p *Parameters, man *channelManifest) []*logScale {
+	var scales []*logScale
+	for _, ent := range man.Channels {
+		ch, _ := signedBaseIndex(p, ent.Name)
+		if ent.Log == nil || ch < 0 {
+			continue
+		}
+		if scales == nil {
+			scales = make([]*logScale, len(builtinChannelNames(p)))
+		}
+		scales[ch] = ent.Log
+	}
+	return scales
+}
+
+// logText returns the PNG text with which to record a channel's logarithmic
+// encoding or nil if the channel is encoded linearly.
+func logText(ls *logScale) map[string]string {
+	if ls == nil {
+		return nil
+	}
+	data, err := json.Marshal(ls)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	return map[string]string{logTextKey: string(data)}
+}
+
+// readChannelLogScales records in p.LogScales the logarithmic encodings
+// recorded in a list of channel files to merge, given in channel order but
+// omitting channels filled by --fill.  Encodings recorded in the files apply
+// only to channels whose encoding was not already specified by --encode or a
+// manifest.
+func readChannelLogScales(p *Parameters, fns []string) {
+	var scales []*logScale
+	fi := 0
+	for ch := range builtinChannelNames(p) {
+		if isFilled(p, ch) {
+			continue
+		}
+		if fi >= len(fns) {
+			break
+		}
+		fn := fns[fi]
+		fi++
+		if ch < len(p.LogScales) && p.LogScales[ch] != nil {
+			continue
+		}
+		val, ok := readPNGText(fn)[logTextKey]
+		if !ok {
+			continue
+		}
+		ls := &logScale{}
+		if json.Unmarshal([]byte(val), ls) != nil || !(ls.Black > 0.0) || !(ls.Stops > 0.0) {
+			notify.Fatalf("%s: Malformed %s text", fn, logTextKey)
+		}
+		if scales == nil {
+			scales = make([]*logScale, len(builtinChannelNames(p)))
+			copy(scales, p.LogScales)
+		}
+		scales[ch] = ls
+	}
+	if scales != nil {
+		p.LogScales = scales
+	}
+}
@@ -0,0 +1,158 @@
+// This file provides support for --lossless, which guarantees that merging a
+// set of split channels reproduces the original image exactly.  Channels are
+// stored as floating-point samples, hues are computed even for nearly
+// neutral colors, alpha is retained, and merged colors are not mapped into
+// the sRGB gamut.
+
+package main
+
+import (
+	"context"
+	"image"
+	"math"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// losslessConflicts lists the operations that discard information and
+// therefore cannot be combined with --lossless.  Each entry maps a
+// description of the operation, suitable for use in an error message, to a
+// function that reports whether a set of parameters requests it.
+var losslessConflicts = []struct {
+	Name string
+	Used func(p *Parameters) bool
+}{
+	{"--opaque or --background", func(p *Parameters) bool { return p.Opaque }},
+	{"--channels", func(p *Parameters) bool { return p.Channels != nil }},
+	{"--visualize, --hue-wheel, or --colormap", func(p *Parameters) bool { return p.Visualize || p.HueWheel || p.Colormap != "" }},
+	{"--equalize, --auto-contrast, or --normalize", func(p *Parameters) bool { return p.AutoTone != nil }},
+	{"--lut or --lut3d", func(p *Parameters) bool { return p.LUTs != nil || p.LUT3D != nil }},
+	{"--subsample", func(p *Parameters) bool { return p.Subsample != "" && p.Subsample != "4:4:4" }},
+	{"--dither", func(p *Parameters) bool { return p.Dither != "" && p.Dither != "none" }},
+	{"--depth=8", func(p *Parameters) bool { return p.Depth == "8" }},
+	{"--mismatch=resize", func(p *Parameters) bool { return !p.Split && p.Mismatch == "resize" }},
+	{"--stream", func(p *Parameters) bool { return p.Stream }},
+}
+
+// losslessFormats lists the output formats that both store floating-point
+// samples and can be read back by --merge.
+var losslessFormats = map[string]bool{
+	"csv":  true,
+	"exr":  true,
+	"fits": true,
+	"pfm":  true,
+	"raw":  true,
+	"tsv":  true,
+}
+
+// checkLosslessParams aborts if a set of parameters requests an operation
+// that would prevent a split from being merged back into the original image.
+func checkLosslessParams(p *Parameters) {
+	for _, c := range losslessConflicts {
+		if c.Used(p) {
+			notify.Fatalf("--lossless cannot be used with %s", c.Name)
+		}
+	}
+	tmpl := p.OutputName
+	if tmpl == "-" {
+		tmpl = ""
+	}
+	name := selectOutputFormat(tmpl, p.Format)
+	of := outputFormats[name]
+	switch {
+	case p.ColorSpace == "hsluv":
+		// Near the edge of the gamut, the conversion from HSLuv amplifies
+		// the rounding of 32-bit floating-point samples.
+		notify.Fatal("--lossless does not support the hsluv color space")
+	case p.Split && (!losslessFormats[name] || p.Depth == "16"):
+		notify.Fatal("--lossless requires split channels to be written in a floating-point format that --merge can read (csv, exr, fits, pfm, raw, or tsv)")
+	case p.Split && name == "raw" && p.RawType != "float32":
+		notify.Fatal(`--lossless requires --raw-type=float32 for raw output`)
+	case !p.Split && of.Max8:
+		notify.Fatalf("--lossless cannot merge into the 8-bit %s format", name)
+	}
+}
+
+// losslessHue returns the hue angle, in degrees, of the chromatic components
+// (a, b) of a color.  Unlike go-colorful, which reports a hue of 0 whenever a
+// and b are nearly equal, losslessHue does so only when both are 0.
+func losslessHue(a, b float64) float64 {
+	if a == 0.0 && b == 0.0 {
+		return 0.0
+	}
+	return math.Mod(57.29577951308232087721*math.Atan2(b, a)+360.0, 360.0)
+}
+
+// toHCLLossless is ToHCLWhiteRef with losslessHue.
+func toHCLLossless(c colorful.Color, wref [3]float64) [3]float64 {
+	x, y, z := fastXyz(c)
+	l, a, b := colorful.XyzToLabWhiteRef(x, y, z, wref)
+	return [3]float64{losslessHue(a, b) / 360.0, math.Sqrt(a*a + b*b), l}
+}
+
+// losslessSplitKernel returns a variant of splitKernel's conversion function
+// that preserves all information for the color spaces in which the usual
+// conversion does not, or nil for the other color spaces.
+func losslessSplitKernel(cs string, wref [3]float64) func(colorful.Color) []float64 {
+	switch cs {
+	case "rgb":
+		// Don't quantize to 8 bits.
+		_, fn := splitKernel("srgb", wref)
+		return fn
+	case "hcl":
+		return func(clr colorful.Color) []float64 {
+			v := toHCLLossless(clr, wref)
+			return v[:]
+		}
+	default:
+		return nil
+	}
+}
+
+// straightImage returns a floating-point copy of an image with straight
+// (non-premultiplied) color samples.  Unlike reading colors through the
+// color.Color interface, which premultiplies them by alpha at 16-bit
+// precision, straightImage preserves every sample of the common 8- and 16-bit
+// non-premultiplied image types, including the color of fully transparent
+// pixels.  It returns the context's error if ctx is canceled.
+func straightImage(ctx context.Context, img image.Image) (*NRGBA32f, error) {
+	if fimg, ok := img.(*NRGBA32f); ok {
+		return fimg, nil
+	}
+	at := storedFloatsAt(img)
+	switch m := img.(type) {
+	case *image.NRGBA:
+		at = func(x, y int) [4]float64 {
+			s := m.Pix[m.PixOffset(x, y):]
+			return [4]float64{
+				float64(s[0]) / 255.0,
+				float64(s[1]) / 255.0,
+				float64(s[2]) / 255.0,
+				float64(s[3]) / 255.0,
+			}
+		}
+	case *image.NRGBA64:
+		at = func(x, y int) [4]float64 {
+			s := m.Pix[m.PixOffset(x, y):]
+			var v [4]float64
+			for c := range v {
+				v[c] = float64(uint16(s[2*c])<<8|uint16(s[2*c+1])) / 65535.0
+			}
+			return v
+		}
+	}
+	bnds := img.Bounds()
+	out := NewNRGBA32f(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			out.SetFloats(x, y, at(x, y))
+		}
+	}
+	return out, nil
+}
+
+// unmappedGamut is a gamutMapper that leaves colors unchanged.
+func unmappedGamut(c colorful.Color) colorful.Color { return c }
@@ -0,0 +1,441 @@
+// This file provides support for lookup tables (LUTs): 1D LUTs that remap the
+// values of individual channels, which lets users apply custom tone curves
+// when splitting or merging, and 3D LUTs that remap colors, which lets users
+// split a color-graded image or grade a merged image.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A lut1D is a one-dimensional lookup table that maps an input value to an
+// output value by piecewise-linear interpolation between control points.
+type lut1D struct {
+	In  []float64 // Input values, in increasing order
+	Out []float64 // Output value corresponding to each input value
+}
+
+// Map maps a value through a lut1D.  Values beyond the first or last input
+// value map to the first or last output value, respectively.  NaN maps to
+// itself.
+func (l *lut1D) Map(v float64) float64 {
+	n := len(l.In)
+	switch {
+	case math.IsNaN(v):
+		return v
+	case v <= l.In[0]:
+		return l.Out[0]
+	case v >= l.In[n-1]:
+		return l.Out[n-1]
+	}
+	i := sort.SearchFloat64s(l.In, v) // l.In[i-1] < v <= l.In[i]
+	t := (v - l.In[i-1]) / (l.In[i] - l.In[i-1])
+	return l.Out[i-1] + t*(l.Out[i]-l.Out[i-1])
+}
+
+// lutFields splits a line of a LUT file into fields separated by whitespace
+// or commas.
+func lutFields(line string) []string {
+	return strings.FieldsFunc(line, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// parseLUTFloats parses each of a list of strings as a finite floating-point
+// number.
+func parseLUTFloats(fields []string) ([]float64, error) {
+	vs := make([]float64, len(fields))
+	for i, f := range fields {
+		var err error
+		vs[i], err = strconv.ParseFloat(f, 64)
+		if err != nil || math.IsNaN(vs[i]) || math.IsInf(vs[i], 0) {
+			return nil, fmt.Errorf("invalid number %q", f)
+		}
+	}
+	return vs, nil
+}
+
+// decodeLUT1D reads a 1D LUT from a text file with two columns, an input
+// value and an output value, per line.  Blank lines and lines beginning with
+// "#" are ignored.
+func decodeLUT1D(r io.Reader) (*lut1D, error) {
+	l := &lut1D{}
+	scanner := bufio.NewScanner(r)
+	for ln := 1; scanner.Scan(); ln++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		vs, err := parseLUTFloats(lutFields(line))
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("line %d: %s", ln, err)
+		case len(vs) != 2:
+			return nil, fmt.Errorf("line %d: expected 2 values but saw %d", ln, len(vs))
+		case len(l.In) > 0 && vs[0] <= l.In[len(l.In)-1]:
+			return nil, fmt.Errorf("line %d: input values must increase", ln)
+		}
+		l.In = append(l.In, vs[0])
+		l.Out = append(l.Out, vs[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(l.In) < 2 {
+		return nil, fmt.Errorf("a LUT requires at least 2 entries")
+	}
+	return l, nil
+}
+
+// decodeCube1D reads a 1D LUT in Adobe/Resolve .cube format.  Such files list
+// three output values (red, green, and blue) per entry.  A tone curve applies
+// the same mapping to all three, so only the first is used.
+func decodeCube1D(r io.Reader) (*lut1D, error) {
+	size := 0
+	lo, hi := 0.0, 1.0
+	var outs []float64
+	scanner := bufio.NewScanner(r)
+	for ln := 1; scanner.Scan(); ln++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "TITLE":
+			continue
+		case "LUT_1D_SIZE":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: malformed LUT_1D_SIZE", ln)
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < 2 {
+				return nil, fmt.Errorf("line %d: invalid LUT_1D_SIZE %q", ln, fields[1])
+			}
+			size = n
+			continue
+		case "LUT_3D_SIZE":
+			return nil, fmt.Errorf("a 1D LUT is required, but this is a 3D LUT")
+		case "DOMAIN_MIN", "DOMAIN_MAX", "LUT_1D_INPUT_RANGE":
+			vs, err := parseLUTFloats(fields[1:])
+			if err != nil || len(vs) == 0 {
+				return nil, fmt.Errorf("line %d: malformed %s", ln, fields[0])
+			}
+			switch fields[0] {
+			case "DOMAIN_MIN":
+				lo = vs[0]
+			case "DOMAIN_MAX":
+				hi = vs[0]
+			default:
+				if len(vs) != 2 {
+					return nil, fmt.Errorf("line %d: malformed %s", ln, fields[0])
+				}
+				lo, hi = vs[0], vs[1]
+			}
+			continue
+		}
+		vs, err := parseLUTFloats(fields)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("line %d: %s", ln, err)
+		case len(vs) != 3:
+			return nil, fmt.Errorf("line %d: expected 3 values but saw %d", ln, len(vs))
+		}
+		outs = append(outs, vs[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case size == 0:
+		return nil, fmt.Errorf("no LUT_1D_SIZE found")
+	case len(outs) != size:
+		return nil, fmt.Errorf("LUT_1D_SIZE is %d, but %d entries were found", size, len(outs))
+	case hi <= lo:
+		return nil, fmt.Errorf("the domain maximum must exceed the domain minimum")
+	}
+	l := &lut1D{In: make([]float64, size), Out: outs}
+	for i := range l.In {
+		l.In[i] = lo + (hi-lo)*float64(i)/float64(size-1)
+	}
+	return l, nil
+}
+
+// isCubeFile reports whether a filename designates a .cube LUT.
+func isCubeFile(fn string) bool {
+	return strings.ToLower(filepath.Ext(fn)) == ".cube"
+}
+
+// ReadLUT1D reads a 1D LUT from a named file: a .cube file, a Photoshop
+// curves (.acv) file, a GIMP curves file, or a two-column text file.  It
+// aborts on error.
+func ReadLUT1D(fn string) *lut1D {
+	f, err := os.Open(fn)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var l *lut1D
+	switch {
+	case isCubeFile(fn):
+		l, err = decodeCube1D(br)
+	case isACVFile(fn):
+		l, err = decodeACV(br)
+	case isGIMPCurves(br):
+		l, err = decodeGIMPCurves(br)
+	default:
+		l, err = decodeLUT1D(br)
+	}
+	if err != nil {
+		notify.Fatalf("%s: %s", fn, err)
+	}
+	return l
+}
+
+// parseLUTs parses the argument to --lut, a comma-separated list of
+// <channel>=<filename> pairs, and returns the LUT for each channel in channel
+// order, with nil for channels not remapped.  It aborts on error.
+func parseLUTs(p *Parameters, arg string) []*lut1D {
+	luts := make([]*lut1D, len(builtinChannelNames(p)))
+	for _, pair := range strings.Split(arg, ",") {
+		eq := strings.Index(pair, "=")
+		if eq <= 0 {
+			notify.Fatalf("--lut requires a list of <channel>=<filename> pairs (not %q)", pair)
+		}
+		ch := channelIndex(p, strings.TrimSpace(pair[:eq]))
+		if luts[ch] != nil {
+			notify.Fatalf("--lut specifies channel %s more than once", builtinChannelNames(p)[ch])
+		}
+		luts[ch] = ReadLUT1D(pair[eq+1:])
+	}
+	return luts
+}
+
+// mapGray returns a copy of a Gray32f image with each pixel value mapped
+// through a 1D LUT.
+func mapGray(g *Gray32f, l *lut1D) *Gray32f {
+	bnds := g.Bounds()
+	out := NewGray32f(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			out.SetFloat(x, y, l.Map(g.FloatAt(x, y)))
+		}
+	}
+	return out
+}
+
+// channelLUT returns the 1D LUT for the channel with a given built-in name or
+// nil if the channel is not remapped.
+func channelLUT(p *Parameters, name string) *lut1D {
+	if p.LUTs == nil {
+		return nil
+	}
+	for i, nm := range builtinChannelNames(p) {
+		if nm == name {
+			return p.LUTs[i]
+		}
+	}
+	return nil
+}
+
+// applySplitLUTs maps each of a set of split channels through its 1D LUT, if
+// any.
+func applySplitLUTs(p *Parameters, infos []ImageInfo) {
+	for i, info := range infos {
+		if l := channelLUT(p, info.Name); l != nil {
+			infos[i].Image = mapGray(info.Image, l)
+		}
+	}
+}
+
+// applyMergeLUTs maps each of a set of channels to merge, given in channel
+// order, through its 1D LUT, if any.  Channels filled by --fill are left as
+// is.
+func applyMergeLUTs(p *Parameters, channels []*Gray32f) []*Gray32f {
+	if p.LUTs == nil {
+		return channels
+	}
+	result := make([]*Gray32f, len(channels))
+	for i, g := range channels {
+		result[i] = g
+		if i < len(p.LUTs) && p.LUTs[i] != nil && !isFilled(p, i) {
+			result[i] = mapGray(g, p.LUTs[i])
+		}
+	}
+	return result
+}
+
+// A lut3D is a three-dimensional lookup table that maps an RGB color to
+// another RGB color by trilinear interpolation within a lattice.
+type lut3D struct {
+	Size   int          // Number of lattice points along each axis
+	Min    [3]float64   // Input values corresponding to the first lattice point
+	Max    [3]float64   // Input values corresponding to the last lattice point
+	Points [][3]float64 // Output colors, with red varying fastest and blue slowest
+}
+
+// Map maps an RGB color through a lut3D.  Colors outside the LUT's domain
+// are clamped to it.  Colors with a NaN component are returned unchanged.
+func (l *lut3D) Map(rgb [3]float64) [3]float64 {
+	if math.IsNaN(rgb[0]) || math.IsNaN(rgb[1]) || math.IsNaN(rgb[2]) {
+		return rgb
+	}
+
+	// Find the lattice cell containing the color and the color's position
+	// within it.
+	var idx [3]int
+	var frac [3]float64
+	n := l.Size - 1
+	for c, v := range rgb {
+		t := (v - l.Min[c]) / (l.Max[c] - l.Min[c]) * float64(n)
+		t = math.Max(0.0, math.Min(t, float64(n)))
+		idx[c] = int(t)
+		if idx[c] == n {
+			idx[c] = n - 1
+		}
+		frac[c] = t - float64(idx[c])
+	}
+
+	// Interpolate among the cell's eight corners.
+	var out [3]float64
+	for corner := 0; corner < 8; corner++ {
+		w := 1.0
+		var pt [3]int
+		for c := range pt {
+			pt[c] = idx[c]
+			if corner&(1<<c) != 0 {
+				pt[c]++
+				w *= frac[c]
+			} else {
+				w *= 1.0 - frac[c]
+			}
+		}
+		v := l.Points[pt[0]+l.Size*(pt[1]+l.Size*pt[2])]
+		for c := range out {
+			out[c] += w * v[c]
+		}
+	}
+	return out
+}
+
+// decodeCube3D reads a 3D LUT in Adobe/Resolve .cube format.
+func decodeCube3D(r io.Reader) (*lut3D, error) {
+	l := &lut3D{Max: [3]float64{1.0, 1.0, 1.0}}
+	scanner := bufio.NewScanner(r)
+	for ln := 1; scanner.Scan(); ln++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "TITLE":
+			continue
+		case "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: malformed LUT_3D_SIZE", ln)
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < 2 {
+				return nil, fmt.Errorf("line %d: invalid LUT_3D_SIZE %q", ln, fields[1])
+			}
+			l.Size = n
+			continue
+		case "LUT_1D_SIZE":
+			return nil, fmt.Errorf("a 3D LUT is required, but this is a 1D LUT")
+		case "DOMAIN_MIN", "DOMAIN_MAX":
+			vs, err := parseLUTFloats(fields[1:])
+			if err != nil || len(vs) != 3 {
+				return nil, fmt.Errorf("line %d: malformed %s", ln, fields[0])
+			}
+			if fields[0] == "DOMAIN_MIN" {
+				copy(l.Min[:], vs)
+			} else {
+				copy(l.Max[:], vs)
+			}
+			continue
+		case "LUT_3D_INPUT_RANGE":
+			vs, err := parseLUTFloats(fields[1:])
+			if err != nil || len(vs) != 2 {
+				return nil, fmt.Errorf("line %d: malformed %s", ln, fields[0])
+			}
+			l.Min = [3]float64{vs[0], vs[0], vs[0]}
+			l.Max = [3]float64{vs[1], vs[1], vs[1]}
+			continue
+		}
+		vs, err := parseLUTFloats(fields)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("line %d: %s", ln, err)
+		case len(vs) != 3:
+			return nil, fmt.Errorf("line %d: expected 3 values but saw %d", ln, len(vs))
+		}
+		l.Points = append(l.Points, [3]float64{vs[0], vs[1], vs[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case l.Size == 0:
+		return nil, fmt.Errorf("no LUT_3D_SIZE found")
+	case len(l.Points) != l.Size*l.Size*l.Size:
+		return nil, fmt.Errorf("LUT_3D_SIZE is %d, requiring %d entries, but %d were found",
+			l.Size, l.Size*l.Size*l.Size, len(l.Points))
+	}
+	for c := range l.Min {
+		if l.Max[c] <= l.Min[c] {
+			return nil, fmt.Errorf("the domain maximum must exceed the domain minimum")
+		}
+	}
+	return l, nil
+}
+
+// ReadLUT3D reads a 3D LUT from a named .cube file.  It aborts on error.
+func ReadLUT3D(fn string) *lut3D {
+	if !isCubeFile(fn) {
+		notify.Fatalf("%s: A 3D LUT must be a .cube file", fn)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	defer f.Close()
+	l, err := decodeCube3D(f)
+	if err != nil {
+		notify.Fatalf("%s: %s", fn, err)
+	}
+	return l
+}
+
+// ApplyLUT3D maps every color of an image through a 3D LUT, applied to
+// sRGB-encoded values, and returns the result.  Alpha is preserved.
+// ApplyLUT3D returns the context's error if ctx is canceled.
+func ApplyLUT3D(ctx context.Context, img image.Image, l *lut3D) (image.Image, error) {
+	bnds := img.Bounds()
+	out := NewNRGBA32f(bnds)
+	colorAt := colorAtFunc(img)
+	alphaAt := alphaAtFunc(img)
+	err := forEachRow(ctx, bnds, func(y int) {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			clr := colorAt(x, y)
+			v := l.Map([3]float64{clr.R, clr.G, clr.B})
+			out.SetFloats(x, y, [4]float64{v[0], v[1], v[2], alphaAt(x, y)})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
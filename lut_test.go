@@ -0,0 +1,90 @@
+// This file tests the 1D and 3D lookup tables.
+
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// TestLUT1DNonFinite verifies that a 1D LUT passes NaN through and clamps
+// infinities to its first and last output values.
+func TestLUT1DNonFinite(t *testing.T) {
+	l, err := decodeLUT1D(strings.NewReader("0 0.1\n0.5 0.2\n1 0.9\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := l.Map(math.NaN()); !math.IsNaN(v) {
+		t.Errorf("mapping NaN: expected NaN but saw %g", v)
+	}
+	checkLUT(t, l, map[float64]float64{
+		math.Inf(-1): 0.1,
+		-1.0:         0.1,
+		0.25:         0.15,
+		0.75:         0.55,
+		2.0:          0.9,
+		math.Inf(1):  0.9,
+	}, 1e-12)
+
+	// NaN passes through when a LUT is applied to an image, too.
+	g := testGrayImage()
+	g.SetFloat(1, 2, math.NaN())
+	g.SetFloat(2, 2, math.Inf(1))
+	m := mapGray(g, l)
+	if v := m.FloatAt(1, 2); !math.IsNaN(v) {
+		t.Errorf("expected NaN but saw %g", v)
+	}
+	if v := m.FloatAt(2, 2); v != float64(float32(0.9)) {
+		t.Errorf("expected 0.9 but saw %g", v)
+	}
+}
+
+// TestLUT3DNonFinite verifies that a 3D LUT returns colors with a NaN
+// component unchanged and clamps infinite components to its domain.
+func TestLUT3DNonFinite(t *testing.T) {
+	// Construct a LUT that swaps red and blue.
+	l := &lut3D{Size: 2, Max: [3]float64{1.0, 1.0, 1.0}}
+	for b := 0.0; b <= 1.0; b++ {
+		for g := 0.0; g <= 1.0; g++ {
+			for r := 0.0; r <= 1.0; r++ {
+				l.Points = append(l.Points, [3]float64{b, g, r})
+			}
+		}
+	}
+	nan, inf := math.NaN(), math.Inf(1)
+	for _, tc := range []struct {
+		in, want [3]float64
+	}{
+		{[3]float64{0.25, 0.5, 0.75}, [3]float64{0.75, 0.5, 0.25}},
+		{[3]float64{inf, 0.5, -inf}, [3]float64{0.0, 0.5, 1.0}},
+		{[3]float64{-inf, inf, 0.5}, [3]float64{0.5, 1.0, 0.0}},
+		{[3]float64{nan, 0.5, 0.75}, [3]float64{nan, 0.5, 0.75}},
+		{[3]float64{0.25, 0.5, nan}, [3]float64{0.25, 0.5, nan}},
+	} {
+		got := l.Map(tc.in)
+		for c, w := range tc.want {
+			if g := got[c]; g != w && !(math.IsNaN(g) && math.IsNaN(w)) {
+				t.Errorf("mapping %v: expected %v but saw %v", tc.in, tc.want, got)
+				break
+			}
+		}
+	}
+}
+
+// TestLUTNonFiniteEntries verifies that LUT files containing NaN or infinite
+// values are rejected.
+func TestLUTNonFiniteEntries(t *testing.T) {
+	for _, text := range []string{
+		"NaN 0\n1 1\n",
+		"0 0\n+Inf 1\n",
+		"0 0\n1 nan\n",
+	} {
+		if _, err := decodeLUT1D(strings.NewReader(text)); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+	if _, err := decodeCube3D(strings.NewReader("LUT_3D_SIZE 2\nDOMAIN_MAX 1 1 Inf\n")); err == nil {
+		t.Error("expected an error for an infinite domain")
+	}
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"image"
 	"log"
 	"os"
 	"strconv"
@@ -21,13 +22,79 @@ var notify *log.Logger
 
 // Parameters encapsulates all program parameters.
 type Parameters struct {
-	InputNames     []string   // Input file names
-	OutputName     string     // Output file names
-	OrigColorSpace string     // Color-space name as written by the user
-	ColorSpace     string     // Color-space name
-	Split          bool       // true: split; false: merge
-	Alpha          bool       // true: split/merge an alpha layer: false: don't
-	WhitePoint     [3]float64 // White reference point as an XYZ color
+	InputNames     []string    // Input file names
+	OutputName     string      // Output file names
+	OrigColorSpace string      // Color-space name as written by the user
+	ColorSpace     string      // Color-space name
+	Split          bool        // true: split; false: merge
+	Convert        bool        // true: convert a color image through ColorSpace (overrides Split)
+	Replace        string      // Name of a channel to replace with a grayscale image ("" for none; overrides Split and Convert)
+	Pack           bool        // true: pack grayscale images into R, G, B, and A without color-space conversion (overrides Split)
+	Unpack         bool        // true: unpack R, G, B, and A into grayscale images without color-space conversion (overrides Split)
+	Combine        bool        // true: combine channels taken from different source images (overrides Split)
+	Diff           bool        // true: write the per-channel difference between two color images (overrides Split)
+	DeltaE         string      // Delta E formula with which to compare two images ("76", "94", "2000", or "" for none; overrides Split)
+	DeltaEMax      float64     // Delta E value to map to full intensity in a Delta E map
+	HeatMap        bool        // true: write a Delta E map as a heat map; false: write it as a grayscale image
+	Info           bool        // true: describe the input images rather than converting them (overrides Split)
+	Verify         bool        // true: report the error of splitting and re-merging the input images in memory (overrides Split)
+	Montage        string      // Name of a contact sheet of split channels to write ("" for none)
+	Visualize      bool        // true: write split channels as tinted color images; false: write them as grayscale images
+	HueWheel       bool        // true: write split hue channels as fully saturated colors; false: write them as grayscale images
+	Colormap       string      // Name of a colormap through which to render split channels ("" for none)
+	Manifest       string      // Name of a JSON manifest describing split channels to write ("" for none)
+	Alpha          bool        // true: split/merge an alpha layer: false: don't
+	KeepAlpha      bool        // true: split/merge an alpha layer whenever the input has one; false: only when Alpha is true
+	Premultiplied  bool        // true: color samples of input and output images are premultiplied by alpha; false: straight
+	VisibleOnly    bool        // true: exclude fully transparent pixels from statistics, normalization, and equalization; false: include them
+	Opaque         bool        // true: remove transparency from the image to split or the merged image; false: retain it
+	Background     string      // Color, as "#rrggbb", over which Opaque composites transparent pixels ("" to discard alpha)
+	WhitePoint     [3]float64  // White reference point as an XYZ color
+	Format         string      // Output file format ("" to infer from the filename)
+	PNGCompression string      // PNG compression level ("none", "fast", "default", or "best")
+	PNGInterlace   bool        // true: write interlaced PNG files; false: write non-interlaced PNG files
+	GeoTags        []tiffTag   // GeoTIFF tags read from the input, to be copied to TIFF outputs
+	RawType        string      // Sample type for raw files ("uint8", "uint16", or "float32")
+	RawEndian      string      // Byte order for raw files ("little" or "big")
+	RawSize        image.Point // Dimensions of raw input files (zero if inputs are not raw)
+	CSVLayout      string      // Layout of CSV and TSV output ("matrix" or "rows")
+	Depth          string      // Output pixel depth ("8", "16", "32f", or "" for the format's default)
+	Lossless       bool        // true: guarantee that merging split channels reproduces the original image; false: allow quantization and gamut mapping
+	Workers        int         // Maximum number of goroutines processing an image concurrently (0 for GOMAXPROCS)
+	Stream         bool        // true: split or merge PNG files one band of rows at a time; false: read entire images into memory
+	BandRows       int         // Number of rows per band when Stream is true
+	Progress       bool        // true: report the progress of splits and merges on stderr; false: work silently
+	Times          *stageTimes // Time spent decoding, converting, and encoding (nil to skip timing)
+	Accel          string      // Acceleration backend for the matrix-based color spaces ("auto", "none", or a backend name)
+	Channels       []string    // Names of the channels to split (nil for all)
+	Names          []string    // Names to use in output filenames in place of the built-in channel names, in channel order (nil for the built-in names)
+	NameScheme     string      // Form of the built-in channel names used in output filenames ("mixed", "lower", or "numeric")
+	Recursive      bool        // true: include images in subdirectories of input directories; false: don't
+	Watch          bool        // true: process files as they appear in the input directory; false: process the input files once
+	Mismatch       string      // How to merge channels whose dimensions differ ("error", "crop", "pad", or "resize")
+	PadValue       float64     // Value with which to pad channels when Mismatch is "pad"
+	ResizeFilter   string      // Filter with which to resample channels when Mismatch is "resize" ("nearest", "bilinear", or "catmull-rom")
+	Gamma          []float64   // Gamma exponent with which to encode (when splitting) or decode (when merging) each channel, in channel order (nil for none)
+	LUTs           []*lut1D    // 1D LUT through which to map each channel after splitting or before merging, in channel order (nil for none)
+	LUT3D          *lut3D      // 3D LUT through which to map colors before splitting or after merging (nil for none)
+	AutoTone       []string    // Automatic tone adjustment to apply to each channel, in channel order ("equalize", "auto-contrast", or ""; nil for none)
+	ToneCurves     []toneCurve // Tone curves, read from a manifest, to undo before merging, in channel order (nil for none)
+	Fill           []float64   // Constant value with which to fill each channel when merging, in channel order (NaN for channels read from files; nil for none)
+	Gamut          string      // How to map merged colors that lie outside the sRGB gamut ("clamp", "scale-chroma", "project", or "error")
+	Ranges         []chanRange // Range of values, in conventional units, that each color channel represents, in channel order (nil for the defaults)
+	BlackGen       *blackGen   // Black-generation curve with which to split into CMYK (nil for full black generation)
+	LogScales      []*logScale // Logarithmic encoding of each color channel, in channel order (nil entries for linear; nil for none)
+	YCbCrMatrix    string      // Matrix with which to convert to and from Y'CbCr ("bt601" or "bt709")
+	UpsampleFilter string      // Filter with which to upsample subsampled chroma channels when merging ("nearest", "bilinear", or "catmull-rom")
+	ICC            string      // How to treat ICC profiles embedded in input images ("convert" or "ignore")
+	EmbedProfile   string      // How to tag color output images as sRGB ("both", "icc", "cicp", or "none")
+	CAT            string      // Chromatic adaptation transform from D65 to WhitePoint ("bradford", "cat02", "von-kries", or "none")
+	AutoWhite      string      // Estimator with which to replace WhitePoint with each split image's white point ("gray-world" or "white-patch"; "" for none)
+	Subsample      string      // Chroma subsampling of split channels ("4:4:4", "4:2:2", or "4:2:0"; "" for none)
+	Signed         string      // Encoding of signed channels ("offset", "twos-complement", or "split")
+	Dither         string      // How to dither samples quantized to 8 bits ("none", "floyd-steinberg", or "blue-noise")
+	ClipMask       string      // Name of an image file in which to mark the pixels whose values were clipped ("" for none)
+	Clip           *clipStats  // Statistics on the pixels whose values were clipped (nil to skip counting)
 }
 
 // colorSpaceList is a list of acceptable color spaces, represented as
@@ -75,16 +142,36 @@ func cleanColorSpaceName(cs string) string {
 	}, cs)
 }
 
-// parseWhitePoint parses a pair of CIE chromaticity coordinates into an XYZ
-// color.  It aborts on error.
-func parseWhitePoint(s string) [3]float64 {
-	// Handle the cases go-colorful supports.
-	wp := strings.ToUpper(strings.TrimSpace(s))
-	if wp == "D65" {
-		return colorful.D65
+// lookupColorSpace maps a color-space name as written by the user to one of
+// the names in colorSpaceList.  It additionally reports whether the name
+// requests an alpha channel and whether the name is valid.
+func lookupColorSpace(name string) (cs string, alpha, ok bool) {
+	cs = cleanColorSpaceName(name)
+	for _, c := range colorSpaceList {
+		if cs == c {
+			return cs, false, true
+		}
+	}
+	if len(cs) >= 1 && cs[len(cs)-1] == 'a' {
+		// Second chance: Look for an alpha channel.
+		opaque := cs[:len(cs)-1]
+		for _, c := range colorSpaceList {
+			if opaque == c {
+				return opaque, true, true
+			}
+		}
 	}
-	if wp == "D50" {
-		return colorful.D50
+	return cs, false, false
+}
+
+// parseWhitePoint parses the name of a standard illuminant, as seen by a
+// given standard observer (2 or 10 degrees), or a pair of CIE chromaticity
+// coordinates into an XYZ color.  It aborts on error.
+func parseWhitePoint(s string, observer int) [3]float64 {
+	// Handle named illuminants.
+	wp := strings.ToUpper(strings.TrimSpace(s))
+	if xyz, ok := standardIlluminant(wp, observer); ok {
+		return xyz
 	}
 
 	// Parse the strings into a pair of floating-point numbers.
@@ -100,7 +187,8 @@ func parseWhitePoint(s string) [3]float64 {
 		}
 	})
 	if len(toks) != 2 {
-		notify.Fatalf(`Failed to parse %q as either "D65", "D50", or a pair of floating-point numbers`, s)
+		notify.Fatalf("Failed to parse %q as either a standard illuminant (%s) or a pair of floating-point numbers",
+			s, strings.Join(illuminantNames(), ", "))
 	}
 	x, err := strconv.ParseFloat(toks[0], 64)
 	if err != nil || x < 0.0 || x > 1.0 {
@@ -114,79 +202,745 @@ func parseWhitePoint(s string) [3]float64 {
 		notify.Fatalf("%s + %s must be less than or equal to 1.0", toks[0], toks[1])
 	}
 
-	// Convert from (x, y) to XYZ.
+	return chromaticityToXYZ(x, y)
+}
+
+// chromaticityToXYZ converts CIE chromaticity coordinates to an XYZ color
+// with unit luminance.
+func chromaticityToXYZ(x, y float64) [3]float64 {
 	z := 1.0 - x - y
 	return [3]float64{x / y, 1.0, z / y}
 }
 
+// parseChannelList parses a comma-separated list of channel names given as
+// the argument to a named option.  It aborts on error.
+func parseChannelList(opt, s string) []string {
+	var names []string
+	for _, nm := range strings.Split(s, ",") {
+		nm = strings.TrimSpace(nm)
+		if nm != "" {
+			names = append(names, nm)
+		}
+	}
+	if len(names) == 0 {
+		notify.Fatalf("--%s requires at least one channel name (not %q)", opt, s)
+	}
+	return names
+}
+
 // ParseCommandLine parses the command line into a Parameters struct.  It
 // aborts on error.
 func ParseCommandLine(p *Parameters) {
 	// Parse the command line.
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [--merge | --split] [other_options] <image-file>...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [--merge | --split | --convert | --replace=<channel> | --pack | --unpack | --combine | --diff | --deltae=<formula> | --info] [other_options] <image-file>...\n", os.Args[0])
 		fmt.Fprint(flag.CommandLine.Output(), "Options:\n\n")
 		flag.PrintDefaults()
 	}
+	def := defaultParameters()
 	flag.StringVar(&p.OutputName, "o", "",
-		`Name of output file for --merge (default standard output) or output-file template containing "%s" for --split (no default)`)
-	flag.StringVar(&p.OrigColorSpace, "space", "rgb",
-		"Color space in which to interpret the input channels ("+colorSpaceString+")")
+		`Name of output file for --merge, --convert, --replace, --pack, --combine, and --deltae (default standard output, except none for --deltae) or output-file template containing "%s" or a text/template such as "{{.Channel}}" for --split, --unpack, and --diff, plus "%b" for the input basename when splitting multiple files, or "-" to write split channels to standard output as a tar stream (no default)`)
+	flag.StringVar(&p.OrigColorSpace, "space", def.OrigColorSpace,
+		"Color space in which to interpret the input channels ("+colorSpaceString+`, or "alpha" to split only an alpha channel or merge one into a color image)`)
+	flag.BoolVar(&p.KeepAlpha, "keep-alpha", false,
+		`Split an alpha channel from every input that has transparent pixels, and merge an alpha channel when given one more file than the color space has channels, without requiring an "a" suffix on --space`)
+	flag.BoolVar(&p.Premultiplied, "premultiplied", false,
+		"Treat the color samples of split and converted images as premultiplied by alpha, and premultiply the color samples of merged and converted images")
+	alphaFile := flag.String("alpha-file", "",
+		`Grayscale image to merge as the alpha channel, following the channels of the color space given by --space (which must not end in "a")`)
 	split := flag.Bool("split", false, "Split a color image into one grayscale image per color channel")
 	merge := flag.Bool("merge", false, "Merge one grayscale image per color channel into a single color image")
+	convert := flag.Bool("convert", false, "Re-encode a color image through the color space specified by --space")
+	flag.StringVar(&p.Replace, "replace", "",
+		"Replace the named channel of a color image with a grayscale image and write the recomposed color image")
+	pack := flag.Bool("pack", false,
+		"Pack grayscale images, given as R=<file>, G=<file>, B=<file>, and A=<file>, into a color image without color-space conversion")
+	unpack := flag.Bool("unpack", false,
+		"Unpack the R, G, B, and A channels of a color image into grayscale images without color-space conversion")
+	combine := flag.Bool("combine", false,
+		"Combine channels, given as <channel>=<file>:<space>:<channel>, taken from different source images into a single color image")
+	diff := flag.Bool("diff", false,
+		"Write one grayscale image per channel representing the difference between two color images (mid-gray = no difference)")
+	flag.StringVar(&p.DeltaE, "deltae", "",
+		`Report statistics on and optionally write a map of the per-pixel Delta E between two images ("76", "94", or "2000")`)
+	flag.Float64Var(&p.DeltaEMax, "deltae-max", def.DeltaEMax,
+		"Delta E value to map to full intensity in --deltae output")
+	flag.BoolVar(&p.HeatMap, "heatmap", false, "Write --deltae output as a color heat map rather than as a grayscale image")
+	info := flag.Bool("info", false,
+		"Describe each input image's format, dimensions, pixel format, bit depth, alpha channel, ICC profile, and EXIF data")
+	verify := flag.Bool("verify", false,
+		"Report the maximum and mean error, in 16-bit code values, of each color channel of each input image and the maximum and mean Delta E 2000 after splitting it into the color space given by --space, quantizing the channels as --split would write them, and merging them again, all in memory")
 	white := flag.String("white", "D65",
-		`White-point CIE chromaticity coordinates (two numbers in [0.0, 1.0]) or "D65" or "D50", used for hcl, lab, and luv`)
+		`White-point CIE chromaticity coordinates (two numbers in [0.0, 1.0]), standard illuminant ("A", "C", "D50", "D55", "D65", "D75", "E", or "F1" through "F12"), or "auto" to estimate each split image's white point, used for hcl, lab, and luv`)
+	whiteEstimator := flag.String("white-estimator", "gray-world",
+		`Method with which --white=auto estimates an image's white point ("gray-world" or "white-patch")`)
+	observer := flag.String("observer", "2",
+		`Standard observer, in degrees, for which --white names an illuminant ("2" for CIE 1931 or "10" for CIE 1964)`)
+	cat := flag.String("cat", def.CAT,
+		`Chromatic adaptation transform with which to adapt colors from D65 to the --white point ("none", "bradford", "cat02", or "von-kries")`)
+	flag.StringVar(&p.Format, "format", "",
+		"Output file format ("+strings.Join(outputFormatNames(), ", ")+`; default: inferred from the output filename or "`+defaultOutputFormat+`")`)
+	flag.StringVar(&p.PNGCompression, "png-compression", def.PNGCompression,
+		`Compression level for PNG output ("none", "fast", "default", or "best")`)
+	flag.BoolVar(&p.PNGInterlace, "png-interlace", false, "Write interlaced (Adam7) PNG output")
+	flag.StringVar(&p.RawType, "raw-type", def.RawType,
+		`Sample type for raw output and input ("uint8", "uint16", or "float32")`)
+	flag.StringVar(&p.RawEndian, "raw-endian", def.RawEndian,
+		`Byte order for raw output and input ("little" or "big")`)
+	size := flag.String("size", "",
+		"Dimensions of raw --merge inputs, expressed as <width>x<height> (default: inputs are not raw)")
+	flag.StringVar(&p.CSVLayout, "csv-layout", def.CSVLayout,
+		`Layout of grayscale CSV and TSV output ("matrix" for one line per image row or "rows" for one x,y,value line per pixel)`)
+	channels := flag.String("channels", "",
+		`Comma-separated list of channels to compute and write with --split, --unpack, or --diff (e.g., "L,a"; default: all channels)`)
+	names := flag.String("names", "",
+		`Comma-separated list of names to use in output filenames in place of the built-in channel names, in channel order, with --split, --unpack, or --diff (e.g., "hue,sat,light")`)
+	flag.StringVar(&p.NameScheme, "name-scheme", def.NameScheme,
+		`Form of the channel names used in output filenames with --split, --unpack, or --diff ("mixed" for the built-in names, "lower" for lowercase names, or "numeric" for zero-padded channel numbers)`)
+	flag.StringVar(&p.Manifest, "manifest", "",
+		"Name of a JSON manifest describing the channels to write in addition to the channels themselves with --split (which --merge accepts in place of the channel files)")
+	flag.StringVar(&p.Montage, "montage", "",
+		"Name of a contact-sheet image showing all channels side by side to write in addition to the channels themselves with --split")
+	flag.BoolVar(&p.Visualize, "visualize", false,
+		"Write split channels as tinted color images for presentation rather than as grayscale images for merging")
+	flag.BoolVar(&p.HueWheel, "hue-wheel", false,
+		"Write split hue channels (hcl, hsl, and hsluv) as fully saturated colors rather than as grayscale images")
+	flag.StringVar(&p.Colormap, "colormap", "",
+		`Render split channels through a scientific colormap ("viridis", "magma", "turbo", or "jet")`)
+	flag.IntVar(&p.Workers, "jobs", 0,
+		"Maximum number of rows to process, or of channel files to decode when merging, concurrently (default: the number of CPUs)")
+	flag.IntVar(&p.Workers, "j", 0, "Shorthand for --jobs")
+	flag.BoolVar(&p.Stream, "stream", false,
+		"Split or merge PNG files one band of rows at a time to bound memory usage")
+	flag.IntVar(&p.BandRows, "band-rows", def.BandRows,
+		"Number of rows per band with --stream")
+	flag.BoolVar(&p.Progress, "progress", false,
+		"Report the percentage of rows split or merged and the estimated time remaining on the standard error device")
+	flag.StringVar(&p.Accel, "accel", def.Accel,
+		`Acceleration backend with which to split and merge linrgb, xyz, and ycbcr channels ("auto" for the fastest available, "none" for the per-pixel conversions, or one of `+strings.Join(accelNames(), ", ")+`)`)
+	timings := flag.Bool("timings", false,
+		"Report the time spent decoding, converting, and encoding each file split or merged (and in total, when splitting multiple files)")
+	flag.BoolVar(&p.Recursive, "recursive", false,
+		"Include images in subdirectories of directories named as inputs to --split, --info, --verify, or --watch")
+	flag.BoolVar(&p.Watch, "watch", false,
+		"Monitor the input directory and split each image file (or, with --merge, merge each ZIP bundle or manifest) that appears in it")
+	gamma := flag.String("gamma", "",
+		"Gamma exponent with which to encode split channels as v^(1/gamma) and decode merged channels, either for all color channels or as a comma-separated list of <channel>=<exponent> pairs")
+	lut := flag.String("lut", "",
+		"Comma-separated list of <channel>=<filename> pairs specifying 1D LUTs (two-column text or .cube files) through which to map channels after splitting or before merging")
+	lut3d := flag.String("lut3d", "",
+		"3D LUT (.cube file) through which to map colors before splitting or after merging")
+	equalize := flag.String("equalize", "",
+		"Comma-separated list of channels to histogram-equalize after splitting or before merging")
+	autoContrast := flag.String("auto-contrast", "",
+		"Comma-separated list of channels to stretch to the full range after splitting or before merging")
+	normalize := flag.Bool("normalize", false,
+		"Stretch each split channel to the full range, recording the original range so that --merge can undo the stretch")
+	flag.BoolVar(&p.Opaque, "opaque", false,
+		"Discard the alpha channel of the image to split or of the merged image (or, with --background, composite the image over a solid color)")
+	flag.StringVar(&p.Background, "background", "",
+		`Color, as "#rrggbb", over which to composite transparent pixels (implies --opaque)`)
+	flag.BoolVar(&p.VisibleOnly, "ignore-transparent", false,
+		"Exclude fully transparent pixels from --equalize, --auto-contrast, --normalize, clipping counts, and --deltae statistics")
+	flag.StringVar(&p.ClipMask, "clip-mask", "",
+		"Image file in which to mark in white the pixels whose values were clipped when splitting or merging")
+	fill := flag.String("fill", "",
+		"Comma-separated list of <channel>=<value> pairs, with values from 0.0 to 1.0, specifying channels to fill with a constant rather than read from a file when merging")
+	gamut := flag.String("gamut", def.Gamut,
+		`How to map merged colors that lie outside the sRGB gamut: "clamp" each component, "scale-chroma" at constant lightness and hue, "project" toward mid-gray at constant hue, or "error" to abort`)
+	mismatch := flag.String("mismatch", def.Mismatch,
+		`How to merge channels whose dimensions differ: "error", "crop" to their intersection, "pad" (or "pad:<value>", with a value from 0.0 to 1.0) to their union, or "resize" to the largest width and height`)
+	flag.StringVar(&p.ResizeFilter, "resize", def.ResizeFilter,
+		`Scale merge inputs to the largest width and height among them using the given filter ("nearest", "bilinear", or "catmull-rom"); implies --mismatch=resize`)
+	rng := flag.String("range", "",
+		`Range of channel values, in conventional units, that split Lab or Luv channels represent: "srgb" for the smallest ranges that hold all sRGB colors or a comma-separated list of <channel>=<min>:<max> pairs (default: 0:100 for L* and -100:100 otherwise)`)
+	signed := flag.String("signed", def.Signed,
+		`Encoding of signed channels such as a* and b*: "offset" binary, with zero as mid-gray; "twos-complement"; or "split" into separate files of positive and negative values`)
+	chromaMax := flag.Float64("chroma-max", 0,
+		"Maximum chroma, in conventional units, that a split HCL C channel represents (default 100)")
+	encode := flag.String("encode", "linear",
+		`Encoding of split lightness or luminance channels (the color channels for RGB color spaces): "linear" or "log", which maps a value v to log2(1 + v/<black>)/<stops> to preserve high-dynamic-range highlights`)
+	logBlack := flag.Float64("log-black", 1.0/1024.0,
+		"Black point of --encode=log, the channel value, relative to a white of 1.0, below which values are encoded nearly linearly")
+	logStops := flag.Float64("log-stops", 18,
+		"Number of doublings above the black point that --encode=log represents")
+	subsample := flag.String("subsample", "4:4:4",
+		`Chroma subsampling with which to write the chroma channels of L*a*b*, L*u*v*, xyY, or Y'CbCr: "4:4:4" (none), "4:2:2" (half width), or "4:2:0" (half width and height)`)
+	icc := flag.String("icc", def.ICC,
+		`How to treat ICC profiles embedded in PNG, JPEG, and TIFF inputs: "convert" colors from the profile's color space to sRGB or "ignore" the profile`)
+	embedProfile := flag.String("embed-profile", def.EmbedProfile,
+		`How to tag color PNG and TIFF output as sRGB: with an ICC profile and, for PNG, a cICP chunk ("both"), with only an "icc" profile, with only a "cicp" chunk, or not at all ("none")`)
+	flag.StringVar(&p.UpsampleFilter, "upsample", def.UpsampleFilter,
+		`Filter with which to upsample subsampled chroma channels when merging ("nearest", "bilinear", or "catmull-rom")`)
+	matrix := flag.String("matrix", def.YCbCrMatrix,
+		`Matrix with which to convert to and from Y'CbCr ("bt601" or "bt709")`)
+	blackGen := flag.String("black-generation", "1",
+		`Black-generation curve with which to split into CMYK, as <amount> or <amount>:<start>: print black with <amount> (0.0 to 1.0) of black ink, ramping down linearly to no black ink for colors whose gray component is at most <start>`)
+	dither := flag.String("dither", def.Dither,
+		`Dithering to apply when quantizing to 8 bits, whether for --depth=8, for formats that store only 8 bits ("none", "floyd-steinberg", or "blue-noise")`)
+	flag.StringVar(&p.Depth, "depth", "",
+		`Pixel depth of output files ("8", "16", or "32f"; default: 32f for formats that store floating-point samples and 16 otherwise)`)
+	flag.BoolVar(&p.Lossless, "lossless", false,
+		"Split into floating-point channels, including any alpha channel, that --merge can reassemble into the original image exactly, and merge without mapping colors into the sRGB gamut")
 	flag.Parse()
 	p.InputNames = flag.Args()
-	p.WhitePoint = parseWhitePoint(*white)
+	if strings.EqualFold(strings.TrimSpace(*white), "auto") {
+		p.AutoWhite = parseWhiteEstimator(*whiteEstimator)
+		p.WhitePoint = colorful.D65 // Placeholder until an image is read
+	} else {
+		p.WhitePoint = parseWhitePoint(*white, parseObserver(*observer))
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	// The "alpha" pseudo color space extracts only the alpha channel when
+	// splitting and applies a grayscale image as the alpha channel of a
+	// color image when merging.
+	if cleanColorSpaceName(p.OrigColorSpace) == "alpha" {
+		switch {
+		case *split && *channels == "":
+			*channels = "alpha"
+		case *split:
+			notify.Fatal("--channels cannot be used with --space=alpha")
+		case *merge && !p.Watch:
+			*merge = false
+			p.Replace = "alpha"
+		default:
+			notify.Fatal("--space=alpha can be used only with --split or --merge")
+		}
+		p.OrigColorSpace = "rgba"
+	}
+
+	// When merging from a ZIP bundle or a manifest, take the color space
+	// and white point from the manifest unless they were specified
+	// explicitly.  A manifest additionally lists the channel files.
+	var man *channelManifest
+	if *merge && len(p.InputNames) == 1 && (isZipFile(p.InputNames[0]) || isManifestFile(p.InputNames[0])) {
+		if isZipFile(p.InputNames[0]) {
+			man = ReadZipManifest(p.InputNames[0])
+		} else {
+			man = ReadManifest(p.InputNames[0])
+			p.InputNames = make([]string, len(man.Channels))
+			for i, ent := range man.Channels {
+				p.InputNames[i] = ent.File
+			}
+		}
+		if !given["space"] && man.Space != "" {
+			p.OrigColorSpace = man.Space
+			if _, alpha, _ := lookupColorSpace(man.Space); man.Alpha && !alpha {
+				p.OrigColorSpace += "a" // Alpha added by --keep-alpha
+			}
+		}
+		if !given["white"] && man.WhitePoint != ([3]float64{}) {
+			p.WhitePoint = man.WhitePoint
+		}
+		p.Premultiplied = p.Premultiplied || man.Premult
+		p.Lossless = p.Lossless || man.Lossless
+	}
+
+	// --lossless retains any alpha channel.
+	if p.Lossless && (*split || *merge) && !p.Opaque && p.Background == "" {
+		p.KeepAlpha = true
+	}
+
+	// When merging files written by --split without an explicit color
+	// space, infer the color space and channel order from the channel
+	// names embedded in the filenames.  Given --space, the files are
+	// merged in the order given, which permits deliberate channel swaps.
+	if *merge && !p.Watch && *fill == "" && !hasNamedInputs(p.InputNames) && !given["space"] {
+		p.OrigColorSpace, p.InputNames = detectMergeOrder(p.InputNames, p.OrigColorSpace)
+	}
+
+	if p.Premultiplied && !*split && !*merge && !*convert && p.Replace == "" {
+		notify.Fatal("--premultiplied can be used only with --split, --merge, --convert, or --replace")
+	}
+	if p.VisibleOnly && !*split && !*merge && p.DeltaE == "" {
+		notify.Fatal("--ignore-transparent can be used only with --split, --merge, or --deltae")
+	}
+
+	// Merge an alpha channel given by --alpha-file after all other
+	// channels.
+	if *alphaFile != "" {
+		if !*merge || p.Watch {
+			notify.Fatal("--alpha-file can be used only with --merge and not with --watch")
+		}
+		if _, alpha, ok := lookupColorSpace(p.OrigColorSpace); ok && alpha {
+			notify.Fatalf("--alpha-file cannot be used with a color space that already includes alpha (%q)", p.OrigColorSpace)
+		}
+		p.OrigColorSpace += "a"
+		if hasNamedInputs(p.InputNames) {
+			p.InputNames = append(p.InputNames, "alpha="+*alphaFile)
+		} else {
+			p.InputNames = append(p.InputNames, *alphaFile)
+		}
+	}
+
+	// With --keep-alpha, merge an alpha channel if there is one more
+	// input file than the color space has channels.
+	if p.KeepAlpha {
+		if !*split && !*merge {
+			notify.Fatal("--keep-alpha can be used only with --split or --merge")
+		}
+		cs, alpha, ok := lookupColorSpace(p.OrigColorSpace)
+		if *merge && man == nil && !p.Watch && ok && !alpha && len(p.InputNames) == colorChannelCount(cs)+1 {
+			p.OrigColorSpace += "a"
+		}
+	}
 
-	// Validate the use of the --split and --merge arguments.
+	// Ensure that a valid output format was designated.
+	p.Format = strings.ToLower(p.Format)
+	if _, ok := outputFormats[p.Format]; p.Format != "" && !ok {
+		notify.Fatalf("--format requires one of %s (not %q)",
+			strings.Join(outputFormatNames(), ", "), p.Format)
+	}
+	p.Depth = strings.ToLower(p.Depth)
+	if p.Depth != "" && !outputDepths[p.Depth] {
+		notify.Fatalf(`--depth requires one of "8", "16", or "32f" (not %q)`, p.Depth)
+	}
+	p.RawType = strings.ToLower(p.RawType)
+	if _, ok := rawSampleSizes[p.RawType]; !ok {
+		notify.Fatalf(`--raw-type requires one of "uint8", "uint16", or "float32" (not %q)`, p.RawType)
+	}
+	p.RawEndian = strings.ToLower(p.RawEndian)
+	if _, ok := rawByteOrders[p.RawEndian]; !ok {
+		notify.Fatalf(`--raw-endian requires either "little" or "big" (not %q)`, p.RawEndian)
+	}
+	if *size != "" {
+		p.RawSize = parseSize(*size)
+	}
+	p.CSVLayout = strings.ToLower(p.CSVLayout)
+	if !tableLayouts[p.CSVLayout] {
+		notify.Fatalf(`--csv-layout requires either "matrix" or "rows" (not %q)`, p.CSVLayout)
+	}
+	p.PNGCompression = strings.ToLower(p.PNGCompression)
+	if _, ok := pngCompressionLevels[p.PNGCompression]; !ok {
+		notify.Fatalf(`--png-compression requires one of "none", "fast", "default", or "best" (not %q)`,
+			p.PNGCompression)
+	}
+
+	p.Accel = strings.ToLower(p.Accel)
+	if _, ok := accelBackends[p.Accel]; !ok && p.Accel != "auto" && p.Accel != "none" {
+		notify.Fatalf(`--accel requires "auto", "none", or one of %s (not %q)`,
+			strings.Join(accelNames(), ", "), p.Accel)
+	}
+	if p.Workers < 0 {
+		notify.Fatalf("--jobs must be nonnegative (not %d)", p.Workers)
+	}
+
+	// Validate the use of the --split, --merge, --convert, --replace,
+	// --pack, --unpack, --combine, --diff, --deltae, --info, and --verify
+	// arguments.
+	nModes := 0
+	for _, m := range []bool{*split, *merge, *convert, p.Replace != "", *pack, *unpack, *combine, *diff, p.DeltaE != "", *info, *verify} {
+		if m {
+			nModes++
+		}
+	}
+	switch {
+	case nModes > 1:
+		notify.Fatal("--split, --merge, --convert, --replace, --pack, --unpack, --combine, --diff, --deltae, --info, and --verify are mutually exclusive")
+	case nModes == 0:
+		notify.Fatal("Exactly one of --split, --merge, --convert, --replace, --pack, --unpack, --combine, --diff, --deltae, --info, and --verify must be specified")
+	}
+	p.Split = *split
+	p.Convert = *convert
+	p.Pack = *pack
+	p.Unpack = *unpack
+	p.Combine = *combine
+	p.Diff = *diff
+	p.Info = *info
+	p.Verify = *verify
+	if p.DeltaE != "" {
+		metric := strings.TrimPrefix(strings.ToLower(p.DeltaE), "de")
+		if _, ok := deltaEMetrics[metric]; !ok {
+			notify.Fatalf(`--deltae requires one of "76", "94", or "2000" (not %q)`, p.DeltaE)
+		}
+		p.DeltaE = metric
+		if p.DeltaEMax <= 0.0 {
+			notify.Fatalf("--deltae-max must be positive (not %g)", p.DeltaEMax)
+		}
+	}
+	if p.Montage != "" && !p.Split {
+		notify.Fatal("--montage can be used only with --split")
+	}
+	if p.ClipMask != "" && !p.Split && !*merge {
+		notify.Fatal("--clip-mask can be used only with --split or --merge")
+	}
+	if p.Manifest != "" && !p.Split {
+		notify.Fatal("--manifest can be used only with --split")
+	}
+	if p.Visualize && !p.Split {
+		notify.Fatal("--visualize can be used only with --split")
+	}
+	if p.HueWheel && !p.Split {
+		notify.Fatal("--hue-wheel can be used only with --split")
+	}
+	if p.Colormap != "" {
+		p.Colormap = strings.ToLower(p.Colormap)
+		if _, ok := colormaps[p.Colormap]; !ok {
+			notify.Fatalf(`--colormap requires one of "viridis", "magma", "turbo", or "jet" (not %q)`, p.Colormap)
+		}
+		switch {
+		case !p.Split:
+			notify.Fatal("--colormap can be used only with --split")
+		case p.Visualize:
+			notify.Fatal("--colormap and --visualize are mutually exclusive")
+		}
+	}
 	switch {
-	case *split && *merge:
-		notify.Fatal("--split and --merge are mutually exclusive")
-	case *split:
-		p.Split = true
-	case *merge:
-		p.Split = false
-	case !*split && !*merge:
-		notify.Fatal("Exactly one of --split and --merge must be specified")
+	case p.Watch:
+		if !p.Split && !*merge {
+			notify.Fatal("--watch can be used only with --split or --merge")
+		}
+		if *merge && (given["space"] || given["white"]) {
+			notify.Fatal("With --merge --watch, the color space and white point are taken from each manifest")
+		}
+	case p.Split || p.Info || p.Verify:
+		p.InputNames = expandInputs(p.InputNames, p.Recursive)
+	case p.Recursive:
+		notify.Fatal("--recursive can be used only with --split, --info, --verify, or --watch")
+	}
+	if *channels != "" {
+		if !p.Split && !p.Unpack && !p.Diff {
+			notify.Fatal("--channels can be used only with --split, --unpack, or --diff")
+		}
+		p.Channels = parseChannelList("channels", *channels)
 	}
 
 	// Ensure a valid color space was designated.  Determine if an alpha
 	// channel should be used.
-	p.ColorSpace = cleanColorSpaceName(p.OrigColorSpace)
 	var validCS bool
-	for _, cs := range colorSpaceList {
-		if p.ColorSpace == cs {
-			validCS = true
-			break
+	p.ColorSpace, p.Alpha, validCS = lookupColorSpace(p.OrigColorSpace)
+	if !validCS {
+		notify.Fatalf("--space requires one of %s (not %q)",
+			colorSpaceString, p.OrigColorSpace)
+	}
+
+	// Parse the options for removing transparency.
+	if p.Background != "" {
+		parseBackground(p.Background)
+		p.Opaque = true
+	}
+	if p.Opaque {
+		switch {
+		case !p.Split && !*merge:
+			notify.Fatal("--opaque and --background can be used only with --split or --merge")
+		case p.Split && (p.Alpha || p.KeepAlpha):
+			notify.Fatal("--opaque and --background cannot split an alpha channel")
 		}
 	}
-	if !validCS && len(p.ColorSpace) >= 1 && p.ColorSpace[len(p.ColorSpace)-1] == 'a' {
-		// Second chance: Look for an alpha channel.
-		opaque := p.ColorSpace[:len(p.ColorSpace)-1]
-		for _, cs := range colorSpaceList {
-			if opaque == cs {
-				validCS = true
-				p.ColorSpace = opaque
-				p.Alpha = true
-				break
+
+	// Parse the dithering mode.
+	p.Dither = parseDither(*dither)
+
+	// Parse the handling of out-of-gamut colors.
+	p.Gamut = parseGamut(*gamut)
+	if given["gamut"] && !*merge {
+		notify.Fatal("--gamut can be used only with --merge")
+	}
+	if given["gamut"] && p.Lossless {
+		notify.Fatal("--gamut cannot be used with --lossless, which never maps colors into the sRGB gamut")
+	}
+
+	// Parse the handling of channels whose dimensions differ.
+	p.Mismatch, p.PadValue = parseMismatch(*mismatch)
+	if given["mismatch"] && !*merge {
+		notify.Fatal("--mismatch can be used only with --merge")
+	}
+
+	// Ensure that a valid resizing filter was designated.
+	p.ResizeFilter = strings.ToLower(p.ResizeFilter)
+	if _, ok := resampleKernels[p.ResizeFilter]; !ok {
+		notify.Fatalf("--resize requires one of %s (not %q)",
+			strings.Join(resizeFilterNames, ", "), p.ResizeFilter)
+	}
+	p.ICC = parseICCMode(*icc)
+	p.EmbedProfile = parseEmbedMode(*embedProfile)
+	p.UpsampleFilter = strings.ToLower(p.UpsampleFilter)
+	if _, ok := resampleKernels[p.UpsampleFilter]; !ok {
+		notify.Fatalf("--upsample requires one of %s (not %q)",
+			strings.Join(resizeFilterNames, ", "), p.UpsampleFilter)
+	}
+	if given["upsample"] && !*merge {
+		notify.Fatal("--upsample can be used only with --merge")
+	}
+	if given["resize"] {
+		if !*merge {
+			notify.Fatal("--resize can be used only with --merge")
+		}
+		if given["mismatch"] && p.Mismatch != "resize" {
+			notify.Fatalf("--resize conflicts with --mismatch=%s", p.Mismatch)
+		}
+		p.Mismatch = "resize"
+	}
+
+	// Parse the gamma exponents to apply to each channel.  When merging
+	// from a ZIP bundle or a manifest, take the exponents from the
+	// manifest unless they were specified explicitly.
+	switch {
+	case *gamma != "":
+		if !p.Split && !*merge {
+			notify.Fatal("--gamma can be used only with --split or --merge")
+		}
+		if *merge && p.Watch {
+			notify.Fatal("With --merge --watch, the gamma exponents are taken from each manifest")
+		}
+		p.Gamma = parseGamma(p, *gamma)
+	case man != nil:
+		p.Gamma = manifestGamma(man)
+	}
+
+	// Read the 1D LUTs to apply to each channel.
+	if *lut != "" {
+		if !p.Split && !*merge {
+			notify.Fatal("--lut can be used only with --split or --merge")
+		}
+		if *merge && p.Watch {
+			notify.Fatal("--lut cannot be used with --merge --watch")
+		}
+		p.LUTs = parseLUTs(p, *lut)
+	}
+
+	// Read the 3D LUT to apply to colors.
+	if *lut3d != "" {
+		if !p.Split && !*merge {
+			notify.Fatal("--lut3d can be used only with --split or --merge")
+		}
+		p.LUT3D = ReadLUT3D(*lut3d)
+	}
+
+	// Parse the lists of channels to equalize or stretch.  When merging
+	// from a ZIP bundle or a manifest, undo the curves the manifest
+	// records.
+	if *normalize && !p.Split {
+		notify.Fatal("--normalize can be used only with --split")
+	}
+	if *equalize != "" || *autoContrast != "" || *normalize {
+		if !p.Split && !*merge {
+			notify.Fatal("--equalize and --auto-contrast can be used only with --split or --merge")
+		}
+		if *merge && p.Watch {
+			notify.Fatal("--equalize and --auto-contrast cannot be used with --merge --watch")
+		}
+		parseAutoTone(p, *equalize, *autoContrast, *normalize)
+	}
+	if *normalize {
+		requireChannelText(p, "--normalize")
+	}
+	if man != nil {
+		p.ToneCurves = manifestToneCurves(man)
+	}
+
+	// Parse the encoding of signed channels.  When merging from a ZIP
+	// bundle or a manifest, take the encoding from the manifest unless it
+	// was specified explicitly.
+	p.Signed = parseSigned(*signed)
+	if given["signed"] {
+		if !p.Split && !*merge {
+			notify.Fatal("--signed can be used only with --split or --merge")
+		}
+		if *merge && p.Watch {
+			notify.Fatal("With --merge --watch, the encoding of signed channels is taken from each manifest")
+		}
+		if p.Signed == "split" && hasNamedInputs(p.InputNames) {
+			notify.Fatal("--signed=split cannot be used with <channel>=<filename> merge inputs")
+		}
+	} else if man != nil && man.Signed != "" {
+		p.Signed = parseSigned(man.Signed)
+	}
+
+	// Parse the ranges of values that channels represent.  When merging
+	// from a ZIP bundle or a manifest, take the ranges from the manifest
+	// unless they were specified explicitly.
+	switch {
+	case *rng != "":
+		if !p.Split && !*merge {
+			notify.Fatal("--range can be used only with --split or --merge")
+		}
+		if *merge && p.Watch {
+			notify.Fatal("With --merge --watch, the ranges are taken from each manifest")
+		}
+		p.Ranges = parseRanges(p, *rng)
+		warnChannelText(p, "--range")
+	case man != nil:
+		p.Ranges = manifestRanges(p, man)
+	}
+	if given["chroma-max"] {
+		if !p.Split && !*merge {
+			notify.Fatal("--chroma-max can be used only with --split or --merge")
+		}
+		if *merge && p.Watch {
+			notify.Fatal("With --merge --watch, the maximum chroma is taken from each manifest")
+		}
+		applyChromaMax(p, *chromaMax)
+		warnChannelText(p, "--chroma-max")
+	}
+
+	// Parse the Y'CbCr matrix.  When merging from a ZIP bundle or a
+	// manifest, take the matrix from the manifest unless it was specified
+	// explicitly.
+	p.YCbCrMatrix = parseYCbCrMatrix(*matrix)
+	if given["matrix"] {
+		if p.ColorSpace != "ycbcr" {
+			notify.Fatal("--matrix can be used only with --space=ycbcr")
+		}
+		if *merge && p.Watch {
+			notify.Fatal("With --merge --watch, the Y'CbCr matrix is taken from each manifest")
+		}
+	} else if man != nil && man.Matrix != "" {
+		p.YCbCrMatrix = parseYCbCrMatrix(man.Matrix)
+	}
+
+	// Parse the chromatic adaptation transform.  When merging from a ZIP
+	// bundle or a manifest, take the transform from the manifest unless it
+	// was specified explicitly.
+	p.CAT = parseCAT(*cat)
+	if given["white-estimator"] && p.AutoWhite == "" {
+		notify.Fatal("--white-estimator can be used only with --white=auto")
+	}
+	if p.AutoWhite != "" {
+		// An estimated white point is the scene's own white, not a
+		// different viewing illuminant, so colors are taken relative
+		// to it without adaptation.
+		if !p.Split || !whiteRelative(p.ColorSpace) {
+			notify.Fatal("--white=auto can be used only with --split and --space=hcl, lab, or luv")
+		}
+		if given["cat"] {
+			notify.Fatal("--cat cannot be used with --white=auto")
+		}
+		p.CAT = "none"
+	} else if given["cat"] {
+		if *merge && p.Watch {
+			notify.Fatal("With --merge --watch, the chromatic adaptation transform is taken from each manifest")
+		}
+	} else if man != nil && man.CAT != "" {
+		p.CAT = parseCAT(man.CAT)
+	}
+
+	// Parse the chroma subsampling.  When merging from a ZIP bundle or a
+	// manifest, take the subsampling from the manifest unless it was
+	// specified explicitly.
+	switch {
+	case given["subsample"]:
+		if !p.Split && !*merge {
+			notify.Fatal("--subsample can be used only with --split or --merge")
+		}
+		if *merge && p.Watch {
+			notify.Fatal("With --merge --watch, the chroma subsampling is taken from each manifest")
+		}
+		p.Subsample = parseSubsample(p, *subsample)
+	case man != nil:
+		p.Subsample = man.Subsample
+	}
+
+	// Parse the black-generation curve.
+	if given["black-generation"] {
+		if p.ColorSpace != "cmyk" || *merge {
+			notify.Fatal("--black-generation can be used only with --space=cmyk and not with --merge")
+		}
+		p.BlackGen = parseBlackGen(*blackGen)
+	}
+
+	// Parse the logarithmic encoding of lightness or luminance channels.
+	// When merging from a ZIP bundle or a manifest, take the encoding from
+	// the manifest unless it was specified explicitly.
+	switch {
+	case given["encode"] || given["log-black"] || given["log-stops"]:
+		if !p.Split && !*merge {
+			notify.Fatal("--encode can be used only with --split or --merge")
+		}
+		if *merge && p.Watch {
+			notify.Fatal("With --merge --watch, the channel encodings are taken from each manifest")
+		}
+		if strings.ToLower(*encode) != "log" && (given["log-black"] || given["log-stops"]) {
+			notify.Fatal("--log-black and --log-stops require --encode=log")
+		}
+		p.LogScales = parseLogScales(p, *encode, *logBlack, *logStops)
+		if p.LogScales != nil {
+			warnChannelText(p, "--encode=log")
+		}
+	case man != nil:
+		p.LogScales = manifestLogScales(p, man)
+	}
+
+	// Parse the list of channels to fill with a constant.
+	if *fill != "" {
+		if !*merge || p.Watch {
+			notify.Fatal("--fill can be used only with --merge and not with --watch")
+		}
+		p.Fill = parseFill(p, *fill)
+	}
+
+	// Put merge inputs given as <channel>=<filename> into merge order.
+	if *merge && hasNamedInputs(p.InputNames) {
+		p.InputNames = orderNamedInputs(p)
+	}
+
+	// Ensure that a valid channel-naming scheme was designated.
+	p.NameScheme = strings.ToLower(p.NameScheme)
+	if !nameSchemes[p.NameScheme] {
+		notify.Fatalf(`--name-scheme requires one of "mixed", "lower", or "numeric" (not %q)`, p.NameScheme)
+	}
+	if given["name-scheme"] && !p.Split && !p.Unpack && !p.Diff {
+		notify.Fatal("--name-scheme can be used only with --split, --unpack, or --diff")
+	}
+
+	// Ensure that custom channel names, if any, correspond one-to-one
+	// with the built-in channel names.
+	if *names != "" {
+		if !p.Split && !p.Unpack && !p.Diff {
+			notify.Fatal("--names can be used only with --split, --unpack, or --diff")
+		}
+		if p.NameScheme != "mixed" {
+			notify.Fatal("--names and --name-scheme are mutually exclusive")
+		}
+		p.Names = parseChannelList("names", *names)
+		builtin := builtinChannelNames(p)
+		if len(p.Names) != len(builtin) {
+			notify.Fatalf("--names requires %d names (for %s) but saw %d",
+				len(builtin), strings.Join(builtin, ", "), len(p.Names))
+		}
+		used := make(map[string]string, len(p.Names))
+		for _, nm := range p.Names {
+			key := strings.ToLower(nm)
+			switch prev, ok := used[key]; {
+			case ok && prev == nm:
+				notify.Fatalf("--names contains %q more than once", nm)
+			case ok:
+				notify.Fatalf("--names contains %q and %q, which would collide on a case-insensitive filesystem", prev, nm)
 			}
+			used[key] = nm
 		}
 	}
-	if !validCS {
-		notify.Fatalf("--space requires one of %s (not %q)",
-			colorSpaceString, p.OrigColorSpace)
+
+	// Progress and timings are reported only for splits and merges.
+	if p.Progress && !p.Split && !*merge {
+		notify.Fatal("--progress can be used only with --split or --merge")
+	}
+	if *timings {
+		if (!p.Split && !*merge) || p.Watch {
+			notify.Fatal("--timings can be used only with --split or --merge and not with --watch")
+		}
+		p.Times = new(stageTimes)
 	}
-}
 
-func main() {
-	notify = log.New(os.Stderr, os.Args[0]+": ", 0)
-	var p Parameters
-	ParseCommandLine(&p)
-	if p.Split {
-		SplitImage(&p)
-	} else {
-		MergeChannels(&p)
+	// Ensure that the requested operations preserve all information.
+	if p.Lossless {
+		if !p.Split && !*merge {
+			notify.Fatal("--lossless can be used only with --split or --merge")
+		}
+		checkLosslessParams(p)
+	}
+
+	// Ensure that the requested operations can be performed one band of
+	// rows at a time.
+	if given["band-rows"] && !p.Stream {
+		notify.Fatal("--band-rows requires --stream")
+	}
+	if p.Stream {
+		if !p.Split && !*merge {
+			notify.Fatal("--stream can be used only with --split or --merge")
+		}
+		checkBandParams(p)
 	}
 }
@@ -0,0 +1,53 @@
+//go:build !js || !wasm
+// +build !js !wasm
+
+// This file provides the entry point for the command-line program.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+)
+
+func main() {
+	notify = log.New(os.Stderr, os.Args[0]+": ", 0)
+	var p Parameters
+	ParseCommandLine(&p)
+
+	// Stop cleanly if the user interrupts a long-running conversion.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var err error
+	switch {
+	case p.Watch:
+		err = watchDirectory(ctx, &p)
+	case p.Info:
+		err = describeImages(&p)
+	case p.Verify:
+		err = verifyImages(ctx, &p)
+	case p.DeltaE != "":
+		err = deltaEImages(ctx, &p)
+	case p.Diff:
+		err = diffImages(ctx, &p)
+	case p.Combine:
+		err = combineChannels(ctx, &p)
+	case p.Unpack:
+		err = unpackChannels(ctx, &p)
+	case p.Pack:
+		err = packChannels(ctx, &p)
+	case p.Replace != "":
+		err = replaceChannel(ctx, &p)
+	case p.Convert:
+		err = convertImage(ctx, &p)
+	case p.Split:
+		err = splitImage(ctx, &p)
+	default:
+		err = mergeChannels(ctx, &p)
+	}
+	if err != nil {
+		notify.Fatal(err)
+	}
+}
@@ -0,0 +1,277 @@
+//go:build js && wasm
+// +build js,wasm
+
+// This file provides the entry point for the WebAssembly build.  Rather than
+// parsing a command line, it exposes split and merge functions to JavaScript
+// as a global colorChannels object that operates on typed arrays.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"syscall/js"
+)
+
+func main() {
+	notify = log.New(os.Stderr, "color-channels: ", 0)
+	js.Global().Set("colorChannels", js.ValueOf(map[string]interface{}{
+		"split": js.FuncOf(jsFunc(jsSplit)),
+		"merge": js.FuncOf(jsFunc(jsMerge)),
+	}))
+	select {}
+}
+
+// jsFunc wraps a function so that any error it returns or any panic it
+// raises is returned to JavaScript as an Error object.
+func jsFunc(fn func(args []js.Value) (interface{}, error)) func(js.Value, []js.Value) interface{} {
+	return func(this js.Value, args []js.Value) (result interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = js.Global().Get("Error").New(fmt.Sprint(r))
+			}
+		}()
+		v, err := fn(args)
+		if err != nil {
+			return js.Global().Get("Error").New(err.Error())
+		}
+		return v
+	}
+}
+
+// jsOptionType returns the named field of a JavaScript options object and
+// reports whether the field is present.  If the field is present but does
+// not have the wanted type, jsOptionType returns an error that names the
+// field and both types.
+func jsOptionType(obj js.Value, name string, want js.Type) (js.Value, bool, error) {
+	v := obj.Get(name)
+	switch v.Type() {
+	case js.TypeUndefined:
+		return v, false, nil
+	case want:
+		return v, true, nil
+	default:
+		return v, false, fmt.Errorf("option %q has type %s; expected %s", name, v.Type(), want)
+	}
+}
+
+// jsOptions converts a JavaScript options object, which may contain space,
+// white, observer, and depth fields, to a list of options.  It returns an
+// error if a field has the wrong type.
+func jsOptions(obj js.Value) ([]option, error) {
+	var opts []option
+	if obj.Type() != js.TypeObject {
+		return opts, nil
+	}
+	sp, ok, err := jsOptionType(obj, "space", js.TypeString)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		opts = append(opts, withColorSpace(sp.String()))
+	}
+	d, ok, err := jsOptionType(obj, "depth", js.TypeString)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		opts = append(opts, withDepth(d.String()))
+	}
+	obs, ok, err := jsOptionType(obj, "observer", js.TypeNumber)
+	if err != nil {
+		return nil, err
+	}
+	observer := 2
+	if ok {
+		observer = obs.Int()
+	}
+	wp := obj.Get("white")
+	switch {
+	case wp.Type() == js.TypeUndefined:
+	case wp.Type() == js.TypeString:
+		xyz, ok := standardIlluminant(wp.String(), observer)
+		if !ok {
+			return nil, fmt.Errorf(`white point must be a standard illuminant, as seen by a 2° or 10° observer, or a pair of chromaticity coordinates (not %q)`, wp.String())
+		}
+		opts = append(opts, withWhitePoint(xyz))
+	case wp.Type() == js.TypeObject && wp.Length() == 2 &&
+		wp.Index(0).Type() == js.TypeNumber && wp.Index(1).Type() == js.TypeNumber:
+		opts = append(opts, withWhitePoint(chromaticityToXYZ(wp.Index(0).Float(), wp.Index(1).Float())))
+	default:
+		return nil, fmt.Errorf(`option "white" has type %s; expected a string or an array of two numbers`, wp.Type())
+	}
+	return opts, nil
+}
+
+// jsFloats copies a JavaScript Float32Array, Uint8Array, or
+// Uint8ClampedArray to a slice of float32s.  Integer samples are scaled from
+// [0, 255] to [0.0, 1.0].
+func jsFloats(arr js.Value) ([]float32, error) {
+	ctor := arr.Get("constructor").Get("name").String()
+	n := arr.Length()
+	switch ctor {
+	case "Uint8Array", "Uint8ClampedArray":
+		b := make([]byte, n)
+		js.CopyBytesToGo(b, arr)
+		f := make([]float32, n)
+		for i, v := range b {
+			f[i] = float32(v) / 255.0
+		}
+		return f, nil
+	case "Float32Array":
+		u8 := js.Global().Get("Uint8Array").New(arr.Get("buffer"), arr.Get("byteOffset"), arr.Get("byteLength"))
+		b := make([]byte, 4*n)
+		js.CopyBytesToGo(b, u8)
+		f := make([]float32, n)
+		for i := range f {
+			f[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+		}
+		return f, nil
+	default:
+		return nil, fmt.Errorf("expected a Float32Array, Uint8Array, or Uint8ClampedArray but saw %s", ctor)
+	}
+}
+
+// jsFloat32Array copies a slice of float32s to a new JavaScript Float32Array.
+func jsFloat32Array(f []float32) js.Value {
+	b := make([]byte, 4*len(f))
+	for i, v := range f {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(v))
+	}
+	u8 := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(u8, b)
+	return js.Global().Get("Float32Array").New(u8.Get("buffer"))
+}
+
+// jsUint8ClampedArray copies a slice of float32s in [0.0, 1.0] to a new
+// JavaScript Uint8ClampedArray with values in [0, 255].
+func jsUint8ClampedArray(f []float32) js.Value {
+	b := make([]byte, len(f))
+	for i, v := range f {
+		b[i] = toUint8(float64(v))
+	}
+	u8 := js.Global().Get("Uint8ClampedArray").New(len(b))
+	js.CopyBytesToJS(u8, b)
+	return u8
+}
+
+// jsSplit implements colorChannels.split(pixels, width, height, options).
+// pixels holds non-premultiplied RGBA values, as in ImageData.data.  The
+// result is an object whose names field lists the channel names and whose
+// channels field holds one Float32Array per channel.
+func jsSplit(args []js.Value) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("split requires pixels, width, and height arguments")
+	}
+	pix, err := jsFloats(args[0])
+	if err != nil {
+		return nil, err
+	}
+	wd, ht := args[1].Int(), args[2].Int()
+	if len(pix) != 4*wd*ht {
+		return nil, fmt.Errorf("expected %d RGBA values but saw %d", 4*wd*ht, len(pix))
+	}
+	var optObj js.Value
+	if len(args) > 3 {
+		optObj = args[3]
+	}
+	opts, err := jsOptions(optObj)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSplitter(wd, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Split each row in turn.
+	names := s.Channels()
+	planes := make([][]float32, len(names))
+	for c := range planes {
+		planes[c] = make([]float32, 0, wd*ht)
+	}
+	for y := 0; y < ht; y++ {
+		err = s.WriteRow(pix[4*wd*y : 4*wd*(y+1)])
+		if err != nil {
+			return nil, err
+		}
+		rows, _ := s.Next()
+		for c, r := range rows {
+			planes[c] = append(planes[c], r...)
+		}
+	}
+
+	// Return the channels to JavaScript.
+	jsNames := make([]interface{}, len(names))
+	jsPlanes := make([]interface{}, len(names))
+	for c, nm := range names {
+		jsNames[c] = nm
+		jsPlanes[c] = jsFloat32Array(planes[c])
+	}
+	return map[string]interface{}{
+		"names":    jsNames,
+		"channels": jsPlanes,
+	}, nil
+}
+
+// jsMerge implements colorChannels.merge(channels, width, height, options).
+// channels is an array of typed arrays, one per channel.  The result is a
+// Uint8ClampedArray of non-premultiplied RGBA values, suitable for an
+// ImageData, or a Float32Array if options.depth is "32f".
+func jsMerge(args []js.Value) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("merge requires channels, width, and height arguments")
+	}
+	wd, ht := args[1].Int(), args[2].Int()
+	planes := make([][]float32, args[0].Length())
+	for c := range planes {
+		var err error
+		planes[c], err = jsFloats(args[0].Index(c))
+		if err != nil {
+			return nil, err
+		}
+		if len(planes[c]) != wd*ht {
+			return nil, fmt.Errorf("expected %d values in channel %d but saw %d", wd*ht, c, len(planes[c]))
+		}
+	}
+	var optObj js.Value
+	if len(args) > 3 {
+		optObj = args[3]
+	}
+	opts, err := jsOptions(optObj)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newParameters(opts...)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMerger(wd, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge each row in turn.
+	pix := make([]float32, 0, 4*wd*ht)
+	rows := make([][]float32, len(planes))
+	for y := 0; y < ht; y++ {
+		for c, pl := range planes {
+			rows[c] = pl[wd*y : wd*(y+1)]
+		}
+		err = m.WriteRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		row, _ := m.Next()
+		pix = append(pix, row...)
+	}
+
+	// Return the merged pixels to JavaScript.
+	if p.Depth == "32f" {
+		return jsFloat32Array(pix), nil
+	}
+	return jsUint8ClampedArray(pix), nil
+}
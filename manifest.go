@@ -0,0 +1,202 @@
+// This file provides support for manifests, which describe a set of split
+// channels so that they can be merged without the user's having to specify
+// the color space, white point, or channel order.  Manifests are stored
+// within ZIP bundles and can also be written alongside individual channel
+// files.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A channelManifest describes a set of split channels.
+type channelManifest struct {
+	Space      string          `json:"space"`                   // Color space, as written by the user
+	WhitePoint [3]float64      `json:"white_point"`             // White reference point as an XYZ color
+	Width      int             `json:"width"`                   // Width of each full-resolution channel in pixels
+	Height     int             `json:"height"`                  // Height of each full-resolution channel in pixels
+	Alpha      bool            `json:"alpha"`                   // true: the final channel is an alpha channel; false: no alpha channel
+	Signed     string          `json:"signed,omitempty"`        // Encoding of signed channels, as given to --signed ("" for offset binary)
+	Matrix     string          `json:"matrix,omitempty"`        // Y'CbCr matrix, as given to --matrix ("" for BT.601 or for other color spaces)
+	CAT        string          `json:"cat,omitempty"`           // Chromatic adaptation transform, as given to --cat ("" for none or for color spaces without a white point)
+	Subsample  string          `json:"chroma,omitempty"`        // Chroma subsampling, as given to --subsample ("" for none)
+	Premult    bool            `json:"premultiplied,omitempty"` // true: the merged image's color samples are to be premultiplied by alpha
+	Lossless   bool            `json:"lossless,omitempty"`      // true: the channels were split with --lossless and are to be merged likewise
+	Channels   []manifestEntry `json:"channels"`                // Channels in merge order
+}
+
+// A manifestEntry describes a single channel within a manifest.
+type manifestEntry struct {
+	Name  string    `json:"name"`            // Channel name
+	File  string    `json:"file"`            // Name of the channel's file, relative to the manifest
+	Min   float64   `json:"min"`             // Channel value represented by a pixel value of 0.0
+	Max   float64   `json:"max"`             // Channel value represented by a pixel value of 1.0
+	Gamma float64   `json:"gamma,omitempty"` // Exponent g such that pixel values were written as v^(1/g) (0 for none)
+	Curve toneCurve `json:"curve,omitempty"` // Tone curve mapping channel values to pixel values (nil for none)
+	Log   *logScale `json:"log,omitempty"`   // Logarithmic encoding applied to channel values before Min and Max (nil for none)
+}
+
+// channelRanges maps a color space to the range of values, in conventional
+// units, that each of its channels maps to [0.0, 1.0].  Color spaces not
+// listed map all channels from [0.0, 1.0].
+var channelRanges = map[string][][2]float64{
+	"hcl":   {{0, 360}, {0, 100}, {0, 100}},
+	"lab":   {{0, 100}, {-100, 100}, {-100, 100}},
+	"luv":   {{0, 100}, {-100, 100}, {-100, 100}},
+	"hsl":   {{0, 360}, {0, 1}, {0, 1}},
+	"hsluv": {{0, 360}, {0, 1}, {0, 1}},
+	"ycbcr": {{0, 255}, {0, 255}, {0, 255}},
+}
+
+// newManifest returns a manifest describing a set of split channels, which
+// are stored in the given files.
+func newManifest(p *Parameters, infos []ImageInfo, files []string) *channelManifest {
+	man := &channelManifest{
+		Space:      p.OrigColorSpace,
+		WhitePoint: p.WhitePoint,
+		Lossless:   p.Lossless,
+		Channels:   make([]manifestEntry, len(infos)),
+	}
+	if p.Signed != "offset" {
+		man.Signed = p.Signed
+	}
+	if p.ColorSpace == "ycbcr" && p.YCbCrMatrix != "bt601" {
+		man.Matrix = p.YCbCrMatrix
+	}
+	if whiteRelative(p.ColorSpace) && p.CAT != "none" {
+		man.CAT = p.CAT
+	}
+	if p.Subsample != "4:4:4" {
+		man.Subsample = p.Subsample
+	}
+	ranges := defaultRanges(p)
+	for i, info := range infos {
+		ent := manifestEntry{Name: info.Name, File: files[i], Min: 0, Max: 1}
+		if g := channelGamma(p, info.Name); g != 1.0 {
+			ent.Gamma = g
+		}
+		ent.Curve = info.Curve
+		ent.Log = info.Log
+		ch, sfx := signedBaseIndex(p, info.Name)
+		if ch >= 0 && ch < len(ranges) {
+			r := ranges[ch]
+			if info.Range != nil {
+				r = *info.Range
+			}
+			switch sfx {
+			case "+":
+				r = chanRange{0, r[1]}
+			case "-":
+				r = chanRange{0, r[0]}
+			}
+			ent.Min, ent.Max = r[0], r[1]
+		}
+		if info.Name == "alpha" {
+			man.Alpha = true
+			man.Premult = p.Premultiplied
+		}
+		man.Channels[i] = ent
+	}
+	for _, info := range infos {
+		// Subsampled chroma channels are smaller than the others.
+		bnds := info.Image.Bounds()
+		if bnds.Dx() > man.Width {
+			man.Width = bnds.Dx()
+		}
+		if bnds.Dy() > man.Height {
+			man.Height = bnds.Dy()
+		}
+	}
+	return man
+}
+
+// encodeManifest writes a manifest as indented JSON.
+func encodeManifest(w io.Writer, man *channelManifest) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(man)
+}
+
+// decodeManifest reads a manifest from JSON.
+func decodeManifest(r io.Reader) (*channelManifest, error) {
+	var man channelManifest
+	err := json.NewDecoder(r).Decode(&man)
+	if err != nil {
+		return nil, err
+	}
+	if len(man.Channels) == 0 {
+		return nil, fmt.Errorf("manifest lists no channels")
+	}
+	return &man, nil
+}
+
+// isManifestFile reports whether a filename designates a JSON manifest.
+func isManifestFile(fn string) bool {
+	return strings.ToLower(filepath.Ext(fn)) == ".json"
+}
+
+// WriteManifest writes a manifest describing a set of split channels, which
+// are stored in the given files, to a named file.  Channel files are recorded
+// relative to the manifest's directory.
+func WriteManifest(p *Parameters, fn string, infos []ImageInfo, files []string) error {
+	dir, err := filepath.Abs(filepath.Dir(fn))
+	if err != nil {
+		return err
+	}
+	rel := make([]string, len(files))
+	for i, cf := range files {
+		abs, err := filepath.Abs(cf)
+		if err != nil {
+			return err
+		}
+		rel[i], err = filepath.Rel(dir, abs)
+		if err != nil {
+			rel[i] = abs
+		}
+		rel[i] = filepath.ToSlash(rel[i])
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return encodeManifest(f, newManifest(p, infos, rel))
+}
+
+// ReadManifest reads a manifest from a named file and returns it with each
+// channel's filename resolved relative to the current directory.  It aborts
+// on error.
+func ReadManifest(fn string) *channelManifest {
+	f, err := os.Open(fn)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	defer f.Close()
+	man, err := decodeManifest(f)
+	if err != nil {
+		notify.Fatalf("%s: %s", fn, err)
+	}
+	for i, ent := range man.Channels {
+		cf := filepath.FromSlash(ent.File)
+		if !filepath.IsAbs(cf) {
+			cf = filepath.Join(filepath.Dir(fn), cf)
+		}
+		man.Channels[i].File = cf
+	}
+	return man
+}
+
+// writeManifest is a helper function for splitImage that writes p.Manifest to
+// describe a set of channels written to the given files.  It aborts on error.
+func writeManifest(p *Parameters, infos []ImageInfo, files []string) {
+	err := WriteManifest(p, p.Manifest, infos, files)
+	if err != nil {
+		notify.Fatal(err)
+	}
+}
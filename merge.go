@@ -4,321 +4,764 @@
 package main
 
 import (
+	"context"
 	"image"
-	"image/color"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/lucasb-eyer/go-colorful"
+	"github.com/spakin/color-channels/channels"
 )
 
-// MergeHCL merges H, C, and L channels into a single image.
-func MergeHCL(imgs []*image.Gray16, wref [3]float64) image.Image {
-	bnds := imgs[0].Bounds()
-	merged := image.NewNRGBA(bnds)
-	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
-		for x := bnds.Min.X; x < bnds.Max.X; x++ {
-			h := float64(imgs[0].Gray16At(x, y).Y) * 360.0 / 65535.0
-			c := float64(imgs[1].Gray16At(x, y).Y) / 65535.0
-			l := float64(imgs[2].Gray16At(x, y).Y) / 65535.0
-			clr := colorful.HclWhiteRef(h, c, l, wref).Clamped()
-			merged.Set(x, y, clr)
-		}
+// setColorful assigns an opaque colorful.Color to the pixel at (x, y) of a
+// merged image.
+func setColorful(merged *NRGBA32f, x, y int, clr colorful.Color) {
+	merged.SetFloats(x, y, [4]float64{clr.R, clr.G, clr.B, 1.0})
+}
+
+// mergeKernel returns a function that maps the values of the channels of a
+// given color space to a color.  wref is used only by color spaces that
+// require a white reference point.
+func mergeKernel(cs string, wref [3]float64) func(v []float64) colorful.Color {
+	raw := rawMergeKernel(cs, wref)
+	return func(v []float64) colorful.Color {
+		return raw(v).Clamped()
 	}
-	return merged
 }
 
-// MergeLab merges L*, a*, and b* channels into a single image.
-func MergeLab(imgs []*image.Gray16, wref [3]float64) image.Image {
-	bnds := imgs[0].Bounds()
-	merged := image.NewNRGBA(bnds)
-	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
-		for x := bnds.Min.X; x < bnds.Max.X; x++ {
-			L := float64(imgs[0].Gray16At(x, y).Y) / 65535.0
-			a := float64(imgs[1].Gray16At(x, y).Y)*2.0/65535.0 - 1.0
-			b := float64(imgs[2].Gray16At(x, y).Y)*2.0/65535.0 - 1.0
-			clr := colorful.LabWhiteRef(L, a, b, wref).Clamped()
-			merged.Set(x, y, clr)
+// rawMergeKernel returns a function that maps the values of the channels of
+// a given color space to a color, which may lie outside the sRGB gamut.  wref
+// is used only by color spaces that require a white reference point.
+func rawMergeKernel(cs string, wref [3]float64) func(v []float64) colorful.Color {
+	switch cs {
+	case "hcl":
+		return func(v []float64) colorful.Color {
+			return channels.FromHCLWhiteRef([3]float64{v[0], v[1], v[2]}, wref)
+		}
+	case "lab":
+		return func(v []float64) colorful.Color {
+			return channels.FromLabWhiteRef([3]float64{v[0], v[1], v[2]}, wref)
+		}
+	case "luv":
+		return func(v []float64) colorful.Color {
+			return channels.FromLuvWhiteRef([3]float64{v[0], v[1], v[2]}, wref)
 		}
+	case "xyy":
+		return func(v []float64) colorful.Color {
+			return channels.FromXyy([3]float64{v[0], v[1], v[2]})
+		}
+	case "hsl":
+		return func(v []float64) colorful.Color {
+			return channels.FromHSL([3]float64{v[0], v[1], v[2]})
+		}
+	case "hsluv":
+		return func(v []float64) colorful.Color {
+			return channels.FromHSLuv([3]float64{v[0], v[1], v[2]})
+		}
+	case "linrgb":
+		return func(v []float64) colorful.Color {
+			return channels.FromLinRGB([3]float64{v[0], v[1], v[2]})
+		}
+	case "rgb":
+		return func(v []float64) colorful.Color {
+			return channels.FromRGB([3]float64{v[0], v[1], v[2]})
+		}
+	case "srgb":
+		return func(v []float64) colorful.Color {
+			return channels.FromSRGB([3]float64{v[0], v[1], v[2]})
+		}
+	case "cmyk":
+		return func(v []float64) colorful.Color {
+			return channels.FromCMYK([4]float64{v[0], v[1], v[2], v[3]})
+		}
+	case "ycbcr":
+		return func(v []float64) colorful.Color {
+			return channels.FromYCbCr([3]float64{v[0], v[1], v[2]})
+		}
+	case "xyz":
+		return func(v []float64) colorful.Color {
+			return channels.FromXYZ([3]float64{v[0], v[1], v[2]})
+		}
+	default:
+		panic("Internal error: unimplemented color space")
 	}
-	return merged
 }
 
-// MergeLuv merges L*, u*, and v* channels into a single image.
-func MergeLuv(imgs []*image.Gray16, wref [3]float64) image.Image {
-	bnds := imgs[0].Bounds()
-	merged := image.NewNRGBA(bnds)
-	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
-		for x := bnds.Min.X; x < bnds.Max.X; x++ {
-			L := float64(imgs[0].Gray16At(x, y).Y) / 65535.0
-			u := float64(imgs[1].Gray16At(x, y).Y)*2.0/65535.0 - 1.0
-			v := float64(imgs[2].Gray16At(x, y).Y)*2.0/65535.0 - 1.0
-			clr := colorful.LuvWhiteRef(L, u, v, wref).Clamped()
-			merged.Set(x, y, clr)
+// paramsRawMergeKernel returns rawMergeKernel's conversion function for the
+// color space specified by a set of parameters, honoring the Y'CbCr matrix
+// and the chromatic adaptation transform.
+func paramsRawMergeKernel(p *Parameters) func(v []float64) colorful.Color {
+	if p.ColorSpace == "ycbcr" && p.YCbCrMatrix != "" && p.YCbCrMatrix != "bt601" {
+		m := ycbcrMatrices[p.YCbCrMatrix]
+		return func(v []float64) colorful.Color {
+			return fromYCbCrMatrix([3]float64{v[0], v[1], v[2]}, m)
 		}
 	}
-	return merged
+	return adaptMergeKernel(p, p.ColorSpace, rawMergeKernel(p.ColorSpace, p.WhitePoint))
 }
 
-// MergeXyy merges x, y, and Y channels into a single image.
-func MergeXyy(imgs []*image.Gray16) image.Image {
-	bnds := imgs[0].Bounds()
-	merged := image.NewNRGBA(bnds)
-	for r := bnds.Min.Y; r < bnds.Max.Y; r++ {
-		for c := bnds.Min.X; c < bnds.Max.X; c++ {
-			x := float64(imgs[0].Gray16At(c, r).Y) / 65535.0
-			y := float64(imgs[1].Gray16At(c, r).Y) / 65535.0
-			Y := float64(imgs[2].Gray16At(c, r).Y) / 65535.0
-			clr := colorful.Xyy(x, y, Y).Clamped()
-			merged.Set(c, r, clr)
-		}
+// paramsMergeKernel is paramsRawMergeKernel with clamping, as mergeKernel is
+// to rawMergeKernel.
+func paramsMergeKernel(p *Parameters) func(v []float64) colorful.Color {
+	raw := paramsRawMergeKernel(p)
+	return func(v []float64) colorful.Color {
+		return raw(v).Clamped()
 	}
-	return merged
 }
 
-// MergeHSL merges H, S, and L channels into a single image.
-func MergeHSL(imgs []*image.Gray16) image.Image {
+// mergeAny is a helper function for the various Merge* functions.  It
+// performs all the boilerplate code, invoking a color space-specific function
+// for each pixel and mapping the result into the sRGB gamut with gm.  If clip
+// is non-nil, out-of-gamut pixels are recorded in it.  mergeAny stops early and
+// returns the context's error if ctx is canceled.
+func mergeAny(ctx context.Context, imgs []*Gray32f, fn func(v []float64) colorful.Color, gm gamutMapper, clip *clipStats) (image.Image, error) {
 	bnds := imgs[0].Bounds()
-	merged := image.NewNRGBA(bnds)
+	merged := NewNRGBA32f(bnds)
+	v := make([]float64, len(imgs))
+	if clip != nil {
+		clip.Begin(bnds)
+	}
+	meter := progressFrom(ctx)
+	meter.Expect(bnds.Dy())
 	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		for x := bnds.Min.X; x < bnds.Max.X; x++ {
-			h := float64(imgs[0].Gray16At(x, y).Y) * 360.0 / 65535.0
-			s := float64(imgs[1].Gray16At(x, y).Y) / 65535.0
-			l := float64(imgs[2].Gray16At(x, y).Y) / 65535.0
-			clr := colorful.Hsl(h, s, l).Clamped()
-			merged.Set(x, y, clr)
+			for i, img := range imgs {
+				v[i] = img.FloatAt(x, y)
+			}
+			clr := fn(v)
+			mapped := gm(clr)
+			if clip != nil {
+				clip.Count(x, y, colorChanged(clr, mapped))
+			}
+			setColorful(merged, x, y, mapped)
 		}
+		meter.Step()
 	}
-	return merged
+	return merged, nil
 }
 
-// MergeHSLuv merges H, S, and L channels into a single image.
-func MergeHSLuv(imgs []*image.Gray16) image.Image {
-	bnds := imgs[0].Bounds()
-	merged := image.NewNRGBA(bnds)
+// AddAlpha replaces an image's alpha channel with a separately specified alpha
+// channel.  It returns the context's error if ctx is canceled.
+func AddAlpha(ctx context.Context, img image.Image, alpha *Gray32f) (image.Image, error) {
+	bnds := img.Bounds()
+	newImg := NewNRGBA32f(bnds)
+	src, isFloat := img.(*NRGBA32f)
 	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		for x := bnds.Min.X; x < bnds.Max.X; x++ {
-			h := float64(imgs[0].Gray16At(x, y).Y) * 360.0 / 65535.0
-			s := float64(imgs[1].Gray16At(x, y).Y) / 65535.0
-			l := float64(imgs[2].Gray16At(x, y).Y) / 65535.0
-			clr := colorful.HSLuv(h, s, l).Clamped()
-			merged.Set(x, y, clr)
+			if isFloat {
+				newImg.SetFloats(x, y, src.FloatsAt(x, y))
+			} else {
+				newImg.Set(x, y, img.At(x, y))
+			}
+			v := newImg.FloatsAt(x, y)
+			v[3] = math.Max(0.0, math.Min(1.0, alpha.FloatAt(x, y)))
+			newImg.SetFloats(x, y, v)
 		}
 	}
-	return merged
+	return newImg, nil
 }
 
-// MergeLinRGB merges R, G, and B channels into a single image.
-func MergeLinRGB(imgs []*image.Gray16) image.Image {
-	bnds := imgs[0].Bounds()
-	merged := image.NewNRGBA(bnds)
-	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
-		for x := bnds.Min.X; x < bnds.Max.X; x++ {
-			r := float64(imgs[0].Gray16At(x, y).Y) / 65535.0
-			g := float64(imgs[1].Gray16At(x, y).Y) / 65535.0
-			b := float64(imgs[2].Gray16At(x, y).Y) / 65535.0
-			clr := colorful.LinearRgb(r, g, b).Clamped()
-			merged.Set(x, y, clr)
+// colorChannelCount returns the number of channels, not counting alpha, in a
+// given color space.
+func colorChannelCount(cs string) int {
+	names, _ := splitKernel(cs, [3]float64{})
+	return len(names)
+}
+
+// checkChannelCount aborts if a given number of channels is inappropriate for
+// the color space.
+func checkChannelCount(p *Parameters, nIn int) {
+	want := colorChannelCount(p.ColorSpace) + signedSplitExtra(p)
+	if p.Alpha {
+		want++
+	}
+	if nFilled := filledChannelCount(p); nFilled > 0 {
+		if nIn != want-nFilled {
+			notify.Fatalf("Expected %d input channels for --space=%q with %d filled by --fill but saw %d",
+				want-nFilled, p.OrigColorSpace, nFilled, nIn)
 		}
+		return
+	}
+	if nIn != want {
+		notify.Fatalf("Expected %d input channels for --space=%q but saw %d",
+			want, p.OrigColorSpace, nIn)
 	}
-	return merged
 }
 
-// MergeRGB merges R, G, and B channels into a single image.
-func MergeRGB(imgs []*image.Gray16) image.Image {
-	bnds := imgs[0].Bounds()
-	merged := image.NewNRGBA64(bnds)
-	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
-		for x := bnds.Min.X; x < bnds.Max.X; x++ {
-			r := imgs[0].Gray16At(x, y).Y
-			g := imgs[1].Gray16At(x, y).Y
-			b := imgs[2].Gray16At(x, y).Y
-			clr := color.NRGBA64{r, g, b, 65535}
-			merged.Set(x, y, clr)
+// isNamedInput reports whether a merge input is of the form
+// <channel>=<filename> rather than a filename alone.  Names of existing files
+// that contain "=" are treated as filenames.
+func isNamedInput(arg string) bool {
+	if strings.Index(arg, "=") <= 0 {
+		return false
+	}
+	_, err := os.Stat(arg)
+	return err != nil
+}
+
+// hasNamedInputs reports whether any merge input is of the form
+// <channel>=<filename>.
+func hasNamedInputs(args []string) bool {
+	for _, arg := range args {
+		if isNamedInput(arg) {
+			return true
 		}
 	}
-	return merged
+	return false
 }
 
-// MergeSRGB merges R, G, and B channels into a single image.
-func MergeSRGB(imgs []*image.Gray16) image.Image {
-	bnds := imgs[0].Bounds()
-	merged := image.NewNRGBA(bnds)
-	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
-		for x := bnds.Min.X; x < bnds.Max.X; x++ {
-			r := float64(imgs[0].Gray16At(x, y).Y) / 65535.0
-			g := float64(imgs[1].Gray16At(x, y).Y) / 65535.0
-			b := float64(imgs[2].Gray16At(x, y).Y) / 65535.0
-			clr := colorful.Color{R: r, G: g, B: b}
-			merged.Set(x, y, clr)
+// channelIndex returns the position in channel order of the channel with
+// a given name, which is matched exactly or, failing that, ignoring case.  It
+// aborts if the name does not designate exactly one channel.
+func channelIndex(p *Parameters, name string) int {
+	names := builtinChannelNames(p)
+	ch := -1
+	for i, nm := range names {
+		if name == nm {
+			return i
+		}
+		if strings.EqualFold(name, nm) {
+			if ch >= 0 {
+				notify.Fatalf("Channel name %q is ambiguous for --space=%q", name, p.OrigColorSpace)
+			}
+			ch = i
 		}
 	}
-	return merged
+	if ch < 0 {
+		notify.Fatalf("Channel names for --space=%q are %s (not %q)",
+			p.OrigColorSpace, strings.Join(names, ", "), name)
+	}
+	return ch
 }
 
-// MergeCMYK merges C, M, Y, and K channels into a single image.
-func MergeCMYK(imgs []*image.Gray16) image.Image {
-	bnds := imgs[0].Bounds()
-	merged := image.NewNRGBA(bnds)
-	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
-		for x := bnds.Min.X; x < bnds.Max.X; x++ {
-			// At the time of this writing, image/color provides
-			// only an 8-bit CMYK-to-RGB converter so we
-			// reluctantly discard the lower 8 bits of CMYK
-			// information.
-			c := uint8(imgs[0].Gray16At(x, y).Y >> 8)
-			m := uint8(imgs[1].Gray16At(x, y).Y >> 8)
-			w := uint8(imgs[2].Gray16At(x, y).Y >> 8) // y is already taken.
-			k := uint8(imgs[3].Gray16At(x, y).Y >> 8)
-			r, g, b := color.CMYKToRGB(c, m, w, k)
-			clr := color.NRGBA{r, g, b, 255}
-			merged.Set(x, y, clr)
-		}
-	}
-	return merged
+// orderNamedInputs parses merge inputs of the form <channel>=<filename>,
+// given in any order, and returns the filenames in merge order, omitting
+// channels filled by --fill.  orderNamedInputs aborts if any input is not of
+// that form or if any channel is unknown, repeated, or missing.
+func orderNamedInputs(p *Parameters) []string {
+	names := builtinChannelNames(p)
+	fns := make([]string, len(names))
+	for _, arg := range p.InputNames {
+		if !isNamedInput(arg) {
+			notify.Fatalf("Either all or no merge inputs must be of the form <channel>=<filename> (not %q)", arg)
+		}
+		eq := strings.Index(arg, "=")
+		ch := channelIndex(p, arg[:eq])
+		switch {
+		case fns[ch] != "":
+			notify.Fatalf("Channel %s was specified more than once", names[ch])
+		case isFilled(p, ch):
+			notify.Fatalf("Channel %s was given both a file and a --fill value", names[ch])
+		}
+		fns[ch] = arg[eq+1:]
+	}
+	ordered := make([]string, 0, len(fns))
+	for i, fn := range fns {
+		switch {
+		case isFilled(p, i):
+			continue
+		case fn == "":
+			notify.Fatalf("No file was specified for channel %s", names[i])
+		}
+		ordered = append(ordered, fn)
+	}
+	return ordered
 }
 
-// MergeYCbCr merges Y, Cb, and Cr channels into a single image.
-func MergeYCbCr(imgs []*image.Gray16) image.Image {
-	bnds := imgs[0].Bounds()
-	merged := image.NewNRGBA(bnds)
-	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
-		for x := bnds.Min.X; x < bnds.Max.X; x++ {
-			// At the time of this writing, image/color provides
-			// only an 8-bit Y'CbCr-to-RGB converter so we
-			// reluctantly discard the lower 8 bits of Y'CbCr.
-			// information.
-			l := uint8(imgs[0].Gray16At(x, y).Y >> 8) // y is already taken.
-			cb := uint8(imgs[1].Gray16At(x, y).Y >> 8)
-			cr := uint8(imgs[2].Gray16At(x, y).Y >> 8)
-			r, g, b := color.YCbCrToRGB(l, cb, cr)
-			clr := color.NRGBA{r, g, b, 255}
-			merged.Set(x, y, clr)
-		}
-	}
-	return merged
+// parseFill parses the argument to --fill, a comma-separated list of
+// <channel>=<value> pairs, and returns the value for each channel in merge
+// order, with NaN for channels not filled.  It aborts on error.
+func parseFill(p *Parameters, arg string) []float64 {
+	fill := make([]float64, len(builtinChannelNames(p)))
+	for i := range fill {
+		fill[i] = math.NaN()
+	}
+	for _, pair := range strings.Split(arg, ",") {
+		eq := strings.Index(pair, "=")
+		if eq <= 0 {
+			notify.Fatalf("--fill requires a list of <channel>=<value> pairs (not %q)", pair)
+		}
+		ch := channelIndex(p, strings.TrimSpace(pair[:eq]))
+		v, err := strconv.ParseFloat(strings.TrimSpace(pair[eq+1:]), 64)
+		if err != nil || v < 0.0 || v > 1.0 {
+			notify.Fatalf("--fill requires values from 0.0 to 1.0 (not %q)", pair[eq+1:])
+		}
+		if !math.IsNaN(fill[ch]) {
+			notify.Fatalf("--fill specifies channel %s more than once", builtinChannelNames(p)[ch])
+		}
+		fill[ch] = v
+	}
+	nFilled := 0
+	for _, v := range fill {
+		if !math.IsNaN(v) {
+			nFilled++
+		}
+	}
+	if nFilled == len(fill) {
+		notify.Fatal("--fill cannot fill every channel; at least one must be read from a file")
+	}
+	return fill
 }
 
-// AddAlpha replaces an image's alpha channel with a separately specified alpha
-// channel.
-func AddAlpha(img image.Image, alpha *image.Gray16) image.Image {
-	bnds := img.Bounds()
-	newImg := image.NewNRGBA64(bnds)
-	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
-		for x := bnds.Min.X; x < bnds.Max.X; x++ {
-			clr := img.At(x, y)
-			nrgba := color.NRGBA64Model.Convert(clr).(color.NRGBA64)
-			nrgba.A = alpha.Gray16At(x, y).Y
-			newImg.Set(x, y, nrgba)
+// isFilled reports whether the channel at a given position in merge order is
+// filled with a constant by --fill rather than read from a file.
+func isFilled(p *Parameters, ch int) bool {
+	return p.Fill != nil && !math.IsNaN(p.Fill[ch])
+}
+
+// filledChannelCount returns the number of channels filled with a constant by
+// --fill.
+func filledChannelCount(p *Parameters) int {
+	n := 0
+	for ch := range p.Fill {
+		if isFilled(p, ch) {
+			n++
 		}
 	}
-	return newImg
+	return n
 }
 
-// MergeXYZ merges X, Y, and Z channels into a single image.
-func MergeXYZ(imgs []*image.Gray16) image.Image {
-	bnds := imgs[0].Bounds()
-	merged := image.NewNRGBA(bnds)
-	for r := bnds.Min.Y; r < bnds.Max.Y; r++ {
-		for c := bnds.Min.X; c < bnds.Max.X; c++ {
-			x := float64(imgs[0].Gray16At(c, r).Y) / 65535.0
-			y := float64(imgs[1].Gray16At(c, r).Y) / 65535.0
-			z := float64(imgs[2].Gray16At(c, r).Y) / 65535.0
-			clr := colorful.Xyz(x, y, z).Clamped()
-			merged.Set(c, r, clr)
+// fillChannels returns a set of channels read from files with the constant
+// channels requested by --fill inserted in their merge-order positions.
+func fillChannels(p *Parameters, channels []*Gray32f) []*Gray32f {
+	if p.Fill == nil {
+		return channels
+	}
+	bnds := channels[0].Bounds()
+	all := make([]*Gray32f, 0, len(p.Fill))
+	for ch, v := range p.Fill {
+		if !isFilled(p, ch) {
+			all = append(all, channels[0])
+			channels = channels[1:]
+			continue
 		}
+		g := NewGray32f(bnds)
+		for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+			for x := bnds.Min.X; x < bnds.Max.X; x++ {
+				g.SetFloat(x, y, v)
+			}
+		}
+		all = append(all, g)
+	}
+	return all
+}
+
+// readChannelFile reads a single color-channel image from a raw, table, or
+// image file.  It aborts on error.
+func readChannelFile(p *Parameters, fn string) *Gray32f {
+	switch {
+	case p.RawSize != (image.Point{}):
+		return ReadRawChannel(p, fn)
+	case isTableFile(fn):
+		return ReadTableChannel(fn)
+	default:
+		return ReadGrayscaleImage(fn)
 	}
-	return merged
 }
 
 // readChannelFiles reads one or more color-channel images and returns them as
-// 16-bit grayscale images.  It aborts on error.
-func readChannelFiles(p *Parameters) []*image.Gray16 {
-	// Ensure we have the correct number of input files.
+// 16-bit grayscale images, decoding as many at a time as the worker limit
+// carried by ctx allows.  It aborts on error.
+func readChannelFiles(ctx context.Context, p *Parameters) []*Gray32f {
+	// Read all channels from a ZIP bundle if one was given.
 	nIn := len(p.InputNames)
-	wrongArgsFmt := "Expected %d input files for --space=%q but saw %d"
-	numAlpha := 0
-	if p.Alpha {
-		numAlpha = 1
+	var channels []*Gray32f
+	fromZip := nIn == 1 && isZipFile(p.InputNames[0])
+	if fromZip {
+		channels = ReadZipChannels(p.InputNames[0])
+		nIn = len(channels)
 	}
-	switch p.ColorSpace {
-	case "cmyk":
-		if nIn != 4+numAlpha {
-			notify.Fatalf(wrongArgsFmt, 4+numAlpha, p.OrigColorSpace, nIn)
+
+	// Ensure we have the correct number of input files.
+	checkChannelCount(p, nIn)
+
+	// Read all the color-channel images unless they were already read
+	// from a ZIP bundle.  The files are decoded concurrently, as many at
+	// a time as there are workers.  Retain the geo-referencing information
+	// from the first channel that has any.
+	if channels == nil {
+		channels = make([]*Gray32f, len(p.InputNames))
+		sem := make(chan struct{}, workerCount(ctx))
+		var wg sync.WaitGroup
+		for i, fn := range p.InputNames {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, fn string) {
+				defer wg.Done()
+				channels[i] = readChannelFile(p, fn)
+				<-sem
+			}(i, fn)
 		}
-	default:
-		if nIn != 3+numAlpha {
-			notify.Fatalf(wrongArgsFmt, 3+numAlpha, p.OrigColorSpace, nIn)
+		wg.Wait()
+		for _, fn := range p.InputNames {
+			if p.GeoTags == nil {
+				p.GeoTags = ReadGeoTags(fn)
+			}
 		}
 	}
 
-	// Read all the color-channel images.
-	channels := make([]*image.Gray16, 0, 4)
-	for _, fn := range p.InputNames {
-		g := ReadGrayscaleImage(fn)
-		channels = append(channels, g)
+	// Decode signed channels and read the tone curves and ranges recorded
+	// in the channel files.
+	channels, fns := decodeSigned(p, channels, p.InputNames)
+	if !fromZip {
+		readChannelCurves(p, fns)
+		readChannelRanges(p, fns)
+		readChannelLogScales(p, fns)
+		readChannelSubsample(p, fns)
 	}
+	symmetrizeSignedRanges(p)
 
-	// Ensure that all channels have the same bounds.
-	bnds := channels[0].Bounds()
-	for _, g := range channels {
-		if g.Bounds() != bnds {
-			notify.Fatal("All input images must have the same dimensions")
-		}
-	}
-	return channels
+	// Ensure that all channels have the same bounds, upsampling any
+	// subsampled chroma channels.
+	return reconcileBounds(p, upsampleChroma(p, channels))
 }
 
-// performChannelMerge is a helper function for MergeChannels that invokes the
-// appropriate channel-merging function.
-func performChannelMerge(p *Parameters, channels []*image.Gray16) image.Image {
+// performChannelMerge is a helper function for mergeChannels that merges
+// channels in the requested color space, mapping out-of-gamut colors as
+// specified by p.Gamut.  performChannelMerge aborts if
+// p.Gamut is "error" and any merged color lies outside the sRGB gamut.
+func performChannelMerge(ctx context.Context, p *Parameters, channels []*Gray32f) (image.Image, error) {
+	clip := p.Clip
+	if clip == nil && p.Gamut == "error" {
+		clip = new(clipStats)
+	}
+	prev := 0
+	if clip != nil {
+		prev = clip.Clipped
+	}
+	colors := channels[:colorChannelCount(p.ColorSpace)]
+	gm := gamutMappers[p.Gamut]
+	if p.Gamut == "clamp" && preservesHDR(p) {
+		gm = clampNonNegative
+	}
+	if p.Lossless {
+		gm = unmappedGamut
+	}
 	var merged image.Image
-	switch p.ColorSpace {
-	case "cmyk":
-		merged = MergeCMYK(channels)
-	case "hcl":
-		merged = MergeHCL(channels, p.WhitePoint)
-	case "hsl":
-		merged = MergeHSL(channels)
-	case "hsluv":
-		merged = MergeHSLuv(channels)
-	case "lab":
-		merged = MergeLab(channels, p.WhitePoint)
-	case "linrgb":
-		merged = MergeLinRGB(channels)
-	case "luv":
-		merged = MergeLuv(channels, p.WhitePoint)
-	case "rgb":
-		merged = MergeRGB(channels)
-	case "srgb":
-		merged = MergeSRGB(channels)
-	case "xyy":
-		merged = MergeXyy(channels)
-	case "xyz":
-		merged = MergeXYZ(channels)
-	case "ycbcr":
-		merged = MergeYCbCr(channels)
-	default:
-		panic("Internal error: unimplemented color space")
+	var err error
+	if ms, be := matrixSpaceFor(p), paramsBackend(p); ms != nil && be != nil {
+		merged, err = mergeMatrix(ctx, colors, ms, be, gm, clip)
+	} else {
+		merged, err = mergeAny(ctx, colors, paramsRawMergeKernel(p), gm, clip)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Gamut == "error" && clip.Clipped > prev {
+		notify.Fatalf("%d merged pixels lie outside the sRGB gamut (use --gamut to map them into the gamut)",
+			clip.Clipped-prev)
+	}
+	return merged, nil
+}
+
+// mergeChannels merges the input files into a single output file as directed
+// by a set of parameters.  It returns the context's error if ctx is canceled
+// and aborts on any other error.
+func mergeChannels(ctx context.Context, p *Parameters) error {
+	p.Clip = new(clipStats)
+	label := p.OutputName
+	if label == "" || label == "-" {
+		label = "Merged image"
+	}
+	ctx, meter := withProgress(withWorkers(ctx, p.Workers), p, label)
+	err := mergeInputs(ctx, p)
+	if err != nil {
+		return err
 	}
-	return merged
+	meter.Finish()
+	reportClipping(p, label)
+	reportTimings(p, label)
+	return nil
 }
 
-// MergeChannels merges the input files into a single output file.  It aborts
-// on error.
-func MergeChannels(p *Parameters) {
+// mergeInputs is a helper function for mergeChannels that merges the
+// per-channel files named by p.InputNames.
+func mergeInputs(ctx context.Context, p *Parameters) error {
+	// Merge each frame of an image sequence in turn.
+	if len(p.InputNames) > 0 && isSequence(p.InputNames[0]) {
+		return mergeSequence(ctx, p)
+	}
+
+	// Merge PNG files one band of rows at a time.
+	if p.Stream {
+		return mergeBands(ctx, p)
+	}
+
+	// Stream per-channel y4m input to y4m output.
+	signed := p.Signed != "" && p.Signed != "offset"
+	subsampled := p.Subsample != "" && p.Subsample != "4:4:4"
+	if streamY4M(p) {
+		if signed {
+			notify.Fatalf("--signed=%s is not supported when merging y4m video", p.Signed)
+		}
+		if subsampled {
+			notify.Fatal("Subsampled chroma channels are not supported when merging y4m video")
+		}
+		return mergeY4M(ctx, p)
+	}
+
+	// Merge animated channels one frame at a time.
+	start := time.Now()
+	anims := readChannelAnimations(p)
+	p.Times.Since(stageDecode, start)
+	if anims != nil {
+		if signed {
+			notify.Fatalf("--signed=%s is not supported when merging animations", p.Signed)
+		}
+		if subsampled {
+			notify.Fatal("Subsampled chroma channels are not supported when merging animations")
+		}
+		return mergeAnimation(ctx, p, anims)
+	}
+
 	// Read the per-channel files we were asked to merge.
-	channels := readChannelFiles(p)
+	start = time.Now()
+	channels := readChannelFiles(ctx, p)
+	p.Times.Since(stageDecode, start)
 
 	// Merge the color channels.
-	merged := performChannelMerge(p, channels)
+	start = time.Now()
+	merged, err := mergeFrame(ctx, p, channels)
+	if err != nil {
+		return err
+	}
+	p.Times.Since(stageConvert, start)
 
-	// If an alpha channel was included, insert it into the image.
+	// Write the result to a file.
+	start = time.Now()
+	err = WriteImage(p, p.OutputName, merged)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	p.Times.Since(stageEncode, start)
+	return nil
+}
+
+// mergeFrame is a helper function for mergeChannels that merges a single set
+// of channels, including an alpha channel if requested.
+func mergeFrame(ctx context.Context, p *Parameters, channels []*Gray32f) (image.Image, error) {
+	channels = decodeGamma(p, fillChannels(p, channels))
+	channels = applyMergeLUTs(p, applyMergeAutoTone(p, channels))
+	channels = applyMergeLog(p, applyMergeRanges(p, channels))
+	merged, err := performChannelMerge(ctx, p, channels)
+	if err != nil {
+		return nil, err
+	}
+	if p.LUT3D != nil {
+		merged, err = ApplyLUT3D(ctx, merged, p.LUT3D)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if p.Alpha {
-		merged = AddAlpha(merged, channels[len(channels)-1])
+		merged, err = AddAlpha(ctx, merged, channels[len(channels)-1])
+		if err != nil {
+			return nil, err
+		}
+		if p.Premultiplied && !p.Opaque {
+			merged, err = Premultiply(ctx, merged)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
+	if p.Opaque {
+		merged, err = Flatten(ctx, merged, paramsBackground(p))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
 
-	// Write the result to a file.
-	err := WritePNG(p.OutputName, merged)
+// readChannelAnimations reads all frames of each animated input file.  It
+// returns nil if the first input file is not animated and aborts if the inputs
+// are a mix of animated and unanimated files or have differing numbers of
+// frames.
+func readChannelAnimations(p *Parameters) []*Animation {
+	if len(p.InputNames) == 0 || p.RawSize != (image.Point{}) {
+		return nil
+	}
+	anims := make([]*Animation, len(p.InputNames))
+	for i, fn := range p.InputNames {
+		if isTableFile(fn) || isZipFile(fn) {
+			return nil
+		}
+		anims[i] = ReadAnimation(fn)
+		switch {
+		case i == 0 && anims[0] == nil:
+			return nil
+		case anims[i] == nil:
+			notify.Fatalf("%s is not animated, but %s is", fn, p.InputNames[0])
+		case len(anims[i].Frames) != len(anims[0].Frames):
+			notify.Fatalf("%s has %d frames, but %s has %d", fn, len(anims[i].Frames),
+				p.InputNames[0], len(anims[0].Frames))
+		case anims[i].Frames[0].Bounds() != anims[0].Frames[0].Bounds() && p.Mismatch == "error":
+			notify.Fatal("All input images must have the same dimensions")
+		}
+	}
+	checkChannelCount(p, len(anims))
+	return anims
+}
+
+// mergeAnimation is a helper function for mergeChannels that merges each
+// frame of a set of animated channels.  If the output filename contains a
+// frame number (e.g., "%04d"), each frame is written to a separate file.
+// Otherwise, the result is written as an animation.
+func mergeAnimation(ctx context.Context, p *Parameters, anims []*Animation) error {
+	// Merge each frame in turn.
+	start := time.Now()
+	merged := &Animation{Delays: anims[0].Delays, Plays: anims[0].Plays}
+	for f := range anims[0].Frames {
+		channels := make([]*Gray32f, len(anims))
+		for c, a := range anims {
+			channels[c] = toGray32f(a.Frames[f])
+		}
+		fr, err := mergeFrame(ctx, p, reconcileBounds(p, channels))
+		if err != nil {
+			return err
+		}
+		merged.Frames = append(merged.Frames, fr)
+	}
+	p.Times.Since(stageConvert, start)
+	defer p.Times.Since(stageEncode, time.Now())
+
+	// Write one file per frame if so requested.
+	if hasFrameVerb(p.OutputName) {
+		for f, fr := range merged.Frames {
+			err := WriteImage(p, expandFrame(p.OutputName, f), fr)
+			if err != nil {
+				notify.Fatal(err)
+			}
+		}
+		return nil
+	}
+
+	// Write a single animation.
+	if outputFormats[selectOutputFormat(p.OutputName, p.Format)].Animate == nil {
+		notify.Fatal(`Animated input requires either a frame number (e.g., "%04d") in the output filename or GIF or PNG output`)
+	}
+	err := WriteAnimation(p, p.OutputName, merged)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	return nil
+}
+
+// mergeSequence is a helper function for mergeChannels that merges each frame
+// of a set of image sequences.  The frame numbers are taken from the files
+// matching the first input filename.  Input filenames without a frame number
+// are used for every frame.  If the output filename contains a frame number,
+// each frame is written to a separate file.  Otherwise, the result is written
+// as an animation.
+func mergeSequence(ctx context.Context, p *Parameters) error {
+	frames := sequenceFrames(p.InputNames[0])
+	anim := &Animation{}
+	animated := !hasFrameVerb(p.OutputName)
+	if animated && outputFormats[selectOutputFormat(p.OutputName, p.Format)].Animate == nil {
+		notify.Fatal(`Image-sequence input requires either a frame number (e.g., "%05d") in the output filename or GIF or PNG output`)
+	}
+	for _, n := range frames {
+		fp := *p
+		fp.InputNames = make([]string, len(p.InputNames))
+		for i, fn := range p.InputNames {
+			fp.InputNames[i] = expandFrame(fn, n)
+		}
+		merged, err := mergeFrame(ctx, &fp, readChannelFiles(ctx, &fp))
+		if err != nil {
+			return err
+		}
+		if animated {
+			anim.Frames = append(anim.Frames, merged)
+			continue
+		}
+		err = WriteImage(&fp, expandFrame(p.OutputName, n), merged)
+		if err != nil {
+			notify.Fatal(err)
+		}
+	}
+	if animated {
+		err := WriteAnimation(p, p.OutputName, anim)
+		if err != nil {
+			notify.Fatal(err)
+		}
+	}
+	return nil
+}
+
+// streamY4M reports whether all inputs are y4m streams and the output is a
+// single y4m stream.
+func streamY4M(p *Parameters) bool {
+	if len(p.InputNames) == 0 || hasFrameVerb(p.OutputName) ||
+		selectOutputFormat(p.OutputName, p.Format) != "y4m" {
+		return false
+	}
+	for _, fn := range p.InputNames {
+		if !isY4MFile(fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeY4M is a helper function for mergeChannels that merges one monochrome
+// y4m stream per channel into a single y4m stream, one frame at a time.
+func mergeY4M(ctx context.Context, p *Parameters) error {
+	// Open all input streams.
+	checkChannelCount(p, len(p.InputNames))
+	yrs := make([]*Y4MReader, len(p.InputNames))
+	for i, fn := range p.InputNames {
+		var rc io.Closer
+		yrs[i], rc = OpenY4M(fn)
+		defer rc.Close()
+	}
+	yw, wc := CreateY4M(p.OutputName, yrs[0].Header.Extra)
+	defer wc.Close()
+
+	// Merge each frame in turn.
+	channels := make([]*Gray32f, len(yrs))
+	for {
+		nEOF := 0
+		for i, yr := range yrs {
+			fr, err := yr.ReadFrame()
+			switch {
+			case err == io.EOF:
+				nEOF++
+				continue
+			case err != nil:
+				notify.Fatalf("%s: %s", p.InputNames[i], err)
+			}
+			channels[i] = toGray32f(fr)
+		}
+		if nEOF == len(yrs) {
+			break
+		}
+		if nEOF > 0 {
+			notify.Fatal("All input streams must contain the same number of frames")
+		}
+		merged, err := mergeFrame(ctx, p, reconcileBounds(p, channels))
+		if err != nil {
+			return err
+		}
+		err = yw.WriteFrame(merged)
+		if err != nil {
+			notify.Fatal(err)
+		}
+	}
+	err := yw.Flush()
 	if err != nil {
 		notify.Fatal(err)
 	}
+	return nil
 }
@@ -0,0 +1,229 @@
+// This file provides support for merging channels whose dimensions differ
+// slightly, as is common with separately scanned or exported channels, by
+// cropping, padding, or resizing them to a common size.
+
+package main
+
+import (
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// mismatchModes lists the valid arguments to --mismatch, not counting a pad
+// value.
+var mismatchModes = map[string]bool{
+	"error":  true,
+	"crop":   true,
+	"pad":    true,
+	"resize": true,
+}
+
+// parseMismatch parses the argument to --mismatch, which is one of "error",
+// "crop", "pad", "pad:<value>", or "resize", and returns the mode and the pad
+// value.  It aborts on error.
+func parseMismatch(arg string) (string, float64) {
+	mode, val, hasVal := strings.ToLower(arg), "", false
+	if colon := strings.Index(mode, ":"); colon >= 0 {
+		mode, val, hasVal = mode[:colon], mode[colon+1:], true
+	}
+	if !mismatchModes[mode] || (hasVal && mode != "pad") {
+		notify.Fatalf(`--mismatch requires one of "error", "crop", "pad", "pad:<value>", or "resize" (not %q)`, arg)
+	}
+	if !hasVal {
+		return mode, 0.0
+	}
+	v, err := strconv.ParseFloat(val, 64)
+	if err != nil || v < 0.0 || v > 1.0 {
+		notify.Fatalf("--mismatch=pad requires a value from 0.0 to 1.0 (not %q)", val)
+	}
+	return mode, v
+}
+
+// reconcileBounds returns a set of channels with a common set of bounds,
+// obtained as specified by p.Mismatch: "crop" crops all channels to the
+// intersection of their bounds; "pad" extends all channels to the union of
+// their bounds, filling new pixels with p.PadValue; and "resize" resamples
+// all channels to the largest width and height among them using the filter
+// named by p.ResizeFilter.  reconcileBounds
+// aborts if p.Mismatch is "error" and the bounds differ or if the channels
+// do not overlap when cropping.
+func reconcileBounds(p *Parameters, channels []*Gray32f) []*Gray32f {
+	// Do nothing if all channels already have the same bounds.
+	bnds := channels[0].Bounds()
+	same := true
+	for _, g := range channels[1:] {
+		same = same && g.Bounds() == bnds
+	}
+	if same {
+		return channels
+	}
+
+	// Determine the common bounds.
+	for _, g := range channels[1:] {
+		r := g.Bounds()
+		switch p.Mismatch {
+		case "crop":
+			bnds = bnds.Intersect(r)
+		case "pad":
+			bnds = bnds.Union(r)
+		case "resize":
+			if r.Dx() > bnds.Dx() {
+				bnds.Max.X = bnds.Min.X + r.Dx()
+			}
+			if r.Dy() > bnds.Dy() {
+				bnds.Max.Y = bnds.Min.Y + r.Dy()
+			}
+		default:
+			notify.Fatal("All input images must have the same dimensions")
+		}
+	}
+	if bnds.Empty() {
+		notify.Fatal("The input images do not overlap")
+	}
+
+	// Crop, pad, or resize each channel to the common bounds.
+	result := make([]*Gray32f, len(channels))
+	for i, g := range channels {
+		switch {
+		case g.Bounds() == bnds:
+			result[i] = g
+		case p.Mismatch == "resize":
+			result[i] = resampleGray(g, bnds, resampleKernels[p.ResizeFilter])
+		default:
+			result[i] = regionGray(g, bnds, p.PadValue)
+		}
+	}
+	return result
+}
+
+// regionGray returns a copy of the region of a Gray32f image that lies within
+// a given rectangle.  Pixels outside the original image are set to pad.
+func regionGray(g *Gray32f, r image.Rectangle, pad float64) *Gray32f {
+	out := NewGray32f(r)
+	gb := g.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if (image.Point{x, y}).In(gb) {
+				out.SetFloat(x, y, g.FloatAt(x, y))
+			} else {
+				out.SetFloat(x, y, pad)
+			}
+		}
+	}
+	return out
+}
+
+// A resampleKernel is a filter used for resampling an image.  Weight maps a
+// distance in source pixels (at the source resolution when upsampling) to a
+// weight, which is zero at distances of Support or more.  A nil Weight
+// designates nearest-neighbor sampling.
+type resampleKernel struct {
+	Support float64                 // Radius beyond which all weights are zero
+	Weight  func(t float64) float64 // Weight at distance t
+}
+
+// resampleKernels maps a filter name to a resampling kernel.
+var resampleKernels = map[string]resampleKernel{
+	"nearest": {0.0, nil},
+	"bilinear": {1.0, func(t float64) float64 {
+		return 1.0 - t
+	}},
+	"catmull-rom": {2.0, func(t float64) float64 {
+		if t < 1.0 {
+			return (3.0*t*t*t - 5.0*t*t + 2.0) / 2.0
+		}
+		return (-t*t*t + 5.0*t*t - 8.0*t + 4.0) / 2.0
+	}},
+}
+
+// resizeFilterNames lists the valid arguments to --resize and --upsample.
+var resizeFilterNames = []string{"nearest", "bilinear", "catmull-rom"}
+
+// resampleWeights returns, for each of n output samples spanning m input
+// samples, the index of the first input sample that contributes to it and the
+// weights of all contributing input samples.  The weights are normalized to
+// sum to 1.
+func resampleWeights(m, n int, k resampleKernel) ([]int, [][]float64) {
+	scale := float64(m) / float64(n)
+	stretch := math.Max(scale, 1.0) // Widen the kernel when downsampling.
+	radius := k.Support * stretch
+	firsts := make([]int, n)
+	weights := make([][]float64, n)
+	if k.Weight == nil {
+		for j := range weights {
+			firsts[j] = int(math.Floor((float64(j) + 0.5) * scale))
+			weights[j] = []float64{1.0}
+		}
+		return firsts, weights
+	}
+	for j := range weights {
+		center := (float64(j)+0.5)*scale - 0.5
+		lo := int(math.Ceil(center - radius))
+		hi := int(math.Floor(center + radius))
+		var ws []float64
+		sum := 0.0
+		for i := lo; i <= hi; i++ {
+			t := math.Abs(float64(i)-center) / stretch
+			w := 0.0
+			if t < k.Support {
+				w = k.Weight(t)
+			}
+			ws = append(ws, w)
+			sum += w
+		}
+		if sum != 0.0 {
+			for i := range ws {
+				ws[i] /= sum
+			}
+		}
+		firsts[j] = lo
+		weights[j] = ws
+	}
+	return firsts, weights
+}
+
+// resampleGray resamples a Gray32f image to a given rectangle using a given
+// kernel.  Samples beyond the image's edges replicate the edge pixels.
+func resampleGray(g *Gray32f, r image.Rectangle, k resampleKernel) *Gray32f {
+	gb := g.Bounds()
+	clampTo := func(i, n int) int {
+		switch {
+		case i < 0:
+			return 0
+		case i >= n:
+			return n - 1
+		}
+		return i
+	}
+
+	// Resample horizontally.
+	xFirsts, xWeights := resampleWeights(gb.Dx(), r.Dx(), k)
+	tmp := make([]float64, r.Dx()*gb.Dy())
+	for y := 0; y < gb.Dy(); y++ {
+		for j := 0; j < r.Dx(); j++ {
+			v := 0.0
+			for i, w := range xWeights[j] {
+				x := clampTo(xFirsts[j]+i, gb.Dx())
+				v += w * g.FloatAt(gb.Min.X+x, gb.Min.Y+y)
+			}
+			tmp[y*r.Dx()+j] = v
+		}
+	}
+
+	// Resample vertically.
+	yFirsts, yWeights := resampleWeights(gb.Dy(), r.Dy(), k)
+	out := NewGray32f(r)
+	for j := 0; j < r.Dy(); j++ {
+		for x := 0; x < r.Dx(); x++ {
+			v := 0.0
+			for i, w := range yWeights[j] {
+				y := clampTo(yFirsts[j]+i, gb.Dy())
+				v += w * tmp[y*r.Dx()+x]
+			}
+			out.SetFloat(r.Min.X+x, r.Min.Y+j, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,96 @@
+// This file provides support for writing a contact sheet that shows all split
+// channels side by side.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Montage layout parameters, in pixels
+const (
+	montageThumbSize = 256 // Maximum width or height of a thumbnail
+	montagePad       = 8   // Space around each thumbnail
+	montageLabel     = 16  // Height of the label beneath each thumbnail
+)
+
+// Montage returns a contact sheet containing a thumbnail of each of a set of
+// channel images, arranged side by side and labeled with the given names.
+// Thumbnails are scaled down, but never up, to fit within a fixed size.
+func Montage(names []string, imgs []image.Image) image.Image {
+	// Determine the thumbnail size from the first channel's bounds.
+	// Other channels, such as subsampled chroma channels, are scaled to the
+	// same size.
+	if len(imgs) == 0 {
+		return image.NewRGBA(image.Rectangle{})
+	}
+	bnds := imgs[0].Bounds()
+	tw, th := bnds.Dx(), bnds.Dy()
+	if tw > montageThumbSize || th > montageThumbSize {
+		if tw >= th {
+			tw, th = montageThumbSize, th*montageThumbSize/tw
+		} else {
+			tw, th = tw*montageThumbSize/th, montageThumbSize
+		}
+		if tw < 1 {
+			tw = 1
+		}
+		if th < 1 {
+			th = 1
+		}
+	}
+
+	// Allocate a white sheet.
+	cellW := tw + montagePad
+	sheet := image.NewRGBA(image.Rect(0, 0,
+		len(imgs)*cellW+montagePad, th+2*montagePad+montageLabel))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, draw.Src)
+
+	// Draw each thumbnail, surrounded by a gray border, and its label.
+	border := image.NewUniform(color.Gray{Y: 0x80})
+	face := basicfont.Face7x13
+	for i, img := range imgs {
+		x0 := montagePad + i*cellW
+		dst := image.Rect(x0, montagePad, x0+tw, montagePad+th)
+		draw.Draw(sheet, dst.Inset(-1), border, image.Point{}, draw.Src)
+		xdraw.CatmullRom.Scale(sheet, dst, img, img.Bounds(), draw.Src, nil)
+		d := &font.Drawer{
+			Dst:  sheet,
+			Src:  image.Black,
+			Face: face,
+		}
+		lw := d.MeasureString(names[i]).Round()
+		d.Dot = fixed.P(x0+(tw-lw)/2, montagePad+th+montageLabel-2)
+		d.DrawString(names[i])
+	}
+	return sheet
+}
+
+// writeMontage writes a contact sheet of a set of channel images, rendered as
+// they are written individually, to a named file.  The file's format is
+// inferred from its name, and the sheet is written at the format's default
+// depth, regardless of the options that apply to the channels themselves.
+// writeMontage aborts on error.
+func writeMontage(p *Parameters, fn string, infos []ImageInfo) {
+	names := make([]string, len(infos))
+	imgs := make([]image.Image, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name
+		imgs[i] = renderChannel(p, info)
+	}
+	mp := *p
+	mp.Format = ""
+	mp.Depth = ""
+	mp.GeoTags = nil
+	err := WriteImage(&mp, fn, Montage(names, imgs))
+	if err != nil {
+		notify.Fatal(err)
+	}
+}
@@ -0,0 +1,273 @@
+// This file provides support for naming the output files of split channels,
+// using either a "%s" placeholder for the channel name or Go's text/template
+// syntax, and for recovering channel names from such files when merging.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// outputNameFields are the fields available to an output-file template
+// written in Go's text/template syntax.
+type outputNameFields struct {
+	Channel string // Channel name (e.g., "L")
+	Index   int    // Zero-based position of the channel among those written
+	Base    string // Input file's name, stripped of its directory and extension
+	Space   string // Lowercase color-space name (e.g., "lab")
+	Ext     string // Output-file extension, including the leading "."
+}
+
+// isNameTemplate reports whether an output-file template uses Go's
+// text/template syntax rather than a "%s" placeholder.
+func isNameTemplate(tmpl string) bool {
+	return strings.Contains(tmpl, "{{")
+}
+
+// namesChannels reports whether an output-file template distinguishes one
+// channel from another.
+func namesChannels(tmpl string) bool {
+	if isNameTemplate(tmpl) {
+		return strings.Contains(tmpl, ".Channel") || strings.Contains(tmpl, ".Index")
+	}
+	return strings.Contains(tmpl, "%s")
+}
+
+// namesInputs reports whether an output-file template distinguishes one input
+// file from another.
+func namesInputs(tmpl string) bool {
+	if isNameTemplate(tmpl) && strings.Contains(tmpl, ".Base") {
+		return true
+	}
+	return hasBaseVerb(tmpl)
+}
+
+// builtinChannelNames returns the built-in names of all channels that the
+// current mode can write, in order.
+func builtinChannelNames(p *Parameters) []string {
+	if p.Unpack {
+		return packChannelNames
+	}
+	names, _ := splitKernel(p.ColorSpace, p.WhitePoint)
+	if p.Alpha {
+		names = append(names, "alpha")
+	}
+	return names
+}
+
+// nameSchemes lists the valid arguments to --name-scheme.
+var nameSchemes = map[string]bool{
+	"mixed":   true,
+	"lower":   true,
+	"numeric": true,
+}
+
+// outputChannelName returns the name to use in output filenames for a
+// channel with a given built-in name, the idx-th of those written.  This is
+// the custom name given by p.Names, if any, or the built-in name in the form
+// given by p.NameScheme.  Numeric names reflect the channel's position in the
+// color space, except for channels not native to the color space (e.g., PSD
+// spot channels), which are numbered by their position among those written.
+// The "+" and "-" suffixes of channels written by --signed=split are retained.
+func outputChannelName(p *Parameters, name string, idx int) string {
+	pos, sfx := signedBaseIndex(p, name)
+	switch {
+	case p.Names != nil && pos >= 0:
+		return p.Names[pos] + sfx
+	case p.NameScheme == "lower":
+		return strings.ToLower(name)
+	case p.NameScheme == "numeric" && pos >= 0:
+		return fmt.Sprintf("%02d", pos) + sfx
+	case p.NameScheme == "numeric":
+		return fmt.Sprintf("%02d", idx)
+	}
+	return name
+}
+
+// outputChannelNames returns the names to use in output filenames for a set
+// of channels, as returned by outputChannelName.  Names that differ only in
+// case, which would collide on a case-insensitive filesystem, are
+// disambiguated by appending "-2", "-3", etc. to all but the first.
+func outputChannelNames(p *Parameters, infos []ImageInfo) []string {
+	names := make([]string, len(infos))
+	used := make(map[string]bool, len(infos))
+	for i, info := range infos {
+		base := outputChannelName(p, info.Name, i)
+		nm := base
+		for n := 2; used[strings.ToLower(nm)]; n++ {
+			nm = fmt.Sprintf("%s-%d", base, n)
+		}
+		used[strings.ToLower(nm)] = true
+		names[i] = nm
+	}
+	return names
+}
+
+// channelFileNames returns the names of the files to which to write a set of
+// channels by expanding an output-file template for each channel in turn.
+// It aborts if the template cannot be expanded or if two channels would be
+// written to files whose names differ at most in case.
+func channelFileNames(p *Parameters, tmpl string, infos []ImageInfo) []string {
+	names := outputChannelNames(p, infos)
+	files := make([]string, len(infos))
+	seen := make(map[string]int, len(infos))
+	for i, nm := range names {
+		files[i] = channelFileName(p, tmpl, i, nm)
+		key := strings.ToLower(files[i])
+		if j, ok := seen[key]; ok {
+			notify.Fatalf("Channels %s and %s would both be written to %s",
+				infos[j].Name, infos[i].Name, files[i])
+		}
+		seen[key] = i
+	}
+	return files
+}
+
+// channelFileName returns the name of the file to which to write the idx-th
+// channel written by expanding an output-file template with the channel's
+// output name.  It aborts if the template cannot be expanded.
+func channelFileName(p *Parameters, tmpl string, idx int, name string) string {
+	if !isNameTemplate(tmpl) {
+		return fmt.Sprintf(tmpl, name)
+	}
+	return expandNameTemplate(p, tmpl, idx, name)
+}
+
+// expandNameTemplate expands an output-file template written in Go's
+// text/template syntax, using a given channel name and index.  It aborts if
+// the template cannot be expanded.
+func expandNameTemplate(p *Parameters, tmpl string, idx int, name string) string {
+	t, err := template.New("output").Parse(tmpl)
+	if err != nil {
+		notify.Fatalf("Invalid output-file template: %s", err)
+	}
+	fields := outputNameFields{
+		Channel: name,
+		Index:   idx,
+		Space:   p.ColorSpace,
+	}
+	if len(p.InputNames) > 0 {
+		fields.Base = baseName(p.InputNames[0])
+	}
+	if of := outputFormats[selectOutputFormat("", p.Format)]; len(of.Exts) > 0 {
+		fields.Ext = of.Exts[0]
+	}
+	var sb strings.Builder
+	err = t.Execute(&sb, fields)
+	if err != nil {
+		notify.Fatalf("Invalid output-file template: %s", err)
+	}
+	return sb.String()
+}
+
+// channelNamesFromFiles returns the part of each of a list of filenames that
+// differs from the others.  For files written by --split, this is the
+// channel's output name.  channelNamesFromFiles returns nil if fewer than two
+// filenames are given or the differing part of any filename is empty.
+func channelNamesFromFiles(fns []string) []string {
+	if len(fns) < 2 {
+		return nil
+	}
+	prefix, suffix := fns[0], fns[0]
+	for _, fn := range fns[1:] {
+		for !strings.HasPrefix(fn, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for _, fn := range fns {
+		for !strings.HasSuffix(fn[len(prefix):], suffix) {
+			suffix = suffix[1:]
+		}
+	}
+	names := make([]string, len(fns))
+	for i, fn := range fns {
+		names[i] = fn[len(prefix) : len(fn)-len(suffix)]
+		if names[i] == "" {
+			return nil
+		}
+	}
+	return names
+}
+
+// matchChannelOrder returns, for each channel of a color space in merge
+// order, the index of the name in a list of names that designates that
+// channel.  The names must match the color space's built-in channel names
+// (plus "alpha" if alpha is true) in some order, ignoring case if fold is
+// true.  matchChannelOrder returns nil if the names do not match.
+func matchChannelOrder(names []string, cs string, alpha, fold bool) []int {
+	builtin, _ := splitKernel(cs, [3]float64{})
+	if alpha {
+		builtin = append(builtin, "alpha")
+	}
+	if len(builtin) != len(names) {
+		return nil
+	}
+	order := make([]int, len(builtin))
+	for i, bn := range builtin {
+		order[i] = -1
+		for j, nm := range names {
+			if nm == bn || (fold && strings.EqualFold(nm, bn)) {
+				order[i] = j
+				break
+			}
+		}
+		if order[i] < 0 {
+			return nil
+		}
+	}
+	return order
+}
+
+// detectMergeOrder infers a color space and the order of a list of channel
+// files to merge from the channel names embedded in the files' names, as
+// written by --split.  It returns the color space and the reordered list of
+// files.  If the color space cannot be inferred, the given color space and
+// list of files are returned unmodified.  detectMergeOrder aborts if the
+// channel names fit more than one color space.
+func detectMergeOrder(fns []string, space string) (string, []string) {
+	names := channelNamesFromFiles(fns)
+	if names == nil {
+		return space, fns
+	}
+	reorder := func(order []int) []string {
+		sorted := make([]string, len(order))
+		for i, j := range order {
+			sorted[i] = fns[j]
+		}
+		return sorted
+	}
+
+	// Find all color spaces whose channel names match, preferring an exact
+	// match to one that ignores case.  The three RGB color spaces share
+	// channel names, so prefer the default, rgb.  Likewise, HSL and HSLuv
+	// share channel names, so prefer the older, hsl.
+	for _, fold := range []bool{false, true} {
+		var spaces []string
+		var orders [][]int
+		for _, cs := range colorSpaceList {
+			for _, alpha := range []bool{false, true} {
+				order := matchChannelOrder(names, cs, alpha, fold)
+				if order == nil || cs == "srgb" || cs == "linrgb" || cs == "hsluv" {
+					continue
+				}
+				if alpha {
+					cs += "a"
+				}
+				spaces = append(spaces, cs)
+				orders = append(orders, order)
+			}
+		}
+		switch len(spaces) {
+		case 0:
+			continue
+		case 1:
+			return spaces[0], reorder(orders[0])
+		default:
+			notify.Fatalf("Channel names %s fit more than one color space (%s); please specify --space",
+				strings.Join(names, ", "), strings.Join(spaces, ", "))
+		}
+	}
+	return space, fns
+}
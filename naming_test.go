@@ -0,0 +1,31 @@
+// This file tests the interpretation of channel filenames.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestDetectMergeOrder verifies that the color space and channel order are
+// inferred from the names of files written by --split.
+func TestDetectMergeOrder(t *testing.T) {
+	for _, tc := range []struct {
+		fns   []string
+		space string
+		want  []string
+	}{
+		{[]string{"x-L.png", "x-H.png", "x-C.png"}, "hcl", []string{"x-H.png", "x-C.png", "x-L.png"}},
+		{[]string{"x-H.png", "x-S.png", "x-L.png"}, "hsl", []string{"x-H.png", "x-S.png", "x-L.png"}},
+		{[]string{"x-l.png", "x-h.png", "x-s.png"}, "hsl", []string{"x-h.png", "x-s.png", "x-l.png"}},
+		{[]string{"x-alpha.png", "x-l.png", "x-h.png", "x-s.png"}, "hsla", []string{"x-h.png", "x-s.png", "x-l.png", "x-alpha.png"}},
+		{[]string{"x-b.png", "x-g.png", "x-r.png"}, "rgb", []string{"x-r.png", "x-g.png", "x-b.png"}},
+		{[]string{"x-L.png", "x-b.png", "x-a.png"}, "lab", []string{"x-L.png", "x-a.png", "x-b.png"}},
+		{[]string{"x-1.png", "x-2.png", "x-3.png"}, "hcl", []string{"x-1.png", "x-2.png", "x-3.png"}},
+	} {
+		space, fns := detectMergeOrder(tc.fns, "hcl")
+		if space != tc.space || !reflect.DeepEqual(fns, tc.want) {
+			t.Errorf("%v: expected %s %v but saw %s %v", tc.fns, tc.space, tc.want, space, fns)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+// This file provides support for reading and writing NumPy .npy arrays and
+// for writing .npz archives of named arrays.
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// npyMagic is the magic string that begins every .npy file.
+const npyMagic = "\x93NUMPY"
+
+// init registers the NumPy .npy format with the image package.
+func init() {
+	image.RegisterFormat("npy", npyMagic, DecodeNPY, DecodeNPYConfig)
+}
+
+// An npyHeader represents the header of a .npy file.
+type npyHeader struct {
+	Width    int                    // Image width in pixels (array columns)
+	Height   int                    // Image height in pixels (array rows)
+	Channels int                    // Number of values per pixel: 1 (gray), 3 (RGB), or 4 (RGBA)
+	Size     int                    // Number of bytes per value
+	Value    func(b []byte) float64 // Function that converts a value's bytes to a float64
+}
+
+// npyFields matches the descr, fortran_order, and shape entries of a .npy
+// header dictionary.
+var npyFields = regexp.MustCompile(`'(descr|fortran_order|shape)'\s*:\s*('[^']*'|True|False|\([^)]*\))`)
+
+// npyValueFuncs maps a .npy type descriptor, less its byte-order character,
+// to the size of a value and a function that converts a value to a float64,
+// given a byte order.  Integer values are scaled to [0.0, 1.0].
+var npyValueFuncs = map[string]struct {
+	Size  int
+	Value func(bo binary.ByteOrder) func(b []byte) float64
+}{
+	"f4": {4, func(bo binary.ByteOrder) func(b []byte) float64 {
+		return func(b []byte) float64 { return float64(math.Float32frombits(bo.Uint32(b))) }
+	}},
+	"f8": {8, func(bo binary.ByteOrder) func(b []byte) float64 {
+		return func(b []byte) float64 { return math.Float64frombits(bo.Uint64(b)) }
+	}},
+	"u1": {1, func(bo binary.ByteOrder) func(b []byte) float64 {
+		return func(b []byte) float64 { return float64(b[0]) / 255.0 }
+	}},
+	"u2": {2, func(bo binary.ByteOrder) func(b []byte) float64 {
+		return func(b []byte) float64 { return float64(bo.Uint16(b)) / 65535.0 }
+	}},
+}
+
+// readNPYHeader reads and parses a .npy header.  Only C-ordered arrays of
+// shape (rows, columns), (rows, columns, 3), or (rows, columns, 4) are
+// accepted.
+func readNPYHeader(r *bufio.Reader) (npyHeader, error) {
+	// Read the magic string, version, and header dictionary.
+	var hdr npyHeader
+	var pre [8]byte
+	if _, err := io.ReadFull(r, pre[:]); err != nil {
+		return hdr, errors.New("npy: truncated header")
+	}
+	if string(pre[:6]) != npyMagic {
+		return hdr, errors.New("npy: invalid format")
+	}
+	var hlen int
+	switch pre[6] {
+	case 1:
+		var n uint16
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return hdr, errors.New("npy: truncated header")
+		}
+		hlen = int(n)
+	case 2, 3:
+		var n uint32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return hdr, errors.New("npy: truncated header")
+		}
+		if n > 1<<20 {
+			return hdr, errors.New("npy: header too large")
+		}
+		hlen = int(n)
+	default:
+		return hdr, fmt.Errorf("npy: unsupported version %d.%d", pre[6], pre[7])
+	}
+	dict := make([]byte, hlen)
+	if _, err := io.ReadFull(r, dict); err != nil {
+		return hdr, errors.New("npy: truncated header")
+	}
+
+	// Parse the header dictionary.
+	fields := make(map[string]string)
+	for _, m := range npyFields.FindAllStringSubmatch(string(dict), -1) {
+		fields[m[1]] = m[2]
+	}
+	if fields["fortran_order"] != "False" {
+		return hdr, errors.New("npy: only C-ordered arrays are supported")
+	}
+	descr := strings.Trim(fields["descr"], "'")
+	if len(descr) != 3 {
+		return hdr, fmt.Errorf("npy: unsupported type %q", descr)
+	}
+	var bo binary.ByteOrder
+	switch descr[0] {
+	case '<', '|':
+		bo = binary.LittleEndian
+	case '>':
+		bo = binary.BigEndian
+	default:
+		return hdr, fmt.Errorf("npy: unsupported type %q", descr)
+	}
+	vf, ok := npyValueFuncs[descr[1:]]
+	if !ok {
+		return hdr, fmt.Errorf("npy: unsupported type %q", descr)
+	}
+	hdr.Size = vf.Size
+	hdr.Value = vf.Value(bo)
+	var shape []int
+	for _, d := range strings.Split(strings.Trim(fields["shape"], "()"), ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		n, err := strconv.Atoi(d)
+		if err != nil || n <= 0 || n > 1<<24 {
+			return hdr, fmt.Errorf("npy: invalid shape %s", fields["shape"])
+		}
+		shape = append(shape, n)
+	}
+	switch {
+	case len(shape) == 2:
+		hdr.Channels = 1
+	case len(shape) == 3 && (shape[2] == 3 || shape[2] == 4):
+		hdr.Channels = shape[2]
+	default:
+		return hdr, fmt.Errorf("npy: unsupported shape %s", fields["shape"])
+	}
+	hdr.Height, hdr.Width = shape[0], shape[1]
+	return hdr, nil
+}
+
+// DecodeNPY decodes a NumPy .npy array of unsigned 8- or 16-bit integers or
+// 32- or 64-bit floating-point numbers.  A two-dimensional array is returned
+// as a *Gray32f, and a three-dimensional array of R, G, B, and (optionally) A
+// values, as written by EncodeNPY, is returned as an *NRGBA32f.  Integer
+// values are scaled to [0.0, 1.0], and floating-point values are returned
+// verbatim.
+func DecodeNPY(rd io.Reader) (image.Image, error) {
+	// Read the header.
+	r := bufio.NewReader(rd)
+	hdr, err := readNPYHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the values before allocating the image so that a corrupt
+	// header cannot cause an enormous allocation.
+	rowSize := hdr.Size * hdr.Channels * hdr.Width
+	data, err := readBytes(r, int64(rowSize)*int64(hdr.Height))
+	if err != nil {
+		return nil, errors.New("npy: truncated array data")
+	}
+
+	// Convert the values one row at a time.
+	bnds := image.Rect(0, 0, hdr.Width, hdr.Height)
+	var gray *Gray32f
+	var rgba *NRGBA32f
+	if hdr.Channels == 1 {
+		gray = NewGray32f(bnds)
+	} else {
+		rgba = NewNRGBA32f(bnds)
+	}
+	for y := 0; y < hdr.Height; y++ {
+		row := data[rowSize*y:]
+		for x := 0; x < hdr.Width; x++ {
+			v := [4]float64{0.0, 0.0, 0.0, 1.0}
+			for c := 0; c < hdr.Channels; c++ {
+				ofs := hdr.Size * (x*hdr.Channels + c)
+				v[c] = hdr.Value(row[ofs : ofs+hdr.Size])
+			}
+			if gray != nil {
+				gray.SetFloat(x, y, v[0])
+			} else {
+				rgba.SetFloats(x, y, v)
+			}
+		}
+	}
+	if gray != nil {
+		return gray, nil
+	}
+	return rgba, nil
+}
+
+// DecodeNPYConfig returns the dimensions and color model of a NumPy .npy
+// array.
+func DecodeNPYConfig(rd io.Reader) (image.Config, error) {
+	var cfg image.Config
+	hdr, err := readNPYHeader(bufio.NewReader(rd))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ColorModel = color.Gray16Model
+	if hdr.Channels > 1 {
+		cfg.ColorModel = color.NRGBA64Model
+	}
+	cfg.Width = hdr.Width
+	cfg.Height = hdr.Height
+	return cfg, nil
+}
+
+// npyValues returns the shape of the NumPy array that represents an image
+// plus a function that returns the values of a given pixel as float32s in
+// [0.0, 1.0] (or beyond, for floating-point images).  Grayscale images are
+// represented as a two-dimensional array, and color images are represented as
+// a three-dimensional array of R, G, B, and A values.
+func npyValues(img image.Image) ([]int, func(x, y int) []float32) {
+	bnds := img.Bounds()
+	shape := []int{bnds.Dy(), bnds.Dx()}
+	switch m := img.(type) {
+	case *Gray32f:
+		return shape, func(x, y int) []float32 {
+			return []float32{float32(m.FloatAt(x, y))}
+		}
+	case *NRGBA32f:
+		return append(shape, 4), func(x, y int) []float32 {
+			v := m.FloatsAt(x, y)
+			return []float32{float32(v[0]), float32(v[1]), float32(v[2]), float32(v[3])}
+		}
+	}
+	if img.ColorModel() == color.GrayModel || img.ColorModel() == color.Gray16Model {
+		return shape, func(x, y int) []float32 {
+			g := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16)
+			return []float32{float32(g.Y) / 65535.0}
+		}
+	}
+	return append(shape, 4), func(x, y int) []float32 {
+		c := toNRGBA64(img.At(x, y))
+		return []float32{
+			float32(c.R) / 65535.0,
+			float32(c.G) / 65535.0,
+			float32(c.B) / 65535.0,
+			float32(c.A) / 65535.0,
+		}
+	}
+}
+
+// EncodeNPY writes an image as a NumPy .npy array of little-endian float32
+// values, with rows first.
+func EncodeNPY(w io.Writer, img image.Image) error {
+	// Construct the header, padded so that the data are 64-byte aligned.
+	shape, valuesAt := npyValues(img)
+	dims := make([]string, len(shape))
+	for i, d := range shape {
+		dims[i] = fmt.Sprint(d)
+	}
+	hdr := fmt.Sprintf("{'descr': '<f4', 'fortran_order': False, 'shape': (%s), }",
+		strings.Join(dims, ", "))
+	pad := 64 - (len(npyMagic)+4+len(hdr)+1)%64
+	hdr += strings.Repeat(" ", pad%64) + "\n"
+
+	// Write the header followed by the data.
+	bw := bufio.NewWriter(w)
+	bw.WriteString(npyMagic)
+	bw.Write([]byte{1, 0}) // Version 1.0
+	binary.Write(bw, binary.LittleEndian, uint16(len(hdr)))
+	bw.WriteString(hdr)
+	var buf [4]byte
+	bnds := img.Bounds()
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			for _, v := range valuesAt(x, y) {
+				binary.LittleEndian.PutUint32(buf[:], math.Float32bits(v))
+				bw.Write(buf[:])
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// writeNPZ writes a set of channels as a NumPy .npz archive, with one array
+// per channel, named after the channel.
+func writeNPZ(w io.Writer, infos []ImageInfo, p *Parameters) error {
+	zw := zip.NewWriter(w)
+	for _, info := range infos {
+		f, err := zw.Create(info.Name + ".npy")
+		if err != nil {
+			return err
+		}
+		if err := EncodeNPY(f, info.Image); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// encodeNPZ writes an image as a NumPy .npz archive containing a single array
+// named "image".
+func encodeNPZ(w io.Writer, img image.Image, p *Parameters) error {
+	zw := zip.NewWriter(w)
+	f, err := zw.Create("image.npy")
+	if err != nil {
+		return err
+	}
+	if err := EncodeNPY(f, img); err != nil {
+		return err
+	}
+	return zw.Close()
+}
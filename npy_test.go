@@ -0,0 +1,108 @@
+// This file tests the NumPy .npy reader and writer.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"testing"
+)
+
+// TestNPYRoundTrip verifies that images written by EncodeNPY are read back
+// exactly by DecodeNPY.
+func TestNPYRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"gray", testGrayImage()},
+		{"opaque", testColorImage(false)},
+		{"alpha", testColorImage(true)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := encodeImage(t, EncodeNPY, tc.img)
+			checkImage(t, decodeImage(t, DecodeNPY, data), tc.img, 0.0)
+		})
+	}
+}
+
+// npyTestFile returns a version 1.0 .npy file with a given header dictionary
+// followed by the given array data.
+func npyTestFile(dict string, data []byte) []byte {
+	f := []byte(npyMagic + "\x01\x00\x00\x00" + dict)
+	binary.LittleEndian.PutUint16(f[8:], uint16(len(dict)))
+	return append(f, data...)
+}
+
+// npyDict returns a .npy header dictionary for a given type descriptor and
+// shape.
+func npyDict(descr, shape string) string {
+	return fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': %s, }\n", descr, shape)
+}
+
+// TestNPYGolden verifies that DecodeNPY reads hand-constructed arrays of
+// each supported type and byte order.
+func TestNPYGolden(t *testing.T) {
+	t.Run("u1", func(t *testing.T) {
+		data := npyTestFile(npyDict("|u1", "(2, 3)"), []byte{0, 51, 102, 153, 204, 255})
+		want := NewGray32f(image.Rect(0, 0, 3, 2))
+		for i, v := range []float64{0.0, 0.2, 0.4, 0.6, 0.8, 1.0} {
+			want.SetFloat(i%3, i/3, v)
+		}
+		checkImage(t, decodeImage(t, DecodeNPY, data), want, 1e-7)
+		checkTruncated(t, DecodeNPY, data, len(data))
+	})
+	t.Run(">u2", func(t *testing.T) {
+		data := npyTestFile(npyDict(">u2", "(1, 1, 4)"), []byte{0xff, 0xff, 0x80, 0x00, 0, 0, 0x33, 0x33})
+		want := NewNRGBA32f(image.Rect(0, 0, 1, 1))
+		want.SetFloats(0, 0, [4]float64{1.0, 32768.0 / 65535.0, 0.0, 0.2})
+		checkImage(t, decodeImage(t, DecodeNPY, data), want, 1e-7)
+		checkTruncated(t, DecodeNPY, data, len(data))
+	})
+	t.Run("<f8", func(t *testing.T) {
+		vals := make([]byte, 24)
+		for i, v := range []uint64{0x3fe0000000000000, 0x4000000000000000, 0xbff0000000000000} {
+			binary.LittleEndian.PutUint64(vals[8*i:], v)
+		}
+		data := npyTestFile(npyDict("<f8", "(1, 1, 3)"), vals)
+		want := NewNRGBA32f(image.Rect(0, 0, 1, 1))
+		want.SetFloats(0, 0, [4]float64{0.5, 2.0, -1.0, 1.0})
+		checkImage(t, decodeImage(t, DecodeNPY, data), want, 0.0)
+		checkTruncated(t, DecodeNPY, data, len(data))
+	})
+}
+
+// TestNPYTruncated verifies that DecodeNPY rejects truncated files.
+func TestNPYTruncated(t *testing.T) {
+	data := encodeImage(t, EncodeNPY, testColorImage(true))
+	checkTruncated(t, DecodeNPY, data, len(data))
+}
+
+// TestNPYMalformed verifies that DecodeNPY rejects corrupt headers without
+// panicking.
+func TestNPYMalformed(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"bad magic":     append([]byte("\x93NUMPX\x01\x00\x00\x00"), make([]byte, 8)...),
+		"bad version":   append([]byte(npyMagic+"\x04\x00\x00\x00"), make([]byte, 8)...),
+		"huge header":   []byte(npyMagic + "\x02\x00\xff\xff\xff\xff"),
+		"long header":   npyTestFile(npyDict("<f4", "(1, 1)")+"\x00", nil)[:20],
+		"Fortran order": npyTestFile("{'descr': '<f4', 'fortran_order': True, 'shape': (1, 1), }", make([]byte, 4)),
+		"bad type":      npyTestFile(npyDict("<i4", "(1, 1)"), make([]byte, 4)),
+		"bad order":     npyTestFile(npyDict("=f4", "(1, 1)"), make([]byte, 4)),
+		"short descr":   npyTestFile(npyDict("f4", "(1, 1)"), make([]byte, 4)),
+		"1-D":           npyTestFile(npyDict("<f4", "(4,)"), make([]byte, 16)),
+		"2 channels":    npyTestFile(npyDict("<f4", "(1, 1, 2)"), make([]byte, 8)),
+		"zero rows":     npyTestFile(npyDict("<f4", "(0, 1)"), nil),
+		"bad shape":     npyTestFile(npyDict("<f4", "(1, x)"), make([]byte, 4)),
+		"huge width":    npyTestFile(npyDict("<f4", "(1, 99999999999)"), make([]byte, 4)),
+		"huge image":    npyTestFile(npyDict("<f8", "(16777216, 16777216, 4)"), make([]byte, 4)),
+		"no shape":      npyTestFile("{'descr': '<f4', 'fortran_order': False}", make([]byte, 4)),
+	} {
+		if _, err := decodeSafely(DecodeNPY, data); err == nil || isPanic(err) {
+			t.Errorf("%s: expected an error but saw %v", name, err)
+		}
+	}
+	data := encodeImage(t, EncodeNPY, testColorImage(true))
+	checkMutated(t, DecodeNPY, data, 128)
+}
@@ -0,0 +1,64 @@
+// This file provides support for removing transparency from images, either
+// by discarding the alpha channel or by compositing the image over a solid
+// background color.  Many print workflows mishandle alpha.
+
+package main
+
+import (
+	"context"
+	"image"
+	"strings"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// parseBackground parses the argument to --background, a color written as
+// "#rrggbb" or "#rgb" (with or without the "#").  It aborts on error.
+func parseBackground(arg string) colorful.Color {
+	hex := strings.TrimPrefix(strings.TrimSpace(arg), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	bg, err := colorful.Hex("#" + hex)
+	if err != nil {
+		notify.Fatalf(`--background requires a color of the form "#rrggbb" (not %q)`, arg)
+	}
+	return bg
+}
+
+// paramsBackground returns the color over which to composite transparent
+// pixels as directed by a set of parameters or nil to discard alpha instead.
+func paramsBackground(p *Parameters) *colorful.Color {
+	if p.Background == "" {
+		return nil
+	}
+	bg := parseBackground(p.Background)
+	return &bg
+}
+
+// Flatten returns a fully opaque copy of an image.  If bg is nil, Flatten
+// discards the image's alpha channel, leaving colors as they are.  Otherwise,
+// it composites the image over bg.  Flatten returns the context's error if
+// ctx is canceled.
+func Flatten(ctx context.Context, img image.Image, bg *colorful.Color) (*NRGBA32f, error) {
+	bnds := img.Bounds()
+	out := NewNRGBA32f(bnds)
+	at := storedFloatsAt(img)
+	err := forEachRow(ctx, bnds, func(y int) {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			v := at(x, y)
+			if bg != nil {
+				a := v[3]
+				v[0] = v[0]*a + bg.R*(1.0-a)
+				v[1] = v[1]*a + bg.G*(1.0-a)
+				v[2] = v[2]*a + bg.B*(1.0-a)
+			}
+			v[3] = 1.0
+			out.SetFloats(x, y, v)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
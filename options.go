@@ -0,0 +1,127 @@
+// This file provides functional options for configuring the split and merge
+// functions of the WebAssembly build and limits on the number of goroutines
+// that process an image.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// An option configures a split or merge operation.
+type option func(*Parameters) error
+
+// defaultParameters returns the parameters that apply when no options are
+// given.  These match the command-line defaults.
+func defaultParameters() Parameters {
+	return Parameters{
+		OrigColorSpace: "rgb",
+		ColorSpace:     "rgb",
+		WhitePoint:     colorful.D65,
+		PNGCompression: "default",
+		RawType:        "uint16",
+		RawEndian:      "little",
+		CSVLayout:      "matrix",
+		DeltaEMax:      10.0,
+		NameScheme:     "mixed",
+		Mismatch:       "error",
+		Gamut:          "clamp",
+		Dither:         "none",
+		Signed:         "offset",
+		YCbCrMatrix:    "bt601",
+		ResizeFilter:   "bilinear",
+		UpsampleFilter: "bilinear",
+		ICC:            "convert",
+		EmbedProfile:   "both",
+		CAT:            "none",
+		BandRows:       256,
+		Accel:          "auto",
+	}
+}
+
+// newParameters returns a set of parameters with the given options applied
+// to the defaults.
+func newParameters(opts ...option) (*Parameters, error) {
+	p := defaultParameters()
+	for _, opt := range opts {
+		if err := opt(&p); err != nil {
+			return nil, err
+		}
+	}
+	return &p, nil
+}
+
+// withColorSpace selects the color space in which to split or merge
+// channels.  Names are interpreted as by --space, so "L*a*b*" and "lab" are
+// equivalent, and a trailing "a" requests an alpha channel.
+func withColorSpace(name string) option {
+	return func(p *Parameters) error {
+		cs, alpha, ok := lookupColorSpace(name)
+		if !ok {
+			return fmt.Errorf("unknown color space %q", name)
+		}
+		p.OrigColorSpace = name
+		p.ColorSpace = cs
+		p.Alpha = alpha
+		return nil
+	}
+}
+
+// withWhitePoint specifies the white reference point, as an XYZ color, used
+// by the HCL, L*a*b*, and L*u*v* color spaces.
+func withWhitePoint(wp [3]float64) option {
+	return func(p *Parameters) error {
+		if wp[1] <= 0.0 {
+			return fmt.Errorf("invalid white point %v", wp)
+		}
+		p.WhitePoint = wp
+		return nil
+	}
+}
+
+// withDepth specifies the pixel depth of output files: "8", "16", "32f", or
+// "" for the output format's default.
+func withDepth(depth string) option {
+	return func(p *Parameters) error {
+		depth = strings.ToLower(depth)
+		if depth != "" && !outputDepths[depth] {
+			return fmt.Errorf("invalid depth %q", depth)
+		}
+		p.Depth = depth
+		return nil
+	}
+}
+
+// workersKey is the context key under which the worker limit is stored.
+type workersKey struct{}
+
+// withWorkers returns a copy of a context that carries a limit on the number
+// of goroutines that process an image concurrently.  A limit of zero leaves
+// the context unchanged, which implies GOMAXPROCS goroutines.
+func withWorkers(ctx context.Context, n int) context.Context {
+	if n <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, workersKey{}, make(chan struct{}, n))
+}
+
+// workerSemaphore returns the channel that limits the number of goroutines
+// that process an image concurrently or nil if there is no limit.
+func workerSemaphore(ctx context.Context) chan struct{} {
+	sem, _ := ctx.Value(workersKey{}).(chan struct{})
+	return sem
+}
+
+// workerCount returns the number of goroutines that should process an image
+// concurrently: the limit carried by ctx, if any, or else GOMAXPROCS.
+func workerCount(ctx context.Context) int {
+	if sem := workerSemaphore(ctx); sem != nil {
+		return cap(sem)
+	}
+	return runtime.GOMAXPROCS(0)
+}
@@ -0,0 +1,217 @@
+// This file provides functions for packing grayscale images into the R, G, B,
+// and A channels of a color image and for unpacking those channels again, in
+// both cases without any color-space conversion, as is common for game-asset
+// textures.
+
+package main
+
+import (
+	"context"
+	"image"
+	"strings"
+)
+
+// packChannelNames lists the names of the channels of a packed image in
+// channel order.
+var packChannelNames = []string{"R", "G", "B", "A"}
+
+// readPackChannel reads a single grayscale image to pack.  It aborts on
+// error.
+func readPackChannel(p *Parameters, fn string) *Gray32f {
+	switch {
+	case p.RawSize != (image.Point{}):
+		return ReadRawChannel(p, fn)
+	case isTableFile(fn):
+		return ReadTableChannel(fn)
+	default:
+		return ReadGrayscaleImage(fn)
+	}
+}
+
+// parsePackInputs parses the input names for --pack, each of the form
+// <channel>=<filename>, and returns the grayscale image assigned to each of
+// R, G, B, and A, with nil for unassigned channels.  It aborts on error.
+func parsePackInputs(p *Parameters) [4]*Gray32f {
+	var grays [4]*Gray32f
+	if len(p.InputNames) == 0 {
+		notify.Fatal("--pack requires at least one <channel>=<filename> argument")
+	}
+	for _, arg := range p.InputNames {
+		// Split the argument into a channel name and a filename.
+		eq := strings.Index(arg, "=")
+		if eq < 0 {
+			notify.Fatalf("--pack requires arguments of the form <channel>=<filename> (not %q)", arg)
+		}
+		ch := -1
+		for i, nm := range packChannelNames {
+			if strings.EqualFold(arg[:eq], nm) {
+				ch = i
+				break
+			}
+		}
+		if ch < 0 {
+			notify.Fatalf("--pack requires a channel name of %s (not %q)",
+				strings.Join(packChannelNames, ", "), arg[:eq])
+		}
+		if grays[ch] != nil {
+			notify.Fatalf("Channel %s was specified more than once", packChannelNames[ch])
+		}
+
+		// Read the grayscale image.  Retain the geo-referencing
+		// information from the first image that has any.
+		fn := arg[eq+1:]
+		grays[ch] = readPackChannel(p, fn)
+		if p.GeoTags == nil {
+			p.GeoTags = ReadGeoTags(fn)
+		}
+	}
+	return grays
+}
+
+// PackChannels packs up to four grayscale images into the R, G, B, and A
+// channels of a color image without any color-space conversion.  Nil images
+// produce a channel value of 0.0 for R, G, and B and of 1.0 (opaque) for A.
+// All non-nil images must have the same bounds.  PackChannels returns the
+// context's error if ctx is canceled.
+func PackChannels(ctx context.Context, grays [4]*Gray32f) (image.Image, error) {
+	var bnds image.Rectangle
+	for _, g := range grays {
+		if g != nil {
+			bnds = g.Bounds()
+			break
+		}
+	}
+	packed := NewNRGBA32f(bnds)
+	err := forEachRow(ctx, bnds, func(y int) {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			v := [4]float64{0.0, 0.0, 0.0, 1.0}
+			for c, g := range grays {
+				if g != nil {
+					v[c] = g.FloatAt(x, y)
+				}
+			}
+			packed.SetFloats(x, y, v)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return packed, nil
+}
+
+// packChannels packs grayscale images into a color image as directed by a set
+// of parameters.  It returns the context's error if ctx is canceled and
+// aborts on any other error.
+func packChannels(ctx context.Context, p *Parameters) error {
+	ctx = withWorkers(ctx, p.Workers)
+	grays := parsePackInputs(p)
+
+	// Ensure that all channels have the same bounds.
+	var bnds image.Rectangle
+	first := true
+	for _, g := range grays {
+		if g == nil {
+			continue
+		}
+		if first {
+			bnds = g.Bounds()
+			first = false
+		} else if g.Bounds() != bnds {
+			notify.Fatal("All input images must have the same dimensions")
+		}
+	}
+
+	// Pack and write the image.
+	packed, err := PackChannels(ctx, grays)
+	if err != nil {
+		return err
+	}
+	err = WriteImage(p, p.OutputName, packed)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	return nil
+}
+
+// UnpackChannels extracts the R, G, B, and A channels of a color image as
+// grayscale images without any color-space conversion or clamping.  Values
+// read from 16-bit images are preserved exactly.  UnpackChannels returns the
+// context's error if ctx is canceled.
+func UnpackChannels(ctx context.Context, img image.Image) ([]ImageInfo, error) {
+	bnds := img.Bounds()
+	grays := allocGrays(bnds, len(packChannelNames))
+	var valsAt func(x, y int) [4]float64
+	if fimg, ok := img.(*NRGBA32f); ok {
+		valsAt = fimg.FloatsAt
+	} else {
+		valsAt = func(x, y int) [4]float64 {
+			clr := toNRGBA64(img.At(x, y))
+			return [4]float64{
+				float64(clr.R) / 65535.0,
+				float64(clr.G) / 65535.0,
+				float64(clr.B) / 65535.0,
+				float64(clr.A) / 65535.0,
+			}
+		}
+	}
+	err := forEachRow(ctx, bnds, func(y int) {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			for c, v := range valsAt(x, y) {
+				grays[c].SetFloat(x, y, v)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ImageInfo, len(packChannelNames))
+	for i, nm := range packChannelNames {
+		result[i].Name = nm
+		result[i].Image = grays[i]
+	}
+	return result, nil
+}
+
+// unpackChannels extracts the R, G, B, and A channels of a color image into
+// separate grayscale images as directed by a set of parameters.  It returns
+// the context's error if ctx is canceled and aborts on any other error.
+func unpackChannels(ctx context.Context, p *Parameters) error {
+	ctx = withWorkers(ctx, p.Workers)
+	if len(p.InputNames) != 1 {
+		notify.Fatalf("Expected 1 input file but saw %d", len(p.InputNames))
+	}
+	if p.OutputName == "" {
+		notify.Fatal("An output-file template must be specified when --unpack is used")
+	}
+	bundle := outputFormats[selectOutputFormat(p.OutputName, p.Format)].Bundle != nil
+	if !bundle && !namesChannels(p.OutputName) {
+		notify.Fatalf(`With --unpack, the output file must contain "%%s" or "{{.Channel}}"`)
+	}
+
+	// Ensure that every requested channel exists.
+	for _, nm := range p.Channels {
+		found := false
+		for _, pn := range packChannelNames {
+			found = found || nm == pn
+		}
+		if !found {
+			notify.Fatalf("--channels requires channels from %s for --unpack (not %q)",
+				strings.Join(packChannelNames, ", "), nm)
+		}
+	}
+
+	// Unpack the requested channels.
+	p.GeoTags = ReadGeoTags(p.InputNames[0])
+	all, err := UnpackChannels(ctx, ReadImage(p.InputNames[0]))
+	if err != nil {
+		return err
+	}
+	var outImgs []ImageInfo
+	for _, info := range all {
+		if channelWanted(p, info.Name) {
+			outImgs = append(outImgs, info)
+		}
+	}
+	writeChannels(p, p.OutputName, outImgs)
+	return nil
+}
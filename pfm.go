@@ -0,0 +1,218 @@
+// This file provides support for reading and writing Portable Float Map (PFM)
+// images, a lightweight alternative to OpenEXR for floating-point channels.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// init registers the PFM format with the image package.
+func init() {
+	image.RegisterFormat("pfm", "PF", DecodePFM, DecodePFMConfig)
+	image.RegisterFormat("pfm", "Pf", DecodePFM, DecodePFMConfig)
+}
+
+// A pfmHeader represents the header of a PFM file.
+type pfmHeader struct {
+	Color  bool             // true: three channels; false: one channel
+	Width  int              // Image width in pixels
+	Height int              // Image height in pixels
+	Order  binary.ByteOrder // Byte order of the samples
+}
+
+// pfmToken returns the next whitespace-delimited token from a PFM header.
+// It consumes exactly one whitespace character following the token.
+func pfmToken(r *bufio.Reader) (string, error) {
+	var tok []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			if len(tok) > 0 {
+				return string(tok), nil
+			}
+		default:
+			tok = append(tok, c)
+		}
+	}
+}
+
+// readPFMHeader reads and parses a PFM header.
+func readPFMHeader(r *bufio.Reader) (pfmHeader, error) {
+	var hdr pfmHeader
+	var toks [4]string
+	for i := range toks {
+		var err error
+		toks[i], err = pfmToken(r)
+		if err != nil {
+			return hdr, errors.New("pfm: truncated header")
+		}
+	}
+	switch toks[0] {
+	case "PF":
+		hdr.Color = true
+	case "Pf":
+		hdr.Color = false
+	default:
+		return hdr, errors.New("pfm: invalid format")
+	}
+	var err error
+	hdr.Width, err = strconv.Atoi(toks[1])
+	if err != nil || hdr.Width <= 0 || hdr.Width > 1<<24 {
+		return hdr, fmt.Errorf("pfm: invalid width %q", toks[1])
+	}
+	hdr.Height, err = strconv.Atoi(toks[2])
+	if err != nil || hdr.Height <= 0 || hdr.Height > 1<<24 {
+		return hdr, fmt.Errorf("pfm: invalid height %q", toks[2])
+	}
+	scale, err := strconv.ParseFloat(toks[3], 64)
+	if err != nil || scale == 0.0 {
+		return hdr, fmt.Errorf("pfm: invalid scale %q", toks[3])
+	}
+	hdr.Order = binary.BigEndian
+	if scale < 0.0 {
+		hdr.Order = binary.LittleEndian
+	}
+	return hdr, nil
+}
+
+// DecodePFM decodes a PFM image.  Three-channel images are returned as an
+// *NRGBA32f, with linear color values converted to gamma-encoded values.
+// One-channel images are returned as a *Gray32f containing the file's values
+// verbatim.
+func DecodePFM(rd io.Reader) (image.Image, error) {
+	// Read the header.
+	r := bufio.NewReader(rd)
+	hdr, err := readPFMHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	nc := 1
+	if hdr.Color {
+		nc = 3
+	}
+
+	// Read the samples before allocating the image so that a corrupt
+	// header cannot cause an enormous allocation.
+	rowSize := 4 * nc * hdr.Width
+	data, err := readBytes(r, int64(rowSize)*int64(hdr.Height))
+	if err != nil {
+		return nil, errors.New("pfm: truncated pixel data")
+	}
+
+	// Convert the samples.  PFM stores rows from bottom to top.
+	bnds := image.Rect(0, 0, hdr.Width, hdr.Height)
+	var gray *Gray32f
+	var rgb *NRGBA32f
+	if hdr.Color {
+		rgb = NewNRGBA32f(bnds)
+	} else {
+		gray = NewGray32f(bnds)
+	}
+	for y := hdr.Height - 1; y >= 0; y-- {
+		row := data[:rowSize]
+		data = data[rowSize:]
+		for x := 0; x < hdr.Width; x++ {
+			var v [3]float64
+			for c := 0; c < nc; c++ {
+				bits := hdr.Order.Uint32(row[4*(x*nc+c):])
+				v[c] = float64(math.Float32frombits(bits))
+			}
+			if hdr.Color {
+				clr := colorful.LinearRgb(v[0], v[1], v[2])
+				rgb.SetFloats(x, y, [4]float64{clr.R, clr.G, clr.B, 1.0})
+			} else {
+				gray.SetFloat(x, y, v[0])
+			}
+		}
+	}
+	if hdr.Color {
+		return rgb, nil
+	}
+	return gray, nil
+}
+
+// DecodePFMConfig returns the color model and dimensions of a PFM image
+// without decoding the entire image.
+func DecodePFMConfig(rd io.Reader) (image.Config, error) {
+	var cfg image.Config
+	hdr, err := readPFMHeader(bufio.NewReader(rd))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ColorModel = color.Gray16Model
+	if hdr.Color {
+		cfg.ColorModel = color.NRGBA64Model
+	}
+	cfg.Width = hdr.Width
+	cfg.Height = hdr.Height
+	return cfg, nil
+}
+
+// EncodePFM writes an image in little-endian PFM format.  Grayscale images are
+// written as a single channel containing the image's values verbatim.  Color
+// images are written as linear R, G, and B channels.  PFM does not support
+// alpha so any alpha channel is discarded.
+func EncodePFM(w io.Writer, img image.Image) error {
+	bnds := img.Bounds()
+	if bnds.Empty() {
+		return errors.New("pfm: cannot encode an empty image")
+	}
+
+	// Determine a function that returns the values of each channel for a
+	// given pixel.
+	var valuesAt func(x, y int) []float64
+	magic := "PF"
+	switch m := img.(type) {
+	case *Gray32f:
+		magic = "Pf"
+		valuesAt = func(x, y int) []float64 {
+			return []float64{m.FloatAt(x, y)}
+		}
+	case *image.Gray, *image.Gray16:
+		magic = "Pf"
+		valuesAt = func(x, y int) []float64 {
+			g := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16)
+			return []float64{float64(g.Y) / 65535.0}
+		}
+	case *NRGBA32f:
+		valuesAt = func(x, y int) []float64 {
+			v := m.FloatsAt(x, y)
+			r, g, b := colorful.Color{R: v[0], G: v[1], B: v[2]}.LinearRgb()
+			return []float64{r, g, b}
+		}
+	default:
+		valuesAt = func(x, y int) []float64 {
+			r, g, b := toColorful(img.At(x, y)).LinearRgb()
+			return []float64{r, g, b}
+		}
+	}
+
+	// Write the header followed by all rows from bottom to top.
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s\n%d %d\n-1.0\n", magic, bnds.Dx(), bnds.Dy())
+	var buf [4]byte
+	for y := bnds.Max.Y - 1; y >= bnds.Min.Y; y-- {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			for _, v := range valuesAt(x, y) {
+				binary.LittleEndian.PutUint32(buf[:], math.Float32bits(float32(v)))
+				bw.Write(buf[:])
+			}
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,66 @@
+// This file tests the PFM reader and writer.
+
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+// TestPFMRoundTrip verifies that images written by EncodePFM are read back
+// by DecodePFM with at most floating-point rounding error.
+func TestPFMRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+		tol  float64
+	}{
+		{"gray", testGrayImage(), 0.0},
+		{"color", testColorImage(false), 1e-6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := encodeImage(t, EncodePFM, tc.img)
+			checkImage(t, decodeImage(t, DecodePFM, data), tc.img, tc.tol)
+		})
+	}
+}
+
+// TestPFMGolden verifies that DecodePFM reads a hand-constructed,
+// big-endian, one-channel file, which stores its rows from bottom to top.
+func TestPFMGolden(t *testing.T) {
+	data := []byte("Pf\n2 2\n1.0\n" +
+		"\x3f\x80\x00\x00\x3f\x00\x00\x00" + // Bottom row: 1.0, 0.5
+		"\x00\x00\x00\x00\x3e\x80\x00\x00") // Top row: 0.0, 0.25
+	want := NewGray32f(image.Rect(0, 0, 2, 2))
+	want.SetFloat(0, 0, 0.0)
+	want.SetFloat(1, 0, 0.25)
+	want.SetFloat(0, 1, 1.0)
+	want.SetFloat(1, 1, 0.5)
+	checkImage(t, decodeImage(t, DecodePFM, data), want, 0.0)
+}
+
+// TestPFMTruncated verifies that DecodePFM rejects truncated files.
+func TestPFMTruncated(t *testing.T) {
+	data := encodeImage(t, EncodePFM, testColorImage(false))
+	checkTruncated(t, DecodePFM, data, len(data))
+}
+
+// TestPFMMalformed verifies that DecodePFM rejects corrupt headers without
+// panicking.
+func TestPFMMalformed(t *testing.T) {
+	for name, hdr := range map[string]string{
+		"bad magic":     "PX\n7 5\n-1.0\n",
+		"zero width":    "Pf\n0 5\n-1.0\n",
+		"bad height":    "Pf\n7 x\n-1.0\n",
+		"zero scale":    "Pf\n7 5\n0\n",
+		"huge width":    "PF\n99999999999 5\n-1.0\n",
+		"huge image":    "PF\n16777216 16777216\n-1.0\n",
+		"missing scale": "Pf\n7 5",
+	} {
+		if _, err := decodeSafely(DecodePFM, []byte(hdr+"\x00\x00\x80\x3f")); err == nil || isPanic(err) {
+			t.Errorf("%s: expected an error but saw %v", name, err)
+		}
+	}
+	data := encodeImage(t, EncodePFM, testGrayImage())
+	checkMutated(t, DecodePFM, data, 16)
+}
@@ -0,0 +1,335 @@
+// This file provides an interlaced (Adam7) PNG encoder.  The standard
+// library's PNG encoder writes only non-interlaced images.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+)
+
+// pngSignature is the eight-byte signature that begins every PNG file.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// adam7Passes describes the seven Adam7 passes as {x offset, y offset, x
+// step, y step}.
+var adam7Passes = [7][4]int{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+// pngWriteChunk writes a single PNG chunk.
+func pngWriteChunk(w io.Writer, name string, data []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)))
+	copy(hdr[4:], name)
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(data)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	for _, b := range [][]byte{hdr[:], data, sum[:]} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pngPaeth implements the PNG Paeth predictor.
+func pngPaeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := p-int(a), p-int(b), p-int(c)
+	if pa < 0 {
+		pa = -pa
+	}
+	if pb < 0 {
+		pb = -pb
+	}
+	if pc < 0 {
+		pc = -pc
+	}
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	default:
+		return c
+	}
+}
+
+// pngFilter filters a scanline, given the previous (unfiltered) scanline
+// and the number of bytes per pixel.  It tries each PNG filter type and
+// returns the result with the smallest sum of absolute values, preceded by
+// the filter-type byte.
+func pngFilter(cur, prev []byte, bpp int) []byte {
+	best := make([]byte, len(cur)+1)
+	bestSum := -1
+	trial := make([]byte, len(cur)+1)
+	for ft := byte(0); ft < 5; ft++ {
+		trial[0] = ft
+		sum := 0
+		for i, x := range cur {
+			var a, b, c byte
+			if i >= bpp {
+				a = cur[i-bpp]
+				c = prev[i-bpp]
+			}
+			b = prev[i]
+			var f byte
+			switch ft {
+			case 0:
+				f = x
+			case 1:
+				f = x - a
+			case 2:
+				f = x - b
+			case 3:
+				f = x - byte((int(a)+int(b))/2)
+			case 4:
+				f = x - pngPaeth(a, b, c)
+			}
+			trial[i+1] = f
+			if int8(f) < 0 {
+				sum -= int(int8(f))
+			} else {
+				sum += int(int8(f))
+			}
+		}
+		if bestSum < 0 || sum < bestSum {
+			bestSum = sum
+			best, trial = trial, best
+		}
+	}
+	return best
+}
+
+// PNG color types.
+const (
+	pngGray = 0
+	pngRGB  = 2
+	pngRGBA = 6
+)
+
+// pngColorType selects a PNG color type and bit depth for an image.
+// Grayscale images are written as grayscale, and color images are written as
+// RGB or, if not opaque, RGBA.  Images with 8-bit color models are written with
+// 8 bits per sample; all others are written with 16 bits per sample.
+func pngColorType(img image.Image) (colorType, depth byte) {
+	switch img.ColorModel() {
+	case color.GrayModel:
+		colorType, depth = pngGray, 8
+	case color.Gray16Model:
+		colorType, depth = pngGray, 16
+	case color.NRGBAModel, color.RGBAModel:
+		colorType, depth = pngRGBA, 8
+	default:
+		colorType, depth = pngRGBA, 16
+	}
+	if o, ok := img.(interface{ Opaque() bool }); ok && colorType == pngRGBA && o.Opaque() {
+		colorType = pngRGB
+	}
+	return colorType, depth
+}
+
+// pngCompressPixels filters and compresses an image's pixels using a given
+// color type, bit depth, and compression level.  Each pass is described as
+// in adam7Passes; a non-interlaced image is represented by the single pass
+// {0, 0, 1, 1}.
+func pngCompressPixels(img image.Image, colorType, depth byte, level png.CompressionLevel, passes [][4]int) ([]byte, error) {
+	// Determine the number of bytes per pixel.
+	nc := map[byte]int{pngGray: 1, pngRGB: 3, pngRGBA: 4}[colorType]
+	bpp := nc * int(depth) / 8
+
+	// samplesAt returns the samples for a given pixel as 16-bit values.
+	samplesAt := func(x, y int) [4]uint16 {
+		if colorType == pngGray {
+			g := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16)
+			return [4]uint16{g.Y}
+		}
+		c := toNRGBA64(img.At(x, y))
+		return [4]uint16{c.R, c.G, c.B, c.A}
+	}
+
+	// Filter and compress each scanline of each pass.
+	var zbuf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&zbuf, pngZlibLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	bnds := img.Bounds()
+	wd, ht := bnds.Dx(), bnds.Dy()
+	for _, pass := range passes {
+		x0, y0, dx, dy := pass[0], pass[1], pass[2], pass[3]
+		pw := (wd - x0 + dx - 1) / dx
+		ph := (ht - y0 + dy - 1) / dy
+		if pw <= 0 || ph <= 0 {
+			continue
+		}
+		cur := make([]byte, pw*bpp)
+		prev := make([]byte, pw*bpp)
+		for py := 0; py < ph; py++ {
+			y := bnds.Min.Y + y0 + py*dy
+			for px := 0; px < pw; px++ {
+				x := bnds.Min.X + x0 + px*dx
+				s := samplesAt(x, y)
+				for c := 0; c < nc; c++ {
+					if depth == 8 {
+						cur[px*bpp+c] = byte(s[c] >> 8)
+					} else {
+						binary.BigEndian.PutUint16(cur[px*bpp+2*c:], s[c])
+					}
+				}
+			}
+			if level == png.NoCompression {
+				zw.Write(append([]byte{0}, cur...))
+			} else {
+				zw.Write(pngFilter(cur, prev, bpp))
+			}
+			cur, prev = prev, cur
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return zbuf.Bytes(), nil
+}
+
+// pngWriteData writes compressed pixel data as one or more chunks of a given
+// type.
+func pngWriteData(w io.Writer, name string, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > 1<<20 {
+			n = 1 << 20
+		}
+		if err := pngWriteChunk(w, name, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// pngIHDR returns the contents of an IHDR chunk.
+func pngIHDR(wd, ht int, colorType, depth, interlace byte) []byte {
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(wd))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(ht))
+	ihdr[8] = depth
+	ihdr[9] = colorType
+	ihdr[12] = interlace
+	return ihdr[:]
+}
+
+// EncodeInterlacedPNG writes an image in Adam7-interlaced PNG format using
+// the given compression level.  The color type and bit depth are chosen as by
+// pngColorType.
+func EncodeInterlacedPNG(w io.Writer, img image.Image, level png.CompressionLevel) error {
+	bnds := img.Bounds()
+	if bnds.Empty() {
+		return errors.New("png: cannot encode an empty image")
+	}
+	colorType, depth := pngColorType(img)
+	data, err := pngCompressPixels(img, colorType, depth, level, adam7Passes[:])
+	if err != nil {
+		return err
+	}
+
+	// Write the PNG signature and all chunks.
+	bw := bufio.NewWriter(w)
+	bw.WriteString(pngSignature)
+	ihdr := pngIHDR(bnds.Dx(), bnds.Dy(), colorType, depth, 1) // Adam7 interlacing
+	if err := pngWriteChunk(bw, "IHDR", ihdr); err != nil {
+		return err
+	}
+	if err := pngWriteData(bw, "IDAT", data); err != nil {
+		return err
+	}
+	if err := pngWriteChunk(bw, "IEND", nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// pngInsertText returns a copy of an encoded PNG file with a tEXt chunk
+// holding a given keyword and value inserted immediately after the IHDR
+// chunk.
+func pngInsertText(data []byte, key, value string) ([]byte, error) {
+	return pngInsertChunk(data, "tEXt", []byte(key+"\x00"+value))
+}
+
+// pngInsertChunk returns a copy of an encoded PNG file with a chunk of a given
+// type and content inserted immediately after the IHDR chunk.
+func pngInsertChunk(data []byte, name string, content []byte) ([]byte, error) {
+	const ihdrEnd = len(pngSignature) + 8 + 13 + 4 // Signature, IHDR header, IHDR data, and CRC
+	if len(data) < ihdrEnd || string(data[:len(pngSignature)]) != pngSignature {
+		return nil, errors.New("png: malformed PNG data")
+	}
+	var buf bytes.Buffer
+	buf.Write(data[:ihdrEnd])
+	if err := pngWriteChunk(&buf, name, content); err != nil {
+		return nil, err
+	}
+	buf.Write(data[ihdrEnd:])
+	return buf.Bytes(), nil
+}
+
+// readPNGText returns the values of all tEXt chunks in a named PNG file that
+// precede the image data, keyed by keyword.  It returns an empty map if the
+// file cannot be read or is not a PNG file.
+func readPNGText(fn string) map[string]string {
+	f, err := os.Open(fn)
+	if err != nil {
+		return map[string]string{}
+	}
+	defer f.Close()
+	return pngReadText(f)
+}
+
+// pngReadText returns the values of all tEXt chunks that precede the image
+// data in a PNG stream, keyed by keyword.  It returns an empty map if r is not
+// a PNG stream.
+func pngReadText(r io.Reader) map[string]string {
+	text := make(map[string]string)
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil || string(sig) != pngSignature {
+		return text
+	}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return text
+		}
+		n := binary.BigEndian.Uint32(hdr[:4])
+		name := string(hdr[4:])
+		if name == "IDAT" || name == "IEND" || n > 1<<24 {
+			return text
+		}
+		data := make([]byte, n+4) // Data plus CRC
+		if _, err := io.ReadFull(r, data); err != nil {
+			return text
+		}
+		if name != "tEXt" {
+			continue
+		}
+		if kv := bytes.SplitN(data[:n], []byte{0}, 2); len(kv) == 2 {
+			text[string(kv[0])] = string(kv[1])
+		}
+	}
+}
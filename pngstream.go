@@ -0,0 +1,537 @@
+// This file provides a PNG decoder and encoder that operate one row at a time.
+// The standard library's PNG codec holds an entire image in memory, which
+// limits the size of the images that can be split or merged.
+
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"sort"
+)
+
+// pngZlibLevel maps a PNG compression level to a zlib compression level.
+func pngZlibLevel(level png.CompressionLevel) int {
+	switch level {
+	case png.NoCompression:
+		return zlib.NoCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.BestCompression:
+		return zlib.BestCompression
+	default:
+		return zlib.DefaultCompression
+	}
+}
+
+// A pngIDATReader presents the contents of a sequence of consecutive IDAT
+// chunks as a single stream, verifying each chunk's CRC.
+type pngIDATReader struct {
+	r      *bufio.Reader // Underlying PNG stream
+	remain uint32        // Bytes remaining in the current chunk
+	crc    uint32        // Running CRC of the current chunk
+	done   bool          // true: a non-IDAT chunk was encountered
+}
+
+// Read implements io.Reader.
+func (ir *pngIDATReader) Read(b []byte) (int, error) {
+	for ir.remain == 0 {
+		if ir.done {
+			return 0, io.EOF
+		}
+		// Verify the CRC of the chunk just finished, if any, and
+		// begin the next chunk.
+		var hdr [8]byte
+		if _, err := io.ReadFull(ir.r, hdr[:]); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if string(hdr[4:]) != "IDAT" {
+			ir.done = true
+			return 0, io.EOF
+		}
+		ir.remain = binary.BigEndian.Uint32(hdr[:4])
+		ir.crc = crc32.Update(0, crc32.IEEETable, hdr[4:])
+		if ir.remain == 0 {
+			if err := ir.checkCRC(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if uint32(len(b)) > ir.remain {
+		b = b[:ir.remain]
+	}
+	n, err := ir.r.Read(b)
+	ir.remain -= uint32(n)
+	ir.crc = crc32.Update(ir.crc, crc32.IEEETable, b[:n])
+	if err != nil {
+		return n, err
+	}
+	if ir.remain == 0 {
+		if err := ir.checkCRC(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// checkCRC reads the CRC that follows a chunk's data and compares it to the
+// running CRC.
+func (ir *pngIDATReader) checkCRC() error {
+	var sum [4]byte
+	if _, err := io.ReadFull(ir.r, sum[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if binary.BigEndian.Uint32(sum[:]) != ir.crc {
+		return errors.New("png: invalid checksum")
+	}
+	return nil
+}
+
+// A PNGRowReader reads the rows of a non-interlaced PNG image one at a time.
+// All PNG color types and bit depths are supported.
+type PNGRowReader struct {
+	Width     int  // Image width in pixels
+	Height    int  // Image height in pixels
+	colorType byte // PNG color type
+	depth     int  // Bits per sample
+	nc        int  // Samples per pixel
+	palette   [][4]float64
+	trns      []uint16      // Transparent gray or RGB value (nil for none)
+	zr        io.ReadCloser // Decompressed image data
+	cur, prev []byte        // Current and previous unfiltered rows
+	y         int           // Number of rows read so far
+}
+
+// NewPNGRowReader reads a PNG stream's header and returns a PNGRowReader
+// that reads the image's rows.
+func NewPNGRowReader(r io.Reader) (*PNGRowReader, error) {
+	br := bufio.NewReader(r)
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(br, sig); err != nil || string(sig) != pngSignature {
+		return nil, errors.New("png: not a PNG file")
+	}
+	pr := &PNGRowReader{}
+	for pr.zr == nil {
+		// Read each chunk that precedes the image data.
+		hdr, err := br.Peek(8)
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n := binary.BigEndian.Uint32(hdr[:4])
+		name := string(hdr[4:])
+		if name == "IDAT" {
+			if pr.Width == 0 {
+				return nil, errors.New("png: missing IHDR chunk")
+			}
+			zr, err := zlib.NewReader(&pngIDATReader{r: br})
+			if err != nil {
+				return nil, err
+			}
+			pr.zr = zr
+			break
+		}
+		if n > 1<<24 {
+			return nil, fmt.Errorf("png: %s chunk is too large", name)
+		}
+		data := make([]byte, 8+n+4) // Header, data, and CRC
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		data = data[8 : 8+n]
+		switch name {
+		case "IHDR":
+			if err := pr.parseIHDR(data); err != nil {
+				return nil, err
+			}
+		case "PLTE":
+			pr.palette = make([][4]float64, len(data)/3)
+			for i := range pr.palette {
+				pr.palette[i] = [4]float64{
+					float64(data[3*i]) / 255.0,
+					float64(data[3*i+1]) / 255.0,
+					float64(data[3*i+2]) / 255.0,
+					1.0,
+				}
+			}
+		case "tRNS":
+			switch pr.colorType {
+			case 3:
+				for i, a := range data {
+					if i < len(pr.palette) {
+						pr.palette[i][3] = float64(a) / 255.0
+					}
+				}
+			case 0, 2:
+				for i := 0; i+1 < len(data); i += 2 {
+					pr.trns = append(pr.trns, binary.BigEndian.Uint16(data[i:]))
+				}
+			}
+		case "IEND":
+			return nil, errors.New("png: missing IDAT chunk")
+		}
+	}
+	rowBytes := (pr.Width*pr.nc*pr.depth + 7) / 8
+	pr.cur = make([]byte, rowBytes+1)
+	pr.prev = make([]byte, rowBytes+1)
+	return pr, nil
+}
+
+// parseIHDR parses the contents of an IHDR chunk.
+func (pr *PNGRowReader) parseIHDR(data []byte) error {
+	if len(data) != 13 {
+		return errors.New("png: malformed IHDR chunk")
+	}
+	pr.Width = int(binary.BigEndian.Uint32(data[0:]))
+	pr.Height = int(binary.BigEndian.Uint32(data[4:]))
+	pr.depth = int(data[8])
+	pr.colorType = data[9]
+	if data[12] != 0 {
+		return errors.New("png: interlaced images cannot be read one row at a time")
+	}
+	pr.nc = map[byte]int{0: 1, 2: 3, 3: 1, 4: 2, 6: 4}[pr.colorType]
+	if pr.nc == 0 || pr.Width <= 0 || pr.Height <= 0 {
+		return errors.New("png: unsupported IHDR parameters")
+	}
+	if !pngValidDepth(pr.colorType, pr.depth) {
+		return fmt.Errorf("png: invalid bit depth %d for color type %d", pr.depth, pr.colorType)
+	}
+	if pr.Width > 1<<20 || pr.Height > 1<<24 || int64(pr.Width)*int64(pr.Height)*int64(pr.nc) > pngMaxSamples {
+		return errors.New("png: image is too large")
+	}
+	return nil
+}
+
+// pngMaxSamples is the largest number of samples a PNGRowReader accepts in an
+// image.
+const pngMaxSamples = 1 << 34
+
+// pngValidDepth reports whether the PNG specification permits a given bit
+// depth for a given color type.
+func pngValidDepth(colorType byte, depth int) bool {
+	switch colorType {
+	case 0:
+		return depth == 1 || depth == 2 || depth == 4 || depth == 8 || depth == 16
+	case 3:
+		return depth == 1 || depth == 2 || depth == 4 || depth == 8
+	default:
+		return depth == 8 || depth == 16
+	}
+}
+
+// ReadRow reads the next row of the image and stores its non-premultiplied
+// R, G, B, and A values in a slice laid out as in NRGBA32f.Pix.  It returns
+// io.EOF when no rows remain.
+func (pr *PNGRowReader) ReadRow(dst []float32) error {
+	if pr.y >= pr.Height {
+		return io.EOF
+	}
+	pr.y++
+	pr.cur, pr.prev = pr.prev, pr.cur
+	if _, err := io.ReadFull(pr.zr, pr.cur); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if err := pngUnfilter(pr.cur, pr.prev, (pr.nc*pr.depth+7)/8); err != nil {
+		return err
+	}
+	row := pr.cur[1:]
+	maxVal := float64(int(1)<<pr.depth - 1)
+	sample := func(i int) uint16 {
+		switch pr.depth {
+		case 16:
+			return binary.BigEndian.Uint16(row[2*i:])
+		case 8:
+			return uint16(row[i])
+		default:
+			bit := i * pr.depth
+			shift := 8 - pr.depth - bit%8
+			return uint16(row[bit/8]>>shift) & uint16(maxVal)
+		}
+	}
+	for x := 0; x < pr.Width; x++ {
+		var v [4]float64
+		switch pr.colorType {
+		case 3:
+			idx := int(sample(x))
+			if idx < len(pr.palette) {
+				v = pr.palette[idx]
+			}
+		case 0, 4:
+			s := sample(x * pr.nc)
+			g := float64(s) / maxVal
+			v = [4]float64{g, g, g, 1.0}
+			if pr.colorType == 4 {
+				v[3] = float64(sample(x*pr.nc+1)) / maxVal
+			} else if len(pr.trns) >= 1 && s == pr.trns[0] {
+				v[3] = 0.0
+			}
+		case 2, 6:
+			var s [4]uint16
+			for c := 0; c < pr.nc; c++ {
+				s[c] = sample(x*pr.nc + c)
+			}
+			v = [4]float64{float64(s[0]) / maxVal, float64(s[1]) / maxVal, float64(s[2]) / maxVal, 1.0}
+			if pr.colorType == 6 {
+				v[3] = float64(s[3]) / maxVal
+			} else if len(pr.trns) >= 3 && s[0] == pr.trns[0] && s[1] == pr.trns[1] && s[2] == pr.trns[2] {
+				v[3] = 0.0
+			}
+		}
+		for c, f := range v {
+			dst[4*x+c] = float32(f)
+		}
+	}
+	return nil
+}
+
+// Close releases the PNGRowReader's decompressor.  It does not close the
+// underlying reader.
+func (pr *PNGRowReader) Close() error {
+	return pr.zr.Close()
+}
+
+// pngUnfilter reverses the filter applied to a scanline, given the previous
+// (unfiltered) scanline and the number of bytes per complete pixel.  Both
+// scanlines begin with a filter-type byte.
+func pngUnfilter(cur, prev []byte, bpp int) error {
+	ft := cur[0]
+	cur, prev = cur[1:], prev[1:]
+	for i := range cur {
+		var a, c byte
+		if i >= bpp {
+			a = cur[i-bpp]
+			c = prev[i-bpp]
+		}
+		b := prev[i]
+		switch ft {
+		case 0:
+		case 1:
+			cur[i] += a
+		case 2:
+			cur[i] += b
+		case 3:
+			cur[i] += byte((int(a) + int(b)) / 2)
+		case 4:
+			cur[i] += pngPaeth(a, b, c)
+		default:
+			return fmt.Errorf("png: invalid filter type %d", ft)
+		}
+	}
+	return nil
+}
+
+// A pngIDATWriter buffers compressed image data and writes it as a sequence
+// of IDAT chunks.
+type pngIDATWriter struct {
+	w   io.Writer // Underlying PNG stream
+	buf []byte    // Data not yet written
+}
+
+// pngIDATSize is the amount of compressed data a pngIDATWriter buffers before
+// writing an IDAT chunk.
+const pngIDATSize = 1 << 16
+
+// Write implements io.Writer.
+func (iw *pngIDATWriter) Write(b []byte) (int, error) {
+	iw.buf = append(iw.buf, b...)
+	for len(iw.buf) >= pngIDATSize {
+		if err := pngWriteChunk(iw.w, "IDAT", iw.buf[:pngIDATSize]); err != nil {
+			return 0, err
+		}
+		iw.buf = append(iw.buf[:0], iw.buf[pngIDATSize:]...)
+	}
+	return len(b), nil
+}
+
+// Flush writes any buffered data as a final IDAT chunk.
+func (iw *pngIDATWriter) Flush() error {
+	if len(iw.buf) == 0 {
+		return nil
+	}
+	err := pngWriteChunk(iw.w, "IDAT", iw.buf)
+	iw.buf = iw.buf[:0]
+	return err
+}
+
+// A PNGRowWriter writes a non-interlaced PNG image one row at a time.
+type PNGRowWriter struct {
+	bw        *bufio.Writer  // Buffered PNG stream
+	iw        *pngIDATWriter // IDAT chunk writer
+	zw        *zlib.Writer   // Compressor
+	width     int            // Image width in pixels
+	height    int            // Image height in pixels
+	colorType byte           // pngGray, pngRGB, or pngRGBA
+	depth     byte           // 8 or 16 bits per sample
+	filter    bool           // true: filter rows; false: write rows unfiltered
+	cur, prev []byte         // Current and previous unfiltered rows
+	y         int            // Number of rows written so far
+}
+
+// NewPNGRowWriter writes a PNG signature and IHDR chunk for an image of a
+// given size, color type (pngGray, pngRGB, or pngRGBA), and bit depth (8 or
+// 16) and returns a PNGRowWriter that writes the image's rows.
+func NewPNGRowWriter(w io.Writer, width, height int, colorType, depth byte, level png.CompressionLevel) (*PNGRowWriter, error) {
+	if width <= 0 || height <= 0 {
+		return nil, errors.New("png: cannot encode an empty image")
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString(pngSignature)
+	if err := pngWriteChunk(bw, "IHDR", pngIHDR(width, height, colorType, depth, 0)); err != nil {
+		return nil, err
+	}
+	pw := &PNGRowWriter{
+		bw:        bw,
+		iw:        &pngIDATWriter{w: bw},
+		width:     width,
+		height:    height,
+		colorType: colorType,
+		depth:     depth,
+		filter:    level != png.NoCompression,
+	}
+	var err error
+	pw.zw, err = zlib.NewWriterLevel(pw.iw, pngZlibLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	nc := map[byte]int{pngGray: 1, pngRGB: 3, pngRGBA: 4}[colorType]
+	pw.cur = make([]byte, width*nc*int(depth)/8)
+	pw.prev = make([]byte, len(pw.cur))
+	return pw, nil
+}
+
+// WriteChunk writes an ancillary chunk.  It must be called before the first
+// row is written.
+func (pw *PNGRowWriter) WriteChunk(name string, data []byte) error {
+	if pw.y > 0 {
+		return fmt.Errorf("png: %s chunk must precede the image data", name)
+	}
+	return pngWriteChunk(pw.bw, name, data)
+}
+
+// WriteRow writes the next row of the image, given as one value per sample
+// (one per pixel for pngGray, three for pngRGB, and four for pngRGBA).
+// Values are clamped to [0.0, 1.0] and rounded to the bit depth.
+func (pw *PNGRowWriter) WriteRow(row []float32) error {
+	if pw.y >= pw.height {
+		return errors.New("png: too many rows")
+	}
+	pw.y++
+	for i, f := range row[:len(pw.cur)*8/int(pw.depth)] {
+		if pw.depth == 8 {
+			pw.cur[i] = toUint8(float64(f))
+		} else {
+			binary.BigEndian.PutUint16(pw.cur[2*i:], toGrayVal(float64(f)).Y)
+		}
+	}
+	var err error
+	if pw.filter {
+		bpp := len(pw.cur) / pw.width
+		_, err = pw.zw.Write(pngFilter(pw.cur, pw.prev, bpp))
+	} else {
+		_, err = pw.zw.Write(append([]byte{0}, pw.cur...))
+	}
+	pw.cur, pw.prev = pw.prev, pw.cur
+	return err
+}
+
+// Close finishes the image data and writes the IEND chunk.  It returns an
+// error if fewer rows were written than the image contains.  Close does not
+// close the underlying writer.
+func (pw *PNGRowWriter) Close() error {
+	if pw.y < pw.height {
+		return fmt.Errorf("png: only %d of %d rows were written", pw.y, pw.height)
+	}
+	if err := pw.zw.Close(); err != nil {
+		return err
+	}
+	if err := pw.iw.Flush(); err != nil {
+		return err
+	}
+	if err := pngWriteChunk(pw.bw, "IEND", nil); err != nil {
+		return err
+	}
+	return pw.bw.Flush()
+}
+
+// writePNGRowChunks writes to a PNGRowWriter a tEXt chunk for each key-value
+// pair in text, in sorted order, followed by whichever of a cICP chunk and an
+// iCCP chunk p.EmbedProfile specifies to identify img's colors as sRGB.
+func writePNGRowChunks(pw *PNGRowWriter, p *Parameters, img image.Image, text map[string]string) error {
+	keys := make([]string, 0, len(text))
+	for k := range text {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := pw.WriteChunk("tEXt", []byte(k+"\x00"+text[k])); err != nil {
+			return err
+		}
+	}
+	if embedsCICP(p, img) {
+		if err := pw.WriteChunk("cICP", srgbCICP); err != nil {
+			return err
+		}
+	}
+	if embedsICC(p, img) {
+		iccp, err := srgbICCPChunk()
+		if err != nil {
+			return err
+		}
+		if err := pw.WriteChunk("iCCP", iccp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodePNGRows writes a floating-point color image in 16-bit PNG format, as
+// does quantizing the image and passing it to encodePNG.  Rows are quantized
+// and compressed one at a time, so no 16-bit copy of the image is built.  The
+// alpha channel is omitted if the image is opaque.
+func encodePNGRows(w io.Writer, img *NRGBA32f, p *Parameters, text map[string]string) error {
+	bnds := img.Bounds()
+	wd := bnds.Dx()
+	colorType, nc := byte(pngRGBA), 4
+	if img.Opaque() {
+		colorType, nc = pngRGB, 3
+	}
+	pw, err := NewPNGRowWriter(w, wd, bnds.Dy(), colorType, 16, pngCompressionLevels[p.PNGCompression])
+	if err != nil {
+		return err
+	}
+	if err := writePNGRowChunks(pw, p, img, text); err != nil {
+		return err
+	}
+	row := make([]float32, nc*wd)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		src := img.Pix[img.PixOffset(bnds.Min.X, y):]
+		for x := 0; x < wd; x++ {
+			copy(row[nc*x:nc*x+nc], src[4*x:4*x+nc])
+		}
+		if err := pw.WriteRow(row); err != nil {
+			return err
+		}
+	}
+	return pw.Close()
+}
+
+// OpenPNGRows opens a named PNG file for reading one row at a time.  It
+// aborts on error.
+func OpenPNGRows(fn string) (*PNGRowReader, io.Closer) {
+	f, err := os.Open(fn)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	pr, err := NewPNGRowReader(f)
+	if err != nil {
+		notify.Fatalf("%s: %s", fn, err)
+	}
+	return pr, f
+}
@@ -0,0 +1,115 @@
+// This file tests the PNG reader and writer that operate one row at a time.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"testing"
+)
+
+// decodePNGRows decodes an entire PNG image using a PNGRowReader.
+func decodePNGRows(r io.Reader) (image.Image, error) {
+	pr, err := NewPNGRowReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer pr.Close()
+	img := NewNRGBA32f(image.Rect(0, 0, pr.Width, pr.Height))
+	for y := 0; y < pr.Height; y++ {
+		if err := pr.ReadRow(img.Pix[img.PixOffset(0, y):img.PixOffset(0, y+1)]); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// testPalettedImage returns a small paletted image with a given number of
+// colors, one of which is transparent.
+func testPalettedImage(n int) *image.Paletted {
+	pal := make(color.Palette, n)
+	for i := range pal {
+		v := uint8(255 * i / (n - 1))
+		pal[i] = color.NRGBA{v, 255 - v, v / 2, 255}
+	}
+	pal[0] = color.NRGBA{0, 0, 0, 0}
+	img := image.NewPaletted(image.Rect(0, 0, 7, 5), pal)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % n)
+	}
+	return img
+}
+
+// TestPNGRowReader verifies that a PNGRowReader reads images of various
+// color types and bit depths exactly as the standard library does.
+func TestPNGRowReader(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"gray", image.NewGray(image.Rect(0, 0, 3, 2))},
+		{"RGB", testColorImage(false)},
+		{"RGBA", testColorImage(true)},
+		{"1-bit paletted", testPalettedImage(2)},
+		{"2-bit paletted", testPalettedImage(4)},
+		{"4-bit paletted", testPalettedImage(16)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := encodeImage(t, png.Encode, tc.img)
+			want := decodeImage(t, png.Decode, data)
+			checkImage(t, decodeImage(t, decodePNGRows, data), want, 1e-6)
+		})
+	}
+}
+
+// TestPNGRowWriter verifies that images written by a PNGRowWriter are read
+// back with at most the error introduced by 16-bit quantization.
+func TestPNGRowWriter(t *testing.T) {
+	img := testColorImage(true)
+	data := encodeImage(t, func(w io.Writer, _ image.Image) error {
+		return encodePNGRows(w, img, &Parameters{}, nil)
+	}, img)
+	checkImage(t, decodeImage(t, decodePNGRows, data), img, 1.0/65535.0)
+}
+
+// TestPNGRowReaderMalformed verifies that a PNGRowReader rejects corrupt
+// files without panicking.
+func TestPNGRowReaderMalformed(t *testing.T) {
+	data := encodeImage(t, png.Encode, testColorImage(true))
+	be32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+	const ihdr = 16 // Offset of the IHDR chunk's data
+	checkPatched(t, decodePNGRows, data, map[string]patch{
+		"not a PNG":       {1, []byte("JPG")},
+		"zero width":      {ihdr, be32(0)},
+		"huge width":      {ihdr, be32(0x7fffffff)},
+		"zero height":     {ihdr + 4, be32(0)},
+		"huge image":      {ihdr, append(be32(1<<20), be32(1<<24)...)},
+		"zero depth":      {ihdr + 8, []byte{0}},
+		"32-bit depth":    {ihdr + 8, []byte{32}},
+		"4-bit RGBA":      {ihdr + 8, []byte{4}},
+		"16-bit paletted": {ihdr + 8, []byte{16, 3}},
+		"bad color type":  {ihdr + 9, []byte{5}},
+		"interlaced":      {ihdr + 12, []byte{1}},
+		"short IHDR":      {ihdr - 4, be32(12)},
+		"huge chunk":      {ihdr - 8, be32(0xffffffff)},
+		"no IHDR":         {ihdr - 4, []byte("IDAT")},
+	})
+	idat := bytes.Index(data, []byte("IDAT"))
+	checkTruncated(t, decodePNGRows, data, idat+4)
+	checkMutated(t, decodePNGRows, data, idat+16)
+
+	// Corrupt the sample data of low-bit-depth images, too.
+	for _, n := range []int{2, 4, 16} {
+		data := encodeImage(t, png.Encode, testPalettedImage(n))
+		checkTruncated(t, decodePNGRows, data, bytes.Index(data, []byte("IDAT"))+4)
+		checkMutated(t, decodePNGRows, data, len(data))
+	}
+}
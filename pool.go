@@ -0,0 +1,87 @@
+// This file recycles pixel buffers across the frames of an image sequence or
+// animation and across the files of a batch.  Each frame otherwise allocates
+// a fresh set of channel planes and quantized output images, which burdens
+// the garbage collector in long jobs.
+
+package main
+
+import (
+	"image"
+	"sync"
+)
+
+// float32Pool and bytePool hold previously released pixel buffers.
+var (
+	float32Pool sync.Pool // *[]float32
+	bytePool    sync.Pool // *[]byte
+)
+
+// getFloat32s returns a zeroed slice of n float32s, reusing a released
+// buffer if one of sufficient capacity is available.
+func getFloat32s(n int) []float32 {
+	if b, ok := float32Pool.Get().(*[]float32); ok && cap(*b) >= n {
+		s := (*b)[:n]
+		for i := range s {
+			s[i] = 0
+		}
+		return s
+	}
+	return make([]float32, n)
+}
+
+// getBytes returns a slice of n bytes, reusing a released buffer if one of
+// sufficient capacity is available.  Unlike getFloat32s, getBytes does not
+// zero the slice, so the caller must overwrite every element.
+func getBytes(n int) []byte {
+	if b, ok := bytePool.Get().(*[]byte); ok && cap(*b) >= n {
+		return (*b)[:n]
+	}
+	return make([]byte, n)
+}
+
+// releaseChannels makes the pixel buffers of a set of split channels
+// available for reuse.  The channels must not be accessed afterwards.
+// Channels that share a buffer are released only once.
+func releaseChannels(infos []ImageInfo) {
+	grays := make([]*Gray32f, len(infos))
+	for i, info := range infos {
+		grays[i] = info.Image
+	}
+	releaseGrays(grays)
+}
+
+// releaseGrays makes the pixel buffers of a set of grayscale images
+// available for reuse.  The images must not be accessed afterwards.  Images
+// that share a buffer are released only once.
+func releaseGrays(grays []*Gray32f) {
+	seen := make(map[*float32]bool, len(grays))
+	for _, g := range grays {
+		if g == nil || len(g.Pix) == 0 || seen[&g.Pix[0]] {
+			continue
+		}
+		seen[&g.Pix[0]] = true
+		pix := g.Pix
+		float32Pool.Put(&pix)
+	}
+}
+
+// releaseQuantized makes available for reuse the pixel buffer of an image
+// that quantizeImage, toDepth16, or the like produced from a floating-point
+// image.  Images that were not produced in that way are ignored.  The
+// quantized image must not be accessed afterwards.
+func releaseQuantized(orig, quant image.Image) {
+	var pix []byte
+	switch q := quant.(type) {
+	case *image.Gray16:
+		if _, ok := orig.(*Gray32f); ok {
+			pix = q.Pix
+		}
+	case *image.NRGBA64:
+		if _, ok := orig.(*NRGBA32f); ok {
+			pix = q.Pix
+		}
+	}
+	if pix != nil {
+		bytePool.Put(&pix)
+	}
+}
@@ -0,0 +1,78 @@
+// This file provides support for images whose color samples are stored
+// premultiplied by alpha, as is conventional in OpenEXR files and common in
+// compositing pipelines, even when the file format does not say so.  Color
+// channels are split from, and merged into, straight (non-premultiplied)
+// colors so that partially transparent pixels do not appear darkened.
+
+package main
+
+import (
+	"context"
+	"image"
+)
+
+// storedFloatsAt returns a function that returns an image's samples at a
+// given pixel as stored, with no interpretation of alpha.
+func storedFloatsAt(img image.Image) func(x, y int) [4]float64 {
+	if fimg, ok := img.(*NRGBA32f); ok {
+		return fimg.FloatsAt
+	}
+	return func(x, y int) [4]float64 {
+		c := toNRGBA64(img.At(x, y))
+		return [4]float64{
+			float64(c.R) / 65535.0,
+			float64(c.G) / 65535.0,
+			float64(c.B) / 65535.0,
+			float64(c.A) / 65535.0,
+		}
+	}
+}
+
+// Unpremultiply returns a copy of an image whose color samples, although
+// stored as straight color, are premultiplied by alpha, with each color
+// sample divided by alpha.  Fully transparent pixels become transparent
+// black.  Unpremultiply returns the context's error if ctx is canceled.
+func Unpremultiply(ctx context.Context, img image.Image) (*NRGBA32f, error) {
+	bnds := img.Bounds()
+	out := NewNRGBA32f(bnds)
+	at := storedFloatsAt(img)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			v := at(x, y)
+			if v[3] == 0.0 {
+				v = [4]float64{}
+			} else {
+				for c := 0; c < 3; c++ {
+					v[c] /= v[3]
+				}
+			}
+			out.SetFloats(x, y, v)
+		}
+	}
+	return out, nil
+}
+
+// Premultiply returns a copy of an image with each color sample multiplied
+// by alpha, to be stored as though it were straight color.  Premultiply
+// returns the context's error if ctx is canceled.
+func Premultiply(ctx context.Context, img image.Image) (*NRGBA32f, error) {
+	bnds := img.Bounds()
+	out := NewNRGBA32f(bnds)
+	at := storedFloatsAt(img)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			v := at(x, y)
+			for c := 0; c < 3; c++ {
+				v[c] *= v[3]
+			}
+			out.SetFloats(x, y, v)
+		}
+	}
+	return out, nil
+}
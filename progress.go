@@ -0,0 +1,116 @@
+// This file reports the progress of long-running splits and merges.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressInterval is the minimum time between progress reports.
+const progressInterval = 250 * time.Millisecond
+
+// A progressMeter counts the rows that have been converted to or from a color
+// space and periodically reports the count, the percentage complete, and the
+// estimated time remaining.  All methods do nothing when invoked on a nil
+// *progressMeter.
+type progressMeter struct {
+	label string     // Name of the file or image being processed
+	w     io.Writer  // Where to write progress reports
+	mu    sync.Mutex // Protection for the fields that follow
+	total int        // Number of rows to process
+	fixed bool       // true: total is known in advance; false: total grows with each Expect
+	done  int        // Number of rows processed so far
+	start time.Time  // Time at which the first rows were expected
+	shown time.Time  // Time of the most recent report
+}
+
+// progressKey is the context key under which a progress meter is stored.
+type progressKey struct{}
+
+// withProgress returns a copy of a context that carries a new progress meter
+// labeled with a given name, along with the meter itself.  If p.Progress is
+// false, the context is returned unchanged along with a nil meter.
+func withProgress(ctx context.Context, p *Parameters, label string) (context.Context, *progressMeter) {
+	if !p.Progress {
+		return ctx, nil
+	}
+	m := &progressMeter{label: label, w: os.Stderr, shown: time.Now()}
+	return context.WithValue(ctx, progressKey{}, m), m
+}
+
+// progressFrom returns the progress meter carried by a context or nil if
+// there is none.
+func progressFrom(ctx context.Context) *progressMeter {
+	m, _ := ctx.Value(progressKey{}).(*progressMeter)
+	return m
+}
+
+// Expect adds a number of rows to the total to process, unless the total was
+// fixed in advance by SetTotal.
+func (m *progressMeter) Expect(rows int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if m.start.IsZero() {
+		m.start = time.Now()
+	}
+	if !m.fixed {
+		m.total += rows
+	}
+	m.mu.Unlock()
+}
+
+// SetTotal fixes the total number of rows to process.  This is useful when an
+// image is processed in pieces, each of which would otherwise be mistaken for
+// the entire image.
+func (m *progressMeter) SetTotal(rows int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.total = rows
+	m.fixed = true
+	m.mu.Unlock()
+}
+
+// Step records that one more row was processed and, if enough time has passed
+// since the previous report, reports the meter's progress.
+func (m *progressMeter) Step() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.done++
+	now := time.Now()
+	if now.Sub(m.shown) < progressInterval || m.total == 0 {
+		return
+	}
+	m.shown = now
+	pct := 100 * m.done / m.total
+	left := time.Duration(float64(now.Sub(m.start)) * float64(m.total-m.done) / float64(m.done))
+	fmt.Fprintf(m.w, "\r%s%s: %3d%% (%d/%d rows, ETA %s)  ",
+		notify.Prefix(), m.label, pct, m.done, m.total, left.Round(time.Second))
+}
+
+// Finish reports the total number of rows processed and the elapsed time and
+// ends the line of progress reports.
+func (m *progressMeter) Finish() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var elapsed time.Duration
+	if !m.start.IsZero() {
+		elapsed = time.Since(m.start).Round(time.Millisecond)
+	}
+	fmt.Fprintf(m.w, "\r%s%s: 100%% (%d rows in %s)          \n",
+		notify.Prefix(), m.label, m.done, elapsed)
+}
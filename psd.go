@@ -0,0 +1,500 @@
+// This file provides support for reading the flattened (composite) image
+// from Adobe Photoshop (.psd) and large-document (.psb) files.
+
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// init registers the PSD format with the image package.
+func init() {
+	image.RegisterFormat("psd", "8BPS", DecodePSD, DecodePSDConfig)
+}
+
+// PSD color modes.
+const (
+	psdBitmap       = 0
+	psdGrayscale    = 1
+	psdIndexed      = 2
+	psdRGB          = 3
+	psdCMYK         = 4
+	psdMultichannel = 7
+	psdDuotone      = 8
+	psdLab          = 9
+)
+
+// A psdHeader represents a PSD file header.
+type psdHeader struct {
+	Version  int // 1=PSD, 2=PSB
+	Channels int // Number of channels in the composite image
+	Height   int // Image height in pixels
+	Width    int // Image width in pixels
+	Depth    int // Bits per channel (1, 8, or 16)
+	Mode     int // Color mode
+}
+
+// readPSDHeader reads and validates a PSD file header.
+func readPSDHeader(r io.Reader) (psdHeader, error) {
+	var raw struct {
+		Sig      [4]byte
+		Version  uint16
+		_        [6]byte
+		Channels uint16
+		Height   uint32
+		Width    uint32
+		Depth    uint16
+		Mode     uint16
+	}
+	var hdr psdHeader
+	if err := binary.Read(r, binary.BigEndian, &raw); err != nil || string(raw.Sig[:]) != "8BPS" {
+		return hdr, errors.New("psd: invalid format")
+	}
+	hdr = psdHeader{
+		Version:  int(raw.Version),
+		Channels: int(raw.Channels),
+		Height:   int(raw.Height),
+		Width:    int(raw.Width),
+		Depth:    int(raw.Depth),
+		Mode:     int(raw.Mode),
+	}
+	maxDim := 30000 // Limit imposed by the PSD specification
+	if hdr.Version == 2 {
+		maxDim = 300000 // Limit imposed by the PSB specification
+	}
+	switch {
+	case hdr.Version != 1 && hdr.Version != 2:
+		return hdr, fmt.Errorf("psd: unsupported version %d", hdr.Version)
+	case hdr.Depth != 1 && hdr.Depth != 8 && hdr.Depth != 16:
+		return hdr, fmt.Errorf("psd: unsupported depth %d", hdr.Depth)
+	case hdr.Width <= 0 || hdr.Height <= 0 || hdr.Width > maxDim || hdr.Height > maxDim:
+		return hdr, errors.New("psd: invalid dimensions")
+	case hdr.Channels <= 0 || hdr.Channels > 56:
+		return hdr, fmt.Errorf("psd: invalid channel count %d", hdr.Channels)
+	}
+	return hdr, nil
+}
+
+// colorChannels returns the number of channels used by the header's color
+// mode.
+func (h psdHeader) colorChannels() int {
+	switch h.Mode {
+	case psdRGB, psdLab:
+		return 3
+	case psdCMYK:
+		return 4
+	default:
+		return 1
+	}
+}
+
+// A PSDImage is the composite image from a PSD file plus any additional
+// alpha or spot channels the file contains.
+type PSDImage struct {
+	image.Image             // Composite image
+	Extra       []ImageInfo // Additional channels, named as in the file
+}
+
+// ExtraChannels returns a PSD file's additional alpha and spot channels.
+func (p *PSDImage) ExtraChannels() []ImageInfo {
+	return p.Extra
+}
+
+// readPSDSection reads a length-prefixed section.  The length is 4 bytes or,
+// if wide is true, 8 bytes.
+func readPSDSection(r io.Reader, wide bool) ([]byte, error) {
+	var n uint64
+	if wide {
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+	} else {
+		var n32 uint32
+		if err := binary.Read(r, binary.BigEndian, &n32); err != nil {
+			return nil, err
+		}
+		n = uint64(n32)
+	}
+	if n > 1<<32 {
+		return nil, errors.New("psd: section too large")
+	}
+	data, err := readBytes(r, int64(n))
+	if err != nil {
+		return nil, errors.New("psd: truncated file")
+	}
+	return data, nil
+}
+
+// psdChannelNames extracts the names of the alpha channels from the image
+// resources section, preferring Unicode names to Pascal-string names.
+func psdChannelNames(res []byte) []string {
+	var pascal, unicode []string
+	for len(res) >= 12 && string(res[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(res[4:])
+		nlen := int(res[6]) + 1
+		if nlen%2 == 1 {
+			nlen++
+		}
+		if 6+nlen+4 > len(res) {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(res[6+nlen:]))
+		start := 6 + nlen + 4
+		if start+size > len(res) {
+			break
+		}
+		data := res[start : start+size]
+		switch id {
+		case 0x03EE: // Alpha channel names as Pascal strings
+			for len(data) > 0 && int(data[0])+1 <= len(data) {
+				pascal = append(pascal, string(data[1:1+int(data[0])]))
+				data = data[1+int(data[0]):]
+			}
+		case 0x0415: // Alpha channel names as Unicode strings
+			for len(data) >= 4 {
+				n := int(binary.BigEndian.Uint32(data))
+				if 4+2*n > len(data) {
+					break
+				}
+				u := make([]uint16, n)
+				for i := range u {
+					u[i] = binary.BigEndian.Uint16(data[4+2*i:])
+				}
+				unicode = append(unicode, strings.TrimRight(string(utf16.Decode(u)), "\x00"))
+				data = data[4+2*n:]
+			}
+		}
+		if size%2 == 1 {
+			size++
+		}
+		if start+size > len(res) {
+			break
+		}
+		res = res[start+size:]
+	}
+	if len(unicode) > 0 {
+		return unicode
+	}
+	return pascal
+}
+
+// unpackBits decompresses a PackBits-encoded row into dst.
+func unpackBits(dst, src []byte) error {
+	for i := 0; i < len(dst); {
+		if len(src) == 0 {
+			return errors.New("psd: truncated RLE data")
+		}
+		n := int(int8(src[0]))
+		src = src[1:]
+		switch {
+		case n >= 0:
+			if len(src) < n+1 || i+n+1 > len(dst) {
+				return errors.New("psd: invalid RLE data")
+			}
+			copy(dst[i:], src[:n+1])
+			src = src[n+1:]
+			i += n + 1
+		case n > -128:
+			if len(src) < 1 || i+1-n > len(dst) {
+				return errors.New("psd: invalid RLE data")
+			}
+			for j := 0; j < 1-n; j++ {
+				dst[i+j] = src[0]
+			}
+			src = src[1:]
+			i += 1 - n
+		}
+	}
+	return nil
+}
+
+// readPSDPlanes reads the image-data section and returns one plane of raw,
+// big-endian samples per channel.  Planes are allocated only as data arrive so
+// that a corrupt header cannot cause an enormous allocation.
+func readPSDPlanes(r io.Reader, h psdHeader) ([][]byte, error) {
+	var comp uint16
+	if err := binary.Read(r, binary.BigEndian, &comp); err != nil {
+		return nil, errors.New("psd: missing image data")
+	}
+	rowBytes := (h.Width*h.Depth + 7) / 8
+	planes := make([][]byte, h.Channels)
+	switch comp {
+	case 0: // Raw
+		for c := range planes {
+			var err error
+			planes[c], err = readBytes(r, int64(rowBytes)*int64(h.Height))
+			if err != nil {
+				return nil, errors.New("psd: truncated image data")
+			}
+		}
+	case 1: // PackBits RLE
+		var counts []int
+		for i := 0; i < h.Channels*h.Height; i++ {
+			if h.Version == 2 {
+				var n uint32
+				if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+					return nil, errors.New("psd: truncated image data")
+				}
+				counts = append(counts, int(n))
+			} else {
+				var n uint16
+				if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+					return nil, errors.New("psd: truncated image data")
+				}
+				counts = append(counts, int(n))
+			}
+		}
+		row := make([]byte, rowBytes)
+		for c := range planes {
+			for y := 0; y < h.Height; y++ {
+				src, err := readBytes(r, int64(counts[c*h.Height+y]))
+				if err != nil {
+					return nil, errors.New("psd: truncated image data")
+				}
+				if err := unpackBits(row, src); err != nil {
+					return nil, err
+				}
+				planes[c] = append(planes[c], row...)
+			}
+		}
+	case 2, 3: // ZIP without or with prediction
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(zr, int64(rowBytes*h.Height*h.Channels)))
+		if err != nil || len(data) < rowBytes*h.Height*h.Channels {
+			return nil, errors.New("psd: truncated image data")
+		}
+		for c := range planes {
+			planes[c] = data[c*rowBytes*h.Height : (c+1)*rowBytes*h.Height]
+			if comp == 3 && h.Depth == 8 {
+				for y := 0; y < h.Height; y++ {
+					row := planes[c][y*rowBytes : (y+1)*rowBytes]
+					for x := 1; x < len(row); x++ {
+						row[x] += row[x-1]
+					}
+				}
+			}
+			if comp == 3 && h.Depth == 16 {
+				for y := 0; y < h.Height; y++ {
+					row := planes[c][y*rowBytes : (y+1)*rowBytes]
+					for x := 2; x+1 < len(row); x += 2 {
+						v := binary.BigEndian.Uint16(row[x:]) + binary.BigEndian.Uint16(row[x-2:])
+						binary.BigEndian.PutUint16(row[x:], v)
+					}
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("psd: unsupported compression method %d", comp)
+	}
+	return planes, nil
+}
+
+// DecodePSD reads the composite image from a PSD or PSB file.  It returns a
+// *PSDImage whose Extra field holds any alpha or spot channels beyond those
+// required by the color mode.  If the file indicates that the first such
+// channel represents the composite image's transparency, that channel is
+// instead used as the image's alpha channel.
+func DecodePSD(r io.Reader) (image.Image, error) {
+	// Read the header and all sections preceding the image data.
+	br := bufio.NewReader(r)
+	h, err := readPSDHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	cmData, err := readPSDSection(br, false)
+	if err != nil {
+		return nil, err
+	}
+	res, err := readPSDSection(br, false)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := readPSDSection(br, h.Version == 2)
+	if err != nil {
+		return nil, err
+	}
+	planes, err := readPSDPlanes(br, h)
+	if err != nil {
+		return nil, err
+	}
+	nc := h.colorChannels()
+	if h.Channels < nc {
+		return nil, fmt.Errorf("psd: expected at least %d channels but saw %d", nc, h.Channels)
+	}
+
+	// A negative layer count indicates that the first extra channel holds
+	// the composite image's transparency.
+	hasAlpha := false
+	lenSize := 4
+	if h.Version == 2 {
+		lenSize = 8
+	}
+	if len(layers) >= lenSize+2 {
+		hasAlpha = int16(binary.BigEndian.Uint16(layers[lenSize:])) < 0 && h.Channels > nc
+	}
+
+	// sample returns a given channel's sample at a given pixel as a value
+	// in [0.0, 1.0].
+	rowBytes := (h.Width*h.Depth + 7) / 8
+	sample := func(c, x, y int) float64 {
+		row := planes[c][y*rowBytes:]
+		switch h.Depth {
+		case 1:
+			return float64((row[x/8] >> (7 - uint(x%8))) & 1)
+		case 8:
+			return float64(row[x]) / 255.0
+		default:
+			return float64(binary.BigEndian.Uint16(row[2*x:])) / 65535.0
+		}
+	}
+
+	// labAB maps an a* or b* sample to the scale used by colorful, in
+	// which a* and b* are divided by 100.  The samples are stored with an
+	// offset of 128 (8-bit) or 32768 (16-bit).
+	labAB := func(v float64) float64 {
+		if h.Depth == 16 {
+			return (v*65535.0/256.0 - 128.0) / 100.0
+		}
+		return (v*255.0 - 128.0) / 100.0
+	}
+
+	// Convert the color channels to an image.
+	bnds := image.Rect(0, 0, h.Width, h.Height)
+	var img image.Image
+	switch h.Mode {
+	case psdBitmap, psdGrayscale, psdMultichannel, psdDuotone:
+		gray := image.NewGray16(bnds)
+		for y := 0; y < h.Height; y++ {
+			for x := 0; x < h.Width; x++ {
+				v := sample(0, x, y)
+				if h.Mode == psdBitmap {
+					v = 1.0 - v // 1 represents black.
+				}
+				gray.SetGray16(x, y, color.Gray16{Y: toGrayVal(v).Y})
+			}
+		}
+		img = gray
+	case psdIndexed:
+		if len(cmData) < 768 || h.Depth != 8 {
+			return nil, errors.New("psd: invalid indexed-color image")
+		}
+		nrgba := image.NewNRGBA64(bnds)
+		for y := 0; y < h.Height; y++ {
+			for x := 0; x < h.Width; x++ {
+				i := int(planes[0][y*rowBytes+x])
+				nrgba.SetNRGBA64(x, y, color.NRGBA64{
+					R: uint16(cmData[i]) * 0x101,
+					G: uint16(cmData[256+i]) * 0x101,
+					B: uint16(cmData[512+i]) * 0x101,
+					A: 0xffff,
+				})
+			}
+		}
+		img = nrgba
+	case psdRGB, psdCMYK, psdLab:
+		nrgba := image.NewNRGBA64(bnds)
+		for y := 0; y < h.Height; y++ {
+			for x := 0; x < h.Width; x++ {
+				var clr colorful.Color
+				switch h.Mode {
+				case psdRGB:
+					clr = colorful.Color{R: sample(0, x, y), G: sample(1, x, y), B: sample(2, x, y)}
+				case psdCMYK:
+					// Samples are stored inverted: 1.0 means no ink.
+					k := sample(3, x, y)
+					clr = colorful.Color{
+						R: sample(0, x, y) * k,
+						G: sample(1, x, y) * k,
+						B: sample(2, x, y) * k,
+					}
+				case psdLab:
+					clr = colorful.LabWhiteRef(sample(0, x, y),
+						labAB(sample(1, x, y)), labAB(sample(2, x, y)),
+						colorful.D50).Clamped()
+				}
+				nrgba.SetNRGBA64(x, y, color.NRGBA64{
+					R: toGrayVal(clr.R).Y,
+					G: toGrayVal(clr.G).Y,
+					B: toGrayVal(clr.B).Y,
+					A: 0xffff,
+				})
+			}
+		}
+		img = nrgba
+	default:
+		return nil, fmt.Errorf("psd: unsupported color mode %d", h.Mode)
+	}
+
+	// Apply the transparency channel, if any.
+	extra := nc
+	if hasAlpha {
+		nrgba, ok := img.(*image.NRGBA64)
+		if !ok {
+			nrgba = image.NewNRGBA64(bnds)
+			for y := 0; y < h.Height; y++ {
+				for x := 0; x < h.Width; x++ {
+					nrgba.Set(x, y, img.At(x, y))
+				}
+			}
+		}
+		for y := 0; y < h.Height; y++ {
+			for x := 0; x < h.Width; x++ {
+				i := nrgba.PixOffset(x, y)
+				binary.BigEndian.PutUint16(nrgba.Pix[i+6:], toGrayVal(sample(nc, x, y)).Y)
+			}
+		}
+		img = nrgba
+		extra++
+	}
+
+	// Gather any remaining channels, naming them as in the file.
+	names := psdChannelNames(res)
+	if hasAlpha && len(names) == h.Channels-nc {
+		names = names[1:]
+	}
+	psd := &PSDImage{Image: img}
+	for c := extra; c < h.Channels; c++ {
+		name := fmt.Sprintf("extra%d", c-extra+1)
+		if i := c - extra; i < len(names) && strings.TrimSpace(names[i]) != "" {
+			name = strings.NewReplacer("/", "_", "\\", "_").Replace(names[i])
+		}
+		gray := NewGray32f(bnds)
+		for y := 0; y < h.Height; y++ {
+			for x := 0; x < h.Width; x++ {
+				gray.SetFloat(x, y, sample(c, x, y))
+			}
+		}
+		psd.Extra = append(psd.Extra, ImageInfo{Name: name, Image: gray})
+	}
+	return psd, nil
+}
+
+// DecodePSDConfig returns the color model and dimensions of a PSD image
+// without decoding the entire image.
+func DecodePSDConfig(r io.Reader) (image.Config, error) {
+	h, err := readPSDHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	cfg := image.Config{Width: h.Width, Height: h.Height, ColorModel: color.NRGBA64Model}
+	switch h.Mode {
+	case psdBitmap, psdGrayscale, psdMultichannel, psdDuotone:
+		cfg.ColorModel = color.Gray16Model
+	}
+	return cfg, nil
+}
@@ -0,0 +1,292 @@
+// This file tests the PSD reader.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+	"unicode/utf16"
+)
+
+// psdTestFile returns a PSD or PSB file with a given header, color-mode data,
+// image resources, layer and mask information, compression method, and image
+// data.
+func psdTestFile(h psdHeader, cm, res, layers []byte, comp uint16, data []byte) []byte {
+	var buf bytes.Buffer
+	be := binary.BigEndian
+	buf.WriteString("8BPS")
+	binary.Write(&buf, be, uint16(h.Version))
+	buf.Write(make([]byte, 6))
+	binary.Write(&buf, be, uint16(h.Channels))
+	binary.Write(&buf, be, uint32(h.Height))
+	binary.Write(&buf, be, uint32(h.Width))
+	binary.Write(&buf, be, uint16(h.Depth))
+	binary.Write(&buf, be, uint16(h.Mode))
+	binary.Write(&buf, be, uint32(len(cm)))
+	buf.Write(cm)
+	binary.Write(&buf, be, uint32(len(res)))
+	buf.Write(res)
+	if h.Version == 2 {
+		binary.Write(&buf, be, uint64(len(layers)))
+	} else {
+		binary.Write(&buf, be, uint32(len(layers)))
+	}
+	buf.Write(layers)
+	binary.Write(&buf, be, comp)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// psdPackBits compresses a row with PackBits, encoding runs of three or more
+// identical bytes as runs and everything else as literals.
+func psdPackBits(row []byte) []byte {
+	var out []byte
+	for i := 0; i < len(row); {
+		run := 1
+		for i+run < len(row) && row[i+run] == row[i] && run < 128 {
+			run++
+		}
+		if run >= 3 {
+			out = append(out, byte(1-run), row[i])
+			i += run
+			continue
+		}
+		lit := 1
+		for i+lit < len(row) && lit < 128 && !(i+lit+2 < len(row) && row[i+lit] == row[i+lit+1] && row[i+lit] == row[i+lit+2]) {
+			lit++
+		}
+		out = append(out, byte(lit-1))
+		out = append(out, row[i:i+lit]...)
+		i += lit
+	}
+	return out
+}
+
+// psdRLE returns PackBits-compressed image data for a set of planes,
+// preceded by the table of row sizes.
+func psdRLE(h psdHeader, planes [][]byte) []byte {
+	rowBytes := (h.Width*h.Depth + 7) / 8
+	var counts, rows bytes.Buffer
+	for _, pl := range planes {
+		for y := 0; y < h.Height; y++ {
+			row := psdPackBits(pl[y*rowBytes : (y+1)*rowBytes])
+			if h.Version == 2 {
+				binary.Write(&counts, binary.BigEndian, uint32(len(row)))
+			} else {
+				binary.Write(&counts, binary.BigEndian, uint16(len(row)))
+			}
+			rows.Write(row)
+		}
+	}
+	return append(counts.Bytes(), rows.Bytes()...)
+}
+
+// psdNames returns an image-resource block that names alpha channels.
+func psdNames(names ...string) []byte {
+	var data bytes.Buffer
+	for _, nm := range names {
+		u := utf16.Encode([]rune(nm))
+		binary.Write(&data, binary.BigEndian, uint32(len(u)))
+		binary.Write(&data, binary.BigEndian, u)
+	}
+	var res bytes.Buffer
+	res.WriteString("8BIM")
+	binary.Write(&res, binary.BigEndian, uint16(0x0415))
+	res.Write([]byte{0, 0}) // Empty, padded Pascal-string name
+	binary.Write(&res, binary.BigEndian, uint32(data.Len()))
+	res.Write(data.Bytes())
+	if data.Len()%2 == 1 {
+		res.WriteByte(0)
+	}
+	return res.Bytes()
+}
+
+// psdTransparency is layer and mask information whose negative layer count
+// indicates that the first extra channel holds the composite image's
+// transparency.
+var psdTransparency = []byte{0, 0, 0, 2, 0xff, 0xff}
+
+// TestPSDRGB verifies that DecodePSD reads raw and RLE-compressed RGB images
+// with transparency.
+func TestPSDRGB(t *testing.T) {
+	want := image.NewNRGBA(image.Rect(0, 0, 5, 3))
+	planes := make([][]byte, 4)
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			c := color.NRGBA{byte(50 * x), 7, byte(100 * y), byte(255 - 20*x - 5*y)}
+			want.SetNRGBA(x, y, c)
+			planes[0] = append(planes[0], c.R)
+			planes[1] = append(planes[1], c.G)
+			planes[2] = append(planes[2], c.B)
+			planes[3] = append(planes[3], c.A)
+		}
+	}
+	h := psdHeader{Version: 1, Channels: 4, Height: 3, Width: 5, Depth: 8, Mode: psdRGB}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"raw", psdTestFile(h, nil, nil, psdTransparency, 0, bytes.Join(planes, nil))},
+		{"RLE", psdTestFile(h, nil, nil, psdTransparency, 1, psdRLE(h, planes))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img := decodeImage(t, DecodePSD, tc.data)
+			checkImage(t, img, want, 0.0)
+			if extra := img.(*PSDImage).Extra; len(extra) != 0 {
+				t.Fatalf("expected no extra channels but saw %d", len(extra))
+			}
+			checkTruncated(t, DecodePSD, tc.data, len(tc.data))
+		})
+	}
+}
+
+// TestPSDExtraChannels verifies that DecodePSD returns channels beyond those
+// required by the color mode, named as in the file, from both PSD and PSB
+// files.
+func TestPSDExtraChannels(t *testing.T) {
+	gray := testGrayImage()
+	want := image.NewGray16(gray.Bounds())
+	planes := make([][]byte, 3)
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 7; x++ {
+			v := toGrayVal(gray.FloatAt(x, y)).Y
+			want.SetGray16(x, y, color.Gray16{Y: v})
+			planes[0] = append(planes[0], byte(v>>8), byte(v))
+			planes[1] = append(planes[1], 0, 0, 0, 0)
+			planes[2] = append(planes[2], 0xff, 0xff, byte(x), byte(y))
+		}
+	}
+	res := psdNames("Mask/One", "Spot")
+	for _, version := range []int{1, 2} {
+		h := psdHeader{Version: version, Channels: 3, Height: 5, Width: 7, Depth: 16, Mode: psdGrayscale}
+		data := psdTestFile(h, nil, res, nil, 1, psdRLE(h, planes))
+		img := decodeImage(t, DecodePSD, data)
+		checkImage(t, img, want, 0.0)
+		extra := img.(*PSDImage).Extra
+		if len(extra) != 2 || extra[0].Name != "Mask_One" || extra[1].Name != "Spot" {
+			t.Fatalf("version %d: expected channels Mask_One and Spot but saw %v", version, extra)
+		}
+		if v := extra[1].Image.FloatAt(6, 4); v != float64(0xffff)/65535.0 {
+			t.Fatalf("version %d: expected a Spot value of 1.0 but saw %g", version, v)
+		}
+		checkTruncated(t, DecodePSD, data, len(data))
+	}
+}
+
+// TestPSDZIP verifies that DecodePSD reads ZIP-compressed data with and
+// without prediction.
+func TestPSDZIP(t *testing.T) {
+	h := psdHeader{Version: 1, Channels: 1, Height: 2, Width: 3, Depth: 16, Mode: psdGrayscale}
+	samples := []uint16{0x0100, 0x0300, 0xff00, 0x8000, 0x8001, 0x0000}
+	want := image.NewGray16(image.Rect(0, 0, 3, 2))
+	for i, v := range samples {
+		want.SetGray16(i%3, i/3, color.Gray16{Y: v})
+	}
+	for _, comp := range []uint16{2, 3} {
+		var raw bytes.Buffer
+		for i, v := range samples {
+			if comp == 3 && i%3 > 0 {
+				v -= samples[i-1] // Predict from the previous sample.
+			}
+			binary.Write(&raw, binary.BigEndian, v)
+		}
+		var zbuf bytes.Buffer
+		zw := zlib.NewWriter(&zbuf)
+		zw.Write(raw.Bytes())
+		zw.Close()
+		data := psdTestFile(h, nil, nil, nil, comp, zbuf.Bytes())
+		checkImage(t, decodeImage(t, DecodePSD, data), want, 0.0)
+		checkTruncated(t, DecodePSD, data, len(data))
+	}
+}
+
+// TestPSDModes verifies that DecodePSD reads bitmap and indexed-color
+// images.
+func TestPSDModes(t *testing.T) {
+	t.Run("bitmap", func(t *testing.T) {
+		h := psdHeader{Version: 1, Channels: 1, Height: 2, Width: 10, Depth: 1, Mode: psdBitmap}
+		data := psdTestFile(h, nil, nil, nil, 0, []byte{0xa0, 0x40, 0xff, 0xc0})
+		want := image.NewGray16(image.Rect(0, 0, 10, 2))
+		for x := 0; x < 10; x++ {
+			want.SetGray16(x, 0, color.Gray16{Y: 0xffff})
+		}
+		want.SetGray16(0, 0, color.Black)
+		want.SetGray16(2, 0, color.Black)
+		want.SetGray16(9, 0, color.Black)
+		checkImage(t, decodeImage(t, DecodePSD, data), want, 0.0)
+	})
+	t.Run("indexed", func(t *testing.T) {
+		h := psdHeader{Version: 1, Channels: 1, Height: 1, Width: 2, Depth: 8, Mode: psdIndexed}
+		cm := make([]byte, 768)
+		cm[1], cm[256+1], cm[512+1] = 10, 20, 30
+		cm[255], cm[256+255], cm[512+255] = 40, 50, 60
+		data := psdTestFile(h, cm, nil, nil, 0, []byte{1, 255})
+		want := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+		want.SetNRGBA(0, 0, color.NRGBA{10, 20, 30, 255})
+		want.SetNRGBA(1, 0, color.NRGBA{40, 50, 60, 255})
+		checkImage(t, decodeImage(t, DecodePSD, data), want, 0.0)
+		if _, err := decodeSafely(DecodePSD, psdTestFile(h, cm[:767], nil, nil, 0, []byte{1, 255})); err == nil || isPanic(err) {
+			t.Fatalf("short color table: expected an error but saw %v", err)
+		}
+	})
+}
+
+// TestPSDMalformed verifies that DecodePSD rejects corrupt files without
+// panicking.
+func TestPSDMalformed(t *testing.T) {
+	h := psdHeader{Version: 1, Channels: 3, Height: 4, Width: 6, Depth: 8, Mode: psdRGB}
+	planes := [][]byte{
+		bytes.Repeat([]byte{1, 2, 3, 3, 3, 3}, 4),
+		bytes.Repeat([]byte{9}, 24),
+		bytes.Repeat([]byte{0, 255}, 12),
+	}
+	data := psdTestFile(h, nil, nil, nil, 1, psdRLE(h, planes))
+	const (
+		ofsChannels = 12
+		ofsHeight   = 14
+		ofsWidth    = 18
+		ofsDepth    = 22
+		ofsMode     = 24
+		ofsCM       = 26
+		ofsComp     = 26 + 3*4
+		ofsCounts   = ofsComp + 2
+	)
+	be32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+	checkPatched(t, DecodePSD, data, map[string]patch{
+		"bad signature":  {0, []byte("8BPX")},
+		"bad version":    {4, []byte{0, 3}},
+		"no channels":    {ofsChannels, []byte{0, 0}},
+		"many channels":  {ofsChannels, []byte{0, 57}},
+		"few channels":   {ofsChannels, []byte{0, 2}},
+		"zero height":    {ofsHeight, be32(0)},
+		"huge height":    {ofsHeight, be32(30001)},
+		"huge width":     {ofsWidth, be32(0xffffffff)},
+		"bad depth":      {ofsDepth, []byte{0, 32}},
+		"bad mode":       {ofsMode, []byte{0, 5}},
+		"huge section":   {ofsCM, be32(0xffffffff)},
+		"bad method":     {ofsComp, []byte{0, 4}},
+		"zero row size":  {ofsCounts, []byte{0, 0}},
+		"short row size": {ofsCounts, []byte{0, 1}},
+		"long row size":  {ofsCounts, []byte{0xff, 0xff}},
+	})
+	for name, data := range map[string][]byte{
+		"huge PSB": psdTestFile(psdHeader{Version: 2, Channels: 56, Height: 300000, Width: 300000, Depth: 16, Mode: psdRGB}, nil, nil, nil, 0, make([]byte, 64)),
+		"huge RLE": psdTestFile(psdHeader{Version: 2, Channels: 56, Height: 300000, Width: 300000, Depth: 16, Mode: psdRGB}, nil, nil, nil, 1, make([]byte, 64)),
+		"huge ZIP": psdTestFile(psdHeader{Version: 2, Channels: 56, Height: 300000, Width: 300000, Depth: 16, Mode: psdRGB}, nil, nil, nil, 2, []byte{0x78, 0x9c, 0x03, 0x00, 0x00, 0x00, 0x00, 0x01}),
+		"bad ZIP":  psdTestFile(h, nil, nil, nil, 3, []byte("not zlib data")),
+		"bad RLE":  psdTestFile(h, nil, nil, nil, 1, append(bytes.Repeat([]byte{0, 2}, 12), bytes.Repeat([]byte{0x80, 0x7f}, 12)...)),
+	} {
+		if _, err := decodeSafely(DecodePSD, data); err == nil || isPanic(err) {
+			t.Errorf("%s: expected an error but saw %v", name, err)
+		}
+	}
+	checkMutated(t, DecodePSD, data, len(data))
+}
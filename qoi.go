@@ -0,0 +1,215 @@
+// This file provides support for reading and writing images in the Quite OK
+// Image (QOI) format.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+)
+
+// qoiMagic is the magic number that begins every QOI file.
+const qoiMagic = "qoif"
+
+// These are the QOI chunk tags.
+const (
+	qoiOpIndex = 0x00
+	qoiOpDiff  = 0x40
+	qoiOpLuma  = 0x80
+	qoiOpRun   = 0xc0
+	qoiOpRGB   = 0xfe
+	qoiOpRGBA  = 0xff
+	qoiMask2   = 0xc0
+)
+
+// qoiEnd is the byte sequence that terminates every QOI file.
+var qoiEnd = []byte{0, 0, 0, 0, 0, 0, 0, 1}
+
+// init registers the QOI format with the image package.
+func init() {
+	image.RegisterFormat("qoi", qoiMagic, DecodeQOI, DecodeQOIConfig)
+}
+
+// qoiHash returns a color's position in the QOI running index.
+func qoiHash(c color.NRGBA) int {
+	return (int(c.R)*3 + int(c.G)*5 + int(c.B)*7 + int(c.A)*11) % 64
+}
+
+// readQOIHeader reads a QOI header and returns the image's configuration.
+func readQOIHeader(r io.Reader) (image.Config, error) {
+	var cfg image.Config
+	var hdr [14]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return cfg, errors.New("qoi: truncated header")
+	}
+	if string(hdr[:4]) != qoiMagic {
+		return cfg, errors.New("qoi: invalid format")
+	}
+	wd := binary.BigEndian.Uint32(hdr[4:])
+	ht := binary.BigEndian.Uint32(hdr[8:])
+	if wd == 0 || ht == 0 || wd > 1<<24 || ht > 1<<24 {
+		return cfg, errors.New("qoi: invalid image dimensions")
+	}
+	if hdr[12] != 3 && hdr[12] != 4 {
+		return cfg, errors.New("qoi: invalid channel count")
+	}
+	cfg.ColorModel = color.NRGBAModel
+	cfg.Width = int(wd)
+	cfg.Height = int(ht)
+	return cfg, nil
+}
+
+// DecodeQOI decodes a QOI image.
+func DecodeQOI(rd io.Reader) (image.Image, error) {
+	r := bufio.NewReader(rd)
+	cfg, err := readQOIHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Grow the pixel data as it is decoded rather than allocating it up
+	// front so that a corrupt header cannot cause an enormous allocation.
+	n := 4 * cfg.Width * cfg.Height
+	var pix []byte
+	var index [64]color.NRGBA
+	px := color.NRGBA{A: 255}
+	run := 0
+	for len(pix) < n {
+		if run > 0 {
+			run--
+		} else {
+			b1, err := r.ReadByte()
+			if err != nil {
+				return nil, errors.New("qoi: truncated pixel data")
+			}
+			switch {
+			case b1 == qoiOpRGB:
+				var buf [3]byte
+				if _, err := io.ReadFull(r, buf[:]); err != nil {
+					return nil, errors.New("qoi: truncated pixel data")
+				}
+				px.R, px.G, px.B = buf[0], buf[1], buf[2]
+			case b1 == qoiOpRGBA:
+				var buf [4]byte
+				if _, err := io.ReadFull(r, buf[:]); err != nil {
+					return nil, errors.New("qoi: truncated pixel data")
+				}
+				px = color.NRGBA{buf[0], buf[1], buf[2], buf[3]}
+			case b1&qoiMask2 == qoiOpIndex:
+				px = index[b1]
+			case b1&qoiMask2 == qoiOpDiff:
+				px.R += (b1>>4)&0x03 - 2
+				px.G += (b1>>2)&0x03 - 2
+				px.B += b1&0x03 - 2
+			case b1&qoiMask2 == qoiOpLuma:
+				b2, err := r.ReadByte()
+				if err != nil {
+					return nil, errors.New("qoi: truncated pixel data")
+				}
+				vg := b1&0x3f - 32
+				px.R += vg - 8 + (b2>>4)&0x0f
+				px.G += vg
+				px.B += vg - 8 + b2&0x0f
+			case b1&qoiMask2 == qoiOpRun:
+				run = int(b1 & 0x3f)
+			}
+			index[qoiHash(px)] = px
+		}
+		pix = append(pix, px.R, px.G, px.B, px.A)
+	}
+	return &image.NRGBA{
+		Pix:    pix,
+		Stride: 4 * cfg.Width,
+		Rect:   image.Rect(0, 0, cfg.Width, cfg.Height),
+	}, nil
+}
+
+// DecodeQOIConfig returns the color model and dimensions of a QOI image
+// without decoding the entire image.
+func DecodeQOIConfig(r io.Reader) (image.Config, error) {
+	return readQOIHeader(r)
+}
+
+// EncodeQOI writes an image in QOI format.  QOI supports only 8-bit RGB and
+// RGBA so grayscale images are written as RGB and 16-bit images are reduced
+// to 8 bits per channel.
+func EncodeQOI(w io.Writer, img image.Image) error {
+	// Convert the image to 8-bit NRGBA.
+	bnds := img.Bounds()
+	if bnds.Empty() {
+		return errors.New("qoi: cannot encode an empty image")
+	}
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(bnds)
+		draw.Draw(nrgba, bnds, img, bnds.Min, draw.Src)
+	}
+
+	// Write the header.
+	bw := bufio.NewWriter(w)
+	var hdr [14]byte
+	copy(hdr[:], qoiMagic)
+	binary.BigEndian.PutUint32(hdr[4:], uint32(bnds.Dx()))
+	binary.BigEndian.PutUint32(hdr[8:], uint32(bnds.Dy()))
+	hdr[12] = 4
+	if nrgba.Opaque() {
+		hdr[12] = 3
+	}
+	bw.Write(hdr[:])
+
+	// Write the pixel data.
+	var index [64]color.NRGBA
+	prev := color.NRGBA{A: 255}
+	run := 0
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			px := nrgba.NRGBAAt(x, y)
+			if px == prev {
+				run++
+				if run == 62 {
+					bw.WriteByte(qoiOpRun | byte(run-1))
+					run = 0
+				}
+				continue
+			}
+			if run > 0 {
+				bw.WriteByte(qoiOpRun | byte(run-1))
+				run = 0
+			}
+			h := qoiHash(px)
+			switch {
+			case index[h] == px:
+				bw.WriteByte(qoiOpIndex | byte(h))
+			case px.A != prev.A:
+				index[h] = px
+				bw.Write([]byte{qoiOpRGBA, px.R, px.G, px.B, px.A})
+			default:
+				index[h] = px
+				vr := int8(px.R - prev.R)
+				vg := int8(px.G - prev.G)
+				vb := int8(px.B - prev.B)
+				vgr := vr - vg
+				vgb := vb - vg
+				switch {
+				case vr > -3 && vr < 2 && vg > -3 && vg < 2 && vb > -3 && vb < 2:
+					bw.WriteByte(qoiOpDiff | byte(vr+2)<<4 | byte(vg+2)<<2 | byte(vb+2))
+				case vgr > -9 && vgr < 8 && vg > -33 && vg < 32 && vgb > -9 && vgb < 8:
+					bw.Write([]byte{qoiOpLuma | byte(vg+32), byte(vgr+8)<<4 | byte(vgb+8)})
+				default:
+					bw.Write([]byte{qoiOpRGB, px.R, px.G, px.B})
+				}
+			}
+			prev = px
+		}
+	}
+	if run > 0 {
+		bw.WriteByte(qoiOpRun | byte(run-1))
+	}
+	bw.Write(qoiEnd)
+	return bw.Flush()
+}
@@ -0,0 +1,91 @@
+// This file tests the QOI reader and writer.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// qoiEndMarker is the byte sequence that ends every QOI file.
+const qoiEndMarker = "\x00\x00\x00\x00\x00\x00\x00\x01"
+
+// testNRGBAImage returns an 8-bit version of testColorImage.
+func testNRGBAImage(alpha bool) *image.NRGBA {
+	src := testColorImage(alpha)
+	img := image.NewNRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, image.Point{}, draw.Src)
+	return img
+}
+
+// TestQOIRoundTrip verifies that 8-bit images written by EncodeQOI are read
+// back exactly by DecodeQOI.
+func TestQOIRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		alpha bool
+	}{
+		{"opaque", false},
+		{"alpha", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img := testNRGBAImage(tc.alpha)
+			data := encodeImage(t, EncodeQOI, img)
+			checkImage(t, decodeImage(t, DecodeQOI, data), img, 0.0)
+		})
+	}
+}
+
+// TestQOIGolden verifies that DecodeQOI reads a hand-constructed file that
+// uses every QOI operation.
+func TestQOIGolden(t *testing.T) {
+	data := []byte(qoiMagic +
+		"\x00\x00\x00\x03\x00\x00\x00\x03\x04\x00" +
+		"\xfe\x0a\x14\x1e" + // RGB: (10, 20, 30, 255)
+		"\x76" + // DIFF: +1, -1, 0
+		"\x09" + // INDEX: hash of the first pixel
+		"\xa5\xa5" + // LUMA: green +5, red +7, blue +2
+		"\xc1" + // RUN: 2 pixels
+		"\xff\x01\x02\x03\x04" + // RGBA: (1, 2, 3, 4)
+		"\x05" + // INDEX: hash of the fourth pixel
+		"\xc0" + // RUN: 1 pixel
+		qoiEndMarker)
+	want := image.NewNRGBA(image.Rect(0, 0, 3, 3))
+	for i, c := range []color.NRGBA{
+		{10, 20, 30, 255},
+		{11, 19, 30, 255},
+		{10, 20, 30, 255},
+		{17, 25, 32, 255},
+		{17, 25, 32, 255},
+		{17, 25, 32, 255},
+		{1, 2, 3, 4},
+		{17, 25, 32, 255},
+		{17, 25, 32, 255},
+	} {
+		want.SetNRGBA(i%3, i/3, c)
+	}
+	checkImage(t, decodeImage(t, DecodeQOI, data), want, 0.0)
+}
+
+// TestQOITruncated verifies that DecodeQOI rejects files truncated before the
+// end of the pixel data.  DecodeQOI does not require the end marker.
+func TestQOITruncated(t *testing.T) {
+	data := encodeImage(t, EncodeQOI, testNRGBAImage(true))
+	checkTruncated(t, DecodeQOI, data, len(data)-len(qoiEndMarker))
+}
+
+// TestQOIMalformed verifies that DecodeQOI rejects corrupt headers without
+// panicking.
+func TestQOIMalformed(t *testing.T) {
+	data := encodeImage(t, EncodeQOI, testNRGBAImage(true))
+	checkPatched(t, DecodeQOI, data, map[string]patch{
+		"bad magic":    {0, []byte("QOIF")},
+		"zero width":   {4, []byte{0, 0, 0, 0}},
+		"huge width":   {4, []byte{0x7f, 0xff, 0xff, 0xff}},
+		"huge image":   {4, []byte{1, 0, 0, 0, 1, 0, 0, 0}},
+		"bad channels": {12, []byte{5}},
+	})
+	checkMutated(t, DecodeQOI, data, len(data))
+}
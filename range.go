@@ -0,0 +1,309 @@
+// This file provides support for choosing the range of channel values that
+// split channels represent.  The default ranges accommodate any color but
+// waste much of each channel's precision on colors that sRGB images never
+// contain.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A chanRange is the range of channel values, in conventional units (e.g.,
+// -128 to 127 for a*), that a channel maps to [0.0, 1.0].
+type chanRange [2]float64
+
+// rangeTextKey is the keyword of the PNG tEXt chunk in which a split
+// channel's range is recorded.
+const rangeTextKey = "color-channels:range"
+
+// srgbRanges maps a color space to the ranges, keyed by channel name, that
+// --range=srgb selects.  Each range covers the values that sRGB colors
+// produce relative to the D65 white point, plus a small margin.
+var srgbRanges = map[string]map[string]chanRange{
+	"hcl": {"C": {0, 134}},
+	"lab": {"a": {-87, 99}, "b": {-108, 95}},
+	"luv": {"u": {-84, 176}, "v": {-135, 108}},
+}
+
+// defaultRanges returns the default range of each color channel in p's color
+// space, in channel order, or nil if the color space's channels all map
+// from [0.0, 1.0].
+func defaultRanges(p *Parameters) []chanRange {
+	rs := channelRanges[p.ColorSpace]
+	if rs == nil {
+		return nil
+	}
+	ranges := make([]chanRange, len(rs))
+	for i, r := range rs {
+		ranges[i] = chanRange(r)
+	}
+	return ranges
+}
+
+// parseChanRange parses a range of the form <min>:<max>.
+func parseChanRange(s string) (chanRange, error) {
+	colon := strings.Index(s, ":")
+	if colon < 0 {
+		return chanRange{}, fmt.Errorf("a range must have the form <min>:<max> (not %q)", s)
+	}
+	lo, err1 := strconv.ParseFloat(strings.TrimSpace(s[:colon]), 64)
+	hi, err2 := strconv.ParseFloat(strings.TrimSpace(s[colon+1:]), 64)
+	if err1 != nil || err2 != nil || !(lo < hi) {
+		return chanRange{}, fmt.Errorf("a range must have the form <min>:<max> with <min> less than <max> (not %q)", s)
+	}
+	return chanRange{lo, hi}, nil
+}
+
+// parseRanges parses the argument to --range, which is either "srgb" or a
+// comma-separated list of <channel>=<min>:<max> pairs.  It returns the range
+// of each color channel in channel order, with the default range for channels
+// not listed.  parseRanges aborts on error.
+func parseRanges(p *Parameters, arg string) []chanRange {
+	ranges := defaultRanges(p)
+	if ranges == nil {
+		notify.Fatalf("--range is not supported for --space=%q", p.OrigColorSpace)
+	}
+	names := builtinChannelNames(p)
+
+	// Select the ranges that suffice for sRGB colors.
+	if strings.ToLower(arg) == "srgb" {
+		preset, ok := srgbRanges[p.ColorSpace]
+		if !ok {
+			notify.Fatalf("--range=srgb is not supported for --space=%q", p.OrigColorSpace)
+		}
+		for i := range ranges {
+			if r, ok := preset[names[i]]; ok {
+				ranges[i] = r
+			}
+		}
+		return ranges
+	}
+
+	// Assign a range to each channel listed.
+	seen := make([]bool, len(ranges))
+	for _, pair := range strings.Split(arg, ",") {
+		eq := strings.Index(pair, "=")
+		if eq <= 0 {
+			notify.Fatalf(`--range requires either "srgb" or a list of <channel>=<min>:<max> pairs (not %q)`, pair)
+		}
+		ch := channelIndex(p, strings.TrimSpace(pair[:eq]))
+		if ch >= len(ranges) {
+			notify.Fatalf("--range cannot be applied to channel %s", names[ch])
+		}
+		if seen[ch] {
+			notify.Fatalf("--range specifies channel %s more than once", names[ch])
+		}
+		seen[ch] = true
+		r, err := parseChanRange(pair[eq+1:])
+		if err != nil {
+			notify.Fatalf("--range: %s", err)
+		}
+		ranges[ch] = r
+	}
+	return ranges
+}
+
+// applyChromaMax sets in p.Ranges the maximum HCL chroma, in conventional
+// units, that a split C channel represents.  It aborts on error.
+func applyChromaMax(p *Parameters, cmax float64) {
+	if p.ColorSpace != "hcl" {
+		notify.Fatal("--chroma-max can be used only with --space=hcl")
+	}
+	if !(cmax > 0.0) || math.IsInf(cmax, 0) {
+		notify.Fatalf("--chroma-max must be positive (not %g)", cmax)
+	}
+	defs := defaultRanges(p)
+	if p.Ranges == nil {
+		p.Ranges = defs
+	} else if p.Ranges[1] != defs[1] {
+		notify.Fatal("--chroma-max conflicts with --range for channel C")
+	}
+	p.Ranges[1] = chanRange{0.0, cmax}
+}
+
+// rerangeGray returns a copy of a Gray32f image with each pixel value, which
+// represents a channel value in range from, changed to represent the same
+// channel value in range to.
+func rerangeGray(g *Gray32f, from, to chanRange) *Gray32f {
+	scale := (from[1] - from[0]) / (to[1] - to[0])
+	offset := (from[0] - to[0]) / (to[1] - to[0])
+	bnds := g.Bounds()
+	out := NewGray32f(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			out.SetFloat(x, y, g.FloatAt(x, y)*scale+offset)
+		}
+	}
+	return out
+}
+
+// applySplitRanges re-encodes each of a set of split channels for which
+// p.Ranges specifies a non-default range, recording the range in the
+// channel's ImageInfo.
+func applySplitRanges(p *Parameters, infos []ImageInfo) {
+	if p.Ranges == nil {
+		return
+	}
+	defs := defaultRanges(p)
+	builtin := builtinChannelNames(p)
+	for i, info := range infos {
+		for ch, nm := range builtin {
+			if nm != info.Name || ch >= len(p.Ranges) || p.Ranges[ch] == defs[ch] {
+				continue
+			}
+			r := p.Ranges[ch]
+			infos[i].Image = rerangeGray(info.Image, defs[ch], r)
+			infos[i].Range = &r
+		}
+	}
+}
+
+// applyMergeRanges returns a set of channels to merge, given in channel order,
+// with each channel for which p.Ranges specifies a non-default range
+// re-encoded in the default range.  Values given to --fill are taken to be in
+// the same range as the channel files.
+func applyMergeRanges(p *Parameters, channels []*Gray32f) []*Gray32f {
+	if p.Ranges == nil {
+		return channels
+	}
+	defs := defaultRanges(p)
+	result := make([]*Gray32f, len(channels))
+	for i, g := range channels {
+		result[i] = g
+		if i < len(p.Ranges) && i < len(defs) && p.Ranges[i] != defs[i] {
+			result[i] = rerangeGray(g, p.Ranges[i], defs[i])
+		}
+	}
+	return result
+}
+
+// manifestRanges returns the ranges recorded in a manifest, in channel order,
+// or nil if the manifest records only default ranges.  The range of a channel
+// written by --signed=split is taken from the file of its positive values.
+func manifestRanges(p *Parameters, man *channelManifest) []chanRange {
+	defs := defaultRanges(p)
+	custom := false
+	for _, ent := range man.Channels {
+		ch, sfx := signedBaseIndex(p, ent.Name)
+		if ch < 0 || ch >= len(defs) || sfx == "-" {
+			continue
+		}
+		r := chanRange{ent.Min, ent.Max}
+		if sfx == "+" {
+			r = chanRange{-ent.Max, ent.Max}
+		}
+		if r != defs[ch] {
+			defs[ch] = r
+			custom = true
+		}
+	}
+	if !custom {
+		return nil
+	}
+	return defs
+}
+
+// rangeText returns the PNG text with which to record a channel's range or
+// nil if the range is nil.
+func rangeText(r *chanRange) map[string]string {
+	if r == nil {
+		return nil
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	return map[string]string{rangeTextKey: string(data)}
+}
+
+// channelText returns the PNG text with which to record a split channel's
+// tone curve, range, logarithmic encoding, and chroma subsampling, or nil if
+// the channel has none of these.
+func channelText(info ImageInfo) map[string]string {
+	text := curveText(info.Curve)
+	for _, more := range []map[string]string{rangeText(info.Range), logText(info.Log), subsampleText(info.Subsample)} {
+		for k, v := range more {
+			if text == nil {
+				text = make(map[string]string)
+			}
+			text[k] = v
+		}
+	}
+	return text
+}
+
+// recordsChannelText reports whether split channels are to be written in a
+// form that can record what --merge needs to restore their values: PNG
+// files, which record it in tEXt chunks, a ZIP bundle, or files described by
+// a manifest.  It returns true when not splitting.
+func recordsChannelText(p *Parameters) bool {
+	if !p.Split || p.Manifest != "" || paramsOutputFormat(p).Bundle != nil {
+		return true
+	}
+	return p.OutputName != "-" && selectOutputFormat(p.OutputName, p.Format) == "png"
+}
+
+// requireChannelText aborts if split channels are to be written in a form that
+// cannot record what --merge needs to restore their values.  opt names the
+// option responsible for the metadata.
+func requireChannelText(p *Parameters, opt string) {
+	if !recordsChannelText(p) {
+		notify.Fatalf("%s requires PNG channel files, a ZIP bundle, or --manifest so that --merge can undo it", opt)
+	}
+}
+
+// warnChannelText warns if split channels are to be written in a form that
+// cannot record the effect of an option that the user can instead repeat
+// when merging.  opt names the option.
+func warnChannelText(p *Parameters, opt string) {
+	if !recordsChannelText(p) {
+		notify.Printf("%s is not recorded in the channel files, so it must be given again to --merge", opt)
+	}
+}
+
+// readChannelRanges records in p.Ranges the ranges recorded in a list of
+// channel files to merge, given in channel order but omitting channels
+// filled by --fill.  Ranges recorded in the files apply only to channels
+// whose range was not already specified by --range or a manifest.
+func readChannelRanges(p *Parameters, fns []string) {
+	defs := defaultRanges(p)
+	if defs == nil {
+		return
+	}
+	var ranges []chanRange
+	fi := 0
+	for ch := range defs {
+		if isFilled(p, ch) {
+			continue
+		}
+		if fi >= len(fns) {
+			break
+		}
+		fn := fns[fi]
+		fi++
+		if p.Ranges != nil && p.Ranges[ch] != defs[ch] {
+			continue
+		}
+		val, ok := readPNGText(fn)[rangeTextKey]
+		if !ok {
+			continue
+		}
+		var r chanRange
+		if json.Unmarshal([]byte(val), &r) != nil || !(r[0] < r[1]) {
+			notify.Fatalf("%s: Malformed %s text", fn, rangeTextKey)
+		}
+		if ranges == nil {
+			ranges = defaultRanges(p)
+			copy(ranges, p.Ranges)
+		}
+		ranges[ch] = r
+	}
+	if ranges != nil {
+		p.Ranges = ranges
+	}
+}
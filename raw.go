@@ -0,0 +1,139 @@
+// This file provides support for reading and writing headerless, planar,
+// binary images ("raw" format), which are convenient for exchanging data
+// with NumPy, MATLAB, and custom C code.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// rawSampleSizes maps each valid --raw-type argument to the size in bytes of
+// a sample of that type.
+var rawSampleSizes = map[string]int{
+	"uint8":   1,
+	"uint16":  2,
+	"float32": 4,
+}
+
+// rawByteOrders maps each valid --raw-endian argument to a byte order.
+var rawByteOrders = map[string]binary.ByteOrder{
+	"little": binary.LittleEndian,
+	"big":    binary.BigEndian,
+}
+
+// parseSize parses a size of the form "<width>x<height>".  It aborts on error.
+func parseSize(s string) image.Point {
+	toks := strings.Split(strings.ToLower(s), "x")
+	if len(toks) != 2 {
+		notify.Fatalf("Failed to parse %q as <width>x<height>", s)
+	}
+	wd, err1 := strconv.Atoi(strings.TrimSpace(toks[0]))
+	ht, err2 := strconv.Atoi(strings.TrimSpace(toks[1]))
+	if err1 != nil || err2 != nil || wd <= 0 || ht <= 0 {
+		notify.Fatalf("Failed to parse %q as <width>x<height>", s)
+	}
+	return image.Point{X: wd, Y: ht}
+}
+
+// rawPutSample encodes a sample in [0.0, 1.0] (or any value, for float32) into
+// a buffer.
+func rawPutSample(buf []byte, v float64, typ string, bo binary.ByteOrder) {
+	switch typ {
+	case "uint8":
+		buf[0] = toUint8(v)
+	case "uint16":
+		bo.PutUint16(buf, toGrayVal(v).Y)
+	case "float32":
+		bo.PutUint32(buf, math.Float32bits(float32(v)))
+	}
+}
+
+// rawGetSample decodes a sample from a buffer, returning a value nominally in
+// [0.0, 1.0].
+func rawGetSample(buf []byte, typ string, bo binary.ByteOrder) float64 {
+	switch typ {
+	case "uint8":
+		return float64(buf[0]) / 255.0
+	case "uint16":
+		return float64(bo.Uint16(buf)) / 65535.0
+	default:
+		return float64(math.Float32frombits(bo.Uint32(buf)))
+	}
+}
+
+// encodeRaw writes an image as one or more headerless binary planes of the
+// sample type and byte order given by the parameters.  Grayscale images are
+// written as a single plane.  Color images are written as consecutive R, G,
+// and B planes followed by an A plane if the image is not opaque.
+func encodeRaw(w io.Writer, img image.Image, p *Parameters) error {
+	// Determine the number of planes and a function that returns a
+	// sample from a given plane.
+	planes := 1
+	var sampleAt func(c, x, y int) float64
+	switch m := img.(type) {
+	case *Gray32f:
+		sampleAt = func(c, x, y int) float64 { return m.FloatAt(x, y) }
+	case *NRGBA32f:
+		sampleAt = func(c, x, y int) float64 { return m.FloatsAt(x, y)[c] }
+		planes = 4
+	default:
+		if img.ColorModel() == color.GrayModel || img.ColorModel() == color.Gray16Model {
+			sampleAt = func(c, x, y int) float64 {
+				return float64(color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y) / 65535.0
+			}
+			break
+		}
+		sampleAt = func(c, x, y int) float64 {
+			n := toNRGBA64(img.At(x, y))
+			return float64([4]uint16{n.R, n.G, n.B, n.A}[c]) / 65535.0
+		}
+		planes = 4
+	}
+	if o, ok := img.(interface{ Opaque() bool }); ok && planes == 4 && o.Opaque() {
+		planes = 3
+	}
+
+	// Write each plane in turn.
+	bw := bufio.NewWriter(w)
+	bo := rawByteOrders[p.RawEndian]
+	buf := make([]byte, rawSampleSizes[p.RawType])
+	bnds := img.Bounds()
+	for c := 0; c < planes; c++ {
+		for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+			for x := bnds.Min.X; x < bnds.Max.X; x++ {
+				rawPutSample(buf, sampleAt(c, x, y), p.RawType, bo)
+				bw.Write(buf)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadRawChannel reads a single headerless binary plane of the size, sample
+// type, and byte order given by the parameters.  It aborts on error.
+func ReadRawChannel(p *Parameters, fn string) *Gray32f {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	ss := rawSampleSizes[p.RawType]
+	if len(data) != p.RawSize.X*p.RawSize.Y*ss {
+		notify.Fatalf("Expected %s to contain %d bytes (%dx%d %s samples) but it contains %d bytes",
+			fn, p.RawSize.X*p.RawSize.Y*ss, p.RawSize.X, p.RawSize.Y, p.RawType, len(data))
+	}
+	bo := rawByteOrders[p.RawEndian]
+	gray := NewGray32f(image.Rectangle{Max: p.RawSize})
+	for i := range gray.Pix {
+		gray.Pix[i] = float32(rawGetSample(data[i*ss:], p.RawType, bo))
+	}
+	return gray
+}
@@ -0,0 +1,222 @@
+// This file provides alternate renderings of split channels, which are more
+// suitable for presentations and analysis figures than the raw grayscale
+// channels but cannot be merged back into a color image.
+
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// A colorRamp is a sequence of evenly spaced sRGB colors through which
+// channel values in [0.0, 1.0] are interpolated.
+type colorRamp [][3]float64
+
+// Commonly used colors
+var (
+	rampBlack   = [3]float64{0.0, 0.0, 0.0}
+	rampWhite   = [3]float64{1.0, 1.0, 1.0}
+	rampGray    = [3]float64{0.5, 0.5, 0.5}
+	rampRed     = [3]float64{1.0, 0.0, 0.0}
+	rampGreen   = [3]float64{0.0, 1.0, 0.0}
+	rampBlue    = [3]float64{0.0, 0.0, 1.0}
+	rampCyan    = [3]float64{0.0, 1.0, 1.0}
+	rampMagenta = [3]float64{1.0, 0.0, 1.0}
+	rampYellow  = [3]float64{1.0, 1.0, 0.0}
+)
+
+// Commonly used ramps
+var (
+	grayRamp         = colorRamp{rampBlack, rampWhite}
+	greenMagentaRamp = colorRamp{{0.0, 0.6, 0.3}, rampGray, {0.85, 0.0, 0.55}}
+	blueYellowRamp   = colorRamp{{0.1, 0.3, 0.9}, rampGray, {0.95, 0.85, 0.0}}
+	saturationRamp   = colorRamp{rampGray, rampRed}
+	redRamp          = colorRamp{rampBlack, rampRed}
+	greenRamp        = colorRamp{rampBlack, rampGreen}
+	blueRamp         = colorRamp{rampBlack, rampBlue}
+	rgbChannelRamps  = map[string]colorRamp{"R": redRamp, "G": greenRamp, "B": blueRamp}
+	hueSatLightRamps = map[string]colorRamp{"S": saturationRamp, "L": grayRamp}
+)
+
+// channelRamps maps a color space and channel name to the ramp with which
+// --visualize renders the channel.  Channels not listed are rendered in
+// grayscale.
+var channelRamps = map[string]map[string]colorRamp{
+	"rgb":    rgbChannelRamps,
+	"srgb":   rgbChannelRamps,
+	"linrgb": rgbChannelRamps,
+	"lab":    {"L": grayRamp, "a": greenMagentaRamp, "b": blueYellowRamp},
+	"luv":    {"L": grayRamp, "u": greenMagentaRamp, "v": blueYellowRamp},
+	"hcl":    {"C": saturationRamp, "L": grayRamp},
+	"hsl":    hueSatLightRamps,
+	"hsluv":  hueSatLightRamps,
+	"cmyk": {
+		"C": {rampWhite, rampCyan},
+		"M": {rampWhite, rampMagenta},
+		"Y": {rampWhite, rampYellow},
+		"K": {rampWhite, rampBlack},
+	},
+	"ycbcr": {
+		"Y":  grayRamp,
+		"Cb": {rampYellow, rampGray, rampBlue},
+		"Cr": {rampCyan, rampGray, rampRed},
+	},
+}
+
+// At returns the color at a given position in [0.0, 1.0] along a ramp.
+// Positions outside that range are clamped.
+func (r colorRamp) At(v float64) [3]float64 {
+	n := len(r) - 1
+	switch {
+	case v <= 0.0:
+		return r[0]
+	case v >= 1.0:
+		return r[n]
+	}
+	pos := v * float64(n)
+	i := int(pos)
+	t := pos - float64(i)
+	var c [3]float64
+	for k := range c {
+		c[k] = r[i][k]*(1.0-t) + r[i+1][k]*t
+	}
+	return c
+}
+
+// renderThrough renders a channel image by mapping each value through a
+// function that returns an sRGB color.
+func renderThrough(g *Gray32f, fn func(v float64) [3]float64) image.Image {
+	bnds := g.Bounds()
+	img := NewNRGBA32f(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			c := fn(g.FloatAt(x, y))
+			img.SetFloats(x, y, [4]float64{c[0], c[1], c[2], 1.0})
+		}
+	}
+	return img
+}
+
+// RenderRamp renders a channel image through a color ramp.
+func RenderRamp(g *Gray32f, ramp colorRamp) image.Image {
+	return renderThrough(g, ramp.At)
+}
+
+// polyColormap returns a colormap defined by a polynomial in v for each of
+// R, G, and B.  Coefficients are listed from the constant term upward.
+func polyColormap(coeffs [][3]float64) func(v float64) [3]float64 {
+	return func(v float64) [3]float64 {
+		v = clamp01(v)
+		var c [3]float64
+		for k := range c {
+			for i := len(coeffs) - 1; i >= 0; i-- {
+				c[k] = c[k]*v + coeffs[i][k]
+			}
+			c[k] = clamp01(c[k])
+		}
+		return c
+	}
+}
+
+// clamp01 clamps a value to [0.0, 1.0].
+func clamp01(v float64) float64 {
+	switch {
+	case v < 0.0:
+		return 0.0
+	case v > 1.0:
+		return 1.0
+	}
+	return v
+}
+
+// colormaps maps the name of each scientific colormap accepted by --colormap
+// to a function that maps a value in [0.0, 1.0] to an sRGB color.  viridis,
+// magma, and turbo are closely approximated by polynomials.
+var colormaps = map[string]func(v float64) [3]float64{
+	"viridis": polyColormap([][3]float64{
+		{0.2777273272234177, 0.005407344544966578, 0.3340998053353061},
+		{0.1050930431085774, 1.404613529898575, 1.384590162594685},
+		{-0.3308618287255563, 0.214847559468213, 0.09509516302823659},
+		{-4.634230498983486, -5.799100973351585, -19.33244095627987},
+		{6.228269936347081, 14.17993336680509, 56.69055260068105},
+		{4.776384997670288, -13.74514537774601, -65.35303263337234},
+		{-5.435455855934631, 4.645852612178535, 26.3124352495832},
+	}),
+	"magma": polyColormap([][3]float64{
+		{-0.002136485053939582, -0.000749655052795221, -0.005386127855323933},
+		{0.2516605407371642, 0.6775232436837668, 2.494026599312351},
+		{8.353717279216625, -3.577719514958484, 0.3144679030132573},
+		{-27.66873308576866, 14.26473078096533, -13.64921318813922},
+		{52.17613981234068, -27.94360607168351, 12.94416944238394},
+		{-50.76852536473588, 29.04658282127291, 4.23415299384598},
+		{18.65570506591883, -11.48977351997711, -5.601961508734096},
+	}),
+	"turbo": polyColormap([][3]float64{
+		{0.13572138, 0.09140261, 0.10667330},
+		{4.61539260, 2.19418839, 12.64194608},
+		{-42.66032258, 4.84296658, -60.58204836},
+		{132.13108234, -14.18503333, 110.36276771},
+		{-152.94239396, 4.27729857, -89.90310912},
+		{59.28637943, 2.82956604, 27.34824973},
+	}),
+	"jet": func(v float64) [3]float64 {
+		v = clamp01(v)
+		return [3]float64{
+			clamp01(1.5 - math.Abs(4.0*v-3.0)),
+			clamp01(1.5 - math.Abs(4.0*v-2.0)),
+			clamp01(1.5 - math.Abs(4.0*v-1.0)),
+		}
+	},
+}
+
+// hueWheels maps each color space with a hue channel to a function that
+// returns a fully saturated, mid-lightness color of a given hue in degrees.
+var hueWheels = map[string]func(h float64, wref [3]float64) colorful.Color{
+	"hcl": func(h float64, wref [3]float64) colorful.Color {
+		return colorful.HclWhiteRef(h, 0.5, 0.6, wref).Clamped()
+	},
+	"hsl": func(h float64, wref [3]float64) colorful.Color {
+		return colorful.Hsl(h, 1.0, 0.5)
+	},
+	"hsluv": func(h float64, wref [3]float64) colorful.Color {
+		return colorful.HSLuv(h, 1.0, 0.5).Clamped()
+	},
+}
+
+// RenderHue renders a hue channel, with values in [0.0, 1.0] representing
+// [0, 360) degrees, as the colors returned by a given function.
+func RenderHue(g *Gray32f, wheel func(h float64) colorful.Color) image.Image {
+	bnds := g.Bounds()
+	img := NewNRGBA32f(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			c := wheel(g.FloatAt(x, y) * 360.0)
+			img.SetFloats(x, y, [4]float64{c.R, c.G, c.B, 1.0})
+		}
+	}
+	return img
+}
+
+// renderChannel returns the image to write for a split channel.  This is the
+// channel itself unless an alternate rendering was requested.
+func renderChannel(p *Parameters, info ImageInfo) image.Image {
+	if wheel, ok := hueWheels[p.ColorSpace]; ok && info.Name == "H" && (p.HueWheel || p.Visualize) {
+		return RenderHue(info.Image, func(h float64) colorful.Color {
+			return wheel(h, p.WhitePoint)
+		})
+	}
+	if p.Colormap != "" {
+		return renderThrough(info.Image, colormaps[p.Colormap])
+	}
+	if !p.Visualize {
+		return info.Image
+	}
+	ramp, ok := channelRamps[p.ColorSpace][info.Name]
+	if !ok {
+		return info.Image
+	}
+	return RenderRamp(info.Image, ramp)
+}
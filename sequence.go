@@ -0,0 +1,79 @@
+// This file provides support for image sequences, which are sets of files
+// whose names differ only by a frame number, such as rendered video frames.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// isSequence reports whether an input filename is a template for an image
+// sequence: it contains a frame-number verb and does not name an existing
+// file.
+func isSequence(fn string) bool {
+	if !hasFrameVerb(fn) {
+		return false
+	}
+	_, err := os.Stat(fn)
+	return err != nil
+}
+
+// sequenceFrames returns, in increasing order, the frame numbers of all
+// existing files that match a filename template.  Only the final component
+// of the template may contain frame-number verbs.  sequenceFrames aborts if
+// no files match.
+func sequenceFrames(tmpl string) []int {
+	// Convert the template to a regular expression.
+	dir, base := filepath.Split(tmpl)
+	if hasFrameVerb(dir) {
+		notify.Fatalf("%s: Frame numbers may appear only in the final component of a filename", tmpl)
+	}
+	var re string
+	prev := 0
+	for _, loc := range frameVerbRE.FindAllStringIndex(base, -1) {
+		re += regexp.QuoteMeta(base[prev:loc[0]])
+		if base[loc[0]:loc[1]] == "%%" {
+			re += "%"
+		} else {
+			re += "([0-9]+)"
+		}
+		prev = loc[1]
+	}
+	re += regexp.QuoteMeta(base[prev:])
+	baseRE := regexp.MustCompile("^" + re + "$")
+
+	// Find all matching files.  Reject those whose names would be
+	// formatted differently (e.g., "7.png" for "%03d.png").
+	if dir == "" {
+		dir = "."
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	seen := make(map[int]bool)
+	for _, ent := range ents {
+		m := baseRE.FindStringSubmatch(ent.Name())
+		if m == nil {
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil || expandFrame(base, n) != ent.Name() {
+			continue
+		}
+		seen[n] = true
+	}
+	if len(seen) == 0 {
+		notify.Fatalf("No files match %s", tmpl)
+	}
+	frames := make([]int, 0, len(seen))
+	for n := range seen {
+		frames = append(frames, n)
+	}
+	sort.Ints(frames)
+	return frames
+}
@@ -0,0 +1,276 @@
+// This file provides support for alternative encodings of signed channels,
+// such as a* and b*, whose values are centered on zero.  By default, such
+// channels are written in offset binary, with zero represented by mid-gray,
+// but some tools expect two's-complement samples or separate files for
+// positive and negative values.
+
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// signedModes lists the valid arguments to --signed.
+var signedModes = map[string]bool{
+	"offset":          true,
+	"twos-complement": true,
+	"split":           true,
+}
+
+// parseSigned validates the argument to --signed and returns it in lowercase.
+// It aborts on error.
+func parseSigned(arg string) string {
+	mode := strings.ToLower(arg)
+	if !signedModes[mode] {
+		notify.Fatalf(`--signed requires one of "offset", "twos-complement", or "split" (not %q)`, arg)
+	}
+	return mode
+}
+
+// isSignedChannel reports whether the channel with a given index in p's color
+// space is signed, i.e., whether its default range includes negative values.
+func isSignedChannel(p *Parameters, ch int) bool {
+	defs := defaultRanges(p)
+	return ch >= 0 && ch < len(defs) && defs[ch][0] < 0.0
+}
+
+// signedSplitExtra returns the number of additional files required to merge
+// channels split with --signed=split, one per signed channel not filled by
+// --fill.
+func signedSplitExtra(p *Parameters) int {
+	if p.Signed != "split" {
+		return 0
+	}
+	n := 0
+	for ch := range builtinChannelNames(p) {
+		if isSignedChannel(p, ch) && !isFilled(p, ch) {
+			n++
+		}
+	}
+	return n
+}
+
+// symmetricRange returns the smallest range centered on zero that contains a
+// given range.
+func symmetricRange(r chanRange) chanRange {
+	m := math.Max(math.Abs(r[0]), math.Abs(r[1]))
+	return chanRange{-m, m}
+}
+
+// signedBaseIndex returns the index within p's color space of the channel
+// with a given name or, if the name ends in "+" or "-", as written by
+// --signed=split, of the signed channel it represents.  It also returns the
+// suffix, if any.  signedBaseIndex returns -1 if the name designates no
+// channel of the color space.
+func signedBaseIndex(p *Parameters, name string) (int, string) {
+	base, sfx := name, ""
+	if strings.HasSuffix(name, "+") || strings.HasSuffix(name, "-") {
+		base, sfx = name[:len(name)-1], name[len(name)-1:]
+	}
+	for ch, nm := range builtinChannelNames(p) {
+		switch {
+		case nm == name:
+			return ch, ""
+		case sfx != "" && nm == base && isSignedChannel(p, ch):
+			return ch, sfx
+		}
+	}
+	return -1, ""
+}
+
+// signedBits returns the number of bits per sample with which split channels
+// will be written, as required by --signed=twos-complement.  It aborts if the
+// channels will be written with floating-point samples.
+func signedBits(p *Parameters) int {
+	of := paramsOutputFormat(p)
+	switch {
+	case p.Depth == "8" || (p.Depth == "" && of.Max8):
+		return 8
+	case p.Depth == "16" || (p.Depth == "" && !of.Float):
+		return 16
+	}
+	notify.Fatal("--signed=twos-complement requires integer output; specify --depth=8 or --depth=16")
+	return 0
+}
+
+// toTwosComplement maps a signed value in [-1.0, 1.0] to the pixel value in
+// [0.0, 1.0] whose bits, at a given depth, represent the value in two's
+// complement.
+func toTwosComplement(s float64, bits int) float64 {
+	full := math.Ldexp(1.0, bits)
+	half := full / 2.0
+	n := math.Max(-half, math.Min(half-1.0, math.Round(s*half)))
+	if n < 0.0 {
+		n += full
+	}
+	return n / (full - 1.0)
+}
+
+// grayBits returns 8 if every pixel value in a Gray32f image is a multiple of
+// 1/255 and 16 otherwise.
+func grayBits(g *Gray32f) int {
+	bnds := g.Bounds()
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			v := g.FloatAt(x, y) * 255.0
+			if math.Abs(v-math.Round(v)) > 1e-4 {
+				return 16
+			}
+		}
+	}
+	return 8
+}
+
+// fromTwosComplement returns a copy of a channel whose pixel values represent
+// signed values in two's complement with each value mapped instead to offset
+// binary.  The number of bits per sample is inferred from the values.
+func fromTwosComplement(g *Gray32f) *Gray32f {
+	full := math.Ldexp(1.0, grayBits(g))
+	half := full / 2.0
+	bnds := g.Bounds()
+	out := NewGray32f(bnds)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			n := math.Round(g.FloatAt(x, y) * (full - 1.0))
+			if n >= half {
+				n -= full
+			}
+			out.SetFloat(x, y, (n/half+1.0)/2.0)
+		}
+	}
+	return out
+}
+
+// encodeSigned returns a set of split channels with each signed channel
+// encoded as specified by p.Signed.  Signed values are scaled by the larger
+// magnitude of the ends of the channel's range so that zero is preserved.
+// With --signed=split, each signed channel is replaced by a channel named
+// with a "+" suffix that holds its positive values and a channel named with
+// a "-" suffix that holds the magnitudes of its negative values.
+func encodeSigned(p *Parameters, infos []ImageInfo) []ImageInfo {
+	if p.Signed == "" || p.Signed == "offset" {
+		return infos
+	}
+	bits := 0
+	if p.Signed == "twos-complement" {
+		bits = signedBits(p)
+	}
+	defs := defaultRanges(p)
+	result := make([]ImageInfo, 0, len(infos))
+	for _, info := range infos {
+		ch, _ := signedBaseIndex(p, info.Name)
+		if !isSignedChannel(p, ch) {
+			result = append(result, info)
+			continue
+		}
+
+		// Re-encode the channel in offset binary in a range centered on
+		// zero.
+		r := defs[ch]
+		if info.Range != nil {
+			r = *info.Range
+		}
+		sym := symmetricRange(r)
+		g := info.Image
+		if sym != r {
+			g = rerangeGray(g, r, sym)
+		}
+		var symPtr *chanRange
+		if sym != defs[ch] {
+			symPtr = &sym
+		}
+
+		// Encode the signed values.
+		bnds := g.Bounds()
+		if p.Signed == "twos-complement" {
+			out := NewGray32f(bnds)
+			for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+				for x := bnds.Min.X; x < bnds.Max.X; x++ {
+					out.SetFloat(x, y, toTwosComplement(g.FloatAt(x, y)*2.0-1.0, bits))
+				}
+			}
+			enc := info
+			enc.Image, enc.Range = out, symPtr
+			result = append(result, enc)
+			continue
+		}
+		pos, neg := NewGray32f(bnds), NewGray32f(bnds)
+		for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+			for x := bnds.Min.X; x < bnds.Max.X; x++ {
+				s := g.FloatAt(x, y)*2.0 - 1.0
+				pos.SetFloat(x, y, math.Max(s, 0.0))
+				neg.SetFloat(x, y, math.Max(-s, 0.0))
+			}
+		}
+		posInfo, negInfo := info, info
+		posInfo.Name, posInfo.Image, posInfo.Range = info.Name+"+", pos, symPtr
+		negInfo.Name, negInfo.Image, negInfo.Range = info.Name+"-", neg, symPtr
+		result = append(result, posInfo, negInfo)
+	}
+	return result
+}
+
+// decodeSigned maps a set of channels read from files, given in channel order
+// but omitting channels filled by --fill, from the encoding specified by
+// p.Signed back to offset binary.  With --signed=split, each signed channel is
+// read from two consecutive files, which decodeSigned combines.  decodeSigned
+// returns one channel per color channel and, for each, the name of a file from
+// which it was read (or "" if the files are unnamed).
+func decodeSigned(p *Parameters, channels []*Gray32f, fns []string) ([]*Gray32f, []string) {
+	if p.Signed == "" || p.Signed == "offset" {
+		return channels, fns
+	}
+	fileName := func(i int) string {
+		if i < len(fns) {
+			return fns[i]
+		}
+		return ""
+	}
+	var result []*Gray32f
+	var names []string
+	i := 0
+	for ch := range builtinChannelNames(p) {
+		if isFilled(p, ch) {
+			continue
+		}
+		if i >= len(channels) {
+			break
+		}
+		g, fn := channels[i], fileName(i)
+		i++
+		switch {
+		case !isSignedChannel(p, ch):
+		case p.Signed == "twos-complement":
+			g = fromTwosComplement(g)
+		case i < len(channels):
+			neg := channels[i]
+			i++
+			bnds := g.Bounds()
+			out := NewGray32f(bnds)
+			for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+				for x := bnds.Min.X; x < bnds.Max.X; x++ {
+					out.SetFloat(x, y, (g.FloatAt(x, y)-neg.FloatAt(x, y)+1.0)/2.0)
+				}
+			}
+			g = out
+		}
+		result = append(result, g)
+		names = append(names, fn)
+	}
+	return result, names
+}
+
+// symmetrizeSignedRanges replaces the range of each signed channel in
+// p.Ranges with the smallest range centered on zero that contains it, as
+// channels encoded with --signed=twos-complement or --signed=split represent.
+func symmetrizeSignedRanges(p *Parameters) {
+	if p.Ranges == nil || p.Signed == "" || p.Signed == "offset" {
+		return
+	}
+	for ch, r := range p.Ranges {
+		if isSignedChannel(p, ch) {
+			p.Ranges[ch] = symmetricRange(r)
+		}
+	}
+}
@@ -3,23 +3,33 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"image/color"
+	"io"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/lucasb-eyer/go-colorful"
+	"github.com/spakin/color-channels/channels"
 )
 
 // A ImageInfo represents a channel name and image data.
 type ImageInfo struct {
-	Name  string        // Channel name
-	Image *image.Gray16 // Grayscale image representing a channel
+	Name      string     // Channel name
+	Image     *Gray32f   // Grayscale image representing a channel
+	Curve     toneCurve  // Tone curve applied to the channel by --equalize or --auto-contrast (nil for none)
+	Range     *chanRange // Range of channel values represented when not the default (nil for the default)
+	Log       *logScale  // Logarithmic encoding applied to the channel by --encode=log (nil for none)
+	Subsample string     // Chroma subsampling applied to the channel by --subsample ("" for none)
 }
 
-// toGrayVal converts a float64 in [0.0, 1.0] to a color.Gray16, clamping if
-// necessary.
+// toGrayVal converts a float64 in [0.0, 1.0] to a color.Gray16, rounding to
+// the nearest representable value and clamping if necessary.
 func toGrayVal(f float64) color.Gray16 {
 	if f < 0.0 {
 		return color.Gray16{Y: 0}
@@ -27,250 +37,820 @@ func toGrayVal(f float64) color.Gray16 {
 	if f > 1.0 {
 		return color.Gray16{Y: 65535}
 	}
-	return color.Gray16{Y: uint16(f * 65535.0)}
+	return color.Gray16{Y: uint16(f*65535.0 + 0.5)}
 }
 
 // allocGrays allocates an array of N grayscale images of a given size.
-func allocGrays(bnds image.Rectangle, n int) []*image.Gray16 {
-	grays := make([]*image.Gray16, n)
+func allocGrays(bnds image.Rectangle, n int) []*Gray32f {
+	grays := make([]*Gray32f, n)
 	for i := range grays {
-		grays[i] = image.NewGray16(bnds)
+		grays[i] = &Gray32f{
+			Pix:    getFloat32s(bnds.Dx() * bnds.Dy()),
+			Stride: bnds.Dx(),
+			Rect:   bnds,
+		}
 	}
 	return grays
 }
 
-// splitAny is a helper function for the various Split* functions.  It performs
-// all the boilerplate code, invoking a color space-specific function for each
-// pixel.
-func splitAny(img image.Image, names []string,
-	fn func(colorful.Color) []float64) []ImageInfo {
-	bnds := img.Bounds()
-	grays := allocGrays(bnds, len(names))
+// colorAtFunc returns a function that returns the color of a given pixel of a
+// given image.  Floating-point images are read without clamping so that
+// out-of-range colors survive until they are split into channels.  The
+// common 8- and 16-bit image types are read directly from their pixel
+// buffers rather than through the color.Color interface, and the colors of
+// non-premultiplied images are read as stored rather than premultiplied by
+// alpha and divided by it again, which would lose precision.  Fully
+// transparent pixels are black.
+func colorAtFunc(img image.Image) func(x, y int) colorful.Color {
+	switch m := img.(type) {
+	case *NRGBA32f:
+		return func(x, y int) colorful.Color {
+			v := m.FloatsAt(x, y)
+			return colorful.Color{R: v[0], G: v[1], B: v[2]}
+		}
+	case *image.NRGBA:
+		return func(x, y int) colorful.Color {
+			if !(image.Point{x, y}.In(m.Rect)) {
+				return colorful.Color{}
+			}
+			s := m.Pix[m.PixOffset(x, y):]
+			if s[3] == 0 {
+				return colorful.Color{}
+			}
+			return colorful.Color{R: float64(s[0]) / 255.0, G: float64(s[1]) / 255.0, B: float64(s[2]) / 255.0}
+		}
+	case *image.RGBA:
+		return func(x, y int) colorful.Color {
+			if !(image.Point{x, y}.In(m.Rect)) {
+				return colorful.Color{}
+			}
+			s := m.Pix[m.PixOffset(x, y):]
+			if s[3] == 0xff {
+				return colorful.Color{R: float64(s[0]) / 255.0, G: float64(s[1]) / 255.0, B: float64(s[2]) / 255.0}
+			}
+			return makeColorRGBA(color.RGBA{s[0], s[1], s[2], s[3]}.RGBA())
+		}
+	case *image.NRGBA64:
+		return func(x, y int) colorful.Color {
+			if !(image.Point{x, y}.In(m.Rect)) {
+				return colorful.Color{}
+			}
+			s := m.Pix[m.PixOffset(x, y):]
+			c := color.NRGBA64{
+				R: uint16(s[0])<<8 | uint16(s[1]),
+				G: uint16(s[2])<<8 | uint16(s[3]),
+				B: uint16(s[4])<<8 | uint16(s[5]),
+				A: uint16(s[6])<<8 | uint16(s[7]),
+			}
+			if c.A == 0 {
+				return colorful.Color{}
+			}
+			return colorful.Color{R: float64(c.R) / 65535.0, G: float64(c.G) / 65535.0, B: float64(c.B) / 65535.0}
+		}
+	case *image.YCbCr:
+		return func(x, y int) colorful.Color {
+			return makeColorRGBA(m.YCbCrAt(x, y).RGBA())
+		}
+	}
+	return func(x, y int) colorful.Color {
+		return makeColorRGBA(img.At(x, y).RGBA())
+	}
+}
+
+// toColorful converts an arbitrary color to a colorful.Color.  A
+// colorful.Color is returned as is so as not to lose precision.
+func toColorful(c color.Color) colorful.Color {
+	if clr, ok := c.(colorful.Color); ok {
+		return clr
+	}
+	return makeColorRGBA(c.RGBA())
+}
+
+// makeColorRGBA converts alpha-premultiplied 16-bit color components to a
+// colorful.Color as does colorful.MakeColor but without passing the color
+// through an interface and with the quotients of the color components divided
+// by alpha rounded rather than truncated.  Fully transparent colors are mapped
+// to black.
+func makeColorRGBA(r, g, b, a uint32) colorful.Color {
+	if a == 0 {
+		return colorful.Color{}
+	}
+	return colorful.Color{
+		R: float64(unpremultiply16(r, a)) / 65535.0,
+		G: float64(unpremultiply16(g, a)) / 65535.0,
+		B: float64(unpremultiply16(b, a)) / 65535.0,
+	}
+}
+
+// alphaAtFunc returns a function that returns the alpha value of a given
+// pixel of a given image.  Floating-point images are read without
+// quantization.
+func alphaAtFunc(img image.Image) func(x, y int) float64 {
+	switch m := img.(type) {
+	case *NRGBA32f:
+		return func(x, y int) float64 { return m.FloatsAt(x, y)[3] }
+	case *image.NRGBA:
+		return func(x, y int) float64 {
+			if !(image.Point{x, y}.In(m.Rect)) {
+				return 0.0
+			}
+			return float64(m.Pix[m.PixOffset(x, y)+3]) / 255.0
+		}
+	case *image.NRGBA64:
+		return func(x, y int) float64 {
+			if !(image.Point{x, y}.In(m.Rect)) {
+				return 0.0
+			}
+			i := m.PixOffset(x, y) + 6
+			return float64(uint16(m.Pix[i])<<8|uint16(m.Pix[i+1])) / 65535.0
+		}
+	}
+	return func(x, y int) float64 {
+		clr := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+		return float64(clr.A) / 65535.0
+	}
+}
+
+// forEachRow invokes a function on each row of an image's bounds.  Rows are
+// processed concurrently by a fixed pool of goroutines, sized by any worker
+// limit carried by ctx.  It stops early and returns the context's error if
+// ctx is canceled.
+func forEachRow(ctx context.Context, bnds image.Rectangle, fn func(y int)) error {
+	nWorkers := workerCount(ctx)
+	if nWorkers > bnds.Dy() {
+		nWorkers = bnds.Dy()
+	}
+	sem := workerSemaphore(ctx)
+	next := int64(bnds.Min.Y)
 	var wg sync.WaitGroup
-	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
-		// Concurrently process all rows
+	for i := 0; i < nWorkers; i++ {
+		// Each worker repeatedly claims the next unprocessed row.  The
+		// semaphore, if any, additionally limits the number of rows
+		// in flight across all concurrent callers that share ctx.
 		wg.Add(1)
-		go func(y int) {
+		go func() {
 			defer wg.Done()
-			for x := bnds.Min.X; x < bnds.Max.X; x++ {
-				clr, _ := colorful.MakeColor(img.At(x, y))
-				for i, f := range fn(clr) {
-					grays[i].Set(x, y, toGrayVal(f))
+			for ctx.Err() == nil {
+				y := int(atomic.AddInt64(&next, 1) - 1)
+				if y >= bnds.Max.Y {
+					return
+				}
+				if sem != nil {
+					sem <- struct{}{}
+				}
+				fn(y)
+				if sem != nil {
+					<-sem
 				}
 			}
-		}(y)
+		}()
 	}
 	wg.Wait()
+	return ctx.Err()
+}
+
+// splitAny is a helper function for the various Split* functions.  It performs
+// all the boilerplate code, invoking a color space-specific function for each
+// pixel.  It stops early and returns the context's error if ctx is canceled.
+func splitAny(ctx context.Context, img image.Image, names []string,
+	fn func(colorful.Color) []float64) ([]ImageInfo, error) {
+	bnds := img.Bounds()
+	grays := allocGrays(bnds, len(names))
+	colorAt := colorAtFunc(img)
+	meter := progressFrom(ctx)
+	meter.Expect(bnds.Dy())
+	err := forEachRow(ctx, bnds, func(y int) {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			for i, f := range fn(colorAt(x, y)) {
+				grays[i].SetFloat(x, y, f)
+			}
+		}
+		meter.Step()
+	})
+	if err != nil {
+		return nil, err
+	}
 	result := make([]ImageInfo, len(names))
 	for i, nm := range names {
 		result[i].Name = nm
 		result[i].Image = grays[i]
 	}
-	return result
+	return result, nil
 }
 
-// SplitHCL splits a color image into separate H, C, and L channels.
-func SplitHCL(img image.Image, wref [3]float64) []ImageInfo {
-	return splitAny(img, []string{"H", "C", "L"},
-		func(clr colorful.Color) []float64 {
-			h, c, l := clr.HclWhiteRef(wref)
-			return []float64{h / 360.0, c, l}
-		})
+// splitKernel returns the channel names for a given color space and a
+// function that maps a color to the values of those channels.  wref is used
+// only by color spaces that require a white reference point.
+func splitKernel(cs string, wref [3]float64) ([]string, func(colorful.Color) []float64) {
+	switch cs {
+	case "hcl":
+		return []string{"H", "C", "L"},
+			func(clr colorful.Color) []float64 {
+				v := channels.ToHCLWhiteRef(clr, wref)
+				return v[:]
+			}
+	case "lab":
+		return []string{"L", "a", "b"},
+			func(clr colorful.Color) []float64 {
+				v := channels.ToLabWhiteRef(clr, wref)
+				return v[:]
+			}
+	case "luv":
+		return []string{"L", "u", "v"},
+			func(clr colorful.Color) []float64 {
+				v := channels.ToLuvWhiteRef(clr, wref)
+				return v[:]
+			}
+	case "xyy":
+		return []string{"x", "y", "YY"},
+			func(clr colorful.Color) []float64 {
+				v := channels.ToXyy(clr)
+				return v[:]
+			}
+	case "hsl":
+		return []string{"H", "S", "L"},
+			func(clr colorful.Color) []float64 {
+				v := channels.ToHSL(clr)
+				return v[:]
+			}
+	case "hsluv":
+		return []string{"H", "S", "L"},
+			func(clr colorful.Color) []float64 {
+				v := channels.ToHSLuv(clr)
+				return v[:]
+			}
+	case "linrgb":
+		return []string{"R", "G", "B"},
+			func(clr colorful.Color) []float64 {
+				v := channels.ToLinRGB(clr)
+				return v[:]
+			}
+	case "rgb":
+		return []string{"R", "G", "B"},
+			func(clr colorful.Color) []float64 {
+				v := channels.ToRGB(clr)
+				return v[:]
+			}
+	case "srgb":
+		return []string{"R", "G", "B"},
+			func(clr colorful.Color) []float64 {
+				v := channels.ToSRGB(clr)
+				return v[:]
+			}
+	case "cmyk":
+		return []string{"C", "M", "Y", "K"},
+			func(clr colorful.Color) []float64 {
+				v := channels.ToCMYK(clr)
+				return v[:]
+			}
+	case "ycbcr":
+		return []string{"Y", "Cb", "Cr"},
+			func(clr colorful.Color) []float64 {
+				v := channels.ToYCbCr(clr)
+				return v[:]
+			}
+	case "xyz":
+		return []string{"X", "Y", "Z"},
+			func(clr colorful.Color) []float64 {
+				v := channels.ToXYZ(clr)
+				return v[:]
+			}
+	default:
+		panic("Internal error: unimplemented color space")
+	}
 }
 
-// SplitLab splits a color image into separate L*, a*, and b* channels.
-func SplitLab(img image.Image, wref [3]float64) []ImageInfo {
-	return splitAny(img, []string{"L", "a", "b"},
-		func(clr colorful.Color) []float64 {
-			l, a, b := clr.LabWhiteRef(wref)
-			return []float64{l, (a + 1.0) / 2.0, (b + 1.0) / 2.0}
-		})
+// ExtractAlpha extracts an image's alpha channel and returns it as an
+// ImageInfo.  The alpha channel of a floating-point image is not quantized.
+// It returns the context's error if ctx is canceled.
+func ExtractAlpha(ctx context.Context, img image.Image) (ImageInfo, error) {
+	bnds := img.Bounds()
+	gray := NewGray32f(bnds)
+	alphaAt := alphaAtFunc(img)
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return ImageInfo{}, err
+		}
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			gray.SetFloat(x, y, alphaAt(x, y))
+		}
+	}
+	return ImageInfo{
+		Name:  "alpha",
+		Image: gray,
+	}, nil
 }
 
-// SplitLuv splits a color image into separate L*, u*, and v* channels.
-func SplitLuv(img image.Image, wref [3]float64) []ImageInfo {
-	return splitAny(img, []string{"L", "u", "v"},
-		func(clr colorful.Color) []float64 {
-			l, u, v := clr.LuvWhiteRef(wref)
-			return []float64{l, (u + 1.0) / 2.0, (v + 1.0) / 2.0}
-		})
-}
+// performImageSplit is a helper function for splitImage that splits an image
+// into the channels of the requested color space.
+func performImageSplit(ctx context.Context, p *Parameters, inImg image.Image) ([]ImageInfo, error) {
+	names, fn := paramsSplitKernel(p)
+	if p.Channels == nil {
+		if ms, be := matrixSpaceFor(p), paramsBackend(p); ms != nil && be != nil {
+			return splitMatrix(ctx, inImg, names, ms, be)
+		}
+		return splitAny(ctx, inImg, names, fn)
+	}
 
-// SplitXyy splits a color image into separate x, y, and Y channels.  The name
-// of the output file for the Y channel replaces "%s" with "YY" rather than "Y"
-// in case the filesystem is case-insensitive.
-func SplitXyy(img image.Image) []ImageInfo {
-	return splitAny(img, []string{"x", "y", "YY"},
-		func(clr colorful.Color) []float64 {
-			x, y, Y := clr.Xyy()
-			return []float64{x, y, Y}
-		})
+	// Compute only the requested channels.
+	var keep []int
+	var kept []string
+	for i, nm := range names {
+		if channelWanted(p, nm) {
+			keep = append(keep, i)
+			kept = append(kept, nm)
+		}
+	}
+	if len(keep) == 0 {
+		return nil, nil
+	}
+	return splitAny(ctx, inImg, kept, func(clr colorful.Color) []float64 {
+		vs := fn(clr)
+		sel := make([]float64, len(keep))
+		for j, i := range keep {
+			sel[j] = vs[i]
+		}
+		return sel
+	})
 }
 
-// SplitHSL splits a color image into separate H, S, and L channels.
-func SplitHSL(img image.Image) []ImageInfo {
-	return splitAny(img, []string{"H", "S", "L"},
-		func(clr colorful.Color) []float64 {
-			h, s, l := clr.Hsl()
-			return []float64{h / 360.0, s, l}
-		})
+// paramsSplitKernel returns splitKernel's channel names and conversion
+// function for the color space specified by a set of parameters, honoring
+// any parameters specific to the color space: the black-generation curve for
+// CMYK, the matrix for Y'CbCr, the exact hues and unquantized samples of
+// --lossless, and the chromatic adaptation transform for the color spaces
+// that take a white point.
+func paramsSplitKernel(p *Parameters) ([]string, func(colorful.Color) []float64) {
+	names, fn := splitKernel(p.ColorSpace, p.WhitePoint)
+	switch {
+	case p.ColorSpace == "cmyk" && p.BlackGen != nil:
+		bg := *p.BlackGen
+		fn = func(clr colorful.Color) []float64 {
+			v := toCMYKBlackGen(clr, bg)
+			return v[:]
+		}
+	case p.ColorSpace == "ycbcr" && p.YCbCrMatrix != "" && p.YCbCrMatrix != "bt601":
+		m := ycbcrMatrices[p.YCbCrMatrix]
+		fn = func(clr colorful.Color) []float64 {
+			v := toYCbCrMatrix(clr, m)
+			return v[:]
+		}
+	case p.Lossless && losslessSplitKernel(p.ColorSpace, p.WhitePoint) != nil:
+		fn = losslessSplitKernel(p.ColorSpace, p.WhitePoint)
+	}
+	return names, adaptSplitKernel(p, p.ColorSpace, fn)
 }
 
-// SplitHSLuv splits a color image into separate H, S, and L channels.
-func SplitHSLuv(img image.Image) []ImageInfo {
-	return splitAny(img, []string{"H", "S", "L"},
-		func(clr colorful.Color) []float64 {
-			h, s, l := clr.HSLuv()
-			return []float64{h / 360.0, s, l}
-		})
+// channelWanted reports whether a channel with a given name should be split.
+func channelWanted(p *Parameters, name string) bool {
+	if p.Channels == nil {
+		return true
+	}
+	for _, nm := range p.Channels {
+		if nm == name {
+			return true
+		}
+	}
+	return false
 }
 
-// SplitLinRGB splits a color image into separate R, G, and B channels.
-func SplitLinRGB(img image.Image) []ImageInfo {
-	return splitAny(img, []string{"R", "G", "B"},
-		func(clr colorful.Color) []float64 {
-			r, g, b := clr.LinearRgb()
-			return []float64{r, g, b}
-		})
-}
+// splitImage splits an image into separate channel images as directed by a
+// set of parameters.  It returns the context's error if ctx is canceled and
+// aborts on any other error.
+func splitImage(ctx context.Context, p *Parameters) error {
+	ctx = withWorkers(ctx, p.Workers)
+	// Ensure we have at least one input file and an output-file template
+	// that distinguishes the outputs of multiple input files.
+	if len(p.InputNames) == 0 {
+		notify.Fatal("Expected at least 1 input file but saw 0")
+	}
+	if p.OutputName == "" {
+		notify.Fatal("An output-file template must be specified when --split is used")
+	}
+	if len(p.InputNames) > 1 {
+		if !namesInputs(p.OutputName) {
+			notify.Fatalf(`With multiple input files, the output file must contain a basename ("%%b")`)
+		}
+		if p.Montage != "" && !namesInputs(p.Montage) {
+			notify.Fatalf(`With multiple input files, the --montage file must contain a basename ("%%b")`)
+		}
+		if p.Manifest != "" && !hasBaseVerb(p.Manifest) {
+			notify.Fatalf(`With multiple input files, the --manifest file must contain a basename ("%%b")`)
+		}
+		if p.ClipMask != "" && !hasBaseVerb(p.ClipMask) {
+			notify.Fatalf(`With multiple input files, the --clip-mask file must contain a basename ("%%b")`)
+		}
+	}
 
-// SplitRGB splits a color image into separate R, G, and B channels.
-func SplitRGB(img image.Image) []ImageInfo {
-	return splitAny(img, []string{"R", "G", "B"},
-		func(clr colorful.Color) []float64 {
-			ri, gi, bi := clr.RGB255()
-			r := float64(ri) / 255.0
-			g := float64(gi) / 255.0
-			b := float64(bi) / 255.0
-			return []float64{r, g, b}
-		})
+	// Split each input file in turn.  Percent signs in a base name are
+	// escaped in a "%s" output-file template to survive its later
+	// expansion.
+	for _, fn := range p.InputNames {
+		var times *stageTimes
+		if p.Times != nil {
+			times = new(stageTimes)
+		}
+		q := *p
+		q.InputNames = []string{fn}
+		base := baseName(fn)
+		q.Montage = expandBase(p.Montage, base)
+		q.Manifest = expandBase(p.Manifest, base)
+		q.ClipMask = expandBase(p.ClipMask, base)
+		q.Clip = new(clipStats)
+		q.Times = times
+		if !isNameTemplate(p.OutputName) {
+			base = strings.ReplaceAll(base, "%", "%%")
+		}
+		q.OutputName = expandBase(p.OutputName, base)
+		fctx, meter := withProgress(ctx, &q, fn)
+		err := splitFile(fctx, &q)
+		if err != nil {
+			return err
+		}
+		meter.Finish()
+		reportClipping(&q, fn)
+		reportTimings(&q, fn)
+		p.Times.Add(times)
+	}
+	if len(p.InputNames) > 1 {
+		reportTimings(p, fmt.Sprintf("All %d files", len(p.InputNames)))
+	}
+	return nil
 }
 
-// SplitSRGB splits a color image into separate R, G, and B channels.
-func SplitSRGB(img image.Image) []ImageInfo {
-	return splitAny(img, []string{"R", "G", "B"},
-		func(clr colorful.Color) []float64 {
-			return []float64{clr.R, clr.G, clr.B}
-		})
+// splitFile is a helper function for splitImage that splits a single input
+// file, which may represent an image sequence or an animation.
+func splitFile(ctx context.Context, p *Parameters) error {
+	// Ensure the output file contains a "%s" unless all channels are to
+	// be bundled into a single file or written to the standard output
+	// device.
+	bundle := outputFormats[selectOutputFormat(p.OutputName, p.Format)].Bundle != nil
+	toStdout := p.OutputName == "-"
+	if !bundle && !toStdout && !namesChannels(p.OutputName) {
+		notify.Fatalf(`With --split, the output file must contain "%%s" or "{{.Channel}}" (or be "-" for the standard output device)`)
+	}
+	if toStdout && selectOutputFormat(p.OutputName, p.Format) == "y4m" {
+		notify.Fatal("y4m channel streams cannot be written to the standard output device")
+	}
+	if p.Manifest != "" && (bundle || toStdout || hasFrameVerb(p.OutputName) || isSequence(p.InputNames[0])) {
+		notify.Fatal("--manifest requires a single image or animation to be split into one file per channel")
+	}
+	if p.Manifest != "" && (p.Visualize || p.HueWheel || p.Colormap != "") {
+		notify.Fatal("--manifest cannot describe channels rendered with --visualize, --hue-wheel, or --colormap")
+	}
+	if (p.Visualize || p.HueWheel || p.Colormap != "") && (bundle || selectOutputFormat(p.OutputName, p.Format) == "y4m") {
+		notify.Fatal("--visualize, --hue-wheel, and --colormap require an output format that stores each channel in a separate image file")
+	}
+
+	// Split each file of an image sequence in turn.
+	if isSequence(p.InputNames[0]) {
+		return splitSequence(ctx, p)
+	}
+
+	// Split a PNG file one band of rows at a time.
+	if p.Stream {
+		return splitBands(ctx, p)
+	}
+
+	// Stream y4m input to per-channel y4m output.
+	if isY4MFile(p.InputNames[0]) && !hasFrameVerb(p.OutputName) &&
+		selectOutputFormat(p.OutputName, p.Format) == "y4m" {
+		return splitY4M(ctx, p)
+	}
+
+	// Copy an image read from the standard input device to a temporary
+	// file, which, unlike a pipe, can be read more than once.
+	if p.InputNames[0] == "-" {
+		fn, remove := spoolStdin()
+		defer remove()
+		p.InputNames = []string{fn}
+	}
+
+	// Read the input image and any geo-referencing information it
+	// contains.  Animated inputs are split one frame at a time.
+	start := time.Now()
+	p.GeoTags = ReadGeoTags(p.InputNames[0])
+	if anim := ReadAnimation(p.InputNames[0]); anim != nil {
+		p.Times.Since(stageDecode, start)
+		return splitAnimation(ctx, p, anim)
+	}
+	inImg := readColorImage(p, p.InputNames[0])
+	p.Times.Since(stageDecode, start)
+
+	// Split the input image into multiple grayscale images.
+	start = time.Now()
+	outImgs, err := splitFrame(ctx, p, inImg)
+	if err != nil {
+		return err
+	}
+	p.Times.Since(stageConvert, start)
+
+	// Write the channels and, if requested, a contact sheet.
+	start = time.Now()
+	files := writeChannels(p, p.OutputName, outImgs)
+	if p.Montage != "" {
+		writeMontage(p, p.Montage, outImgs)
+	}
+	if p.Manifest != "" {
+		writeManifest(p, outImgs, files)
+	}
+	p.Times.Since(stageEncode, start)
+	releaseChannels(outImgs)
+	return nil
 }
 
-// SplitCMYK splits a color image into separate C, M, Y, and K channels.
-func SplitCMYK(img image.Image) []ImageInfo {
-	return splitAny(img, []string{"C", "M", "Y", "K"},
-		func(clr colorful.Color) []float64 {
-			ri, gi, bi := clr.RGB255()
-			ci, mi, yi, ki := color.RGBToCMYK(ri, gi, bi)
-			c := float64(ci) / 255.0
-			m := float64(mi) / 255.0
-			y := float64(yi) / 255.0
-			k := float64(ki) / 255.0
-			return []float64{c, m, y, k}
-		})
+// applyKeepAlpha requests an alpha channel if so directed by p.KeepAlpha and
+// any of the given images has a pixel that is not fully opaque.  The decision
+// is made only once so that all frames of an animation or image sequence
+// have the same channels.
+func applyKeepAlpha(p *Parameters, imgs ...image.Image) {
+	if !p.KeepAlpha {
+		return
+	}
+	p.KeepAlpha = false
+	for _, img := range imgs {
+		if !isOpaque(img) {
+			p.Alpha = true
+			return
+		}
+	}
 }
 
-// SplitYCbCr splits a color image into separate Y, Cb, and Cr channels.
-func SplitYCbCr(img image.Image) []ImageInfo {
-	return splitAny(img, []string{"Y", "Cb", "Cr"},
-		func(clr colorful.Color) []float64 {
-			ri, gi, bi := clr.RGB255()
-			yi, cbi, cri := color.RGBToYCbCr(ri, gi, bi)
-			y := float64(yi) / 255.0
-			cb := float64(cbi) / 255.0
-			cr := float64(cri) / 255.0
-			return []float64{y, cb, cr}
-		})
+// splitFrame is a helper function for splitImage that splits a single image,
+// including its alpha channel if requested and any additional channels the
+// image carries.
+func splitFrame(ctx context.Context, p *Parameters, inImg image.Image) ([]ImageInfo, error) {
+	src := inImg
+	if p.Premultiplied {
+		var err error
+		src, err = Unpremultiply(ctx, src)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.Lossless && !p.Premultiplied {
+		var err error
+		src, err = straightImage(ctx, src)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.Opaque {
+		var err error
+		src, err = Flatten(ctx, src, paramsBackground(p))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.LUT3D != nil {
+		var err error
+		src, err = ApplyLUT3D(ctx, src, p.LUT3D)
+		if err != nil {
+			return nil, err
+		}
+	}
+	applyAutoWhite(p, src)
+	applyKeepAlpha(p, src)
+	outImgs, err := performImageSplit(ctx, p, src)
+	if err != nil {
+		return nil, err
+	}
+	applySplitLog(p, outImgs)
+	applySplitRanges(p, outImgs)
+	if p.Alpha && channelWanted(p, "alpha") {
+		alpha, err := ExtractAlpha(ctx, src)
+		if err != nil {
+			return nil, err
+		}
+		outImgs = append(outImgs, alpha)
+	}
+	// Append any additional channels stored in the input file (e.g., PSD
+	// alpha and spot channels), renaming those that would collide with
+	// another channel's name.
+	if ex, ok := inImg.(interface{ ExtraChannels() []ImageInfo }); ok {
+		used := make(map[string]bool, len(outImgs))
+		for _, info := range outImgs {
+			used[info.Name] = true
+		}
+		for _, info := range ex.ExtraChannels() {
+			name := info.Name
+			for i := 2; used[name]; i++ {
+				name = fmt.Sprintf("%s-%d", info.Name, i)
+			}
+			used[name] = true
+			if channelWanted(p, name) {
+				outImgs = append(outImgs, ImageInfo{Name: name, Image: info.Image})
+			}
+		}
+	}
+
+	// Ensure that every requested channel was produced.
+	for _, nm := range p.Channels {
+		found := false
+		for _, info := range outImgs {
+			if info.Name == nm {
+				found = true
+				break
+			}
+		}
+		if !found {
+			names, _ := splitKernel(p.ColorSpace, p.WhitePoint)
+			if p.Alpha {
+				names = append(names, "alpha")
+			}
+			notify.Fatalf("--channels requires channels from %s for --space=%q (not %q)",
+				strings.Join(names, ", "), p.OrigColorSpace, nm)
+		}
+	}
+	applySplitLUTs(p, outImgs)
+	var mask *image.Gray
+	if p.VisibleOnly {
+		mask = transparentMask(src)
+	}
+	applySplitAutoTone(p, outImgs, mask)
+	encodeGamma(p, outImgs)
+	countSplitClipping(p, outImgs, mask)
+	subsampleChroma(p, outImgs)
+	return encodeSigned(p, outImgs), nil
 }
 
-// SplitXYZ splits a color image into separate X, Y, and Z channels.
-func SplitXYZ(img image.Image) []ImageInfo {
-	return splitAny(img, []string{"X", "Y", "Z"},
-		func(clr colorful.Color) []float64 {
-			x, y, z := clr.Xyz()
-			return []float64{x, y, z}
-		})
+// paramsOutputFormat returns the format in which split channels or a merged
+// image will be written as directed by a set of parameters.
+func paramsOutputFormat(p *Parameters) outputFormat {
+	tmpl := p.OutputName
+	if tmpl == "-" {
+		tmpl = ""
+	}
+	return outputFormats[selectOutputFormat(tmpl, p.Format)]
 }
 
-// ExtractAlpha extracts an image's alpha channel and returns it as an
-// ImageInfo.
-func ExtractAlpha(img image.Image) ImageInfo {
-	bnds := img.Bounds()
-	gray := image.NewGray16(bnds)
-	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
-		for x := bnds.Min.X; x < bnds.Max.X; x++ {
-			clr := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
-			gray.SetGray16(x, y, color.Gray16{Y: clr.A})
+// writeChannels is a helper function for splitImage that writes a set of
+// split channels to files named by a given template.  It returns the names of
+// the files written or nil if the channels were not written to separate
+// files.
+func writeChannels(p *Parameters, tmpl string, outImgs []ImageInfo) []string {
+	// Write all channels to a single file if the output format supports
+	// that.  In this case, any "%s" in the filename is replaced with the
+	// color-space name, and "-" designates the standard output device.
+	if outputFormats[selectOutputFormat(tmpl, p.Format)].Bundle != nil {
+		name := strings.ReplaceAll(tmpl, "%s", p.ColorSpace)
+		if isNameTemplate(tmpl) {
+			name = expandNameTemplate(p, tmpl, 0, p.ColorSpace)
 		}
+		if name == "-" {
+			name = ""
+		}
+		err := WriteBundle(p, name, outImgs)
+		if err != nil {
+			notify.Fatal(err)
+		}
+		return nil
 	}
-	return ImageInfo{
-		Name:  "alpha",
-		Image: gray,
+
+	// Write all channels to the standard output device as a tar stream if
+	// the output file is "-".
+	if tmpl == "-" {
+		err := writeTar(os.Stdout, p, outImgs)
+		if err != nil {
+			notify.Fatal(err)
+		}
+		return nil
 	}
-}
 
-// performImageSplit is a helper function for SplitImage that invokes
-// the appropriate image-splitting function.
-func performImageSplit(p *Parameters, inImg image.Image) []ImageInfo {
-	var outImgs []ImageInfo
-	switch p.ColorSpace {
-	case "cmyk":
-		outImgs = SplitCMYK(inImg)
-	case "hcl":
-		outImgs = SplitHCL(inImg, p.WhitePoint)
-	case "hsl":
-		outImgs = SplitHSL(inImg)
-	case "hsluv":
-		outImgs = SplitHSLuv(inImg)
-	case "lab":
-		outImgs = SplitLab(inImg, p.WhitePoint)
-	case "linrgb":
-		outImgs = SplitLinRGB(inImg)
-	case "luv":
-		outImgs = SplitLuv(inImg, p.WhitePoint)
-	case "rgb":
-		outImgs = SplitRGB(inImg)
-	case "srgb":
-		outImgs = SplitSRGB(inImg)
-	case "xyy":
-		outImgs = SplitXyy(inImg)
-	case "xyz":
-		outImgs = SplitXYZ(inImg)
-	case "ycbcr":
-		outImgs = SplitYCbCr(inImg)
-	default:
-		panic("Internal error: unimplemented color space")
+	// Write each channel to a separate file.
+	names := channelFileNames(p, tmpl, outImgs)
+	for i, info := range outImgs {
+		err := writeAnnotatedImage(p, names[i], renderChannel(p, info), channelText(info))
+		if err != nil {
+			notify.Fatal(err)
+		}
 	}
-	return outImgs
+	return names
 }
 
-// SplitImage splits an image into separate channel images.  It aborts on error.
-func SplitImage(p *Parameters) {
-	// Ensure we have exactly one input file.
-	if len(p.InputNames) != 1 {
-		notify.Fatalf("Expected 1 input file but saw %d", len(p.InputNames))
+// splitAnimation is a helper function for splitImage that splits each frame
+// of an animation.  If the output-file template contains a frame number
+// (e.g., "%04d"), each frame's channels are written to separate files.
+// Otherwise, each channel is written as an animation.
+func splitAnimation(ctx context.Context, p *Parameters, anim *Animation) error {
+	if p.OutputName == "-" {
+		notify.Fatal("Animated input cannot be split to the standard output device")
 	}
 
-	// Ensure the output file contains a "%s".
-	if p.OutputName == "" {
-		notify.Fatal("An output-file template must be specified when --split is used")
+	// Split each frame in turn.  All frames have an alpha channel if any
+	// frame does.
+	applyKeepAlpha(p, anim.Frames...)
+	start := time.Now()
+	frameSets := make([][]ImageInfo, len(anim.Frames))
+	for i, fr := range anim.Frames {
+		var err error
+		frameSets[i], err = splitFrame(ctx, p, fr)
+		if err != nil {
+			return err
+		}
 	}
-	if !strings.Contains(p.OutputName, "%s") {
-		notify.Fatalf(`With --split, the output file must contain "%%s"`)
+	p.Times.Since(stageConvert, start)
+	defer p.Times.Since(stageEncode, time.Now())
+
+	// Write a contact sheet of the first frame if so requested.
+	if p.Montage != "" && len(frameSets) > 0 {
+		writeMontage(p, p.Montage, frameSets[0])
 	}
 
-	// Read the input image.
-	inImg := ReadImage(p.InputNames[0])
+	// Write one set of files per frame if so requested.
+	if hasFrameVerb(p.OutputName) {
+		for i, outImgs := range frameSets {
+			writeChannels(p, expandFrame(p.OutputName, i), outImgs)
+		}
+		return nil
+	}
 
-	// Split the input image into multiple grayscale images.
-	outImgs := performImageSplit(p, inImg)
+	// Write one animation per channel.
+	of := outputFormats[selectOutputFormat(p.OutputName, p.Format)]
+	if of.Animate == nil {
+		notify.Fatal(`Animated input requires either a frame number (e.g., "%04d") in the output-file template or GIF or PNG output`)
+	}
+	names := channelFileNames(p, p.OutputName, frameSets[0])
+	for c := range frameSets[0] {
+		chAnim := &Animation{Delays: anim.Delays, Plays: anim.Plays}
+		for _, outImgs := range frameSets {
+			chAnim.Frames = append(chAnim.Frames, renderChannel(p, outImgs[c]))
+		}
+		err := WriteAnimation(p, names[c], chAnim)
+		if err != nil {
+			notify.Fatal(err)
+		}
+	}
+	if p.Manifest != "" {
+		if p.AutoTone != nil {
+			notify.Fatal("--manifest cannot record per-frame --equalize or --auto-contrast curves for animated input")
+		}
+		writeManifest(p, frameSets[0], names)
+	}
+	return nil
+}
 
-	// Optionally include an alpha channel.
-	if p.Alpha {
-		outImgs = append(outImgs, ExtractAlpha(inImg))
+// splitSequence is a helper function for splitImage that splits each file of
+// an image sequence.  The output-file template must contain a frame number,
+// which is replaced by the input file's frame number.
+func splitSequence(ctx context.Context, p *Parameters) error {
+	if !hasFrameVerb(p.OutputName) {
+		notify.Fatal(`With an image-sequence input, the output file must contain a frame number (e.g., "%05d")`)
 	}
+	for _, n := range sequenceFrames(p.InputNames[0]) {
+		fn := expandFrame(p.InputNames[0], n)
+		p.GeoTags = ReadGeoTags(fn)
+		outImgs, err := splitFrame(ctx, p, readColorImage(p, fn))
+		if err != nil {
+			return err
+		}
+		writeChannels(p, expandFrame(p.OutputName, n), outImgs)
+		if p.Montage != "" {
+			writeMontage(p, expandFrame(p.Montage, n), outImgs)
+		}
+		releaseChannels(outImgs)
+	}
+	return nil
+}
 
-	// Write each channel to a separate grayscale file.
-	for _, info := range outImgs {
-		name := fmt.Sprintf(p.OutputName, info.Name)
-		WritePNG(name, info.Image)
+// splitY4M is a helper function for splitImage that splits a y4m stream into
+// one monochrome y4m stream per channel, one frame at a time.
+func splitY4M(ctx context.Context, p *Parameters) error {
+	yr, rc := OpenY4M(p.InputNames[0])
+	defer rc.Close()
+	var yws []*Y4MWriter
+	for {
+		fr, err := yr.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			notify.Fatalf("%s: %s", p.InputNames[0], err)
+		}
+		outImgs, err := splitFrame(ctx, p, fr)
+		if err != nil {
+			return err
+		}
+		if yws == nil {
+			for _, fn := range channelFileNames(p, p.OutputName, outImgs) {
+				yw, wc := CreateY4M(fn, yr.Header.Extra)
+				defer wc.Close()
+				yws = append(yws, yw)
+			}
+		}
+		for i, info := range outImgs {
+			err = yws[i].WriteFrame(info.Image)
+			if err != nil {
+				notify.Fatal(err)
+			}
+		}
+		releaseChannels(outImgs)
+	}
+	for _, yw := range yws {
+		err := yw.Flush()
+		if err != nil {
+			notify.Fatal(err)
+		}
 	}
+	return nil
 }
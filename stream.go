@@ -0,0 +1,167 @@
+// This file provides types that split and merge images one row at a time.
+// The WebAssembly build uses these so that JavaScript callers that decode or
+// encode images incrementally need not hold entire channel planes in memory.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// A splitter splits color pixels into channel values one row at a time.
+// Rows are written with WriteRow and the corresponding channel rows are
+// retrieved, in the same order, with Next.
+type splitter struct {
+	names   []string                       // Channel names
+	fn      func(colorful.Color) []float64 // Per-pixel split function
+	alpha   bool                           // true: also output alpha
+	width   int                            // Row width in pixels
+	pending [][][]float32                  // Split rows not yet retrieved
+}
+
+// newSplitter returns a splitter for rows of a given width.  The options
+// withColorSpace and withWhitePoint determine the channels to produce.
+func newSplitter(width int, opts ...option) (*splitter, error) {
+	p, err := newParameters(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if width <= 0 {
+		return nil, fmt.Errorf("invalid row width (%d)", width)
+	}
+	s := &splitter{alpha: p.Alpha, width: width}
+	s.names, s.fn = paramsSplitKernel(p)
+	if s.alpha {
+		s.names = append(s.names, "alpha")
+	}
+	return s, nil
+}
+
+// Channels returns the names of the channels the splitter produces, in the
+// order in which Next returns them.
+func (s *splitter) Channels() []string {
+	return append([]string(nil), s.names...)
+}
+
+// WriteRow splits a row of pixels.  The row contains non-premultiplied R, G,
+// B, and A values for each pixel, laid out as in NRGBA32f.Pix.
+func (s *splitter) WriteRow(row []float32) error {
+	if len(row) != 4*s.width {
+		return fmt.Errorf("expected a row of %d values but saw %d", 4*s.width, len(row))
+	}
+	out := make([][]float32, len(s.names))
+	for c := range out {
+		out[c] = make([]float32, s.width)
+	}
+	for x := 0; x < s.width; x++ {
+		px := row[4*x : 4*x+4]
+		clr := colorful.Color{R: float64(px[0]), G: float64(px[1]), B: float64(px[2])}
+		for c, v := range s.fn(clr) {
+			out[c][x] = float32(v)
+		}
+		if s.alpha {
+			out[len(out)-1][x] = px[3]
+		}
+	}
+	s.pending = append(s.pending, out)
+	return nil
+}
+
+// Next returns one row of values per channel for the oldest row written but
+// not yet retrieved.  It returns false if no such row remains.
+func (s *splitter) Next() ([][]float32, bool) {
+	if len(s.pending) == 0 {
+		return nil, false
+	}
+	out := s.pending[0]
+	s.pending[0] = nil
+	s.pending = s.pending[1:]
+	return out, true
+}
+
+// A merger merges channel values into color pixels one row at a time.  Rows
+// are written with WriteRow and the corresponding merged rows are retrieved,
+// in the same order, with Next.
+type merger struct {
+	nColor  int                              // Number of color channels
+	fn      func(v []float64) colorful.Color // Per-pixel merge function
+	alpha   bool                             // true: also expect alpha
+	width   int                              // Row width in pixels
+	pending [][]float32                      // Merged rows not yet retrieved
+}
+
+// newMerger returns a merger for rows of a given width.  The options
+// withColorSpace and withWhitePoint determine the channels to expect.
+func newMerger(width int, opts ...option) (*merger, error) {
+	p, err := newParameters(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if width <= 0 {
+		return nil, fmt.Errorf("invalid row width (%d)", width)
+	}
+	return &merger{
+		nColor: colorChannelCount(p.ColorSpace),
+		fn:     paramsMergeKernel(p),
+		alpha:  p.Alpha,
+		width:  width,
+	}, nil
+}
+
+// Channels returns the number of channel rows WriteRow expects, including
+// alpha if requested.
+func (m *merger) Channels() int {
+	if m.alpha {
+		return m.nColor + 1
+	}
+	return m.nColor
+}
+
+// WriteRow merges one row of values per channel.
+func (m *merger) WriteRow(rows [][]float32) error {
+	if len(rows) != m.Channels() {
+		return fmt.Errorf("expected %d channel rows but saw %d", m.Channels(), len(rows))
+	}
+	for _, r := range rows {
+		if len(r) != m.width {
+			return fmt.Errorf("expected a row of %d values but saw %d", m.width, len(r))
+		}
+	}
+	out := make([]float32, 4*m.width)
+	v := make([]float64, m.nColor)
+	for x := 0; x < m.width; x++ {
+		for c := range v {
+			v[c] = float64(rows[c][x])
+		}
+		clr := m.fn(v)
+		px := out[4*x : 4*x+4]
+		px[0], px[1], px[2], px[3] = float32(clr.R), float32(clr.G), float32(clr.B), 1.0
+		if m.alpha {
+			a := rows[m.nColor][x]
+			switch {
+			case a < 0.0:
+				a = 0.0
+			case a > 1.0:
+				a = 1.0
+			}
+			px[3] = a
+		}
+	}
+	m.pending = append(m.pending, out)
+	return nil
+}
+
+// Next returns the oldest merged row not yet retrieved.  The row contains
+// non-premultiplied R, G, B, and A values for each pixel, laid out as in
+// NRGBA32f.Pix.  Next returns false if no such row remains.
+func (m *merger) Next() ([]float32, bool) {
+	if len(m.pending) == 0 {
+		return nil, false
+	}
+	out := m.pending[0]
+	m.pending[0] = nil
+	m.pending = m.pending[1:]
+	return out, true
+}
@@ -0,0 +1,201 @@
+// This file provides support for chroma subsampling, which writes the
+// chroma channels of a split image at reduced resolution, as video codecs do,
+// and restores their resolution when merging.
+
+package main
+
+import (
+	"image"
+)
+
+// subsampleTextKey is the keyword of the PNG tEXt chunk in which a split
+// channel's chroma subsampling is recorded.
+const subsampleTextKey = "color-channels:subsample"
+
+// subsampleFactors maps each valid argument to --subsample to the factors by
+// which chroma channels are reduced horizontally and vertically.
+var subsampleFactors = map[string]image.Point{
+	"4:4:4": {1, 1},
+	"4:2:2": {2, 1},
+	"4:2:0": {2, 2},
+}
+
+// chromaChannelNames maps a color space to the names of its chroma channels,
+// which --subsample reduces in resolution.
+var chromaChannelNames = map[string][]string{
+	"lab":   {"a", "b"},
+	"luv":   {"u", "v"},
+	"xyy":   {"x", "y"},
+	"ycbcr": {"Cb", "Cr"},
+}
+
+// parseSubsample validates the argument to --subsample for p's color space
+// and returns it.  It aborts on error.
+func parseSubsample(p *Parameters, arg string) string {
+	if _, ok := subsampleFactors[arg]; !ok {
+		notify.Fatalf(`--subsample requires one of "4:4:4", "4:2:2", or "4:2:0" (not %q)`, arg)
+	}
+	if _, ok := chromaChannelNames[p.ColorSpace]; !ok && arg != "4:4:4" {
+		notify.Fatalf("--subsample is not supported for --space=%q", p.OrigColorSpace)
+	}
+	return arg
+}
+
+// isChromaChannel reports whether the channel with a given index in p's
+// color space is a chroma channel.
+func isChromaChannel(p *Parameters, ch int) bool {
+	names := builtinChannelNames(p)
+	if ch < 0 || ch >= len(names) {
+		return false
+	}
+	for _, nm := range chromaChannelNames[p.ColorSpace] {
+		if nm == names[ch] {
+			return true
+		}
+	}
+	return false
+}
+
+// subsampleGray returns a Gray32f image reduced in size by given integer
+// factors, with each pixel the average of the corresponding block of pixels
+// in the original image.  Blocks at the right and bottom edges may be
+// partial.
+func subsampleGray(g *Gray32f, f image.Point) *Gray32f {
+	bnds := g.Bounds()
+	wd := (bnds.Dx() + f.X - 1) / f.X
+	ht := (bnds.Dy() + f.Y - 1) / f.Y
+	out := NewGray32f(image.Rect(bnds.Min.X, bnds.Min.Y, bnds.Min.X+wd, bnds.Min.Y+ht))
+	for j := 0; j < ht; j++ {
+		for i := 0; i < wd; i++ {
+			blk := image.Rect(i*f.X, j*f.Y, (i+1)*f.X, (j+1)*f.Y).Add(bnds.Min).Intersect(bnds)
+			sum := 0.0
+			for y := blk.Min.Y; y < blk.Max.Y; y++ {
+				for x := blk.Min.X; x < blk.Max.X; x++ {
+					sum += g.FloatAt(x, y)
+				}
+			}
+			out.SetFloat(bnds.Min.X+i, bnds.Min.Y+j, sum/float64(blk.Dx()*blk.Dy()))
+		}
+	}
+	return out
+}
+
+// subsampleChroma reduces in resolution each of a set of split channels that
+// is a chroma channel, as specified by p.Subsample, recording the
+// subsampling in the channel's ImageInfo.
+func subsampleChroma(p *Parameters, infos []ImageInfo) {
+	f := subsampleFactors[p.Subsample]
+	if f.X*f.Y <= 1 {
+		return
+	}
+	for i, info := range infos {
+		if ch, _ := signedBaseIndex(p, info.Name); isChromaChannel(p, ch) {
+			infos[i].Image = subsampleGray(info.Image, f)
+			infos[i].Subsample = p.Subsample
+		}
+	}
+}
+
+// maxChromaFactor is the largest factor by which upsampleChroma infers that
+// a chroma channel was subsampled, as by 4:1:1 subsampling.
+const maxChromaFactor = 4
+
+// inferChromaFactor returns the integer factor, from 1 to maxChromaFactor, by
+// which a dimension of n samples was reduced to produce m samples, rounding
+// up, or 0 if there is no such factor.
+func inferChromaFactor(n, m int) int {
+	for f := 1; f <= maxChromaFactor; f++ {
+		if (n+f-1)/f == m {
+			return f
+		}
+	}
+	return 0
+}
+
+// upsampleChroma returns a set of channels to merge, given in channel order
+// but omitting channels filled by --fill, with each subsampled chroma channel
+// resampled to the size of the other channels using the filter named by
+// p.UpsampleFilter.  Chroma channels are subsampled as specified by
+// p.Subsample or, if p.Subsample is empty, by whatever factors their size
+// implies, as with planes dumped from a video codec.  Chroma samples are
+// taken to lie at the centers of the blocks they represent.
+func upsampleChroma(p *Parameters, channels []*Gray32f) []*Gray32f {
+	given := subsampleFactors[p.Subsample]
+	if p.Subsample != "" && given.X*given.Y <= 1 {
+		return channels
+	}
+
+	// Determine which of the channels are chroma channels and the bounds
+	// of the full-resolution channels.
+	chroma := make([]bool, len(channels))
+	var full image.Rectangle
+	i := 0
+	for ch := range builtinChannelNames(p) {
+		if isFilled(p, ch) {
+			continue
+		}
+		if i >= len(channels) {
+			break
+		}
+		chroma[i] = isChromaChannel(p, ch)
+		if !chroma[i] && full.Empty() {
+			full = channels[i].Bounds()
+		}
+		i++
+	}
+	if p.Subsample == "" && full.Empty() {
+		return channels // Nothing against which to compare the chroma channels
+	}
+
+	// Resample each chroma channel to an integer multiple of its size and
+	// crop the result to the full-resolution bounds.
+	result := make([]*Gray32f, len(channels))
+	for i, g := range channels {
+		result[i] = g
+		if !chroma[i] {
+			continue
+		}
+		gb := g.Bounds()
+		f := given
+		if p.Subsample == "" {
+			f = image.Pt(inferChromaFactor(full.Dx(), gb.Dx()), inferChromaFactor(full.Dy(), gb.Dy()))
+			if f.X == 0 || f.Y == 0 || f.X*f.Y == 1 {
+				continue // Not subsampled or not subsampled by an integer factor
+			}
+		}
+		big := image.Rect(gb.Min.X, gb.Min.Y, gb.Min.X+gb.Dx()*f.X, gb.Min.Y+gb.Dy()*f.Y)
+		up := resampleGray(g, big, resampleKernels[p.UpsampleFilter])
+		if !full.Empty() && full != big {
+			up = regionGray(up, full, 0.0)
+		}
+		result[i] = up
+	}
+	return result
+}
+
+// readChannelSubsample sets p.Subsample from the chroma subsampling recorded
+// in a list of channel files to merge unless p.Subsample was already
+// specified by --subsample or a manifest.
+func readChannelSubsample(p *Parameters, fns []string) {
+	if p.Subsample != "" {
+		return
+	}
+	for _, fn := range fns {
+		if val, ok := readPNGText(fn)[subsampleTextKey]; ok {
+			if _, ok := subsampleFactors[val]; !ok {
+				notify.Fatalf("%s: Malformed %s text", fn, subsampleTextKey)
+			}
+			p.Subsample = val
+			return
+		}
+	}
+}
+
+// subsampleText returns the PNG text with which to record a channel's chroma
+// subsampling or nil if the channel was not subsampled.
+func subsampleText(sub string) map[string]string {
+	if sub == "" {
+		return nil
+	}
+	return map[string]string{subsampleTextKey: sub}
+}
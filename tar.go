@@ -0,0 +1,53 @@
+// This file provides support for writing split channels to the standard
+// output device as a tar stream so that splitting can run entirely within a
+// pipeline.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"time"
+)
+
+// writeTar writes a set of channel images as files within a tar archive.
+// Each file is named after its channel, as reported by outputChannelNames, and
+// encoded in the format given by p.Format or, if that is empty, the default
+// output format.
+func writeTar(w io.Writer, p *Parameters, infos []ImageInfo) error {
+	of := outputFormats[selectOutputFormat("", p.Format)]
+	ext := ""
+	if len(of.Exts) > 0 {
+		ext = of.Exts[0]
+	}
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	names := outputChannelNames(p, infos)
+	for i, info := range infos {
+		img, err := convertDepth(renderChannel(p, info), p, of)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		err = of.Encode(&buf, img, p)
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     names[i] + ext,
+			Mode:     0644,
+			Size:     int64(buf.Len()),
+			ModTime:  now,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,65 @@
+// This file measures and reports the time spent in each stage of splitting
+// and merging.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A stage is a phase of splitting or merging an image.
+type stage int
+
+// These are the stages of splitting or merging an image.
+const (
+	stageDecode  stage = iota // Reading and decoding input files
+	stageConvert              // Converting to or from a color space
+	stageEncode               // Encoding and writing output files
+	numStages
+)
+
+// stageNames names each stage for presentation to the user.
+var stageNames = [numStages]string{"decode", "convert", "encode"}
+
+// stageTimes accumulates the time spent in each stage.  All methods do
+// nothing when invoked on a nil *stageTimes.
+type stageTimes [numStages]time.Duration
+
+// Since adds to a stage the time elapsed since a given start time.
+func (st *stageTimes) Since(s stage, start time.Time) {
+	if st == nil {
+		return
+	}
+	st[s] += time.Since(start)
+}
+
+// Add adds another set of stage times to st.
+func (st *stageTimes) Add(other *stageTimes) {
+	if st == nil || other == nil {
+		return
+	}
+	for s, d := range other {
+		st[s] += d
+	}
+}
+
+// String formats the time spent in each stage and in total.
+func (st *stageTimes) String() string {
+	var msg string
+	var total time.Duration
+	for s, d := range st {
+		msg += fmt.Sprintf("%s %s, ", stageNames[s], d.Round(time.Millisecond))
+		total += d
+	}
+	return msg + fmt.Sprintf("total %s", total.Round(time.Millisecond))
+}
+
+// reportTimings reports the time recorded in p.Times, if any, prefixing the
+// report with a given label.
+func reportTimings(p *Parameters, label string) {
+	if p.Times == nil {
+		return
+	}
+	notify.Printf("%s: %s", label, p.Times)
+}
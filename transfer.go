@@ -0,0 +1,40 @@
+// This file provides table-driven versions of go-colorful's conversions
+// between sRGB and linear RGB or CIE XYZ.  Every such conversion otherwise
+// calls math.Pow once per component, which dominates the cost of splitting
+// and merging in those spaces.  The tables themselves are provided by the
+// channels package.
+
+package main
+
+import (
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/spakin/color-channels/channels"
+)
+
+// fastLinearRgb is equivalent to colorful.Color.LinearRgb but uses lookup
+// tables rather than math.Pow.
+func fastLinearRgb(c colorful.Color) (r, g, b float64) {
+	return channels.Linearize(c.R), channels.Linearize(c.G), channels.Linearize(c.B)
+}
+
+// fastFromLinearRgb is equivalent to colorful.LinearRgb but uses lookup tables
+// rather than math.Pow.
+func fastFromLinearRgb(r, g, b float64) colorful.Color {
+	return colorful.Color{
+		R: channels.Delinearize(r),
+		G: channels.Delinearize(g),
+		B: channels.Delinearize(b),
+	}
+}
+
+// fastXyz is equivalent to colorful.Color.Xyz but uses lookup tables rather
+// than math.Pow.
+func fastXyz(c colorful.Color) (x, y, z float64) {
+	return colorful.LinearRgbToXyz(fastLinearRgb(c))
+}
+
+// fastFromXyz is equivalent to colorful.Xyz but uses lookup tables rather
+// than math.Pow.
+func fastFromXyz(x, y, z float64) colorful.Color {
+	return fastFromLinearRgb(colorful.XyzToLinearRgb(x, y, z))
+}
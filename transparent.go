@@ -0,0 +1,81 @@
+// This file provides support for excluding fully transparent pixels from
+// image analysis.  Such pixels are often black, which skews statistics,
+// normalization, and histogram equalization toward black although no color is
+// ever visible there.
+
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// transparentMask returns a mask that is white where an image is fully
+// transparent and black elsewhere or nil if no pixel is fully transparent.
+func transparentMask(img image.Image) *image.Gray {
+	if isOpaque(img) {
+		return nil
+	}
+	bnds := img.Bounds()
+	at := storedFloatsAt(img)
+	var mask *image.Gray
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			if at(x, y)[3] != 0.0 {
+				continue
+			}
+			if mask == nil {
+				mask = image.NewGray(bnds)
+			}
+			mask.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+	return mask
+}
+
+// alphaTransparentMask is like transparentMask but takes an alpha channel
+// rather than an image with alpha.
+func alphaTransparentMask(alpha *Gray32f) *image.Gray {
+	bnds := alpha.Bounds()
+	var mask *image.Gray
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			if alpha.FloatAt(x, y) > 0.0 {
+				continue
+			}
+			if mask == nil {
+				mask = image.NewGray(bnds)
+			}
+			mask.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+	return mask
+}
+
+// isMasked reports whether a mask returned by transparentMask marks the pixel
+// at (x, y) as fully transparent.  A nil mask marks no pixels.
+func isMasked(mask *image.Gray, x, y int) bool {
+	if mask == nil || !(image.Point{x, y}).In(mask.Rect) {
+		return false
+	}
+	return mask.GrayAt(x, y).Y != 0
+}
+
+// bothTransparentMask returns a mask that is white where two images of the
+// same bounds are both fully transparent or nil if no such pixel exists.
+func bothTransparentMask(a, b image.Image) *image.Gray {
+	ma := transparentMask(a)
+	mb := transparentMask(b)
+	if ma == nil || mb == nil {
+		return nil
+	}
+	found := false
+	for i, v := range ma.Pix {
+		ma.Pix[i] = v & mb.Pix[i]
+		found = found || ma.Pix[i] != 0
+	}
+	if !found {
+		return nil
+	}
+	return ma
+}
@@ -0,0 +1,164 @@
+// This file provides routines for measuring how closely merging a set of split
+// channels reproduces the original image, in both code values and Delta E.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// channelQuantizer returns a function that quantizes a channel value as
+// --split would when writing it in a given output format: to 8 bits, to 16
+// bits, or to 32-bit floating point.
+func channelQuantizer(p *Parameters, of outputFormat) func(v float64) float64 {
+	switch {
+	case p.Depth == "8" || (p.Depth == "" && of.Max8):
+		return func(v float64) float64 { return float64(toUint8(v)) / 255.0 }
+	case p.Depth == "32f" || (p.Depth == "" && of.Float):
+		return func(v float64) float64 { return float64(float32(v)) }
+	default:
+		return func(v float64) float64 { return float64(toGrayVal(v).Y) / 65535.0 }
+	}
+}
+
+// roundTripStats summarizes the differences between the samples of an image
+// and those of the same image split and merged again.
+type roundTripStats struct {
+	Max       [4]int     // Maximum absolute error in R, G, B, and alpha, in 16-bit code values
+	Sum       [4]float64 // Sum of absolute errors in R, G, B, and alpha, in 16-bit code values
+	N         [4]int     // Number of R, G, B, and alpha samples compared
+	MaxDeltaE float64    // Maximum Delta E 2000 between original and merged colors
+	SumDeltaE float64    // Sum of Delta E 2000 between original and merged colors
+}
+
+// add accumulates another set of statistics into s.
+func (s *roundTripStats) add(o roundTripStats) {
+	for c := range s.Max {
+		if o.Max[c] > s.Max[c] {
+			s.Max[c] = o.Max[c]
+		}
+		s.Sum[c] += o.Sum[c]
+		s.N[c] += o.N[c]
+	}
+	s.MaxDeltaE = math.Max(s.MaxDeltaE, o.MaxDeltaE)
+	s.SumDeltaE += o.SumDeltaE
+}
+
+// roundTripError splits each pixel of an image into channel values, quantizes
+// each value with a given function, and merges the values back into a color.
+// It returns statistics on the absolute differences, in 16-bit code values,
+// between the original and the merged R, G, B, and alpha samples and on the
+// Delta E 2000 between the original and the merged colors, relative to
+// p.WhitePoint.  The color of fully transparent pixels is disregarded.  Alpha
+// is split and merged only if an alpha channel is requested.  roundTripError
+// returns the context's error if ctx is canceled.
+func roundTripError(ctx context.Context, p *Parameters, img image.Image, quant func(v float64) float64) (roundTripStats, error) {
+	_, split := paramsSplitKernel(p)
+	merge := paramsMergeKernel(p)
+	colorAt := colorAtFunc(img)
+	alphaAt := alphaAtFunc(img)
+	ref, err := straightImage(ctx, img)
+	if err != nil {
+		return roundTripStats{}, err
+	}
+	bnds := img.Bounds()
+	rowStats := make([]roundTripStats, bnds.Dy())
+	err = forEachRow(ctx, bnds, func(y int) {
+		st := &rowStats[y-bnds.Min.Y]
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			vs := split(colorAt(x, y))
+			for i, v := range vs {
+				vs[i] = quant(v)
+			}
+			clr := merge(vs)
+			orig := ref.At(x, y).(color.NRGBA64)
+			origS := [4]uint16{orig.R, orig.G, orig.B, orig.A}
+			merged := [4]uint16{toGrayVal(clr.R).Y, toGrayVal(clr.G).Y, toGrayVal(clr.B).Y, orig.A}
+			if p.Alpha {
+				merged[3] = toGrayVal(quant(alphaAt(x, y))).Y
+			}
+			c0 := 0
+			if orig.A == 0 {
+				// The color of a fully transparent pixel is
+				// not split.
+				c0 = 3
+			} else {
+				de := 100.0 * relabelWhite(samplesColor(origS), p.WhitePoint).DistanceCIEDE2000(relabelWhite(samplesColor(merged), p.WhitePoint))
+				st.MaxDeltaE = math.Max(st.MaxDeltaE, de)
+				st.SumDeltaE += de
+			}
+			for c := c0; c < 4; c++ {
+				d := int(origS[c]) - int(merged[c])
+				if d < 0 {
+					d = -d
+				}
+				if d > st.Max[c] {
+					st.Max[c] = d
+				}
+				st.Sum[c] += float64(d)
+				st.N[c]++
+			}
+		}
+	})
+	if err != nil {
+		return roundTripStats{}, err
+	}
+	var stats roundTripStats
+	for _, st := range rowStats {
+		stats.add(st)
+	}
+	return stats, nil
+}
+
+// samplesColor converts 16-bit R, G, and B samples to a colorful.Color.
+func samplesColor(s [4]uint16) colorful.Color {
+	return colorful.Color{R: float64(s[0]) / 65535.0, G: float64(s[1]) / 65535.0, B: float64(s[2]) / 65535.0}
+}
+
+// verifyImages reports, for each input image, the maximum and mean error per
+// color channel and the maximum and mean Delta E 2000 that result from
+// splitting the image in memory as directed by a set of parameters,
+// quantizing the channels to the depth --split would write, and merging them
+// again.  It returns the context's error if ctx is canceled and aborts on any
+// other error.
+func verifyImages(ctx context.Context, p *Parameters) error {
+	ctx = withWorkers(ctx, p.Workers)
+	if len(p.InputNames) == 0 {
+		notify.Fatal("--verify requires at least one input file")
+	}
+	of := paramsOutputFormat(p)
+	if p.Depth == "32f" && !of.Float {
+		notify.Fatal("--depth=32f requires a format that stores floating-point samples")
+	}
+	quant := channelQuantizer(p, of)
+	names := []string{"R", "G", "B"}
+	if p.Alpha {
+		names = append(names, "A")
+	}
+	for _, fn := range p.InputNames {
+		st, err := roundTripError(ctx, p, readColorImage(p, fn), quant)
+		if err != nil {
+			return err
+		}
+		for c, nm := range names {
+			mean := 0.0
+			if st.N[c] > 0 {
+				mean = st.Sum[c] / float64(st.N[c])
+			}
+			fmt.Printf("%s: %s max error: %d, mean error: %.4f (16-bit code values)\n",
+				fn, nm, st.Max[c], mean)
+		}
+		meanDE := 0.0
+		if st.N[0] > 0 {
+			meanDE = st.SumDeltaE / float64(st.N[0])
+		}
+		fmt.Printf("%s: DeltaE2000 max: %.4f, mean: %.4f\n", fn, st.MaxDeltaE, meanDE)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// This file provides a "hot folder" mode that monitors a directory and splits
+// (or merges) files as they appear in it.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// watchInterval is the time between successive scans of a watched directory.
+const watchInterval = time.Second
+
+// A watchedFile records the state of a file in a watched directory.
+type watchedFile struct {
+	Size    int64     // File size in bytes
+	ModTime time.Time // Time of last modification
+	Done    bool      // true: file has been processed; false: not yet
+}
+
+// checkWatchOutput aborts if an output-file template would write into a
+// watched directory, where the outputs would themselves be processed.
+func checkWatchOutput(p *Parameters, dir, tmpl string) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	absOut, err := filepath.Abs(filepath.Dir(tmpl))
+	if err != nil {
+		notify.Fatal(err)
+	}
+	rel, err := filepath.Rel(absDir, absOut)
+	if err != nil {
+		return
+	}
+	if rel == "." || (p.Recursive && !strings.HasPrefix(rel, "..")) {
+		notify.Fatalf("%s: With --watch, outputs must be written outside the watched directory", tmpl)
+	}
+}
+
+// processWatchedFile splits an image file or merges a ZIP bundle or the
+// channels listed in a manifest found in a watched directory.  When merging,
+// the color space and white point are taken from the manifest.  Files that
+// are not images (or, when merging, not ZIP bundles or manifests) are
+// ignored.
+func processWatchedFile(ctx context.Context, p *Parameters, fn string) error {
+	q := *p
+	q.InputNames = []string{fn}
+	if p.Split {
+		if !isImageFile(fn) {
+			return nil
+		}
+		return splitImage(ctx, &q)
+	}
+	var man *channelManifest
+	switch {
+	case isZipFile(fn):
+		man = ReadZipManifest(fn)
+	case isManifestFile(fn):
+		man = ReadManifest(fn)
+		q.InputNames = make([]string, len(man.Channels))
+		for i, ent := range man.Channels {
+			q.InputNames[i] = ent.File
+		}
+	default:
+		return nil
+	}
+	q.OutputName = expandBase(p.OutputName, baseName(fn))
+	var ok bool
+	q.OrigColorSpace = man.Space
+	q.ColorSpace, q.Alpha, ok = lookupColorSpace(man.Space)
+	if !ok {
+		notify.Fatalf("%s: Unrecognized color space %q", fn, man.Space)
+	}
+	q.Alpha = q.Alpha || man.Alpha
+	q.Premultiplied = q.Premultiplied || man.Premult
+	q.Lossless = q.Lossless || man.Lossless
+	if man.WhitePoint != ([3]float64{}) {
+		q.WhitePoint = man.WhitePoint
+	}
+	if g := manifestGamma(man); g != nil {
+		q.Gamma = g
+	}
+	q.ToneCurves = manifestToneCurves(man)
+	if man.Signed != "" {
+		q.Signed = parseSigned(man.Signed)
+	}
+	q.Subsample = man.Subsample
+	if man.Matrix != "" {
+		q.YCbCrMatrix = parseYCbCrMatrix(man.Matrix)
+	}
+	if man.CAT != "" {
+		q.CAT = parseCAT(man.CAT)
+	}
+	q.Ranges = manifestRanges(&q, man)
+	q.LogScales = manifestLogScales(&q, man)
+	return mergeChannels(ctx, &q)
+}
+
+// watchDirectory monitors a directory as directed by a set of parameters and
+// splits each image file (or, when merging, each ZIP bundle or manifest)
+// that appears in it, including those present initially.  A file is
+// processed once its size and modification time stop changing, and again if
+// it is later modified.
+// watchDirectory runs until ctx is canceled, at which point it returns nil.
+// It aborts on error.
+func watchDirectory(ctx context.Context, p *Parameters) error {
+	// Validate the input directory and output-file templates.
+	if len(p.InputNames) != 1 {
+		notify.Fatalf("--watch requires exactly 1 input directory but saw %d inputs", len(p.InputNames))
+	}
+	dir := p.InputNames[0]
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		notify.Fatalf("%s: --watch requires a directory", dir)
+	}
+	if p.OutputName == "" {
+		notify.Fatal("An output-file template must be specified when --watch is used")
+	}
+	if !namesInputs(p.OutputName) {
+		notify.Fatalf(`With --watch, the output file must contain a basename ("%%b")`)
+	}
+	checkWatchOutput(p, dir, p.OutputName)
+	if p.Montage != "" {
+		if !namesInputs(p.Montage) {
+			notify.Fatalf(`With --watch, the --montage file must contain a basename ("%%b")`)
+		}
+		checkWatchOutput(p, dir, p.Montage)
+	}
+
+	// Repeatedly scan the directory for new or modified files.
+	files := make(map[string]*watchedFile)
+	tick := time.NewTicker(watchInterval)
+	defer tick.Stop()
+	for {
+		names, err := listFiles(dir, p.Recursive, func(string) bool { return true })
+		if err != nil {
+			notify.Fatal(err)
+		}
+		for _, fn := range names {
+			st, err := os.Stat(fn)
+			if err != nil {
+				continue // File was removed since the scan.
+			}
+			wf := files[fn]
+			switch {
+			case wf == nil || wf.Size != st.Size() || !wf.ModTime.Equal(st.ModTime()):
+				// The file is new or still being written.
+				files[fn] = &watchedFile{Size: st.Size(), ModTime: st.ModTime()}
+			case !wf.Done:
+				// The file is unchanged since the previous scan.
+				wf.Done = true
+				err = processWatchedFile(ctx, p, fn)
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return err
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+	}
+}
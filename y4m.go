@@ -0,0 +1,476 @@
+// This file provides support for reading and writing YUV4MPEG2 (y4m)
+// streams, as produced and consumed by ffmpeg's yuv4mpegpipe format.  This
+// lets split and merge operate on video frames within a pipeline.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// y4mMagic is the string that begins every y4m stream.
+const y4mMagic = "YUV4MPEG2 "
+
+// init registers the y4m format with the image package.  Only a stream's
+// first frame is decoded.
+func init() {
+	image.RegisterFormat("y4m", y4mMagic, DecodeY4M, DecodeY4MConfig)
+}
+
+// A y4mHeader represents the parameters of a y4m stream.
+type y4mHeader struct {
+	Width, Height int      // Frame dimensions
+	Chroma        string   // Chroma subsampling and depth (e.g., "420jpeg" or "444p16")
+	Full          bool     // true: full-range samples; false: limited-range samples
+	Extra         []string // Other parameters (e.g., frame rate and aspect ratio), copied verbatim
+}
+
+// y4mLayout describes the sample layout implied by a chroma string.
+type y4mLayout struct {
+	Planes int // Number of planes (1=Y, 3=YCbCr, 4=YCbCrA)
+	XSub   int // Horizontal chroma subsampling factor
+	YSub   int // Vertical chroma subsampling factor
+	Depth  int // Bits per sample
+}
+
+// parseY4MChroma parses a y4m chroma string.
+func parseY4MChroma(c string) (y4mLayout, error) {
+	lay := y4mLayout{Planes: 3, XSub: 1, YSub: 1, Depth: 8}
+	base := c
+	if i := strings.LastIndex(c, "p"); i > 0 {
+		if d, err := strconv.Atoi(c[i+1:]); err == nil {
+			if d < 8 || d > 16 {
+				return lay, fmt.Errorf("y4m: unsupported chroma %q", c)
+			}
+			base, lay.Depth = c[:i], d
+		}
+	}
+	switch base {
+	case "mono":
+		lay.Planes = 1
+	case "mono16":
+		lay.Planes, lay.Depth = 1, 16
+	case "444":
+	case "444alpha":
+		lay.Planes = 4
+	case "422":
+		lay.XSub = 2
+	case "411":
+		lay.XSub = 4
+	case "420", "420jpeg", "420mpeg2", "420paldv":
+		lay.XSub, lay.YSub = 2, 2
+	default:
+		return lay, fmt.Errorf("y4m: unsupported chroma %q", c)
+	}
+	return lay, nil
+}
+
+// readY4MHeader reads and parses a y4m stream header.
+func readY4MHeader(br *bufio.Reader) (*y4mHeader, error) {
+	line, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, y4mMagic) {
+		return nil, errors.New("y4m: invalid format")
+	}
+	hdr := &y4mHeader{Chroma: "420jpeg"}
+	for _, tok := range strings.Fields(line[len(y4mMagic):]) {
+		switch tok[0] {
+		case 'W':
+			hdr.Width, err = strconv.Atoi(tok[1:])
+		case 'H':
+			hdr.Height, err = strconv.Atoi(tok[1:])
+		case 'C':
+			hdr.Chroma = tok[1:]
+		case 'X':
+			if strings.HasPrefix(tok, "XCOLORRANGE=") {
+				hdr.Full = tok == "XCOLORRANGE=FULL"
+				continue
+			}
+			hdr.Extra = append(hdr.Extra, tok)
+		default:
+			hdr.Extra = append(hdr.Extra, tok)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("y4m: invalid parameter %q", tok)
+		}
+	}
+	if hdr.Width <= 0 || hdr.Height <= 0 {
+		return nil, errors.New("y4m: missing frame dimensions")
+	}
+	if hdr.Width > 1<<20 || hdr.Height > 1<<20 {
+		return nil, errors.New("y4m: invalid frame dimensions")
+	}
+	if _, err := parseY4MChroma(hdr.Chroma); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(hdr.Chroma, "mono") && !strings.Contains(line, "XCOLORRANGE=") {
+		hdr.Full = true
+	}
+	return hdr, nil
+}
+
+// FrameDelay returns the display time of each frame implied by the header's
+// frame rate.
+func (h *y4mHeader) FrameDelay() time.Duration {
+	for _, tok := range h.Extra {
+		var num, den int64
+		if _, err := fmt.Sscanf(tok, "F%d:%d", &num, &den); err == nil && num > 0 && den > 0 {
+			return time.Duration(den * int64(time.Second) / num)
+		}
+	}
+	return defaultFrameDelay
+}
+
+// A Y4MReader reads frames from a y4m stream.
+type Y4MReader struct {
+	Header *y4mHeader // Stream parameters
+	br     *bufio.Reader
+	layout y4mLayout
+	buf    []byte
+}
+
+// NewY4MReader reads a y4m stream header and returns a Y4MReader that reads
+// the stream's frames.
+func NewY4MReader(r io.Reader) (*Y4MReader, error) {
+	br := bufio.NewReader(r)
+	hdr, err := readY4MHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	lay, _ := parseY4MChroma(hdr.Chroma)
+	return &Y4MReader{Header: hdr, br: br, layout: lay}, nil
+}
+
+// ReadFrame reads the next frame from a y4m stream and returns it as an
+// *image.Gray16 (monochrome streams) or an *image.NRGBA64 (all others).
+// Subsampled chroma is replicated to full resolution, and YCbCr is converted
+// to RGB using the BT.601 coefficients.  ReadFrame returns io.EOF when no
+// frames remain.
+func (yr *Y4MReader) ReadFrame() (image.Image, error) {
+	// Read the frame header.
+	line, err := yr.br.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return nil, io.EOF
+	}
+	if err != nil || !strings.HasPrefix(line, "FRAME") {
+		return nil, errors.New("y4m: invalid frame header")
+	}
+
+	// Read all planes.
+	h, lay := yr.Header, yr.layout
+	wd, ht := h.Width, h.Height
+	cw, ch := (wd+lay.XSub-1)/lay.XSub, (ht+lay.YSub-1)/lay.YSub
+	ss := 1
+	if lay.Depth > 8 {
+		ss = 2
+	}
+	size := wd * ht * ss
+	if lay.Planes >= 3 {
+		size += 2 * cw * ch * ss
+	}
+	if lay.Planes == 4 {
+		size += wd * ht * ss
+	}
+	var data []byte
+	if cap(yr.buf) < size {
+		// Grow the buffer only as data arrive so that a corrupt
+		// header cannot cause an enormous allocation.
+		data, err = readBytes(yr.br, int64(size))
+		yr.buf = data
+	} else {
+		data = yr.buf[:size]
+		_, err = io.ReadFull(yr.br, data)
+	}
+	if err != nil {
+		return nil, errors.New("y4m: truncated frame")
+	}
+	maxVal := float64(int(1)<<lay.Depth - 1)
+	scale := float64(int(1) << (lay.Depth - 8))
+	sample := func(plane []byte, i int) float64 {
+		if ss == 1 {
+			return float64(plane[i])
+		}
+		return float64(uint16(plane[2*i]) | uint16(plane[2*i+1])<<8)
+	}
+	luma := func(v float64) float64 {
+		if h.Full {
+			return v / maxVal
+		}
+		return (v - 16*scale) / (219 * scale)
+	}
+	chroma := func(v float64) float64 {
+		if h.Full {
+			return (v - 128*scale) / maxVal
+		}
+		return (v - 128*scale) / (224 * scale)
+	}
+	to16 := func(v float64) uint16 {
+		return uint16(math.Max(0, math.Min(1, v))*65535 + 0.5)
+	}
+	yPlane := data[:wd*ht*ss]
+	if lay.Planes == 1 {
+		gray := image.NewGray16(image.Rect(0, 0, wd, ht))
+		for y := 0; y < ht; y++ {
+			for x := 0; x < wd; x++ {
+				gray.SetGray16(x, y, color.Gray16{Y: to16(luma(sample(yPlane, y*wd+x)))})
+			}
+		}
+		return gray, nil
+	}
+	cbPlane := data[wd*ht*ss : (wd*ht+cw*ch)*ss]
+	crPlane := data[(wd*ht+cw*ch)*ss : (wd*ht+2*cw*ch)*ss]
+	var aPlane []byte
+	if lay.Planes == 4 {
+		aPlane = data[(wd*ht+2*cw*ch)*ss:]
+	}
+	img := image.NewNRGBA64(image.Rect(0, 0, wd, ht))
+	for y := 0; y < ht; y++ {
+		for x := 0; x < wd; x++ {
+			ci := (y/lay.YSub)*cw + x/lay.XSub
+			yy := luma(sample(yPlane, y*wd+x))
+			cb := chroma(sample(cbPlane, ci))
+			cr := chroma(sample(crPlane, ci))
+			c := color.NRGBA64{
+				R: to16(yy + 1.402*cr),
+				G: to16(yy - 0.344136*cb - 0.714136*cr),
+				B: to16(yy + 1.772*cb),
+				A: 0xffff,
+			}
+			if aPlane != nil {
+				c.A = to16(sample(aPlane, y*wd+x) / maxVal)
+			}
+			img.SetNRGBA64(x, y, c)
+		}
+	}
+	return img, nil
+}
+
+// A Y4MWriter writes frames to a y4m stream.  Grayscale frames are written as
+// full-range, 16-bit monochrome.  Color frames are written as limited-range,
+// 16-bit, unsubsampled YCbCr or, if the first frame is not opaque, as 8-bit
+// YCbCr plus alpha.
+type Y4MWriter struct {
+	bw    *bufio.Writer
+	extra []string // Parameters to copy to the stream header
+	hdr   *y4mHeader
+	lay   y4mLayout
+}
+
+// NewY4MWriter returns a Y4MWriter that writes to a given io.Writer.  The
+// given parameters (e.g., "F30000:1001") are included in the stream header.
+func NewY4MWriter(w io.Writer, extra []string) *Y4MWriter {
+	return &Y4MWriter{bw: bufio.NewWriter(w), extra: extra}
+}
+
+// WriteFrame writes a single frame, preceded by the stream header if this is
+// the first frame.  All frames must have the same dimensions.
+func (yw *Y4MWriter) WriteFrame(img image.Image) error {
+	// Write the stream header before the first frame.
+	bnds := img.Bounds()
+	gray := img.ColorModel() == color.GrayModel || img.ColorModel() == color.Gray16Model
+	if yw.hdr == nil {
+		yw.hdr = &y4mHeader{Width: bnds.Dx(), Height: bnds.Dy(), Extra: yw.extra}
+		switch {
+		case gray:
+			yw.hdr.Chroma, yw.hdr.Full = "mono16", true
+		default:
+			yw.hdr.Chroma = "444p16"
+			if o, ok := img.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+				yw.hdr.Chroma = "444alpha"
+			}
+		}
+		yw.lay, _ = parseY4MChroma(yw.hdr.Chroma)
+		rng := "LIMITED"
+		if yw.hdr.Full {
+			rng = "FULL"
+		}
+		params := append([]string{
+			fmt.Sprintf("W%d", yw.hdr.Width),
+			fmt.Sprintf("H%d", yw.hdr.Height),
+			"C" + yw.hdr.Chroma,
+		}, yw.extra...)
+		params = append(params, "XCOLORRANGE="+rng)
+		fmt.Fprintf(yw.bw, "%s%s\n", y4mMagic, strings.Join(params, " "))
+	}
+	if bnds.Dx() != yw.hdr.Width || bnds.Dy() != yw.hdr.Height {
+		return errors.New("y4m: all frames must have the same dimensions")
+	}
+
+	// Prepare to write samples in either 8 or 16 bits.
+	lay := yw.lay
+	scale := float64(int(1) << (lay.Depth - 8))
+	maxVal := float64(int(1)<<lay.Depth - 1)
+	put := func(plane []byte, i int, v float64) {
+		s := uint16(math.Max(0, math.Min(maxVal, math.Round(v))))
+		if lay.Depth == 8 {
+			plane[i] = uint8(s)
+		} else {
+			plane[2*i] = uint8(s)
+			plane[2*i+1] = uint8(s >> 8)
+		}
+	}
+	ss := (lay.Depth + 7) / 8
+	n := bnds.Dx() * bnds.Dy()
+	planes := make([][]byte, lay.Planes)
+	for i := range planes {
+		planes[i] = make([]byte, n*ss)
+	}
+
+	// Convert each pixel to Y, Cb, Cr, and possibly A.
+	i := 0
+	for y := bnds.Min.Y; y < bnds.Max.Y; y++ {
+		for x := bnds.Min.X; x < bnds.Max.X; x++ {
+			if lay.Planes == 1 {
+				g := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16)
+				put(planes[0], i, float64(g.Y)/65535*maxVal)
+				i++
+				continue
+			}
+			c := toNRGBA64(img.At(x, y))
+			r, g, b := float64(c.R)/65535, float64(c.G)/65535, float64(c.B)/65535
+			yy := 0.299*r + 0.587*g + 0.114*b
+			put(planes[0], i, 16*scale+219*scale*yy)
+			put(planes[1], i, 128*scale+224*scale*(b-yy)/1.772)
+			put(planes[2], i, 128*scale+224*scale*(r-yy)/1.402)
+			if lay.Planes == 4 {
+				put(planes[3], i, float64(c.A)/65535*maxVal)
+			}
+			i++
+		}
+	}
+
+	// Write the frame.
+	yw.bw.WriteString("FRAME\n")
+	for _, pl := range planes {
+		if _, err := yw.bw.Write(pl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes any buffered data to the underlying io.Writer.
+func (yw *Y4MWriter) Flush() error {
+	return yw.bw.Flush()
+}
+
+// DecodeY4M reads the first frame of a y4m stream.
+func DecodeY4M(r io.Reader) (image.Image, error) {
+	yr, err := NewY4MReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return yr.ReadFrame()
+}
+
+// DecodeY4MConfig returns the color model and dimensions of a y4m stream's
+// frames without decoding any frames.
+func DecodeY4MConfig(r io.Reader) (image.Config, error) {
+	hdr, err := readY4MHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	cfg := image.Config{Width: hdr.Width, Height: hdr.Height, ColorModel: color.NRGBA64Model}
+	if strings.HasPrefix(hdr.Chroma, "mono") {
+		cfg.ColorModel = color.Gray16Model
+	}
+	return cfg, nil
+}
+
+// DecodeY4MAnimation reads all frames of a y4m stream.
+func DecodeY4MAnimation(r io.Reader) (*Animation, error) {
+	yr, err := NewY4MReader(r)
+	if err != nil {
+		return nil, err
+	}
+	anim := &Animation{}
+	delay := yr.Header.FrameDelay()
+	for {
+		fr, err := yr.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		anim.Frames = append(anim.Frames, fr)
+		anim.Delays = append(anim.Delays, delay)
+	}
+	return anim, nil
+}
+
+// y4mRate returns a y4m frame-rate parameter corresponding to a frame delay.
+func y4mRate(d time.Duration) string {
+	if d <= 0 {
+		d = defaultFrameDelay
+	}
+	return fmt.Sprintf("F1000000:%d", d.Microseconds())
+}
+
+// encodeY4M writes an image as a single-frame y4m stream.
+func encodeY4M(w io.Writer, img image.Image) error {
+	yw := NewY4MWriter(w, nil)
+	if err := yw.WriteFrame(img); err != nil {
+		return err
+	}
+	return yw.Flush()
+}
+
+// writeY4MAnimation is the outputFormat Animate function for y4m.
+func writeY4MAnimation(w io.Writer, anim *Animation, p *Parameters) error {
+	yw := NewY4MWriter(w, []string{y4mRate(anim.Delay(0))})
+	for _, fr := range anim.Frames {
+		if err := yw.WriteFrame(fr); err != nil {
+			return err
+		}
+	}
+	return yw.Flush()
+}
+
+// isY4MFile reports whether a filename designates a y4m stream: either "-"
+// (the standard input device) or a name ending in ".y4m".
+func isY4MFile(fn string) bool {
+	return fn == "-" || strings.ToLower(filepath.Ext(fn)) == ".y4m"
+}
+
+// OpenY4M opens a y4m stream for reading from a named file or, if the name is
+// "-", from the standard input device.  It aborts on error.
+func OpenY4M(fn string) (*Y4MReader, io.Closer) {
+	var f *os.File = os.Stdin
+	if fn != "-" {
+		var err error
+		f, err = os.Open(fn)
+		if err != nil {
+			notify.Fatal(err)
+		}
+	}
+	yr, err := NewY4MReader(f)
+	if err != nil {
+		notify.Fatalf("%s: %s", fn, err)
+	}
+	return yr, f
+}
+
+// CreateY4M creates a y4m stream for writing to a named file or, if the name
+// is empty, to the standard output device.  It aborts on error.
+func CreateY4M(fn string, extra []string) (*Y4MWriter, io.Closer) {
+	var f *os.File = os.Stdout
+	if fn != "" {
+		var err error
+		f, err = os.Create(fn)
+		if err != nil {
+			notify.Fatal(err)
+		}
+	}
+	return NewY4MWriter(f, extra), f
+}
@@ -0,0 +1,116 @@
+// This file tests the y4m reader and writer.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"testing"
+)
+
+// TestY4MRoundTrip verifies that images written by encodeY4M are read back by
+// DecodeY4M with at most the error introduced by conversion to YCbCr.
+func TestY4MRoundTrip(t *testing.T) {
+	gray := image.NewGray16(image.Rect(0, 0, 7, 5))
+	draw.Draw(gray, gray.Bounds(), testGrayImage(), image.Point{}, draw.Src)
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+		tol  float64
+	}{
+		{"gray", gray, 0.0},
+		{"opaque", testColorImage(false), 1e-4},
+		{"alpha", testColorImage(true), 1e-2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := encodeImage(t, encodeY4M, tc.img)
+			checkImage(t, decodeImage(t, DecodeY4M, data), tc.img, tc.tol)
+		})
+	}
+}
+
+// TestY4MGolden verifies that DecodeY4M reads hand-constructed frames with
+// full-range monochrome and limited-range, subsampled chroma.
+func TestY4MGolden(t *testing.T) {
+	t.Run("mono", func(t *testing.T) {
+		data := []byte("YUV4MPEG2 W3 H1 F25:1 Cmono\nFRAME\n\x00\xff\x33")
+		want := image.NewGray16(image.Rect(0, 0, 3, 1))
+		for x, v := range []uint16{0, 0xffff, 0x3333} {
+			want.SetGray16(x, 0, color.Gray16{Y: v})
+		}
+		checkImage(t, decodeImage(t, DecodeY4M, data), want, 0.0)
+		checkTruncated(t, DecodeY4M, data, len(data))
+	})
+	t.Run("420", func(t *testing.T) {
+		data := []byte("YUV4MPEG2 W2 H2 C420jpeg\nFRAME\n\x10\xeb\x7e\x51\x80\xf0")
+		want := image.NewNRGBA64(image.Rect(0, 0, 2, 2))
+		want.SetNRGBA64(0, 0, color.NRGBA64{45940, 0, 0, 0xffff})
+		want.SetNRGBA64(1, 0, color.NRGBA64{65535, 42135, 65535, 0xffff})
+		want.SetNRGBA64(0, 1, color.NRGBA64{65535, 9517, 32917, 0xffff})
+		want.SetNRGBA64(1, 1, color.NRGBA64{65391, 0, 19451, 0xffff})
+		checkImage(t, decodeImage(t, DecodeY4M, data), want, 0.0)
+		checkTruncated(t, DecodeY4M, data, len(data))
+	})
+}
+
+// TestY4MFrames verifies that a Y4MReader reads every frame of a stream and
+// then returns io.EOF.
+func TestY4MFrames(t *testing.T) {
+	var buf bytes.Buffer
+	yw := NewY4MWriter(&buf, []string{"F30:1"})
+	frames := []image.Image{testColorImage(false), testColorImage(false)}
+	frames[1].(*NRGBA32f).SetFloats(0, 0, [4]float64{1.0, 1.0, 1.0, 1.0})
+	for _, fr := range frames {
+		if err := yw.WriteFrame(fr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := yw.WriteFrame(image.NewGray16(image.Rect(0, 0, 2, 2))); err == nil {
+		t.Fatal("writing a frame of a different size unexpectedly succeeded")
+	}
+	if err := yw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	yr, err := NewY4MReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range frames {
+		got, err := yr.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		checkImage(t, got, want, 1e-4)
+	}
+	if _, err := yr.ReadFrame(); err != io.EOF {
+		t.Fatalf("expected io.EOF but saw %v", err)
+	}
+}
+
+// TestY4MMalformed verifies that DecodeY4M rejects corrupt headers without
+// panicking.
+func TestY4MMalformed(t *testing.T) {
+	for name, hdr := range map[string]string{
+		"bad magic":    "YUV4MPEG3 W1 H1\nFRAME\n",
+		"no newline":   "YUV4MPEG2 W1 H1",
+		"no width":     "YUV4MPEG2 H1 Cmono\nFRAME\n",
+		"bad height":   "YUV4MPEG2 W1 Hx Cmono\nFRAME\n",
+		"bad chroma":   "YUV4MPEG2 W1 H1 C440\nFRAME\n",
+		"bad depth":    "YUV4MPEG2 W1 H1 C444p20\nFRAME\n",
+		"huge width":   "YUV4MPEG2 W99999999999 H1 Cmono\nFRAME\n",
+		"huge frame":   "YUV4MPEG2 W1048576 H1048576 C444alpha\nFRAME\n",
+		"no frame":     "YUV4MPEG2 W1 H1 Cmono\n",
+		"bad frame":    "YUV4MPEG2 W1 H1 Cmono\nFRAM\n\x00",
+		"short frame":  "YUV4MPEG2 W2 H2 C420\nFRAME\n\x00\x00\x00\x00\x00",
+		"short 16-bit": "YUV4MPEG2 W1 H1 Cmono16\nFRAME\n\x00",
+	} {
+		if _, err := decodeSafely(DecodeY4M, []byte(hdr)); err == nil || isPanic(err) {
+			t.Errorf("%s: expected an error but saw %v", name, err)
+		}
+	}
+	data := encodeImage(t, encodeY4M, testColorImage(true))
+	checkMutated(t, DecodeY4M, data, bytes.IndexByte(data, '\n')+len("\nFRAME\n"))
+}
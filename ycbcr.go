@@ -0,0 +1,58 @@
+// This file provides full-precision conversions between colors and Y'CbCr
+// channel values using a selectable matrix.  Unlike image/color's converters,
+// these do not quantize to 8 bits.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// A ycbcrMatrix specifies the luma coefficients of red and blue from which
+// a Y'CbCr matrix is derived.  The coefficient of green is 1 - Kr - Kb.
+type ycbcrMatrix struct {
+	Kr float64 // Coefficient of R' in Y'
+	Kb float64 // Coefficient of B' in Y'
+}
+
+// ycbcrMatrices maps each valid argument to --matrix to the corresponding
+// ycbcrMatrix.
+var ycbcrMatrices = map[string]ycbcrMatrix{
+	"bt601": {Kr: 0.299, Kb: 0.114},
+	"bt709": {Kr: 0.2126, Kb: 0.0722},
+}
+
+// parseYCbCrMatrix validates the argument to --matrix and returns it in
+// canonical form, lowercase and without punctuation (e.g., "BT.709" becomes
+// "bt709").  It aborts on error.
+func parseYCbCrMatrix(arg string) string {
+	name := strings.NewReplacer(".", "", "-", "", "_", "").Replace(strings.ToLower(arg))
+	if _, ok := ycbcrMatrices[name]; !ok {
+		notify.Fatalf(`--matrix requires either "bt601" or "bt709" (not %q)`, arg)
+	}
+	return name
+}
+
+// toYCbCrMatrix converts a color to full-range Y', Cb, and Cr channel values,
+// each in [0.0, 1.0] with Cb and Cr centered on 0.5, using a given matrix.
+func toYCbCrMatrix(c colorful.Color, m ycbcrMatrix) [3]float64 {
+	r, g, b := clamp01(c.R), clamp01(c.G), clamp01(c.B)
+	y := m.Kr*r + (1.0-m.Kr-m.Kb)*g + m.Kb*b
+	return [3]float64{
+		y,
+		0.5 + 0.5*(b-y)/(1.0-m.Kb),
+		0.5 + 0.5*(r-y)/(1.0-m.Kr),
+	}
+}
+
+// fromYCbCrMatrix converts full-range Y', Cb, and Cr channel values to a
+// color using a given matrix.  The result is not clamped.
+func fromYCbCrMatrix(v [3]float64, m ycbcrMatrix) colorful.Color {
+	y := v[0]
+	r := y + 2.0*(1.0-m.Kr)*(v[2]-0.5)
+	b := y + 2.0*(1.0-m.Kb)*(v[1]-0.5)
+	g := (y - m.Kr*r - m.Kb*b) / (1.0 - m.Kr - m.Kb)
+	return colorful.Color{R: r, G: g, B: b}
+}
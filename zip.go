@@ -0,0 +1,117 @@
+// This file provides support for bundling split channels into a single ZIP
+// archive, along with a manifest that describes them, and for merging
+// channels directly from such an archive.
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"image"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// zipManifestName is the name of the manifest within a ZIP bundle.
+const zipManifestName = "manifest.json"
+
+// isZipFile reports whether a filename designates a ZIP file.
+func isZipFile(fn string) bool {
+	return strings.ToLower(filepath.Ext(fn)) == ".zip"
+}
+
+// writeZip writes a set of images as PNG files within a ZIP archive, followed
+// by a manifest that lists them.  The PNG files are 16-bit unless --depth
+// says otherwise.
+func writeZip(w io.Writer, infos []ImageInfo, p *Parameters) error {
+	zw := zip.NewWriter(w)
+	files := make([]string, len(infos))
+	for i, info := range infos {
+		files[i] = info.Name + ".png"
+		f, err := zw.Create(files[i])
+		if err != nil {
+			return err
+		}
+		img := quantizeImage(info.Image)
+		if p.Depth == "8" {
+			img = toDepth8(info.Image)
+		}
+		err = encodePNG(f, img, p)
+		if err != nil {
+			return err
+		}
+	}
+	f, err := zw.Create(zipManifestName)
+	if err != nil {
+		return err
+	}
+	err = encodeManifest(f, newManifest(p, infos, files))
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// encodeZip writes an image as a ZIP archive containing a single PNG file
+// named "image.png".
+func encodeZip(w io.Writer, img image.Image, p *Parameters) error {
+	return writeZip(w, []ImageInfo{{Name: "image", Image: toGray32f(img)}}, p)
+}
+
+// readZipManifest reads the manifest from an open ZIP bundle.
+func readZipManifest(zr *zip.Reader) (*channelManifest, error) {
+	f, err := zr.Open(zipManifestName)
+	if err != nil {
+		return nil, fmt.Errorf("no %s found", zipManifestName)
+	}
+	defer f.Close()
+	man, err := decodeManifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", zipManifestName, err)
+	}
+	return man, nil
+}
+
+// ReadZipManifest reads the manifest from a named ZIP bundle.  It aborts on
+// error.
+func ReadZipManifest(fn string) *channelManifest {
+	zr, err := zip.OpenReader(fn)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	defer zr.Close()
+	man, err := readZipManifest(&zr.Reader)
+	if err != nil {
+		notify.Fatalf("%s: %s", fn, err)
+	}
+	return man
+}
+
+// ReadZipChannels reads all channels from a named ZIP bundle in the order
+// listed by its manifest.  It aborts on error.
+func ReadZipChannels(fn string) []*Gray32f {
+	zr, err := zip.OpenReader(fn)
+	if err != nil {
+		notify.Fatal(err)
+	}
+	defer zr.Close()
+	man, err := readZipManifest(&zr.Reader)
+	if err != nil {
+		notify.Fatalf("%s: %s", fn, err)
+	}
+	channels := make([]*Gray32f, 0, len(man.Channels))
+	for _, ent := range man.Channels {
+		f, err := zr.Open(ent.File)
+		if err != nil {
+			notify.Fatalf("%s: %s", fn, err)
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			notify.Fatalf("%s: %s: %s", fn, ent.File, err)
+		}
+		channels = append(channels, toGray32f(img))
+	}
+	return channels
+}